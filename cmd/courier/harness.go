@@ -39,6 +39,10 @@ func runHarness(args []string) error {
 		awsRegion   = flags.String("aws.region", defaultAWSRegion, "AWS configuration region")
 		awsSQSQueue = flags.String("aws.sqs.queue", defaultAWSSQSQueue, "AWS configuration queue")
 
+		awsSQSEndpoint      = flags.String("aws.sqs.endpoint", defaultAWSSQSEndpoint, "AWS configuration endpoint of a SQS compatible service, instead of AWS")
+		awsEndpointInsecure = flags.Bool("aws.endpoint.insecure", defaultAWSEndpointInsecure, "AWS configuration to use http for endpoints without a scheme")
+		awsEndpointPath     = flags.Bool("aws.endpoint.pathstyle", defaultAWSEndpointPath, "AWS configuration to use path style addressing with endpoints")
+
 		broadcast = flags.Bool("broadcast", defaultBroadcast, "broadcast new records")
 
 		metricsRegistration = flags.Bool("metrics.registration", defaultMetricsRegistration, "Registration of metrics on launch")
@@ -98,6 +102,9 @@ func runHarness(args []string) error {
 		queue.WithToken(*awsToken),
 		queue.WithRegion(*awsRegion),
 		queue.WithQueue(*awsSQSQueue),
+		queue.WithEndpoint(*awsSQSEndpoint),
+		queue.WithDisableSSL(*awsEndpointInsecure),
+		queue.WithForcePathStyle(*awsEndpointPath),
 	)
 	if err != nil {
 		return errors.Wrap(err, "queue remote config")
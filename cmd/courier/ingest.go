@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/SimonRichardson/flagset"
@@ -17,26 +18,81 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/trussle/courier/pkg/audit"
 	"github.com/trussle/courier/pkg/consumer"
+	"github.com/trussle/courier/pkg/fanout"
 	h "github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/ingress"
 	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/courier/pkg/ratelimit"
+	"github.com/trussle/courier/pkg/router"
 	"github.com/trussle/courier/pkg/status"
 	"github.com/trussle/fsys"
 )
 
 const (
 	defaultQueue            = "remote"
+	defaultQueueRootPath    = "bin/queue"
+	defaultIngressCapacity  = 1000
 	defaultAuditLog         = "remote"
 	defaultAuditLogRootPath = "bin"
+	defaultAuditLogFormat   = "json"
 	defaultFilesystem       = "nop"
 
+	defaultAuditLogSegmentSize   = 16 * 1024 * 1024
+	defaultAuditLogSegmentAge    = 10 * time.Minute
+	defaultAuditLogRetentionAge  = 0 * time.Second
+	defaultAuditLogRetentionSize = 0
+	defaultAuditLogCompress      = false
+
+	defaultAuditLogMultiRequired   = "local"
+	defaultAuditLogMultiBestEffort = "remote"
+
+	defaultAuditLogShip           = ""
+	defaultAuditLogShipInterval   = 10 * time.Second
+	defaultAuditLogShipBackoff    = time.Second
+	defaultAuditLogShipMaxBackoff = 5 * time.Minute
+	defaultAuditLogShipBucket     = ""
+	defaultAuditLogShipPrefix     = ""
+	defaultAuditLogShipEndpoint   = ""
+	defaultAuditLogShipURL        = ""
+
 	defaultEC2Role   = true
 	defaultAWSID     = ""
 	defaultAWSSecret = ""
 	defaultAWSToken  = ""
 	defaultAWSRegion = "eu-west-1"
 
-	defaultAWSSQSQueue       = ""
-	defaultAWSFirehoseStream = ""
+	defaultAWSSQSQueue           = ""
+	defaultAWSSQSDeadLetterQueue = ""
+	defaultAWSSQSMaxReceiveCount = 5
+	defaultAWSFirehoseStream     = ""
+
+	defaultAWSFirehoseAttempts   = 3
+	defaultAWSFirehoseBackoff    = 100 * time.Millisecond
+	defaultAWSFirehoseMaxBackoff = 5 * time.Second
+	defaultAuditLogFallbackPath  = "bin/fallback"
+
+	defaultKafkaBrokers    = ""
+	defaultKafkaTopic      = ""
+	defaultKafkaGroup      = "courier"
+	defaultKafkaRetryTopic = ""
+	defaultKafkaDeadTopic  = ""
+	defaultKafkaDeliveries = 5
+
+	defaultAMQPURL                = ""
+	defaultAMQPQueue              = ""
+	defaultAMQPDeadLetterExchange = ""
+
+	defaultRedisAddr          = ""
+	defaultRedisStream        = ""
+	defaultRedisGroup         = "courier"
+	defaultRedisConsumer      = "courier"
+	defaultRedisRetryStream   = ""
+	defaultRedisMaxDeliveries = 5
+
+	defaultAWSSQSEndpoint      = ""
+	defaultAWSFirehoseEndpoint = ""
+	defaultAWSEndpointInsecure = false
+	defaultAWSEndpointPath     = false
 
 	defaultConsumerFrequency   = time.Second
 	defaultRecipientURL        = ""
@@ -44,6 +100,31 @@ const (
 	defaultMaxNumberOfMessages = 10
 	defaultVisibilityTimeout   = "30s"
 	defaultMetricsRegistration = true
+
+	defaultRetryAttempts    = 3
+	defaultRetryBaseBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff  = 5 * time.Second
+	defaultRetryJitter      = 0.2
+
+	defaultDeliveryConcurrency  = 1
+	defaultDeliveryOrdered      = false
+	defaultDeliveryBatch        = false
+	defaultDeliveryBatchFormat  = "json"
+	defaultDeliveryHeaderPrefix = h.DefaultHeaderPrefix
+	defaultDeliveryAttributes   = h.AllAttributes
+
+	defaultHeartbeatInterval = 10 * time.Second
+
+	defaultRedelivery         = "default"
+	defaultRedeliveryDelay    = 0 * time.Second
+	defaultRedeliveryMaxDelay = 15 * time.Minute
+
+	defaultRateLimit      = 0.0
+	defaultRateLimitBurst = 1
+
+	defaultRouterConfig = ""
+	defaultFanOutURLs   = ""
+	defaultFanOutPolicy = "all"
 )
 
 func runIngest(args []string) error {
@@ -54,23 +135,85 @@ func runIngest(args []string) error {
 		debug   = flags.Bool("debug", false, "debug logging")
 		apiAddr = flags.String("api", defaultAPIAddr, "listen address for ingest API")
 
-		awsEC2Role          = flags.Bool("aws.ec2.role", defaultEC2Role, "AWS configuration to use EC2 roles")
-		awsID               = flags.String("aws.id", defaultAWSID, "AWS configuration id")
-		awsSecret           = flags.String("aws.secret", defaultAWSSecret, "AWS configuration secret")
-		awsToken            = flags.String("aws.token", defaultAWSToken, "AWS configuration token")
-		awsRegion           = flags.String("aws.region", defaultAWSRegion, "AWS configuration region")
-		awsSQSQueue         = flags.String("aws.sqs.queue", defaultAWSSQSQueue, "AWS configuration queue")
-		awsFirehoseStream   = flags.String("aws.firehose.stream", defaultAWSFirehoseStream, "AWS configuration stream")
-		queueType           = flags.String("queue", defaultQueue, "type of queue to use (remote, virtual, nop)")
-		auditLogType        = flags.String("auditlog", defaultAuditLog, "type of audit log to use (remote, local, nop)")
-		auditLogRootPath    = flags.String("auditlog.path", defaultAuditLogRootPath, "audit log root directory for the filesystem to use")
-		filesystemType      = flags.String("filesystem", defaultFilesystem, "type of filesystem backing (local, virtual, nop)")
-		recipientURL        = flags.String("recipient.url", defaultRecipientURL, "URL to hit with the message payload")
-		consumerFrequency   = flags.Duration("consumer.frequency", defaultConsumerFrequency, "frequency at which the consumer should run")
-		numConsumers        = flags.Int("num.consumers", defaultNumConsumers, "number of consumers to run at once")
-		maxNumberOfMessages = flags.Int("max.messages", defaultMaxNumberOfMessages, "max number of messages to dequeue at once")
-		visibilityTimeout   = flags.String("visibility.timeout", defaultVisibilityTimeout, "how long the visibility of a message should extended by in seconds")
-		metricsRegistration = flags.Bool("metrics.registration", defaultMetricsRegistration, "Registration of metrics on launch")
+		awsEC2Role           = flags.Bool("aws.ec2.role", defaultEC2Role, "AWS configuration to use EC2 roles")
+		awsID                = flags.String("aws.id", defaultAWSID, "AWS configuration id")
+		awsSecret            = flags.String("aws.secret", defaultAWSSecret, "AWS configuration secret")
+		awsToken             = flags.String("aws.token", defaultAWSToken, "AWS configuration token")
+		awsRegion            = flags.String("aws.region", defaultAWSRegion, "AWS configuration region")
+		awsSQSQueue          = flags.String("aws.sqs.queue", defaultAWSSQSQueue, "AWS configuration queue")
+		awsSQSDeadLetter     = flags.String("aws.sqs.dlq", defaultAWSSQSDeadLetterQueue, "AWS configuration dead letter queue for failed messages")
+		awsSQSMaxReceives    = flags.Int("aws.sqs.dlq.receives", defaultAWSSQSMaxReceiveCount, "number of times a failed message is received before it's sent to the dead letter queue")
+		awsFirehoseStream    = flags.String("aws.firehose.stream", defaultAWSFirehoseStream, "AWS configuration stream")
+		awsFirehoseAttempts  = flags.Int("aws.firehose.attempts", defaultAWSFirehoseAttempts, "max number of times an audit log record is put on the Firehose stream before it's spilled to auditlog.fallback.path")
+		awsFirehoseBackoff   = flags.Duration("aws.firehose.backoff", defaultAWSFirehoseBackoff, "backoff after the first failure to put audit log records on the Firehose stream")
+		awsFirehoseMaxDelay  = flags.Duration("aws.firehose.backoff.max", defaultAWSFirehoseMaxBackoff, "max backoff between attempts to put audit log records on the Firehose stream")
+		awsSQSEndpoint       = flags.String("aws.sqs.endpoint", defaultAWSSQSEndpoint, "AWS configuration endpoint of a SQS compatible service, instead of AWS")
+		awsFirehoseEndpoint  = flags.String("aws.firehose.endpoint", defaultAWSFirehoseEndpoint, "AWS configuration endpoint of a Firehose compatible service, instead of AWS")
+		awsEndpointInsecure  = flags.Bool("aws.endpoint.insecure", defaultAWSEndpointInsecure, "AWS configuration to use http for endpoints without a scheme")
+		awsEndpointPath      = flags.Bool("aws.endpoint.pathstyle", defaultAWSEndpointPath, "AWS configuration to use path style addressing with endpoints")
+		kafkaBrokers         = flags.String("kafka.brokers", defaultKafkaBrokers, "comma separated addresses of the kafka brokers")
+		kafkaTopic           = flags.String("kafka.topic", defaultKafkaTopic, "kafka topic to consume records from")
+		kafkaGroup           = flags.String("kafka.group", defaultKafkaGroup, "kafka consumer group to consume as")
+		kafkaRetryTopic      = flags.String("kafka.retry.topic", defaultKafkaRetryTopic, "kafka topic to route failed records to (defaults to kafka.topic with a .retry suffix)")
+		kafkaDeadTopic       = flags.String("kafka.dead.topic", defaultKafkaDeadTopic, "kafka topic to route records that run out of deliveries to (defaults to kafka.topic with a .dead suffix)")
+		kafkaDeliveries      = flags.Int("kafka.deliveries.max", defaultKafkaDeliveries, "number of times a kafka record is delivered before it's routed to the dead topic (0 to never dead letter)")
+		amqpURL              = flags.String("amqp.url", defaultAMQPURL, "URL of the amqp broker")
+		amqpQueue            = flags.String("amqp.queue", defaultAMQPQueue, "amqp queue to consume records from")
+		amqpDeadLetter       = flags.String("amqp.dlx", defaultAMQPDeadLetterExchange, "amqp exchange to dead letter failed records to, instead of requeueing them")
+		redisAddr            = flags.String("redis.addr", defaultRedisAddr, "address of the redis server")
+		redisStream          = flags.String("redis.stream", defaultRedisStream, "redis stream to consume records from")
+		redisGroup           = flags.String("redis.group", defaultRedisGroup, "redis consumer group to consume as")
+		redisConsumer        = flags.String("redis.consumer", defaultRedisConsumer, "prefix of the name of every redis consumer")
+		redisRetryStream     = flags.String("redis.retry.stream", defaultRedisRetryStream, "redis stream to move failed records to (defaults to redis.stream with a :retry suffix)")
+		redisMaxDeliveries   = flags.Int("redis.deliveries.max", defaultRedisMaxDeliveries, "number of times a redis record is delivered before it's moved to the retry stream (0 never moves them)")
+		queueType            = flags.String("queue", defaultQueue, "type of queue to use (remote, disk, kafka, amqp, http, redis, virtual, nop)")
+		queueRootPath        = flags.String("queue.path", defaultQueueRootPath, "disk queue root directory for the filesystem to use")
+		ingressCapacity      = flags.Int("ingress.capacity", defaultIngressCapacity, "max number of records the http queue holds before producers are turned away")
+		auditLogType         = flags.String("auditlog", defaultAuditLog, "type of audit log to use (remote, local, multi, nop)")
+		auditLogRootPath     = flags.String("auditlog.path", defaultAuditLogRootPath, "audit log root directory for the filesystem to use")
+		auditLogFormat       = flags.String("auditlog.format", defaultAuditLogFormat, "format of the audit log entries (json, protobuf, avro)")
+		auditLogSegmentSize  = flags.Int64("auditlog.segment.size", defaultAuditLogSegmentSize, "bytes of entries written to a local audit log segment before it's flushed")
+		auditLogSegmentAge   = flags.Duration("auditlog.segment.age", defaultAuditLogSegmentAge, "how long a local audit log segment is written to before it's flushed")
+		auditLogRetentionAge = flags.Duration("auditlog.retention.age", defaultAuditLogRetentionAge, "how long flushed local audit log segments are kept for (0 keeps them forever)")
+		auditLogRetention    = flags.Int64("auditlog.retention.size", defaultAuditLogRetentionSize, "bytes the local audit log segments can take up before the oldest are removed (0 for no limit)")
+		auditLogFallbackPath = flags.String("auditlog.fallback.path", defaultAuditLogFallbackPath, "directory the remote audit log spills records that fail to be put on the Firehose stream to")
+		auditLogCompress     = flags.Bool("auditlog.compress", defaultAuditLogCompress, "gzip the local audit log segments")
+		auditLogRequired     = flags.String("auditlog.multi.required", defaultAuditLogMultiRequired, "comma separated audit logs the multi audit log has to write to for a commit to succeed (remote, local, nop)")
+		auditLogBestEffort   = flags.String("auditlog.multi.besteffort", defaultAuditLogMultiBestEffort, "comma separated audit logs the multi audit log writes to, where failures are only logged (remote, local, nop)")
+		auditLogShip         = flags.String("auditlog.ship", defaultAuditLogShip, "sink to ship flushed local audit log segments to (firehose, s3, http), empty doesn't ship them")
+		auditLogShipInterval = flags.Duration("auditlog.ship.interval", defaultAuditLogShipInterval, "interval at which flushed local audit log segments are shipped")
+		auditLogShipBackoff  = flags.Duration("auditlog.ship.backoff", defaultAuditLogShipBackoff, "backoff after the first failure to ship a local audit log segment")
+		auditLogShipMaxDelay = flags.Duration("auditlog.ship.backoff.max", defaultAuditLogShipMaxBackoff, "max backoff between attempts to ship a local audit log segment")
+		auditLogShipBucket   = flags.String("auditlog.ship.bucket", defaultAuditLogShipBucket, "bucket the s3 sink uploads local audit log segments to")
+		auditLogShipPrefix   = flags.String("auditlog.ship.prefix", defaultAuditLogShipPrefix, "prefix of the keys of the local audit log segments uploaded by the s3 sink")
+		auditLogShipEndpoint = flags.String("auditlog.ship.endpoint", defaultAuditLogShipEndpoint, "endpoint of a S3 compatible store for the s3 sink, instead of AWS")
+		auditLogShipURL      = flags.String("auditlog.ship.url", defaultAuditLogShipURL, "URL the http sink posts local audit log segments to")
+		filesystemType       = flags.String("filesystem", defaultFilesystem, "type of filesystem backing (local, virtual, nop)")
+		recipientURL         = flags.String("recipient.url", defaultRecipientURL, "URL to hit with the message payload")
+		routerConfig         = flags.String("router.config", defaultRouterConfig, "path to a JSON file of routes to recipients (recipient.url is the default route)")
+		fanOutURLs           = flags.String("fanout.urls", defaultFanOutURLs, "comma separated URLs to deliver every message to, instead of recipient.url")
+		fanOutPolicy         = flags.String("fanout.policy", defaultFanOutPolicy, "recipients that have to accept a fanned out message (all, any, quorum)")
+		consumerFrequency    = flags.Duration("consumer.frequency", defaultConsumerFrequency, "frequency at which the consumer should run")
+		numConsumers         = flags.Int("num.consumers", defaultNumConsumers, "number of consumers to run at once")
+		maxNumberOfMessages  = flags.Int("max.messages", defaultMaxNumberOfMessages, "max number of messages to dequeue at once")
+		visibilityTimeout    = flags.String("visibility.timeout", defaultVisibilityTimeout, "how long the visibility of a message should extended by in seconds")
+		metricsRegistration  = flags.Bool("metrics.registration", defaultMetricsRegistration, "Registration of metrics on launch")
+		retryAttempts        = flags.Int("retry.attempts", defaultRetryAttempts, "max number of delivery attempts for a message, including previous receives (0 for no limit)")
+		retryBaseBackoff     = flags.Duration("retry.backoff.base", defaultRetryBaseBackoff, "backoff after the first failed delivery attempt")
+		retryMaxBackoff      = flags.Duration("retry.backoff.max", defaultRetryMaxBackoff, "max backoff between delivery attempts")
+		retryJitter          = flags.Float64("retry.jitter", defaultRetryJitter, "fraction of the backoff to randomly remove (0.0 to 1.0)")
+		deliveryConcurrency  = flags.Int("delivery.concurrency", defaultDeliveryConcurrency, "number of records each consumer delivers at the same time")
+		deliveryOrdered      = flags.Bool("delivery.ordered", defaultDeliveryOrdered, "deliver records that share a message group in order (always on for FIFO queues)")
+		deliveryBatch        = flags.Bool("delivery.batch", defaultDeliveryBatch, "deliver all the gathered records in one request")
+		deliveryBatchFormat  = flags.String("delivery.batch.format", defaultDeliveryBatchFormat, "format of batched deliveries (json, ndjson, multipart)")
+		deliveryHeaderPrefix = flags.String("delivery.headers.prefix", defaultDeliveryHeaderPrefix, "prefix of the headers describing each delivered record")
+		deliveryAttributes   = flags.String("delivery.headers.attributes", defaultDeliveryAttributes, "comma separated message attributes to forward as headers (* for all)")
+		redelivery           = flags.String("redelivery", defaultRedelivery, "when failed messages are redelivered (default, zero, fixed, exponential)")
+		redeliveryDelay      = flags.Duration("redelivery.delay", defaultRedeliveryDelay, "delay before a failed message is redelivered, or the first delay when exponential (required when fixed or exponential)")
+		redeliveryMaxDelay   = flags.Duration("redelivery.delay.max", defaultRedeliveryMaxDelay, "max delay before a failed message is redelivered when exponential")
+		heartbeatInterval    = flags.Duration("heartbeat.interval", defaultHeartbeatInterval, "interval at which the visibility of messages still being delivered is extended (0 to disable)")
+		rateLimit            = flags.Float64("ratelimit.rate", defaultRateLimit, "max deliveries per second across all consumers (0 for no limit)")
+		rateLimitBurst       = flags.Int("ratelimit.burst", defaultRateLimitBurst, "max deliveries allowed at once above the rate")
 	)
 	flags.Usage = usageFor(flags, "ingest [flags]")
 	if err := flags.Parse(args); err != nil {
@@ -89,7 +232,7 @@ func runIngest(args []string) error {
 		logger = level.NewFilter(logger, logLevel)
 	}
 
-	level.Debug(logger).Log("ec2_role", *awsEC2Role, "aws_region", *awsRegion, "aws_sqs_queue", *awsSQSQueue, "aws_firehose_stream", *awsFirehoseStream)
+	level.Debug(logger).Log("ec2_role", *awsEC2Role, "aws_region", *awsRegion, "aws_sqs_queue", *awsSQSQueue, "aws_sqs_dlq", *awsSQSDeadLetter, "aws_firehose_stream", *awsFirehoseStream)
 
 	// Instrumentation
 	connectedClients := prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -133,6 +276,63 @@ func runIngest(args []string) error {
 		Name:      "failed_records",
 		Help:      "Records failed from ingest.",
 	})
+	heartbeatFailures := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "courier_transformer",
+		Name:      "heartbeat_failures",
+		Help:      "Records that failed to have their visibility extended.",
+	})
+	fanOutDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "courier_transformer",
+		Name:      "fanout_delivery_duration_seconds",
+		Help:      "Fan out delivery duration in seconds by recipient.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"recipient", "status"})
+	routeDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "courier_transformer",
+		Name:      "route_delivery_duration_seconds",
+		Help:      "Delivery duration in seconds by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "status"})
+	throttledSeconds := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "courier_transformer",
+		Name:      "throttled_seconds",
+		Help:      "Seconds deliveries spent waiting on the rate limiter.",
+	})
+	auditSegments := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_segments",
+		Help:      "Number of local audit log segments by consumer.",
+	}, []string{"consumer"})
+	auditDiskUsage := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_disk_usage_bytes",
+		Help:      "Bytes taken up by the local audit log segments by consumer.",
+	}, []string{"consumer"})
+	auditRecoveredSegments := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_recovered_segments",
+		Help:      "Local audit log segments left active by a crash and recovered on startup by consumer.",
+	}, []string{"consumer"})
+	auditFailedSegments := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_failed_segments",
+		Help:      "Local audit log segments that couldn't be fully recovered by consumer.",
+	}, []string{"consumer"})
+	auditShippedSegments := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_shipped_segments",
+		Help:      "Local audit log segments shipped to the sink.",
+	})
+	auditShipFailures := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_ship_failures",
+		Help:      "Attempts to ship a local audit log segment that failed.",
+	})
+	auditDroppedSegments := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "courier_transformer",
+		Name:      "audit_dropped_segments",
+		Help:      "Local audit log segments removed by the retention size before they were shipped by consumer.",
+	}, []string{"consumer"})
 
 	if *metricsRegistration {
 		prometheus.MustRegister(
@@ -144,6 +344,17 @@ func runIngest(args []string) error {
 			replicatedRecords,
 			failedSegments,
 			failedRecords,
+			heartbeatFailures,
+			throttledSeconds,
+			routeDuration,
+			fanOutDuration,
+			auditSegments,
+			auditDiskUsage,
+			auditRecoveredSegments,
+			auditFailedSegments,
+			auditShippedSegments,
+			auditShipFailures,
+			auditDroppedSegments,
 		)
 	}
 
@@ -176,19 +387,80 @@ func runIngest(args []string) error {
 		return errors.Wrap(err, "filesystem")
 	}
 
-	// Firehose setup.
-	auditRemoteConfig, err := audit.BuildRemoteConfig(
+	auditFormat, err := audit.ParseFormat(*auditLogFormat)
+	if err != nil {
+		return errors.Wrap(err, "audit format")
+	}
+
+	// Firehose setup, every consumer adds it's own fallback to the options.
+	auditRemoteOptions := []audit.RemoteConfigOption{
 		audit.WithEC2Role(*awsEC2Role),
 		audit.WithID(*awsID),
 		audit.WithSecret(*awsSecret),
 		audit.WithToken(*awsToken),
 		audit.WithRegion(*awsRegion),
 		audit.WithStream(*awsFirehoseStream),
-	)
+		audit.WithEndpoint(*awsFirehoseEndpoint),
+		audit.WithDisableSSL(*awsEndpointInsecure),
+		audit.WithForcePathStyle(*awsEndpointPath),
+		audit.WithRemoteFormat(auditFormat),
+		audit.WithPutAttempts(*awsFirehoseAttempts),
+		audit.WithPutBackoff(*awsFirehoseBackoff, *awsFirehoseMaxDelay),
+	}
+	auditRemoteConfig, err := audit.BuildRemoteConfig(auditRemoteOptions...)
 	if err != nil {
 		return errors.Wrap(err, "audit remote config")
 	}
 
+	auditMultiConfig, err := audit.BuildMultiConfig(
+		audit.WithRequiredLogs(splitList(*auditLogRequired)),
+		audit.WithBestEffortLogs(splitList(*auditLogBestEffort)),
+	)
+	if err != nil {
+		return errors.Wrap(err, "audit multi config")
+	}
+
+	// The local audit log is written to on it's own, or as one of the logs
+	// of the multi audit log.
+	localAuditLog := *auditLogType == "local"
+	if *auditLogType == "multi" {
+		for _, names := range [][]string{auditMultiConfig.Required, auditMultiConfig.BestEffort} {
+			for _, v := range names {
+				localAuditLog = localAuditLog || v == "local"
+			}
+		}
+	}
+
+	// Shipper setup, for the local audit log.
+	var auditShipper *audit.Shipper
+	if localAuditLog && *auditLogShip != "" {
+		auditShipperConfig, err := audit.BuildShipperConfig(
+			audit.WithShipperRootPath(*auditLogRootPath),
+			audit.WithShipperFsys(fs),
+			audit.WithShipperFormat(auditFormat),
+			audit.WithSink(*auditLogShip),
+			audit.WithShipInterval(*auditLogShipInterval),
+			audit.WithShipBackoff(*auditLogShipBackoff, *auditLogShipMaxDelay),
+			audit.WithShipRemoteConfig(auditRemoteConfig),
+			audit.WithBucket(*auditLogShipBucket, *auditLogShipPrefix),
+			audit.WithBucketEndpoint(*auditLogShipEndpoint),
+			audit.WithShipURL(*auditLogShipURL),
+		)
+		if err != nil {
+			return errors.Wrap(err, "audit shipper config")
+		}
+
+		auditShipper, err = audit.NewShipper(
+			auditShipperConfig,
+			auditShippedSegments,
+			auditShipFailures,
+			log.With(logger, "component", "audit_shipper"),
+		)
+		if err != nil {
+			return errors.Wrap(err, "audit shipper")
+		}
+	}
+
 	// Create the HTTP clients we'll use for various purposes.
 	timeoutClient := &http.Client{
 		Transport: &http.Transport{
@@ -200,10 +472,24 @@ func runIngest(args []string) error {
 			}).Dial,
 			TLSHandshakeTimeout: 10 * time.Second,
 			DisableKeepAlives:   false,
-			MaxIdleConnsPerHost: 1,
+			MaxIdleConnsPerHost: *deliveryConcurrency,
 		},
 	}
 
+	redeliveryStrategy, err := queue.ParseRedelivery(*redelivery)
+	if err != nil {
+		return errors.Wrap(err, "redelivery")
+	}
+
+	redeliveryPolicy := queue.RedeliveryPolicy{
+		Strategy: redeliveryStrategy,
+		Delay:    *redeliveryDelay,
+		MaxDelay: *redeliveryMaxDelay,
+	}
+	if err := redeliveryPolicy.Validate(); err != nil {
+		return errors.Wrap(err, "redelivery")
+	}
+
 	// Configuration for the queue
 	queueRemoteConfig, err := queue.BuildConfig(
 		queue.WithEC2Role(*awsEC2Role),
@@ -212,22 +498,216 @@ func runIngest(args []string) error {
 		queue.WithToken(*awsToken),
 		queue.WithRegion(*awsRegion),
 		queue.WithQueue(*awsSQSQueue),
+		queue.WithDeadLetterQueue(*awsSQSDeadLetter),
+		queue.WithMaxReceiveCount(*awsSQSMaxReceives),
 		queue.WithMaxNumberOfMessages(int64(*maxNumberOfMessages)),
 		queue.WithVisibilityTimeout(visibilityTimeoutDuration),
+		queue.WithEndpoint(*awsSQSEndpoint),
+		queue.WithDisableSSL(*awsEndpointInsecure),
+		queue.WithForcePathStyle(*awsEndpointPath),
+		queue.WithRedelivery(redeliveryPolicy),
 	)
 	if err != nil {
 		return errors.Wrap(err, "queue remote config")
 	}
 
+	queueDiskConfig, err := queue.BuildDiskConfig(
+		queue.WithRootPath(*queueRootPath),
+		queue.WithFsys(fs),
+		queue.WithLeaseTimeout(visibilityTimeoutDuration),
+		queue.WithBatchSize(*maxNumberOfMessages),
+		queue.WithDiskRedelivery(redeliveryPolicy),
+	)
+	if err != nil {
+		return errors.Wrap(err, "queue disk config")
+	}
+
+	queueKafkaConfig, err := queue.BuildKafkaConfig(
+		queue.WithKafkaBrokers(splitList(*kafkaBrokers)),
+		queue.WithKafkaTopic(*kafkaTopic),
+		queue.WithKafkaGroup(*kafkaGroup),
+		queue.WithKafkaRetryTopic(*kafkaRetryTopic),
+		queue.WithKafkaDeadTopic(*kafkaDeadTopic),
+		queue.WithKafkaMaxDeliveries(*kafkaDeliveries),
+		queue.WithKafkaBatchSize(*maxNumberOfMessages),
+	)
+	if err != nil {
+		return errors.Wrap(err, "queue kafka config")
+	}
+
+	queueAMQPConfig, err := queue.BuildAMQPConfig(
+		queue.WithAMQPURL(*amqpURL),
+		queue.WithAMQPQueue(*amqpQueue),
+		queue.WithAMQPDeadLetterExchange(*amqpDeadLetter),
+		queue.WithAMQPPrefetch(*maxNumberOfMessages),
+	)
+	if err != nil {
+		return errors.Wrap(err, "queue amqp config")
+	}
+
+	queueRedisConfig, err := queue.BuildRedisConfig(
+		queue.WithRedisAddr(*redisAddr),
+		queue.WithRedisStream(*redisStream),
+		queue.WithRedisGroup(*redisGroup),
+		queue.WithRedisConsumer(*redisConsumer),
+		queue.WithRedisRetryStream(*redisRetryStream),
+		queue.WithRedisMaxDeliveries(*redisMaxDeliveries),
+		queue.WithRedisClaimIdle(visibilityTimeoutDuration),
+		queue.WithRedisBatchSize(*maxNumberOfMessages),
+	)
+	if err != nil {
+		return errors.Wrap(err, "queue redis config")
+	}
+
+	queueHTTPConfig, err := queue.BuildHTTPConfig(
+		queue.WithHTTPCapacity(*ingressCapacity),
+		queue.WithHTTPLeaseTimeout(visibilityTimeoutDuration),
+		queue.WithHTTPBatchSize(*maxNumberOfMessages),
+		queue.WithHTTPRedelivery(redeliveryPolicy),
+	)
+	if err != nil {
+		return errors.Wrap(err, "queue http config")
+	}
+
 	queueConfig, err := queue.Build(
 		queue.With(*queueType),
 		queue.WithConfig(queueRemoteConfig),
+		queue.WithDiskConfig(queueDiskConfig),
+		queue.WithKafkaConfig(queueKafkaConfig),
+		queue.WithAMQPConfig(queueAMQPConfig),
+		queue.WithHTTPConfig(queueHTTPConfig),
+		queue.WithRedisConfig(queueRedisConfig),
 	)
 	if err != nil {
 		return errors.Wrap(err, "queue config")
 	}
 
+	// Every consumer gets it's own queue, unless it's on disk or pushed to
+	// over http, in which case the one queue owns the root directory, or the
+	// records, and is shared. Nothing else produces to either of them, so
+	// producers push records to them through the ingress API.
+	newQueue := func() (queue.Queue, error) {
+		return queue.New(queueConfig, log.With(logger, "component", "queue"))
+	}
+	var ingressQueue queue.Queue
+	if *queueType == "disk" || *queueType == "http" {
+		q, err := newQueue()
+		if err != nil {
+			return err
+		}
+		newQueue = func() (queue.Queue, error) {
+			return q, nil
+		}
+		ingressQueue = q
+	}
+
+	// The recipient written to the audit log, a router names the route of each
+	// record instead.
+	recipient := *recipientURL
+	if len(splitList(*fanOutURLs)) > 0 {
+		recipient = *fanOutURLs
+	}
+
+	// Records from a FIFO SQS queue are always delivered in order, the name of
+	// the SQS queue means nothing to the other types of queue.
+	ordered := *deliveryOrdered || (*queueType == "remote" && queue.IsFIFO(*awsSQSQueue))
+
+	// Configuration for the consumers
+	consumerConfig, err := consumer.Build(
+		consumer.WithRetryPolicy(consumer.RetryPolicy{
+			MaxAttempts: *retryAttempts,
+			BaseBackoff: *retryBaseBackoff,
+			MaxBackoff:  *retryMaxBackoff,
+			Jitter:      *retryJitter,
+		}),
+		consumer.WithConcurrency(*deliveryConcurrency),
+		consumer.WithOrderedDelivery(ordered),
+		consumer.WithBatchDelivery(*deliveryBatch),
+		consumer.WithHeartbeat(*heartbeatInterval),
+		consumer.WithRecipient(recipient),
+	)
+	if err != nil {
+		return errors.Wrap(err, "consumer config")
+	}
+
+	batchFormat, err := h.ParseBatchFormat(*deliveryBatchFormat)
+	if err != nil {
+		return errors.Wrap(err, "batch format")
+	}
+
+	// Rate limiter shared between all the consumers.
+	limiter, err := ratelimit.New(*rateLimit, *rateLimitBurst, throttledSeconds)
+	if err != nil {
+		return errors.Wrap(err, "rate limiter")
+	}
+
+	newClient := func(url string) h.Sender {
+		return h.NewClient(
+			timeoutClient,
+			url,
+			h.WithLimiter(limiter),
+			h.WithBatchFormat(batchFormat),
+			h.WithHeaders(h.Headers{
+				Prefix:     *deliveryHeaderPrefix,
+				Attributes: splitList(*deliveryAttributes),
+			}),
+		)
+	}
+
+	// Every consumer gets it's own client, unless there is a fan out or a
+	// router, in which case it (and each of it's clients) are shared.
+	newSender := func() h.Sender {
+		return newClient(*recipientURL)
+	}
+	if urls := splitList(*fanOutURLs); len(urls) > 0 {
+		if *routerConfig != "" {
+			return errors.New("fanout.urls can't be used with router.config")
+		}
+
+		policy, err := fanout.ParsePolicy(*fanOutPolicy)
+		if err != nil {
+			return errors.Wrap(err, "fan out policy")
+		}
+
+		recipients := make([]fanout.Recipient, len(urls))
+		for k, v := range urls {
+			recipients[k] = fanout.Recipient{
+				Name:   v,
+				Sender: newClient(v),
+			}
+		}
+
+		f, err := fanout.New(recipients, policy, fanOutDuration)
+		if err != nil {
+			return errors.Wrap(err, "fan out")
+		}
+		newSender = func() h.Sender {
+			return f
+		}
+	}
+	if *routerConfig != "" {
+		routes, err := readRouterConfig(*routerConfig)
+		if err != nil {
+			return errors.Wrap(err, "router config")
+		}
+		if routes.Default == nil && *recipientURL != "" {
+			routes.Default = &router.RouteConfig{
+				Name: "default",
+				URL:  *recipientURL,
+			}
+		}
+
+		r, err := router.New(routes, newClient, routeDuration)
+		if err != nil {
+			return errors.Wrap(err, "router")
+		}
+		newSender = func() h.Sender {
+			return r
+		}
+	}
+
 	// Execution group.
+	var consumerLogs []audit.Log
 	g := gexec.NewGroup()
 	gexec.Block(g)
 	{
@@ -237,21 +717,50 @@ func runIngest(args []string) error {
 			auditLocalConfig, err := audit.BuildLocalConfig(
 				audit.WithRootPath(consumerRootDir),
 				audit.WithFsys(fs),
+				audit.WithLocalFormat(auditFormat),
+				audit.WithSegmentSize(*auditLogSegmentSize),
+				audit.WithSegmentAge(*auditLogSegmentAge),
+				audit.WithRetentionAge(*auditLogRetentionAge),
+				audit.WithRetentionSize(*auditLogRetention),
+				audit.WithCompression(*auditLogCompress),
+				audit.WithShipping(auditShipper != nil),
+				audit.WithSegmentMetrics(
+					auditSegments.WithLabelValues(strconv.Itoa(i)),
+					auditDiskUsage.WithLabelValues(strconv.Itoa(i)),
+				),
+				audit.WithRecoveryMetrics(
+					auditRecoveredSegments.WithLabelValues(strconv.Itoa(i)),
+					auditFailedSegments.WithLabelValues(strconv.Itoa(i)),
+				),
+				audit.WithRetentionMetrics(
+					auditDroppedSegments.WithLabelValues(strconv.Itoa(i)),
+				),
 			)
 			if err != nil {
 				return errors.Wrap(err, "audit local config")
 			}
 
+			// Every consumer spills to it's own fallback directory, so that they
+			// don't write over each other.
+			consumerRemoteConfig, err := audit.BuildRemoteConfig(append(
+				auditRemoteOptions[:len(auditRemoteOptions):len(auditRemoteOptions)],
+				audit.WithFallback(fs, filepath.Join(*auditLogFallbackPath, fmt.Sprintf("audit-%04d", i))),
+			)...)
+			if err != nil {
+				return errors.Wrap(err, "audit remote config")
+			}
+
 			auditConfig, err := audit.Build(
 				audit.With(*auditLogType),
-				audit.WithRemoteConfig(auditRemoteConfig),
+				audit.WithRemoteConfig(consumerRemoteConfig),
 				audit.WithLocalConfig(auditLocalConfig),
+				audit.WithMultiConfig(auditMultiConfig),
 			)
 			if err != nil {
 				return errors.Wrap(err, "audit config")
 			}
 
-			consumerQueue, err := queue.New(queueConfig, log.With(logger, "component", "queue"))
+			consumerQueue, err := newQueue()
 			if err != nil {
 				return err
 			}
@@ -260,19 +769,22 @@ func runIngest(args []string) error {
 			if err != nil {
 				return err
 			}
+			consumerLogs = append(consumerLogs, consumerLog)
 
 			// Create the consumer
 			c := consumer.New(
-				h.NewClient(timeoutClient, *recipientURL),
+				newSender(),
 				consumerQueue,
 				consumerLog,
 				*consumerFrequency,
+				consumerConfig,
 				consumedSegments,
 				consumedRecords,
 				replicatedSegments,
 				replicatedRecords,
 				failedSegments,
 				failedRecords,
+				heartbeatFailures,
 				log.With(logger, "component", fmt.Sprintf("consumer-%d", i)),
 			)
 			g.Add(func() error {
@@ -283,6 +795,14 @@ func runIngest(args []string) error {
 			})
 		}
 	}
+	if auditShipper != nil {
+		g.Add(func() error {
+			auditShipper.Run()
+			return nil
+		}, func(error) {
+			auditShipper.Stop()
+		})
+	}
 	{
 		g.Add(func() error {
 			mux := http.NewServeMux()
@@ -291,6 +811,26 @@ func runIngest(args []string) error {
 				connectedClients.WithLabelValues("status"),
 				apiDuration,
 			)))
+			mux.Handle("/ratelimit/", http.StripPrefix("/ratelimit", ratelimit.NewAPI(
+				limiter,
+				log.With(logger, "component", "ratelimit_api"),
+				connectedClients.WithLabelValues("ratelimit"),
+				apiDuration,
+			)))
+			mux.Handle("/audit/", http.StripPrefix("/audit", audit.NewAPI(
+				consumerLogs,
+				log.With(logger, "component", "audit_api"),
+				connectedClients.WithLabelValues("audit"),
+				apiDuration,
+			)))
+			if ingressQueue != nil {
+				mux.Handle("/ingress/", http.StripPrefix("/ingress", ingress.NewAPI(
+					ingressQueue,
+					log.With(logger, "component", "ingress_api"),
+					connectedClients.WithLabelValues("ingress"),
+					apiDuration,
+				)))
+			}
 
 			registerMetrics(mux)
 			registerProfile(mux)
@@ -303,3 +843,13 @@ func runIngest(args []string) error {
 	gexec.Interrupt(g)
 	return g.Run()
 }
+
+func readRouterConfig(path string) (router.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return router.Config{}, err
+	}
+	defer file.Close()
+
+	return router.ParseConfig(file)
+}
@@ -37,6 +37,18 @@ func parseAddr(addr string, defaultPort int) (network, address string, err error
 	return u.Scheme, u.Host, nil
 }
 
+// "a, b,,c" => [a b c]
+// ""        => []
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 func registerMetrics(mux *http.ServeMux) {
 	mux.Handle("/metrics", promhttp.Handler())
 }
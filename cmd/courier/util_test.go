@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -36,3 +37,20 @@ func TestParseAddr(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitList(t *testing.T) {
+	for _, testcase := range []struct {
+		list   string
+		values []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a, b,,c ", []string{"a", "b", "c"}},
+		{"*", []string{"*"}},
+	} {
+		values := splitList(testcase.list)
+		if !reflect.DeepEqual(values, testcase.values) {
+			t.Errorf("(%q): want %v, have %v", testcase.list, testcase.values, values)
+		}
+	}
+}
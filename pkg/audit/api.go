@@ -0,0 +1,222 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	errs "github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/metrics"
+	"github.com/trussle/uuid"
+)
+
+// These are the audit API URL paths.
+const (
+	APIPathRecoveriesQuery = "/recoveries"
+	APIPathRecordsQuery    = "/records"
+)
+
+// recoverer is implemented by logs that recover segments on startup.
+type recoverer interface {
+	Recoveries() ([]Recovery, error)
+}
+
+// Query selects the entries of a record, either by the id courier gave it or
+// by the id of it's message on the queue.
+type Query struct {
+	ID        string
+	MessageID string
+}
+
+// Matches returns if the entry is selected by the query.
+func (q Query) Matches(entry Entry) bool {
+	if q.ID != "" && q.ID != entry.ID {
+		return false
+	}
+	if q.MessageID != "" && q.MessageID != entry.MessageID {
+		return false
+	}
+	return q.ID != "" || q.MessageID != ""
+}
+
+// finder is implemented by logs that can find the entries they've appended.
+type finder interface {
+	Find(Query) ([]Entry, error)
+}
+
+// API serves the audit API
+type API struct {
+	logs     []Log
+	logger   log.Logger
+	clients  metrics.Gauge
+	duration metrics.HistogramVec
+	errors   errs.Error
+}
+
+// NewAPI creates a API with the correct dependencies.
+func NewAPI(logs []Log,
+	logger log.Logger,
+	clients metrics.Gauge,
+	duration metrics.HistogramVec,
+) *API {
+	return &API{
+		logs:     logs,
+		logger:   logger,
+		clients:  clients,
+		duration: duration,
+		errors:   errs.NewError(logger),
+	}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	level.Info(a.logger).Log("method", r.Method, "url", r.URL.String())
+
+	iw := &interceptingWriter{http.StatusOK, w}
+	w = iw
+
+	// Metrics
+	a.clients.Inc()
+	defer a.clients.Dec()
+
+	// The id of a record is left out of the path that's observed, so that
+	// every record doesn't have it's own metric.
+	route := r.URL.Path
+	defer func(begin time.Time) {
+		a.duration.WithLabelValues(
+			r.Method,
+			route,
+			strconv.Itoa(iw.code),
+		).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	// Routing table
+	method, path := r.Method, r.URL.Path
+	switch {
+	case method == "GET" && path == APIPathRecoveriesQuery:
+		a.handleRecoveries(w, r)
+	case method == "GET" && path == APIPathRecordsQuery:
+		a.handleRecords(w, r)
+	case method == "GET" && strings.HasPrefix(path, APIPathRecordsQuery+"/"):
+		route = APIPathRecordsQuery + "/{id}"
+		a.handleRecord(w, r, strings.TrimPrefix(path, APIPathRecordsQuery+"/"))
+	default:
+		// Nothing found
+		a.errors.NotFound(w, r)
+	}
+}
+
+func (a *API) handleRecoveries(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Logs that don't recover anything, such as the remote log, are left out.
+	recoveries := make([]Recovery, 0)
+	for _, v := range a.logs {
+		if l, ok := v.(recoverer); ok {
+			res, err := l.Recoveries()
+			if err != nil {
+				a.errors.InternalServerError(w, r, err.Error())
+				return
+			}
+			recoveries = append(recoveries, res...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Segments []Recovery `json:"segments"`
+	}{
+		Segments: recoveries,
+	}); err != nil {
+		a.errors.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (a *API) handleRecords(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	messageID := r.URL.Query().Get("message_id")
+	if messageID == "" {
+		a.errors.BadRequest(w, r, "expected message_id")
+		return
+	}
+
+	entries, err := a.find(Query{MessageID: messageID})
+	if err != nil {
+		a.errors.InternalServerError(w, r, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		a.errors.NotFound(w, r)
+		return
+	}
+
+	a.writeRecords(w, r, entries)
+}
+
+func (a *API) handleRecord(w http.ResponseWriter, r *http.Request, id string) {
+	defer r.Body.Close()
+
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		a.errors.BadRequest(w, r, err.Error())
+		return
+	}
+
+	entries, err := a.find(Query{ID: parsed.String()})
+	if err != nil {
+		a.errors.InternalServerError(w, r, err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		a.errors.NotFound(w, r)
+		return
+	}
+
+	a.writeRecords(w, r, entries)
+}
+
+// find returns the entries selected by the query from every log that can find
+// them, such as the recent records of the remote log, or the flushed segments
+// of the local log.
+func (a *API) find(query Query) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	for _, v := range a.logs {
+		if l, ok := v.(finder); ok {
+			res, err := l.Find(query)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, res...)
+		}
+	}
+	return entries, nil
+}
+
+func (a *API) writeRecords(w http.ResponseWriter, r *http.Request, entries []Entry) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(struct {
+		Records []Entry `json:"records"`
+	}{
+		Records: entries,
+	}); err != nil {
+		a.errors.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type interceptingWriter struct {
+	code int
+	http.ResponseWriter
+}
+
+func (iw *interceptingWriter) WriteHeader(code int) {
+	iw.code = code
+	iw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,276 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
+)
+
+func TestAPI(t *testing.T) {
+	t.Parallel()
+
+	t.Run("get recoveries", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		virtual := fsys.NewVirtualFilesystem()
+		file, err := virtual.Create("/root/segment.active")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("{"))
+
+		config, err := BuildLocalConfig(
+			WithRootPath("/root"),
+			WithFsys(virtual),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		localLog, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI([]Log{localLog, newNopLog()}, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("GET", "/recoveries", "200").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		response, err := http.Get(fmt.Sprintf("%s/recoveries", server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusOK, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var body struct {
+			Segments []Recovery `json:"segments"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := []Recovery{{
+			Segment: "/root/segment.failed",
+			Status:  SegmentFailed,
+			Err:     "unexpected EOF",
+		}}, body.Segments; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("get records", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+		config, err := BuildLocalConfig(
+			WithRootPath("/root"),
+			WithFsys(fsys.NewVirtualFilesystem()),
+			WithSegmentSize(1),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		localLog, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := uuid.NewWithRand(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := queue.NewTransaction()
+		txn.Push(id, record)
+		if err := localLog.Append(txn); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI([]Log{localLog, newNopLog()}, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(2)
+		clients.EXPECT().Dec().Times(2)
+
+		duration.EXPECT().WithLabelValues("GET", "/records/{id}", "200").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("GET", "/records", "200").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(2)
+
+		for _, path := range []string{
+			fmt.Sprintf("/records/%s", id.String()),
+			fmt.Sprintf("/records?message_id=%s", url.QueryEscape(record.RecordID())),
+		} {
+			response, err := http.Get(fmt.Sprintf("%s%s", server.URL, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if expected, actual := http.StatusOK, response.StatusCode; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+
+			var body struct {
+				Records []Entry `json:"records"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := 1, len(body.Records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := id.String(), body.Records[0].ID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := OutcomeCommitted, body.Records[0].Outcome; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("get records with bad requests", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI([]Log{newNopLog()}, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(4)
+		clients.EXPECT().Dec().Times(4)
+
+		duration.EXPECT().WithLabelValues("GET", "/records/{id}", "400").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("GET", "/records/{id}", "404").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("GET", "/records", "400").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("GET", "/records", "404").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(4)
+
+		for path, code := range map[string]int{
+			"/records/bad": http.StatusBadRequest,
+			fmt.Sprintf("/records/%s", uuid.MustNew().String()): http.StatusNotFound,
+			"/records":                http.StatusBadRequest,
+			"/records?message_id=bad": http.StatusNotFound,
+		} {
+			response, err := http.Get(fmt.Sprintf("%s%s", server.URL, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if expected, actual := code, response.StatusCode; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(nil, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("GET", "/bad", "404").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		response, err := http.Get(fmt.Sprintf("%s/bad", server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusNotFound, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+type float64Matcher struct{}
+
+func (float64Matcher) Matches(x interface{}) bool {
+	_, ok := x.(float64)
+	return ok
+}
+
+func (float64Matcher) String() string {
+	return "is float64"
+}
+
+func Float64() gomock.Matcher { return float64Matcher{} }
+
+func TestQuery(t *testing.T) {
+	t.Parallel()
+
+	entry := Entry{
+		ID:        "id",
+		MessageID: "message",
+	}
+	for query, expected := range map[Query]bool{
+		{}:                               false,
+		{ID: "id"}:                       true,
+		{MessageID: "message"}:           true,
+		{ID: "id", MessageID: "message"}: true,
+		{ID: "other"}:                    false,
+		{ID: "id", MessageID: "other"}:   false,
+		{MessageID: "other"}:             false,
+	} {
+		if actual := query.Matches(entry); expected != actual {
+			t.Errorf("%v expected: %t, actual: %t", query, expected, actual)
+		}
+	}
+}
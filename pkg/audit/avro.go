@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// AvroSchema is the schema entries are encoded with. Each entry is prefixed by
+// it's length, encoded as an avro long.
+const AvroSchema = `{
+  "type": "record",
+  "name": "Entry",
+  "namespace": "courier.audit",
+  "fields": [
+    {"name": "version", "type": "int"},
+    {"name": "id", "type": "string"},
+    {"name": "message_id", "type": "string"},
+    {"name": "receipt", "type": "string"},
+    {"name": "group_id", "type": "string"},
+    {"name": "attributes", "type": {"type": "map", "values": "string"}},
+    {"name": "body", "type": "bytes"},
+    {"name": "attempts", "type": "int"},
+    {"name": "received_at", "type": "long"},
+    {"name": "delivered_at", "type": "long"},
+    {"name": "recipient", "type": "string"},
+    {"name": "status_code", "type": "int"},
+    {"name": "outcome", "type": "string"}
+  ]
+}`
+
+func encodeAvro(entry Entry) []byte {
+	var datum []byte
+	datum = appendAvroLong(datum, int64(entry.Version))
+	datum = appendAvroBytes(datum, []byte(entry.ID))
+	datum = appendAvroBytes(datum, []byte(entry.MessageID))
+	datum = appendAvroBytes(datum, []byte(entry.Receipt))
+	datum = appendAvroBytes(datum, []byte(entry.GroupID))
+	if n := len(entry.Attributes); n > 0 {
+		// A single block holding every attribute.
+		datum = appendAvroLong(datum, int64(n))
+		for _, k := range sortedKeys(entry.Attributes) {
+			datum = appendAvroBytes(datum, []byte(k))
+			datum = appendAvroBytes(datum, []byte(entry.Attributes[k]))
+		}
+	}
+	datum = appendAvroLong(datum, 0)
+	datum = appendAvroBytes(datum, entry.Body)
+	datum = appendAvroLong(datum, int64(entry.Attempts))
+	datum = appendAvroLong(datum, unixNano(entry.ReceivedAt))
+	datum = appendAvroLong(datum, unixNano(entry.DeliveredAt))
+	datum = appendAvroBytes(datum, []byte(entry.Recipient))
+	datum = appendAvroLong(datum, int64(entry.StatusCode))
+	datum = appendAvroBytes(datum, []byte(entry.Outcome))
+
+	return append(appendAvroLong(nil, int64(len(datum))), datum...)
+}
+
+func decodeAvro(r *bufio.Reader) (Entry, error) {
+	b, err := readDelimited(r, func() (int64, error) {
+		return binary.ReadVarint(r)
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	var (
+		d     = avroDecoder{b: b}
+		entry Entry
+	)
+	entry.Version = int(d.long())
+	entry.ID = string(d.bytes())
+	entry.MessageID = string(d.bytes())
+	entry.Receipt = string(d.bytes())
+	entry.GroupID = string(d.bytes())
+	for {
+		n := d.long()
+		if n == 0 || d.err != nil {
+			break
+		}
+		if n < 0 {
+			// A negative count is followed by the size of the block in bytes.
+			n = -n
+			d.long()
+		}
+		if entry.Attributes == nil {
+			entry.Attributes = make(map[string]string, n)
+		}
+		for i := int64(0); i < n && d.err == nil; i++ {
+			k := string(d.bytes())
+			entry.Attributes[k] = string(d.bytes())
+		}
+	}
+	entry.Body = d.bytes()
+	entry.Attempts = int(d.long())
+	entry.ReceivedAt = fromUnixNano(d.long())
+	entry.DeliveredAt = fromUnixNano(d.long())
+	entry.Recipient = string(d.bytes())
+	entry.StatusCode = int(d.long())
+	entry.Outcome = Outcome(d.bytes())
+
+	if d.err != nil {
+		return Entry{}, d.err
+	}
+	return entry, nil
+}
+
+// avroDecoder reads values from a datum, holding on to the first error.
+type avroDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *avroDecoder) long() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.New("invalid avro long")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *avroDecoder) bytes() []byte {
+	size := d.long()
+	if d.err != nil {
+		return nil
+	}
+	if size < 0 || int64(len(d.b)) < size {
+		d.err = errors.New("invalid avro length")
+		return nil
+	}
+	var b []byte
+	if size > 0 {
+		b = append(b, d.b[:size]...)
+	}
+	d.b = d.b[size:]
+	return b
+}
+
+// appendAvroLong appends the value zig-zag encoded as a varint, which is
+// exactly what binary.PutVarint does.
+func appendAvroLong(b []byte, value int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], value)]...)
+}
+
+func appendAvroBytes(b []byte, value []byte) []byte {
+	return append(appendAvroLong(b, int64(len(value))), value...)
+}
@@ -0,0 +1,181 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
+)
+
+// Version of the entries written to the audit log, which is bumped whenever the
+// fields change.
+const Version = 2
+
+// maxRowSize is the largest row that's read, so that a corrupt
+// length doesn't allocate everything.
+const maxRowSize = 64 << 20
+
+// Format describes how entries are encoded in to rows of the audit log.
+type Format string
+
+const (
+	// FormatJSON encodes every entry as a line of JSON.
+	FormatJSON Format = "json"
+
+	// FormatProtobuf encodes every entry as a length delimited protobuf
+	// message, see protobuf.go for the schema.
+	FormatProtobuf Format = "protobuf"
+
+	// FormatAvro encodes every entry as length delimited avro binary, using
+	// AvroSchema.
+	FormatAvro Format = "avro"
+)
+
+// ParseFormat returns the Format for a name or returns an error if the name
+// isn't known.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatJSON, FormatProtobuf, FormatAvro:
+		return format, nil
+	default:
+		return "", errors.Errorf("unexpected audit format %q", name)
+	}
+}
+
+// Entry is everything that's known about a record when it's written to the
+// audit log.
+type Entry struct {
+	Version     int               `json:"version"`
+	ID          string            `json:"id"`
+	MessageID   string            `json:"message_id"`
+	Receipt     string            `json:"receipt"`
+	GroupID     string            `json:"group_id,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Body        []byte            `json:"body"`
+	Attempts    int               `json:"attempts"`
+	ReceivedAt  time.Time         `json:"received_at"`
+	DeliveredAt time.Time         `json:"delivered_at"`
+	Recipient   string            `json:"recipient,omitempty"`
+	StatusCode  int               `json:"status_code,omitempty"`
+	Outcome     Outcome           `json:"outcome"`
+}
+
+// Delivery describes how a record was delivered.
+type Delivery struct {
+	Recipient   string
+	StatusCode  int
+	DeliveredAt time.Time
+}
+
+// Delivered returns the record along with how it was delivered, so that the
+// delivery is written to the audit log as well.
+func Delivered(record models.Record, delivery Delivery) models.Record {
+	return deliveredRecord{
+		Record:   record,
+		delivery: delivery,
+	}
+}
+
+type deliveredRecord struct {
+	models.Record
+	delivery Delivery
+}
+
+// NewEntry creates an Entry for the record appended under the id, with what
+// happened to it.
+func NewEntry(id uuid.UUID, record models.Record, outcome Outcome) Entry {
+	entry := Entry{
+		Version:    Version,
+		ID:         id.String(),
+		MessageID:  record.RecordID(),
+		Receipt:    record.Receipt().String(),
+		GroupID:    record.GroupID(),
+		Attributes: record.Attributes(),
+		Body:       record.Body(),
+		Attempts:   record.Attempts(),
+		ReceivedAt: record.ReceivedAt().UTC(),
+		Outcome:    outcome,
+	}
+	if r, ok := record.(deliveredRecord); ok {
+		entry.Recipient = r.delivery.Recipient
+		entry.StatusCode = r.delivery.StatusCode
+		entry.DeliveredAt = r.delivery.DeliveredAt.UTC()
+	}
+	return entry
+}
+
+// encodeEntry encodes the entry as a single row of the format, which can be
+// read back with decodeEntry.
+func encodeEntry(format Format, entry Entry) ([]byte, error) {
+	switch format {
+	case FormatJSON, "":
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case FormatProtobuf:
+		return encodeProtobuf(entry), nil
+	case FormatAvro:
+		return encodeAvro(entry), nil
+	default:
+		return nil, errors.Errorf("unexpected audit format %q", format)
+	}
+}
+
+// decodeEntry reads the next row of the format, returning io.EOF once there
+// are no more rows, or io.ErrUnexpectedEOF if the last row is incomplete.
+func decodeEntry(format Format, r *bufio.Reader) (Entry, error) {
+	switch format {
+	case FormatJSON, "":
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return Entry{}, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return Entry{}, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return Entry{}, errors.Wrap(err, "decoding json")
+		}
+		return entry, nil
+	case FormatProtobuf:
+		return decodeProtobuf(r)
+	case FormatAvro:
+		return decodeAvro(r)
+	default:
+		return Entry{}, errors.Errorf("unexpected audit format %q", format)
+	}
+}
+
+// readDelimited reads a row that's prefixed by it's length, returning io.EOF
+// only if there's nothing left to read at all.
+func readDelimited(r *bufio.Reader, size func() (int64, error)) ([]byte, error) {
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+
+	n, err := size()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxRowSize {
+		return nil, errors.Errorf("invalid row length %d", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+func TestEntry(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("new entry", func(t *testing.T) {
+		fn := func(id uuid.UUID, body []byte, name, value string) bool {
+			receivedAt := time.Now()
+			record := queue.NewRecord(id, "message", "receipt", body, receivedAt, map[string]string{
+				name: value,
+			}, map[string]string{
+				"ApproximateReceiveCount": "3",
+				"MessageGroupId":          "group",
+			})
+
+			entry := NewEntry(id, record, OutcomeFailed)
+			if expected, actual := Version, entry.Version; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := id.String(), entry.ID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := "group", entry.GroupID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := 3, entry.Attempts; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := true, receivedAt.Equal(entry.ReceivedAt); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+			if expected, actual := OutcomeFailed, entry.Outcome; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := true, entry.DeliveredAt.IsZero(); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+			return entry.MessageID == "message" &&
+				entry.Receipt == "receipt" &&
+				entry.Attributes[name] == value &&
+				bytes.Equal(entry.Body, body)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("new entry with delivery", func(t *testing.T) {
+		fn := func(id uuid.UUID, recipient string, statusCode uint16) bool {
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deliveredAt := time.Now()
+			entry := NewEntry(id, Delivered(record, Delivery{
+				Recipient:   recipient,
+				StatusCode:  int(statusCode),
+				DeliveredAt: deliveredAt,
+			}), OutcomeCommitted)
+
+			if expected, actual := record.RecordID(), entry.MessageID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return entry.Recipient == recipient &&
+				entry.StatusCode == int(statusCode) &&
+				entry.DeliveredAt.Equal(deliveredAt)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	for _, format := range []Format{FormatJSON, FormatProtobuf, FormatAvro} {
+		format := format
+
+		t.Run("encode and decode "+string(format), func(t *testing.T) {
+			fn := func(entries []testEntry) bool {
+				var buf bytes.Buffer
+				for _, entry := range entries {
+					row, err := encodeEntry(format, Entry(entry))
+					if err != nil {
+						t.Fatal(err)
+					}
+					buf.Write(row)
+				}
+
+				r := bufio.NewReader(&buf)
+				for _, entry := range entries {
+					actual, err := decodeEntry(format, r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if expected := Entry(entry); !reflect.DeepEqual(expected, actual) {
+						t.Errorf("expected: %v, actual: %v", expected, actual)
+					}
+				}
+
+				_, err := decodeEntry(format, r)
+				return err == io.EOF
+			}
+			if err := quick.Check(fn, nil); err != nil {
+				t.Error(err)
+			}
+		})
+
+		t.Run("decode incomplete "+string(format), func(t *testing.T) {
+			fn := func(entry testEntry) bool {
+				row, err := encodeEntry(format, Entry(entry))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = decodeEntry(format, bufio.NewReader(bytes.NewReader(row[:len(row)-1])))
+				return err == io.ErrUnexpectedEOF
+			}
+			if err := quick.Check(fn, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse", func(t *testing.T) {
+		for name, expected := range map[string]Format{
+			"json":     FormatJSON,
+			"Protobuf": FormatProtobuf,
+			"AVRO":     FormatAvro,
+		} {
+			actual, err := ParseFormat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("invalid parse", func(t *testing.T) {
+		_, err := ParseFormat("xml")
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+// testEntry is an Entry that can be generated by quick, with everything set
+// to a value that survives being encoded, such as times in UTC.
+type testEntry Entry
+
+func (testEntry) Generate(r *rand.Rand, size int) reflect.Value {
+	str := func() string {
+		v, _ := quick.Value(reflect.TypeOf(""), r)
+		return v.String()
+	}
+	entry := testEntry{
+		Version:    Version,
+		ID:         str(),
+		MessageID:  str(),
+		Receipt:    str(),
+		GroupID:    str(),
+		Attempts:   r.Intn(10) + 1,
+		ReceivedAt: time.Unix(0, r.Int63()).UTC(),
+		Recipient:  str(),
+		StatusCode: 200 + r.Intn(400),
+		Outcome:    []Outcome{OutcomeCommitted, OutcomeFailed, OutcomeEvicted, OutcomeDropped}[r.Intn(4)],
+	}
+	if n := r.Intn(4); n > 0 {
+		entry.Attributes = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			entry.Attributes[str()] = str()
+		}
+	}
+	// Make sure there are newlines with in the body.
+	if n := r.Intn(size + 1); n > 0 {
+		entry.Body = make([]byte, n)
+		r.Read(entry.Body)
+		entry.Body[r.Intn(n)] = '\n'
+	}
+	if r.Intn(2) == 0 {
+		entry.DeliveredAt = time.Unix(0, r.Int63()).UTC()
+	}
+	return reflect.ValueOf(entry)
+}
@@ -0,0 +1,162 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFirehoseBatch is the most records Firehose accepts in one batch.
+	maxFirehoseBatch = 500
+
+	// maxFirehoseBatchBytes is the most bytes Firehose accepts in one batch.
+	maxFirehoseBatchBytes = 4 * 1024 * 1024
+
+	// maxFirehoseRecordBytes is the most bytes Firehose accepts for a record,
+	// anything larger is never put.
+	maxFirehoseRecordBytes = 1000 * 1024
+)
+
+const (
+	defaultPutAttempts   = 3
+	defaultPutBackoff    = 100 * time.Millisecond
+	defaultPutMaxBackoff = 5 * time.Second
+)
+
+// firehoseAPI is the part of the Firehose API that's used.
+type firehoseAPI interface {
+	PutRecordBatch(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+// firehosePutter puts rows on to a Firehose stream, split in to batches that
+// are with in Firehose's limits. The rows that fail to be put, either because
+// the batch failed or because Firehose rejected them, are put again after a
+// backoff, until they run out of attempts.
+type firehosePutter struct {
+	client     firehoseAPI
+	stream     *string
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	sleep      func(time.Duration)
+}
+
+func newFirehosePutter(client firehoseAPI, config *RemoteConfig) *firehosePutter {
+	return &firehosePutter{
+		client:     client,
+		stream:     aws.String(config.Stream),
+		attempts:   config.PutAttempts,
+		backoff:    config.PutBackoff,
+		maxBackoff: config.PutMaxBackoff,
+		sleep:      time.Sleep,
+	}
+}
+
+// put the rows on to the stream, returning the index of every row that still
+// failed after all the attempts, along with the last error that was returned
+// by Firehose.
+func (p *firehosePutter) put(rows [][]byte) ([]int, error) {
+	var (
+		pending []int
+		failed  []int
+		lastErr error
+	)
+	for k, v := range rows {
+		if len(v) > maxFirehoseRecordBytes {
+			failed = append(failed, k)
+			lastErr = errors.Errorf("record of %d bytes is too large", len(v))
+			continue
+		}
+		pending = append(pending, k)
+	}
+
+	delay := p.backoff
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var retry []int
+		for _, batch := range splitFirehoseBatches(rows, pending) {
+			res, err := p.putBatch(rows, batch)
+			if err != nil {
+				lastErr = err
+			}
+			retry = append(retry, res...)
+		}
+		pending = retry
+
+		if len(pending) == 0 || attempt >= p.attempts {
+			break
+		}
+
+		p.sleep(delay)
+		if delay *= 2; delay > p.maxBackoff {
+			delay = p.maxBackoff
+		}
+	}
+
+	return append(failed, pending...), lastErr
+}
+
+// putBatch returns the index of every row in the batch that failed.
+func (p *firehosePutter) putBatch(rows [][]byte, batch []int) ([]int, error) {
+	records := make([]*firehose.Record, len(batch))
+	for k, v := range batch {
+		records[k] = &firehose.Record{
+			Data: rows[v],
+		}
+	}
+
+	output, err := p.client.PutRecordBatch(&firehose.PutRecordBatchInput{
+		DeliveryStreamName: p.stream,
+		Records:            records,
+	})
+	if err != nil {
+		return batch, err
+	}
+	if aws.Int64Value(output.FailedPutCount) == 0 {
+		return nil, nil
+	}
+
+	// Firehose responds with an entry for every record, in the same order,
+	// where the failed records have an error code. If it doesn't, every
+	// record has to be put again.
+	if len(output.RequestResponses) != len(batch) {
+		return batch, errors.Errorf("failed to put %d records", aws.Int64Value(output.FailedPutCount))
+	}
+
+	var (
+		failed  []int
+		lastErr error
+	)
+	for k, v := range output.RequestResponses {
+		if v != nil && v.ErrorCode != nil {
+			failed = append(failed, batch[k])
+			lastErr = errors.Errorf("%s: %s", aws.StringValue(v.ErrorCode), aws.StringValue(v.ErrorMessage))
+		}
+	}
+	return failed, lastErr
+}
+
+// splitFirehoseBatches splits the indexes of the rows in to batches that are
+// with in the record and byte limits of Firehose.
+func splitFirehoseBatches(rows [][]byte, indexes []int) [][]int {
+	var (
+		batches [][]int
+		batch   []int
+		size    int
+	)
+	for _, v := range indexes {
+		n := len(rows[v])
+		if len(batch) > 0 && (len(batch) >= maxFirehoseBatch || size+n > maxFirehoseBatchBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, v)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFirehosePutter(t *testing.T) {
+	t.Parallel()
+
+	rows := func(sizes ...int) [][]byte {
+		res := make([][]byte, len(sizes))
+		for k, v := range sizes {
+			res[k] = bytes.Repeat([]byte{byte('a' + k)}, v)
+		}
+		return res
+	}
+
+	t.Run("put", func(t *testing.T) {
+		var (
+			client = &fakeFirehose{}
+			putter = newTestPutter(client)
+			data   = rows(1, 2, 3)
+		)
+
+		failed, err := putter.put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(failed); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := data, client.records; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put retries rejected records", func(t *testing.T) {
+		var (
+			delays []time.Duration
+			client = &fakeFirehose{rejects: 3}
+			putter = newTestPutter(client)
+			data   = rows(1, 2, 3)
+		)
+		putter.backoff, putter.maxBackoff = time.Second, time.Minute
+		putter.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+		failed, _ := putter.put(data)
+		if expected, actual := 0, len(failed); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Only the rejected records are put again.
+		if expected, actual := []int{3, 3}, client.batches; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := []time.Duration{time.Second}, delays; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put gives up after attempts", func(t *testing.T) {
+		var (
+			delays []time.Duration
+			client = &fakeFirehose{err: errors.New("bad")}
+			putter = newTestPutter(client)
+		)
+		putter.backoff, putter.maxBackoff = time.Second, 3*time.Second
+		putter.attempts = 4
+		putter.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+		failed, err := putter.put(rows(1, 2))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := []int{0, 1}, failed; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, delays; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put never puts records that are too large", func(t *testing.T) {
+		var (
+			client = &fakeFirehose{}
+			putter = newTestPutter(client)
+		)
+
+		failed, err := putter.put(rows(1, maxFirehoseRecordBytes+1))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := []int{1}, failed; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := []int{1}, client.batches; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+}
+
+func TestSplitFirehoseBatches(t *testing.T) {
+	t.Parallel()
+
+	t.Run("records", func(t *testing.T) {
+		var (
+			data    = make([][]byte, maxFirehoseBatch*2+1)
+			indexes = make([]int, len(data))
+		)
+		for k := range data {
+			data[k] = []byte{'a'}
+			indexes[k] = k
+		}
+
+		var sizes []int
+		for _, v := range splitFirehoseBatches(data, indexes) {
+			sizes = append(sizes, len(v))
+		}
+		if expected, actual := []int{maxFirehoseBatch, maxFirehoseBatch, 1}, sizes; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		var (
+			row  = make([]byte, maxFirehoseRecordBytes)
+			data = [][]byte{row, row, row, row, row}
+		)
+
+		batches := splitFirehoseBatches(data, []int{0, 1, 2, 3, 4})
+		if expected, actual := [][]int{{0, 1, 2, 3}, {4}}, batches; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+}
@@ -1,14 +1,22 @@
 package audit
 
 import (
-	"encoding/base64"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/metrics"
 	"github.com/trussle/courier/pkg/models"
 	"github.com/trussle/uuid"
 	"github.com/trussle/fsys"
@@ -27,6 +35,9 @@ const (
 
 	// Failed status which items are failed
 	Failed Extension = ".failed"
+
+	// Shipped states which items have been flushed and shipped to a Sink
+	Shipped Extension = ".shipped"
 )
 
 // Ext returns the extension of the constant extension
@@ -36,19 +47,75 @@ func (e Extension) Ext() string {
 
 const (
 	lockFile = "LOCK"
+
+	// compressedExt marks a segment that's gzipped, it comes before the
+	// Extension so that the state of the segment is still the last extension.
+	compressedExt = ".gz"
+
+	// indexExt is the extension of the index flushed along side a segment,
+	// which holds the ids of the entries with in it.
+	indexExt = ".index"
+
+	defaultSegmentSize = 16 * 1024 * 1024
+	defaultSegmentAge  = 10 * time.Minute
 )
 
 // LocalConfig creates a configuration to create a LocalLog.
 type LocalConfig struct {
-	RootPath string
-	Fsys     fsys.Filesystem
+	RootPath      string
+	Fsys          fsys.Filesystem
+	Format        Format
+	SegmentSize   int64
+	SegmentAge    time.Duration
+	RetentionAge  time.Duration
+	RetentionSize int64
+	Compress      bool
+	Shipping      bool
+	Segments      metrics.Gauge
+	DiskUsage     metrics.Gauge
+	Recovered     metrics.Gauge
+	Failed        metrics.Gauge
+	Dropped       metrics.Counter
 }
 
-// Log represents a series of active records
+// Log represents a series of segments, where entries are appended to the
+// active segment until it's too big or too old, at which point it's flushed
+// and a new one is started. Flushed segments are removed once they're past
+// the retention age, or once all the segments take up more than the
+// retention size. When the segments are shipped, only the segments that have
+// been shipped or have failed are removed, unless there's nothing else left to
+// remove to fit in the retention size.
 type localLog struct {
-	root   string
-	fsys   fsys.Filesystem
-	logger log.Logger
+	mutex         sync.Mutex
+	root          string
+	fsys          fsys.Filesystem
+	format        Format
+	segmentSize   int64
+	segmentAge    time.Duration
+	retentionAge  time.Duration
+	retentionSize int64
+	compress      bool
+	shipping      bool
+	active        *activeSegment
+	lastName      int64
+	recoveries    []Recovery
+	segments      metrics.Gauge
+	diskUsage     metrics.Gauge
+	failed        metrics.Gauge
+	dropped       metrics.Counter
+	now           func() time.Time
+	logger        log.Logger
+}
+
+// activeSegment is the segment that entries are currently appended to.
+type activeSegment struct {
+	file      fsys.File
+	writer    io.Writer
+	gzip      *gzip.Writer
+	written   int64
+	createdAt time.Time
+	expiry    *time.Timer
+	index     *segmentIndex
 }
 
 // NewLocalLog creates a new Log with a size and age to know when a
@@ -69,14 +136,143 @@ func newLocalLog(config *LocalConfig, logger log.Logger) (Log, error) {
 	}
 	defer r.Release()
 
-	return &localLog{
-		root:   root,
-		fsys:   fsys,
-		logger: logger,
-	}, nil
+	l := &localLog{
+		root:          root,
+		fsys:          fsys,
+		format:        config.Format,
+		segmentSize:   config.SegmentSize,
+		segmentAge:    config.SegmentAge,
+		retentionAge:  config.RetentionAge,
+		retentionSize: config.RetentionSize,
+		compress:      config.Compress,
+		shipping:      config.Shipping,
+		segments:      config.Segments,
+		diskUsage:     config.DiskUsage,
+		failed:        config.Failed,
+		dropped:       config.Dropped,
+		now:           time.Now,
+		logger:        logger,
+	}
+	if l.segmentSize <= 0 {
+		l.segmentSize = defaultSegmentSize
+	}
+	if l.segmentAge <= 0 {
+		l.segmentAge = defaultSegmentAge
+	}
+
+	recoveries, err := recoverSegments(fsys, root, config.Format)
+	if err != nil {
+		return nil, errors.Wrap(err, "recovering segments")
+	}
+	for _, v := range recoveries {
+		if v.Status != SegmentRecovered {
+			level.Warn(logger).Log("state", "recover", "segment", v.Segment, "status", v.Status, "entries", v.Entries, "err", v.Err)
+		}
+	}
+	l.recoveries = recoveries
+	if config.Recovered != nil {
+		config.Recovered.Set(float64(len(recoveries)))
+	}
+
+	if err := l.retain(); err != nil {
+		return nil, errors.Wrap(err, "retaining segments")
+	}
+	return l, nil
+}
+
+// Recoveries returns the segments that were recovered on startup, along with
+// any other failed segments that are on disk.
+func (r *localLog) Recoveries() ([]Recovery, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	infos, err := walkSegments(r.fsys, r.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		recoveries = append([]Recovery(nil), r.recoveries...)
+		known      = make(map[string]bool, len(recoveries))
+	)
+	for _, v := range recoveries {
+		known[v.Segment] = true
+	}
+	for _, info := range infos {
+		if info.ext == Failed && !known[info.path] {
+			recoveries = append(recoveries, Recovery{
+				Segment: info.path,
+				Status:  SegmentFailed,
+			})
+		}
+	}
+	return recoveries, nil
+}
+
+// Find scans the flushed and shipped segments for the entries selected by the
+// query, so an entry is only found once it's segment has been flushed.
+func (r *localLog) Find(query Query) ([]Entry, error) {
+	r.mutex.Lock()
+	infos, err := walkSegments(r.fsys, r.root)
+	r.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, info := range infos {
+		if info.ext != Flushed && info.ext != Shipped {
+			continue
+		}
+
+		// Segments flushed with out an index, such as those flushed before
+		// indexes were written, are always read.
+		if index, err := readIndex(r.fsys, info.path); err == nil && !index.holds(query) {
+			continue
+		}
+
+		res, err := r.findSegment(info)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range res {
+			if query.Matches(v) {
+				entries = append(entries, v)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// findSegment reads the entries of a segment that was walked by Find, which
+// could have been shipped or removed since.
+func (r *localLog) findSegment(info segmentInfo) ([]Entry, error) {
+	path := info.path
+	res, err := readSegment(r.fsys, path, r.format)
+	if err != nil && info.ext == Flushed && !r.fsys.Exists(path) {
+		// The segment was shipped since it was walked, so it's read again
+		// under it's new name.
+		path = modifyExtension(path, Shipped.Ext())
+		res, err = readSegment(r.fsys, path, r.format)
+	}
+	if err != nil {
+		// The segment was removed by the retention since it was walked.
+		if !r.fsys.Exists(path) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "reading segment %s", path)
+	}
+	return res, nil
 }
 
 func (r *localLog) Append(txn models.Transaction) error {
+	return r.AppendOutcome(txn, OutcomeCommitted)
+}
+
+func (r *localLog) AppendOutcome(txn models.Transaction, outcome Outcome) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	lock := filepath.Join(r.root, lockFile)
 	releaser, _, err := r.fsys.Lock(lock)
 	if err != nil {
@@ -84,45 +280,333 @@ func (r *localLog) Append(txn models.Transaction) error {
 	}
 	defer releaser.Release()
 
-	var (
-		timestamp = time.Now().Format(time.RFC3339Nano)
-		fileName  = base64.RawURLEncoding.EncodeToString([]byte(timestamp))
-		filePath  = filepath.Join(r.root, fileName)
-	)
+	// Start a new segment if the active one has been open for too long, in
+	// case it's expiry hasn't caught up with it yet.
+	if r.active != nil && r.now().Sub(r.active.createdAt) >= r.segmentAge {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.active == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	segment := r.active
+	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
+		entry := NewEntry(id, record, outcome)
+		row, err := encodeEntry(r.format, entry)
+		if err != nil {
+			return err
+		}
+		segment.index.add(entry)
+		n, err := segment.writer.Write(row)
+		segment.written += int64(n)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if segment.gzip != nil {
+		if err := segment.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := segment.file.Sync(); err != nil {
+		return err
+	}
+
+	if segment.written >= r.segmentSize {
+		return r.rotate()
+	}
+	return nil
+}
+
+// open starts a new active segment, named after the time it was started so
+// that segments sort oldest first.
+func (r *localLog) open() error {
+	now := r.now()
+
+	// Make sure that segments started with in the same tick don't share a name.
+	name := now.UnixNano()
+	if name <= r.lastName {
+		name = r.lastName + 1
+	}
+	r.lastName = name
+
+	filePath := filepath.Join(r.root, fmt.Sprintf("%020d", name))
+	if r.compress {
+		filePath += compressedExt
+	}
 
 	file, err := generateFile(r.fsys, filePath, Active)
 	if err != nil {
 		return err
 	}
 
-	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
-		_, e := file.Write(row(id, record))
-		return e
-	}); err != nil {
-		return err
+	segment := &activeSegment{
+		file:      file,
+		writer:    file,
+		createdAt: now,
+		index:     newSegmentIndex(),
+	}
+	if r.compress {
+		segment.gzip = gzip.NewWriter(file)
+		segment.writer = segment.gzip
 	}
+	segment.expiry = time.AfterFunc(r.segmentAge, func() {
+		if err := r.expire(segment); err != nil {
+			level.Warn(r.logger).Log("state", "expire", "err", err)
+		}
+	})
+	r.active = segment
 
-	if err := file.Sync(); err != nil {
+	return r.observe()
+}
+
+// expire rotates the segment once it's as old as the segment age, if it's
+// still the active segment, so that quiet logs still flush their segments.
+func (r *localLog) expire(segment *activeSegment) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active != segment {
+		return nil
+	}
+
+	lock := filepath.Join(r.root, lockFile)
+	releaser, _, err := r.fsys.Lock(lock)
+	if err != nil {
+		return errors.Wrapf(err, "locking %s", lock)
+	}
+	defer releaser.Release()
+
+	return r.rotate()
+}
+
+// Close flushes the active segment, so that the entries appended to it aren't
+// left in an active segment until the log is opened again.
+func (r *localLog) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active == nil {
+		return nil
+	}
+
+	lock := filepath.Join(r.root, lockFile)
+	releaser, _, err := r.fsys.Lock(lock)
+	if err != nil {
+		return errors.Wrapf(err, "locking %s", lock)
+	}
+	defer releaser.Release()
+
+	return r.rotate()
+}
+
+// rotate flushes the active segment, before applying the retention to the
+// flushed segments. The next append starts a new active segment.
+func (r *localLog) rotate() error {
+	segment := r.active
+	r.active = nil
+	segment.expiry.Stop()
+
+	if segment.gzip != nil {
+		if err := segment.gzip.Close(); err != nil {
+			segment.file.Close()
+			return err
+		}
+	}
+	if err := segment.file.Sync(); err != nil {
+		segment.file.Close()
+		return err
+	}
+	if err := segment.file.Close(); err != nil {
 		return err
 	}
 
 	// Flush it
 	var (
-		oldname = file.Name()
+		oldname = segment.file.Name()
 		newname = modifyExtension(oldname, Flushed.Ext())
 	)
-	return r.fsys.Rename(oldname, newname)
+	if err := r.fsys.Rename(oldname, newname); err != nil {
+		return err
+	}
+
+	// The segment is still found with out it's index, it's just read every
+	// time, so failing to write it doesn't fail the rotation.
+	if err := writeIndex(r.fsys, newname, segment.index); err != nil {
+		level.Warn(r.logger).Log("state", "rotate", "action", "index", "segment", newname, "err", err)
+	}
+
+	return r.retain()
 }
 
-func generateFile(fsys fsys.Filesystem, root string, ext Extension) (fsys.File, error) {
-	filename := fmt.Sprintf("%s%s", root, ext.Ext())
-	return fsys.Create(filename)
+// retain removes the segments that are older than the retention age, then
+// removes the oldest until all the segments fit in the retention size.
+func (r *localLog) retain() error {
+	infos, err := walkSegments(r.fsys, r.root)
+	if err != nil {
+		return err
+	}
+
+	var (
+		now   = r.now()
+		total int64
+		kept  []segmentInfo
+	)
+	for _, info := range infos {
+		if r.removable(info) && r.retentionAge > 0 && now.Sub(info.modTime) > r.retentionAge {
+			removed, err := r.remove(info)
+			if err != nil {
+				return err
+			}
+			if removed {
+				continue
+			}
+		}
+		total += info.size
+		kept = append(kept, info)
+	}
+
+	if r.retentionSize > 0 {
+		if kept, total, err = r.shrink(kept, total, r.removable); err != nil {
+			return err
+		}
+
+		// The segments that are yet to be shipped are only dropped once
+		// there's nothing else left to remove, so that a sink that can't keep
+		// up doesn't fill the disk.
+		if r.shipping && total > r.retentionSize {
+			unshipped := len(kept)
+			if kept, total, err = r.shrink(kept, total, func(info segmentInfo) bool {
+				return info.ext == Flushed
+			}); err != nil {
+				return err
+			}
+			if dropped := unshipped - len(kept); dropped > 0 {
+				level.Warn(r.logger).Log("state", "retain", "action", "drop", "unshipped", dropped)
+				if r.dropped != nil {
+					r.dropped.Add(float64(dropped))
+				}
+			}
+		}
+	}
+
+	return r.observe()
+}
+
+// removable returns if the retention can remove the segment. The active
+// segment is never removed, and neither are the segments that are yet to be
+// shipped, if they're shipped.
+func (r *localLog) removable(info segmentInfo) bool {
+	switch info.ext {
+	case Active:
+		return false
+	case Flushed:
+		return !r.shipping
+	default:
+		return true
+	}
+}
+
+// shrink removes the oldest segments selected by fn, until all the segments
+// fit in the retention size, returning the segments that are left and the
+// bytes they take up.
+func (r *localLog) shrink(infos []segmentInfo, total int64, fn func(segmentInfo) bool) ([]segmentInfo, int64, error) {
+	var kept []segmentInfo
+	for k, info := range infos {
+		if total <= r.retentionSize {
+			return append(kept, infos[k:]...), total, nil
+		}
+		if !fn(info) {
+			kept = append(kept, info)
+			continue
+		}
+		removed, err := r.remove(info)
+		if err != nil {
+			return nil, total, err
+		}
+		if !removed {
+			kept = append(kept, info)
+			continue
+		}
+		total -= info.size
+	}
+	return kept, total, nil
+}
+
+// remove the segment, returning if it was removed. The shipper renames flushed
+// segments with out holding the log's lock, so a segment that's gone since it
+// was walked has been shipped, and is left for the next retention.
+func (r *localLog) remove(info segmentInfo) (bool, error) {
+	level.Debug(r.logger).Log("state", "retain", "action", "remove", "segment", info.path)
+	if err := r.fsys.Remove(info.path); err != nil {
+		if !r.fsys.Exists(info.path) {
+			level.Debug(r.logger).Log("state", "retain", "action", "skip", "segment", info.path, "reason", "renamed")
+			return false, nil
+		}
+		return false, err
+	}
+
+	// A failed segment shares it's stem with the segment salvaged from it, so
+	// only flushed and shipped segments own their index.
+	if info.ext != Flushed && info.ext != Shipped {
+		return true, nil
+	}
+	if index := indexPath(info.path); r.fsys.Exists(index) {
+		return true, r.fsys.Remove(index)
+	}
+	return true, nil
 }
 
-// Recover any active segments and make them failed segments.
-func recoverSegments(filesys fsys.Filesystem, root string) error {
-	var toRename []string
-	filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
+// observe sets the segment metrics to what's on disk.
+func (r *localLog) observe() error {
+	if r.segments == nil && r.diskUsage == nil && r.failed == nil {
+		return nil
+	}
+
+	infos, err := walkSegments(r.fsys, r.root)
+	if err != nil {
+		return err
+	}
+
+	var (
+		total  int64
+		failed int
+	)
+	for _, info := range infos {
+		total += info.size
+		if info.ext == Failed {
+			failed++
+		}
+	}
+	if r.segments != nil {
+		r.segments.Set(float64(len(infos)))
+	}
+	if r.diskUsage != nil {
+		r.diskUsage.Set(float64(total))
+	}
+	if r.failed != nil {
+		r.failed.Set(float64(failed))
+	}
+	return nil
+}
+
+// segmentInfo describes a segment on disk.
+type segmentInfo struct {
+	path    string
+	ext     Extension
+	size    int64
+	modTime time.Time
+}
+
+// walkSegments returns every segment with in the root, oldest first.
+func walkSegments(filesys fsys.Filesystem, root string) ([]segmentInfo, error) {
+	var infos []segmentInfo
+	if err := filesys.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -130,23 +614,360 @@ func recoverSegments(filesys fsys.Filesystem, root string) error {
 			return nil
 		}
 
-		switch filepath.Ext(path) {
-		case Active.Ext():
-			toRename = append(toRename, path)
+		switch ext := Extension(filepath.Ext(path)); ext {
+		case Active, Flushed, Failed, Shipped:
+			infos = append(infos, segmentInfo{
+				path:    path,
+				ext:     ext,
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
 		}
 		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return filepath.Base(infos[i].path) < filepath.Base(infos[j].path)
 	})
+	return infos, nil
+}
+
+// openSegment opens a segment for reading, decompressing it if it was
+// compressed.
+func openSegment(filesys fsys.Filesystem, path string) (io.ReadCloser, error) {
+	file, err := filesys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	if filepath.Ext(stem) != compressedExt {
+		return file, nil
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipSegment{reader, file}, nil
+}
+
+// gzipSegment closes both the gzip reader and the segment underneath it.
+type gzipSegment struct {
+	*gzip.Reader
+	file fsys.File
+}
+
+func (s gzipSegment) Close() error {
+	s.Reader.Close()
+	return s.file.Close()
+}
+
+func generateFile(fsys fsys.Filesystem, root string, ext Extension) (fsys.File, error) {
+	filename := fmt.Sprintf("%s%s", root, ext.Ext())
+	return fsys.Create(filename)
+}
+
+// RecoveryStatus describes how much of a segment was recovered.
+type RecoveryStatus string
+
+const (
+
+	// SegmentRecovered states that every entry with in the segment was
+	// recovered
+	SegmentRecovered RecoveryStatus = "recovered"
+
+	// SegmentSalvaged states that the complete entries with in the segment
+	// were recovered, the rest of it is left as a failed segment
+	SegmentSalvaged RecoveryStatus = "salvaged"
 
-	for _, path := range toRename {
-		var (
-			oldname = path
-			newname = modifyExtension(oldname, Failed.Ext())
-		)
-		if err := filesys.Rename(oldname, newname); err != nil {
+	// SegmentFailed states that nothing could be recovered from the segment,
+	// it's left as a failed segment
+	SegmentFailed RecoveryStatus = "failed"
+)
+
+// Recovery describes a segment that was left active when courier last
+// stopped, or a failed segment that's on disk.
+type Recovery struct {
+	Segment string         `json:"segment"`
+	Status  RecoveryStatus `json:"status"`
+	Entries int            `json:"entries"`
+	Err     string         `json:"error,omitempty"`
+}
+
+// Recover any active segments, by salvaging all the complete entries with in
+// them in to flushed segments. Anything that can't be salvaged is left as a
+// failed segment.
+func recoverSegments(filesys fsys.Filesystem, root string, format Format) ([]Recovery, error) {
+	infos, err := walkSegments(filesys, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var recoveries []Recovery
+	for _, info := range infos {
+		if info.ext != Active {
+			continue
+		}
+		recovery, err := recoverSegment(filesys, info.path, format)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recovering %s", info.path)
+		}
+		recoveries = append(recoveries, recovery)
+	}
+	return recoveries, nil
+}
+
+func recoverSegment(filesys fsys.Filesystem, path string, format Format) (Recovery, error) {
+	entries, readErr := readSegment(filesys, path, format)
+
+	var (
+		stem       = strings.TrimSuffix(path, filepath.Ext(path))
+		compressed = filepath.Ext(stem) == compressedExt
+		flushed    = stem + Flushed.Ext()
+		failed     = stem + Failed.Ext()
+	)
+
+	// A segment that's intact only has to be flushed, unless it's compressed
+	// as it'll be missing the end of the gzip stream.
+	if readErr == nil && !compressed {
+		if err := filesys.Rename(path, flushed); err != nil {
+			return Recovery{}, err
+		}
+		if err := writeEntriesIndex(filesys, flushed, entries); err != nil {
+			return Recovery{}, err
+		}
+		return Recovery{
+			Segment: flushed,
+			Status:  SegmentRecovered,
+			Entries: len(entries),
+		}, nil
+	}
+
+	// Keep the segment as it is, while the entries are written to a new one.
+	if err := filesys.Rename(path, failed); err != nil {
+		return Recovery{}, err
+	}
+	if len(entries) > 0 {
+		if err := writeSegment(filesys, stem, format, compressed, entries); err != nil {
+			return Recovery{}, err
+		}
+	}
+
+	if readErr == nil {
+		if err := filesys.Remove(failed); err != nil {
+			return Recovery{}, err
+		}
+		return Recovery{
+			Segment: flushed,
+			Status:  SegmentRecovered,
+			Entries: len(entries),
+		}, nil
+	}
+
+	status := SegmentFailed
+	if len(entries) > 0 {
+		status = SegmentSalvaged
+	}
+	return Recovery{
+		Segment: failed,
+		Status:  status,
+		Entries: len(entries),
+		Err:     readErr.Error(),
+	}, nil
+}
+
+// readSegment reads every complete entry with in the segment, returning an
+// error if the segment doesn't end with a complete entry.
+func readSegment(filesys fsys.Filesystem, path string, format Format) ([]Entry, error) {
+	file, err := openSegment(filesys, path)
+	if err == io.EOF {
+		// A compressed segment that nothing was written to.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		entries []Entry
+		reader  = bufio.NewReader(unterminatedReader{file})
+	)
+	for {
+		entry, err := decodeEntry(format, reader)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// writeSegment writes the entries to a new segment, which is flushed once
+// they're all written.
+func writeSegment(filesys fsys.Filesystem, stem string, format Format, compress bool, entries []Entry) error {
+	file, err := generateFile(filesys, stem, Active)
+	if err != nil {
+		return err
+	}
+
+	var (
+		writer io.Writer = file
+		zip    *gzip.Writer
+	)
+	if compress {
+		zip = gzip.NewWriter(file)
+		writer = zip
+	}
+	for _, entry := range entries {
+		row, err := encodeEntry(format, entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := writer.Write(row); err != nil {
+			file.Close()
 			return err
 		}
 	}
-	return nil
+	if zip != nil {
+		if err := zip.Close(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	flushed := modifyExtension(file.Name(), Flushed.Ext())
+	if err := filesys.Rename(file.Name(), flushed); err != nil {
+		return err
+	}
+	return writeEntriesIndex(filesys, flushed, entries)
+}
+
+// segmentIndex holds the ids and message ids of every entry with in a
+// segment, so that finding an entry only reads the segments that hold it.
+type segmentIndex struct {
+	ids        map[string]struct{}
+	messageIDs map[string]struct{}
+}
+
+func newSegmentIndex() *segmentIndex {
+	return &segmentIndex{
+		ids:        map[string]struct{}{},
+		messageIDs: map[string]struct{}{},
+	}
+}
+
+func (i *segmentIndex) add(entry Entry) {
+	i.ids[entry.ID] = struct{}{}
+	i.messageIDs[entry.MessageID] = struct{}{}
+}
+
+// holds returns if the segment could hold entries selected by the query.
+func (i *segmentIndex) holds(query Query) bool {
+	if _, ok := i.ids[query.ID]; query.ID != "" && !ok {
+		return false
+	}
+	if _, ok := i.messageIDs[query.MessageID]; query.MessageID != "" && !ok {
+		return false
+	}
+	return true
+}
+
+// indexFile is how a segment index is written to disk.
+type indexFile struct {
+	IDs        []string `json:"ids"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// indexPath returns the path of the index of the segment, which is the same
+// whatever state the segment is in, so that it's kept when it's shipped.
+func indexPath(path string) string {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	return strings.TrimSuffix(stem, compressedExt) + indexExt
+}
+
+func writeIndex(filesys fsys.Filesystem, path string, index *segmentIndex) error {
+	var contents indexFile
+	for k := range index.ids {
+		contents.IDs = append(contents.IDs, k)
+	}
+	for k := range index.messageIDs {
+		contents.MessageIDs = append(contents.MessageIDs, k)
+	}
+	sort.Strings(contents.IDs)
+	sort.Strings(contents.MessageIDs)
+
+	file, err := filesys.Create(indexPath(path))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeEntriesIndex writes the index of a segment that was written with out
+// one, such as a recovered segment.
+func writeEntriesIndex(filesys fsys.Filesystem, path string, entries []Entry) error {
+	index := newSegmentIndex()
+	for _, entry := range entries {
+		index.add(entry)
+	}
+	return writeIndex(filesys, path, index)
+}
+
+func readIndex(filesys fsys.Filesystem, path string) (*segmentIndex, error) {
+	file, err := filesys.Open(indexPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var contents indexFile
+	if err := json.NewDecoder(file).Decode(&contents); err != nil {
+		return nil, err
+	}
+
+	index := newSegmentIndex()
+	for _, v := range contents.IDs {
+		index.ids[v] = struct{}{}
+	}
+	for _, v := range contents.MessageIDs {
+		index.messageIDs[v] = struct{}{}
+	}
+	return index, nil
+}
+
+// unterminatedReader reads a segment that was still being written to, where
+// a compressed segment is always missing the end of it's gzip stream. Only
+// the entries with in it can tell if it's complete.
+type unterminatedReader struct {
+	io.Reader
+}
+
+func (r unterminatedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
 
 func modifyExtension(filename, newExt string) string {
@@ -160,7 +981,10 @@ type LocalConfigOption func(*LocalConfig) error
 // BuildLocalConfig ingests configuration options to then yield a
 // LocalConfig, and return an error if it fails during configuring.
 func BuildLocalConfig(opts ...LocalConfigOption) (*LocalConfig, error) {
-	var config LocalConfig
+	config := LocalConfig{
+		SegmentSize: defaultSegmentSize,
+		SegmentAge:  defaultSegmentAge,
+	}
 	for _, opt := range opts {
 		err := opt(&config)
 		if err != nil {
@@ -185,3 +1009,109 @@ func WithFsys(fsys fsys.Filesystem) LocalConfigOption {
 		return nil
 	}
 }
+
+// WithLocalFormat adds an Format option to the configuration, which is how
+// entries are encoded, defaulting to FormatJSON
+func WithLocalFormat(format Format) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Format = format
+		return nil
+	}
+}
+
+// WithSegmentSize adds an SegmentSize option to the configuration, which is
+// how many bytes of entries are written to a segment before it's flushed
+func WithSegmentSize(segmentSize int64) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		if segmentSize <= 0 {
+			return errors.Errorf("invalid segment size %d", segmentSize)
+		}
+		config.SegmentSize = segmentSize
+		return nil
+	}
+}
+
+// WithSegmentAge adds an SegmentAge option to the configuration, which is how
+// long a segment is written to before it's flushed
+func WithSegmentAge(segmentAge time.Duration) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		if segmentAge <= 0 {
+			return errors.Errorf("invalid segment age %s", segmentAge)
+		}
+		config.SegmentAge = segmentAge
+		return nil
+	}
+}
+
+// WithRetentionAge adds an RetentionAge option to the configuration, which is
+// how long flushed segments are kept for, zero keeps them forever
+func WithRetentionAge(retentionAge time.Duration) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		if retentionAge < 0 {
+			return errors.Errorf("invalid retention age %s", retentionAge)
+		}
+		config.RetentionAge = retentionAge
+		return nil
+	}
+}
+
+// WithRetentionSize adds an RetentionSize option to the configuration, which
+// is how many bytes all the segments can take up before the oldest are
+// removed, zero doesn't limit them
+func WithRetentionSize(retentionSize int64) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		if retentionSize < 0 {
+			return errors.Errorf("invalid retention size %d", retentionSize)
+		}
+		config.RetentionSize = retentionSize
+		return nil
+	}
+}
+
+// WithCompression adds an Compress option to the configuration, which gzips
+// the segments
+func WithCompression(compress bool) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Compress = compress
+		return nil
+	}
+}
+
+// WithShipping adds an Shipping option to the configuration, which keeps the
+// segments until they've been shipped, unless they don't fit in the retention
+// size
+func WithShipping(shipping bool) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Shipping = shipping
+		return nil
+	}
+}
+
+// WithSegmentMetrics adds the gauges for the number of segments and the bytes
+// they take up on disk to the configuration
+func WithSegmentMetrics(segments, diskUsage metrics.Gauge) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Segments = segments
+		config.DiskUsage = diskUsage
+		return nil
+	}
+}
+
+// WithRecoveryMetrics adds the gauges for the number of segments recovered on
+// startup and the number of failed segments on disk to the configuration
+func WithRecoveryMetrics(recovered, failed metrics.Gauge) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Recovered = recovered
+		config.Failed = failed
+		return nil
+	}
+}
+
+// WithRetentionMetrics adds the counter for the number of segments dropped by
+// the retention size before they were shipped to the configuration
+func WithRetentionMetrics(dropped metrics.Counter) LocalConfigOption {
+	return func(config *LocalConfig) error {
+		config.Dropped = dropped
+		return nil
+	}
+}
@@ -1,17 +1,23 @@
 package audit
 
 import (
-	"io/ioutil"
+	"bufio"
+	"bytes"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"testing/quick"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
 	"github.com/pkg/errors"
+	metricsMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/models"
 	"github.com/trussle/courier/pkg/queue"
 	"github.com/trussle/fsys"
 	"github.com/trussle/uuid"
@@ -60,35 +66,549 @@ func TestLocal(t *testing.T) {
 				return err
 			}
 
-			bytes, err := ioutil.ReadAll(file)
+			entry, err := decodeEntry(FormatJSON, bufio.NewReader(file))
 			if err != nil {
 				return err
 			}
 
-			if expected, actual := record.RecordID(), strings.Split(string(bytes), " ")[0]; expected != actual {
+			if expected, actual := record.RecordID(), entry.MessageID; expected != actual {
 				t.Errorf("expected: %s, actual: %s", expected, actual)
 			}
+			if expected, actual := id.String(), entry.ID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := OutcomeCommitted, entry.Outcome; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("append outcome", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		config, err := BuildLocalConfig(
+			WithRootPath(""),
+			WithFsys(virtual),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		localLog, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, err := uuid.NewWithRand(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := queue.NewTransaction()
+		txn.Push(id, record)
+
+		if err := localLog.AppendOutcome(txn, OutcomeEvicted); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := virtual.Walk("", func(path string, info os.FileInfo, err error) error {
+			file, err := virtual.Open(path)
+			if err != nil {
+				return err
+			}
+
+			entry, err := decodeEntry(FormatJSON, bufio.NewReader(file))
+			if err != nil {
+				return err
+			}
+
+			if expected, actual := record.RecordID(), entry.MessageID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := OutcomeEvicted, entry.Outcome; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLocalSegments(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	newTransaction := func(t *testing.T, n int) models.Transaction {
+		txn := queue.NewTransaction()
+		for i := 0; i < n; i++ {
+			id, err := uuid.NewWithRand(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txn.Push(id, record)
+		}
+		return txn
+	}
+
+	newLog := func(t *testing.T, virtual fsys.Filesystem, opts ...LocalConfigOption) *localLog {
+		config, err := BuildLocalConfig(append([]LocalConfigOption{
+			WithRootPath("/root"),
+			WithFsys(virtual),
+		}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.(*localLog)
+	}
+
+	segments := func(t *testing.T, virtual fsys.Filesystem) []segmentInfo {
+		infos, err := walkSegments(virtual, "/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	t.Run("append to one segment", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual)
+
+		for i := 0; i < 3; i++ {
+			if err := localLog.Append(newTransaction(t, 2)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := Active, infos[0].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := 6, countEntries(t, virtual, infos[0].path); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("rotate by size", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1))
+
+		for i := 0; i < 3; i++ {
+			if err := localLog.Append(newTransaction(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 3, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for _, info := range infos {
+			if expected, actual := Flushed, info.ext; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("rotate by age", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentAge(time.Minute))
+
+		now := time.Now()
+		localLog.now = func() time.Time { return now }
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(time.Minute)
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 2, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := Flushed, infos[0].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := Active, infos[1].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("rotate on expiry", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentAge(time.Millisecond))
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The segment is rotated in the background once it's expired, without
+		// anything else being appended.
+		var infos []segmentInfo
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			localLog.mutex.Lock()
+			infos = segments(t, virtual)
+			localLog.mutex.Unlock()
+			if len(infos) == 1 && infos[0].ext == Flushed {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := Flushed, infos[0].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
 
+	t.Run("close", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual)
+
+		if err := localLog.Append(newTransaction(t, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := localLog.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := Flushed, infos[0].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := 2, countEntries(t, virtual, infos[0].path); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Closing a log without an active segment does nothing.
+		if err := localLog.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("retain by age", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1), WithRetentionAge(time.Hour))
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		old := infos[0].path
+		if err := virtual.Chtimes(old, time.Now(), time.Now().Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		infos = segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := false, infos[0].path == old; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("retain by size", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1))
+
+		var paths []string
+		for i := 0; i < 3; i++ {
+			if err := localLog.Append(newTransaction(t, 1)); err != nil {
+				t.Fatal(err)
+			}
+			infos := segments(t, virtual)
+			paths = append(paths, infos[len(infos)-1].path)
+		}
+
+		// Only leave enough room for the newest segment.
+		infos := segments(t, virtual)
+		localLog.retentionSize = infos[len(infos)-1].size
+		if err := localLog.retain(); err != nil {
+			t.Fatal(err)
+		}
+
+		infos = segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := paths[2], infos[0].path; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		// The indexes of the removed segments are removed with them.
+		for k, v := range paths {
+			if expected, actual := k == 2, virtual.Exists(indexPath(v)); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithCompression(true))
+
+		txn := newTransaction(t, 2)
+		if err := localLog.Append(txn); err != nil {
+			t.Fatal(err)
+		}
+		if err := localLog.rotate(); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		index, err := readIndex(virtual, infos[0].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
+			for _, query := range []Query{
+				{ID: id.String()},
+				{MessageID: record.RecordID()},
+				{ID: id.String(), MessageID: record.RecordID()},
+			} {
+				if expected, actual := true, index.holds(query); expected != actual {
+					t.Errorf("expected: %t, actual: %t", expected, actual)
+				}
+			}
 			return nil
 		}); err != nil {
 			t.Fatal(err)
 		}
+		if expected, actual := false, index.holds(Query{ID: uuid.MustNew().String()}); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("find only reads indexed segments", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1))
+
+		var ids []string
+		for i := 0; i < 2; i++ {
+			txn := newTransaction(t, 1)
+			if err := localLog.Append(txn); err != nil {
+				t.Fatal(err)
+			}
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				ids = append(ids, id.String())
+				return nil
+			})
+		}
+
+		// Break the first segment, which is only read if it's index holds the
+		// id that's found.
+		infos := segments(t, virtual)
+		if expected, actual := 2, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		file, err := virtual.Create(infos[0].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("bad"))
+		file.Close()
+
+		entries, err := localLog.Find(Query{ID: ids[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		_, err = localLog.Find(Query{ID: ids[0]})
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("find a segment shipped after it was walked", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1))
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if err := virtual.Rename(infos[0].path, modifyExtension(infos[0].path, Shipped.Ext())); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := localLog.findSegment(infos[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("find a segment removed after it was walked", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithSegmentSize(1))
+
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if _, err := localLog.remove(infos[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := localLog.findSegment(infos[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(entries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("compression", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		localLog := newLog(t, virtual, WithCompression(true))
+
+		if err := localLog.Append(newTransaction(t, 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := localLog.rotate(); err != nil {
+			t.Fatal(err)
+		}
+
+		infos := segments(t, virtual)
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := true, strings.HasSuffix(infos[0].path, ".gz.flushed"); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := 3, countEntries(t, virtual, infos[0].path); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			virtual   = fsys.NewVirtualFilesystem()
+			segments  = metricsMocks.NewMockGauge(ctrl)
+			diskUsage = metricsMocks.NewMockGauge(ctrl)
+		)
+
+		// Once when created, and again when the segment is opened.
+		segments.EXPECT().Set(float64(0))
+		segments.EXPECT().Set(float64(1))
+		diskUsage.EXPECT().Set(float64(0)).Times(2)
+
+		localLog := newLog(t, virtual, WithSegmentMetrics(segments, diskUsage))
+		if err := localLog.Append(newTransaction(t, 1)); err != nil {
+			t.Fatal(err)
+		}
 	})
 }
 
+func countEntries(t *testing.T, filesys fsys.Filesystem, path string) int {
+	file, err := openSegment(filesys, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var (
+		n      int
+		reader = bufio.NewReader(file)
+	)
+	for {
+		if _, err := decodeEntry(FormatJSON, reader); err == io.EOF {
+			return n
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
 func TestBuildLocalConfig(t *testing.T) {
 	t.Parallel()
 
 	t.Run("build", func(t *testing.T) {
-		fn := func(path string) bool {
+		fn := func(path string, segmentSize, retentionSize uint32, segmentAge, retentionAge uint16, compress, shipping bool) bool {
 			config, err := BuildLocalConfig(
 				WithRootPath(path),
 				WithFsys(fsys.NewNopFilesystem()),
+				WithLocalFormat(FormatProtobuf),
+				WithSegmentSize(int64(segmentSize)+1),
+				WithSegmentAge(time.Duration(segmentAge)+1),
+				WithRetentionAge(time.Duration(retentionAge)),
+				WithRetentionSize(int64(retentionSize)),
+				WithCompression(compress),
+				WithShipping(shipping),
 			)
 			if err != nil {
 				t.Fatal(err)
 			}
-			return config.RootPath == path
+			return config.RootPath == path &&
+				config.Format == FormatProtobuf &&
+				config.SegmentSize == int64(segmentSize)+1 &&
+				config.SegmentAge == time.Duration(segmentAge)+1 &&
+				config.RetentionAge == time.Duration(retentionAge) &&
+				config.RetentionSize == int64(retentionSize) &&
+				config.Compress == compress &&
+				config.Shipping == shipping
 		}
 
 		if err := quick.Check(fn, nil); err != nil {
@@ -107,6 +627,33 @@ func TestBuildLocalConfig(t *testing.T) {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
 		}
 	})
+
+	t.Run("invalid segments", func(t *testing.T) {
+		for _, opt := range []LocalConfigOption{
+			WithSegmentSize(0),
+			WithSegmentAge(0),
+			WithRetentionAge(-1),
+			WithRetentionSize(-1),
+		} {
+			_, err := BuildLocalConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("default segments", func(t *testing.T) {
+		config, err := BuildLocalConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(defaultSegmentSize), config.SegmentSize; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := defaultSegmentAge, config.SegmentAge; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
 }
 
 func TestExtension(t *testing.T) {
@@ -129,6 +676,12 @@ func TestExtension(t *testing.T) {
 			t.Errorf("expected: %s, actual: %s", expected, actual)
 		}
 	})
+
+	t.Run("shipped", func(t *testing.T) {
+		if expected, actual := ".shipped", Shipped.Ext(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
 }
 
 func TestModifyExtension(t *testing.T) {
@@ -175,21 +728,239 @@ func TestRecoverSegments(t *testing.T) {
 	fsys := fsys.NewVirtualFilesystem()
 	fsys.Create("/root/filename.active")
 
-	if err := recoverSegments(fsys, "/root"); err != nil {
+	recoveries, err := recoverSegments(fsys, "/root", FormatJSON)
+	if err != nil {
 		t.Error(err)
 	}
 
-	var called bool
+	var paths []string
 	fsys.Walk("/root", func(path string, info os.FileInfo, err error) error {
-		called = true
+		paths = append(paths, path)
+		return nil
+	})
+
+	// The recovered segment is flushed along side it's index.
+	if expected, actual := []string{"/root/filename.flushed", "/root/filename.index"}, paths; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+	if expected, actual := []Recovery{{
+		Segment: "/root/filename.flushed",
+		Status:  SegmentRecovered,
+	}}, recoveries; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestRecoverSegment(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, format := range []Format{FormatJSON, FormatProtobuf, FormatAvro} {
+		format := format
+
+		writeRows := func(t *testing.T, w io.Writer, n int) {
+			for i := 0; i < n; i++ {
+				v, ok := quick.Value(reflect.TypeOf(testEntry{}), rnd)
+				if !ok {
+					t.Fatal("generating entry")
+				}
+				row, err := encodeEntry(format, Entry(v.Interface().(testEntry)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		t.Run("recover "+string(format), func(t *testing.T) {
+			virtual := fsys.NewVirtualFilesystem()
+			file, err := virtual.Create("/root/segment.active")
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeRows(t, file, 3)
+
+			recovery, err := recoverSegment(virtual, "/root/segment.active", format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := (Recovery{
+				Segment: "/root/segment.flushed",
+				Status:  SegmentRecovered,
+				Entries: 3,
+			}), recovery; expected != actual {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		})
+
+		t.Run("salvage "+string(format), func(t *testing.T) {
+			virtual := fsys.NewVirtualFilesystem()
+			file, err := virtual.Create("/root/segment.active")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			writeRows(t, &buf, 3)
+			file.Write(buf.Bytes()[:buf.Len()-1])
+
+			recovery, err := recoverSegment(virtual, "/root/segment.active", format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := SegmentSalvaged, recovery.Status; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := "/root/segment.failed", recovery.Segment; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := 2, recovery.Entries; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+
+			entries, err := readSegment(virtual, "/root/segment.flushed", format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := 2, len(entries); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		})
+
+		t.Run("fail "+string(format), func(t *testing.T) {
+			virtual := fsys.NewVirtualFilesystem()
+			file, err := virtual.Create("/root/segment.active")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			writeRows(t, &buf, 1)
+			file.Write(buf.Bytes()[:buf.Len()-1])
+
+			recovery, err := recoverSegment(virtual, "/root/segment.active", format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := SegmentFailed, recovery.Status; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := false, virtual.Exists("/root/segment.flushed"); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+			if expected, actual := true, virtual.Exists("/root/segment.failed"); expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		})
+	}
 
-		if expected, actual := "/root/filename.failed", path; expected != actual {
+	t.Run("recover compressed", func(t *testing.T) {
+		virtual := fsys.NewVirtualFilesystem()
+		config, err := BuildLocalConfig(
+			WithRootPath("/root"),
+			WithFsys(virtual),
+			WithCompression(true),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := queue.NewTransaction()
+		for i := 0; i < 3; i++ {
+			id, err := uuid.NewWithRand(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txn.Push(id, record)
+		}
+		if err := l.Append(txn); err != nil {
+			t.Fatal(err)
+		}
+
+		// Starting again leaves the active segment without the end of it's
+		// gzip stream.
+		l, err = newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recoveries, err := l.(*localLog).Recoveries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(recoveries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := SegmentRecovered, recoveries[0].Status; expected != actual {
 			t.Errorf("expected: %s, actual: %s", expected, actual)
 		}
-		return nil
+		if expected, actual := 3, countEntries(t, virtual, recoveries[0].Segment); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
 	})
 
-	if expected, actual := true, called; expected != actual {
-		t.Errorf("expected: %t, actual: %t", expected, actual)
-	}
+	t.Run("recoveries", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		virtual := fsys.NewVirtualFilesystem()
+		file, err := virtual.Create("/root/00000000000000000001.active")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("{"))
+		virtual.Create("/root/00000000000000000000.failed")
+
+		var (
+			recovered = metricsMocks.NewMockGauge(ctrl)
+			failed    = metricsMocks.NewMockGauge(ctrl)
+		)
+		recovered.EXPECT().Set(float64(1))
+		failed.EXPECT().Set(float64(2))
+
+		config, err := BuildLocalConfig(
+			WithRootPath("/root"),
+			WithFsys(virtual),
+			WithRecoveryMetrics(recovered, failed),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recoveries, err := l.(*localLog).Recoveries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 2, len(recoveries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "/root/00000000000000000001.failed", recoveries[0].Segment; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "/root/00000000000000000000.failed", recoveries[1].Segment; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		for _, v := range recoveries {
+			if expected, actual := SegmentFailed, v.Status; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
 }
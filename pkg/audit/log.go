@@ -6,11 +6,35 @@ import (
 	"github.com/trussle/courier/pkg/models"
 )
 
+// Outcome is what happened to the records with in a transaction.
+type Outcome string
+
+const (
+	// OutcomeCommitted records were delivered and committed to the queue.
+	OutcomeCommitted Outcome = "committed"
+
+	// OutcomeFailed records couldn't be delivered and were handed back to the
+	// queue as failures.
+	OutcomeFailed Outcome = "failed"
+
+	// OutcomeEvicted records were never delivered, because an earlier record
+	// in their group failed, and are left for the queue to redeliver.
+	OutcomeEvicted Outcome = "evicted"
+
+	// OutcomeDropped records were held when the consumer stopped, and are
+	// left for the queue to redeliver.
+	OutcomeDropped Outcome = "dropped"
+)
+
 // Log represents an audit log of transactions that have occurred.
 type Log interface {
 
-	// Append a transaction to the log
+	// Append a transaction of committed records to the log
 	Append(models.Transaction) error
+
+	// AppendOutcome appends a transaction to the log, along with what
+	// happened to the records with in it.
+	AppendOutcome(models.Transaction, Outcome) error
 }
 
 // Config encapsulates the requirements for generating a Stream
@@ -18,6 +42,7 @@ type Config struct {
 	name         string
 	remoteConfig *RemoteConfig
 	localConfig  *LocalConfig
+	multiConfig  *MultiConfig
 }
 
 // Option defines a option for generating a stream Config
@@ -60,6 +85,14 @@ func WithLocalConfig(localConfig *LocalConfig) Option {
 	}
 }
 
+// WithMultiConfig adds a multi log config to the configuration
+func WithMultiConfig(multiConfig *MultiConfig) Option {
+	return func(config *Config) error {
+		config.multiConfig = multiConfig
+		return nil
+	}
+}
+
 // New returns a new log
 func New(config *Config, logger log.Logger) (log Log, err error) {
 	switch config.name {
@@ -69,6 +102,8 @@ func New(config *Config, logger log.Logger) (log Log, err error) {
 		log, err = newLocalLog(config.localConfig, logger)
 	case "nop":
 		log = newNopLog()
+	case "multi":
+		log, err = newMultiLog(config, logger)
 	default:
 		err = errors.Errorf("unexpected log type %q", config.name)
 	}
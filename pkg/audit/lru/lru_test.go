@@ -623,12 +623,20 @@ type TestRecord struct {
 	receipt   models.Receipt
 	body      []byte
 	timestamp time.Time
+	attempts  int
+	groupID   string
 }
 
 func (t TestRecord) ID() uuid.UUID           { return t.id }
 func (t TestRecord) Body() []byte            { return t.body }
 func (t TestRecord) RecordID() string        { return t.messageID }
 func (t TestRecord) Receipt() models.Receipt { return t.receipt }
+func (t TestRecord) Attempts() int           { return t.attempts }
+func (t TestRecord) GroupID() string         { return t.groupID }
+func (t TestRecord) ReceivedAt() time.Time   { return t.timestamp }
+
+func (t TestRecord) Attributes() map[string]string       { return nil }
+func (t TestRecord) SystemAttributes() map[string]string { return nil }
 
 func (t TestRecord) Commit(txn models.Transaction) error {
 	return txn.Push(t.id, t)
@@ -688,5 +696,8 @@ func generate(rnd *rand.Rand) (rec TestRecord, err error) {
 	// Timestamp generation
 	rec.timestamp = time.Now().Round(time.Millisecond)
 
+	// Attempts generation
+	rec.attempts = 1
+
 	return
 }
@@ -6,6 +6,7 @@ package mocks
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	audit "github.com/trussle/courier/pkg/audit"
 	models "github.com/trussle/courier/pkg/models"
 	reflect "reflect"
 )
@@ -44,3 +45,15 @@ func (m *MockLog) Append(arg0 models.Transaction) error {
 func (mr *MockLogMockRecorder) Append(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Append", reflect.TypeOf((*MockLog)(nil).Append), arg0)
 }
+
+// AppendOutcome mocks base method
+func (m *MockLog) AppendOutcome(arg0 models.Transaction, arg1 audit.Outcome) error {
+	ret := m.ctrl.Call(m, "AppendOutcome", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendOutcome indicates an expected call of AppendOutcome
+func (mr *MockLogMockRecorder) AppendOutcome(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendOutcome", reflect.TypeOf((*MockLog)(nil).AppendOutcome), arg0, arg1)
+}
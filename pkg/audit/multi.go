@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+)
+
+// MultiConfig creates a configuration to create a multi log.
+type MultiConfig struct {
+	Required   []string
+	BestEffort []string
+}
+
+type multiLog struct {
+	logs   []multiEntry
+	logger log.Logger
+}
+
+type multiEntry struct {
+	name     string
+	log      Log
+	required bool
+}
+
+// newMultiLog creates a Log that tees every transaction to each of the logs
+// named in the multi config. A transaction fails to append only if one of the
+// required logs fails, failures of the best effort logs are only logged.
+func newMultiLog(config *Config, logger log.Logger) (Log, error) {
+	multiConfig := config.multiConfig
+	if multiConfig == nil {
+		return nil, errors.New("missing multi config")
+	}
+
+	var (
+		logs []multiEntry
+		seen = map[string]bool{}
+	)
+	add := func(names []string, required bool) error {
+		for _, name := range names {
+			if seen[name] {
+				return errors.Errorf("duplicate log %q", name)
+			}
+			seen[name] = true
+
+			l, err := New(&Config{
+				name:         name,
+				remoteConfig: config.remoteConfig,
+				localConfig:  config.localConfig,
+			}, log.With(logger, "log", name))
+			if err != nil {
+				return errors.Wrapf(err, "log %q", name)
+			}
+
+			logs = append(logs, multiEntry{
+				name:     name,
+				log:      l,
+				required: required,
+			})
+		}
+		return nil
+	}
+	if err := add(multiConfig.Required, true); err != nil {
+		return nil, err
+	}
+	if err := add(multiConfig.BestEffort, false); err != nil {
+		return nil, err
+	}
+	if len(logs) == 0 {
+		return nil, errors.New("no logs to write to")
+	}
+
+	return &multiLog{
+		logs:   logs,
+		logger: logger,
+	}, nil
+}
+
+func (r *multiLog) Append(txn models.Transaction) error {
+	return r.AppendOutcome(txn, OutcomeCommitted)
+}
+
+func (r *multiLog) AppendOutcome(txn models.Transaction, outcome Outcome) error {
+	// Every log is appended to, even if a required log has already failed, so
+	// that none of them miss a transaction that could be appended.
+	var failures []string
+	for _, v := range r.logs {
+		if err := v.log.AppendOutcome(txn, outcome); err != nil {
+			if v.required {
+				failures = append(failures, fmt.Sprintf("%s: %s", v.name, err.Error()))
+				continue
+			}
+			level.Warn(r.logger).Log("state", "append", "log", v.name, "err", err)
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("failed to append to required logs (%s)", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Close closes every log that can be closed, even if one of them has already
+// failed to close.
+func (r *multiLog) Close() error {
+	var failures []string
+	for _, v := range r.logs {
+		if l, ok := v.log.(io.Closer); ok {
+			if err := l.Close(); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", v.name, err.Error()))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("failed to close logs (%s)", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Recoveries returns the recoveries of every log that recovers segments.
+func (r *multiLog) Recoveries() ([]Recovery, error) {
+	var recoveries []Recovery
+	for _, v := range r.logs {
+		if l, ok := v.log.(recoverer); ok {
+			res, err := l.Recoveries()
+			if err != nil {
+				return nil, err
+			}
+			recoveries = append(recoveries, res...)
+		}
+	}
+	return recoveries, nil
+}
+
+// Find returns the entries selected by the query from every log that can find
+// them.
+func (r *multiLog) Find(query Query) ([]Entry, error) {
+	var entries []Entry
+	for _, v := range r.logs {
+		if l, ok := v.log.(finder); ok {
+			res, err := l.Find(query)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, res...)
+		}
+	}
+	return entries, nil
+}
+
+// MultiConfigOption defines a option for generating a MultiConfig
+type MultiConfigOption func(*MultiConfig) error
+
+// BuildMultiConfig ingests configuration options to then yield a MultiConfig,
+// and return an error if it fails during configuring.
+func BuildMultiConfig(opts ...MultiConfigOption) (*MultiConfig, error) {
+	var config MultiConfig
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithRequiredLogs adds the types of logs (remote, local, nop) that have to
+// be appended to for a transaction to be appended, to the configuration
+func WithRequiredLogs(names []string) MultiConfigOption {
+	return func(config *MultiConfig) error {
+		if err := validMultiLogs(names); err != nil {
+			return err
+		}
+		config.Required = names
+		return nil
+	}
+}
+
+// WithBestEffortLogs adds the types of logs (remote, local, nop) that are
+// appended to, but are allowed to fail, to the configuration
+func WithBestEffortLogs(names []string) MultiConfigOption {
+	return func(config *MultiConfig) error {
+		if err := validMultiLogs(names); err != nil {
+			return err
+		}
+		config.BestEffort = names
+		return nil
+	}
+}
+
+func validMultiLogs(names []string) error {
+	for _, name := range names {
+		switch name {
+		case "remote", "local", "nop":
+		default:
+			return errors.Errorf("unexpected log type %q", name)
+		}
+	}
+	return nil
+}
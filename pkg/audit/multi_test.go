@@ -0,0 +1,272 @@
+package audit
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
+)
+
+func TestMultiLog(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	newTransaction := func(t *testing.T) models.Transaction {
+		id, err := uuid.NewWithRand(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := queue.NewTransaction()
+		txn.Push(id, record)
+		return txn
+	}
+
+	t.Run("append", func(t *testing.T) {
+		var (
+			required   = &fakeLog{}
+			bestEffort = &fakeLog{}
+			multi      = &multiLog{
+				logs: []multiEntry{
+					{"local", required, true},
+					{"remote", bestEffort, false},
+				},
+				logger: log.NewNopLogger(),
+			}
+		)
+
+		if err := multi.AppendOutcome(newTransaction(t), OutcomeFailed); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range []*fakeLog{required, bestEffort} {
+			if expected, actual := []Outcome{OutcomeFailed}, v.outcomes; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		}
+	})
+
+	t.Run("append with best effort failure", func(t *testing.T) {
+		multi := &multiLog{
+			logs: []multiEntry{
+				{"local", &fakeLog{}, true},
+				{"remote", &fakeLog{err: errors.New("bad")}, false},
+			},
+			logger: log.NewNopLogger(),
+		}
+
+		if err := multi.Append(newTransaction(t)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("append with required failure", func(t *testing.T) {
+		var (
+			bestEffort = &fakeLog{}
+			multi      = &multiLog{
+				logs: []multiEntry{
+					{"remote", &fakeLog{err: errors.New("bad")}, true},
+					{"local", bestEffort, false},
+				},
+				logger: log.NewNopLogger(),
+			}
+		)
+
+		err := multi.Append(newTransaction(t))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+
+		// The rest of the logs are still appended to.
+		if expected, actual := []Outcome{OutcomeCommitted}, bestEffort.outcomes; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var (
+			closing = &closingLog{}
+			multi   = &multiLog{
+				logs: []multiEntry{
+					{"local", closing, true},
+					{"nop", &fakeLog{}, false},
+				},
+				logger: log.NewNopLogger(),
+			}
+		)
+
+		if err := multi.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, closing.closed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("close with failure", func(t *testing.T) {
+		var (
+			closing = &closingLog{}
+			multi   = &multiLog{
+				logs: []multiEntry{
+					{"local", &closingLog{fakeLog: fakeLog{err: errors.New("bad")}}, true},
+					{"remote", closing, false},
+				},
+				logger: log.NewNopLogger(),
+			}
+		)
+
+		err := multi.Close()
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+
+		// The rest of the logs are still closed.
+		if expected, actual := 1, closing.closed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("new", func(t *testing.T) {
+		localConfig, err := BuildLocalConfig(
+			WithRootPath("/root"),
+			WithFsys(fsys.NewVirtualFilesystem()),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		multiConfig, err := BuildMultiConfig(
+			WithRequiredLogs([]string{"local"}),
+			WithBestEffortLogs([]string{"nop"}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := Build(
+			With("multi"),
+			WithLocalConfig(localConfig),
+			WithMultiConfig(multiConfig),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := New(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Append(newTransaction(t)); err != nil {
+			t.Error(err)
+		}
+
+		recoveries, err := l.(recoverer).Recoveries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(recoveries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("new with invalid config", func(t *testing.T) {
+		for _, multiConfig := range []*MultiConfig{
+			nil,
+			{},
+			{Required: []string{"nop"}, BestEffort: []string{"nop"}},
+		} {
+			config, err := Build(
+				With("multi"),
+				WithMultiConfig(multiConfig),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = New(config, log.NewNopLogger())
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func TestBuildMultiConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		config, err := BuildMultiConfig(
+			WithRequiredLogs([]string{"local"}),
+			WithBestEffortLogs([]string{"remote", "nop"}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []string{"local"}, config.Required; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := []string{"remote", "nop"}, config.BestEffort; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []MultiConfigOption{
+			WithRequiredLogs([]string{"multi"}),
+			WithBestEffortLogs([]string{"disk"}),
+		} {
+			_, err := BuildMultiConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+// fakeLog keeps the outcome of every transaction appended to it, unless it
+// has an error to return.
+type fakeLog struct {
+	outcomes []Outcome
+	err      error
+}
+
+func (l *fakeLog) Append(txn models.Transaction) error {
+	return l.AppendOutcome(txn, OutcomeCommitted)
+}
+
+func (l *fakeLog) AppendOutcome(txn models.Transaction, outcome Outcome) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.outcomes = append(l.outcomes, outcome)
+	return nil
+}
+
+// closingLog is a fakeLog that counts how many times it's closed, unless it
+// has an error to return.
+type closingLog struct {
+	fakeLog
+	closed int
+}
+
+func (l *closingLog) Close() error {
+	if l.err != nil {
+		return l.err
+	}
+	l.closed++
+	return nil
+}
@@ -6,4 +6,5 @@ type nop struct{}
 
 func newNopLog() Log { return nop{} }
 
-func (nop) Append(models.Transaction) error { return nil }
+func (nop) Append(models.Transaction) error                 { return nil }
+func (nop) AppendOutcome(models.Transaction, Outcome) error { return nil }
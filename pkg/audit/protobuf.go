@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entries are encoded as the following protobuf message, with each message
+// prefixed by it's length as a varint, the same as
+// protobuf's writeDelimitedTo.
+//
+//	message Entry {
+//	  uint32 version = 1;
+//	  string id = 2;
+//	  string message_id = 3;
+//	  string receipt = 4;
+//	  string group_id = 5;
+//	  map<string, string> attributes = 6;
+//	  bytes body = 7;
+//	  uint32 attempts = 8;
+//	  int64 received_at = 9;  // unix nanoseconds
+//	  int64 delivered_at = 10; // unix nanoseconds
+//	  string recipient = 11;
+//	  uint32 status_code = 12;
+//	  string outcome = 13;
+//	}
+const (
+	protoVersion = iota + 1
+	protoID
+	protoMessageID
+	protoReceipt
+	protoGroupID
+	protoAttributes
+	protoBody
+	protoAttempts
+	protoReceivedAt
+	protoDeliveredAt
+	protoRecipient
+	protoStatusCode
+	protoOutcome
+)
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func encodeProtobuf(entry Entry) []byte {
+	var msg []byte
+	msg = appendProtoVarint(msg, protoVersion, uint64(entry.Version))
+	msg = appendProtoBytes(msg, protoID, []byte(entry.ID))
+	msg = appendProtoBytes(msg, protoMessageID, []byte(entry.MessageID))
+	msg = appendProtoBytes(msg, protoReceipt, []byte(entry.Receipt))
+	msg = appendProtoBytes(msg, protoGroupID, []byte(entry.GroupID))
+	for _, k := range sortedKeys(entry.Attributes) {
+		var pair []byte
+		pair = appendProtoBytes(pair, 1, []byte(k))
+		pair = appendProtoBytes(pair, 2, []byte(entry.Attributes[k]))
+		msg = appendTag(msg, protoAttributes, wireBytes)
+		msg = appendUvarint(msg, uint64(len(pair)))
+		msg = append(msg, pair...)
+	}
+	msg = appendProtoBytes(msg, protoBody, entry.Body)
+	msg = appendProtoVarint(msg, protoAttempts, uint64(entry.Attempts))
+	msg = appendProtoVarint(msg, protoReceivedAt, uint64(unixNano(entry.ReceivedAt)))
+	msg = appendProtoVarint(msg, protoDeliveredAt, uint64(unixNano(entry.DeliveredAt)))
+	msg = appendProtoBytes(msg, protoRecipient, []byte(entry.Recipient))
+	msg = appendProtoVarint(msg, protoStatusCode, uint64(entry.StatusCode))
+	msg = appendProtoBytes(msg, protoOutcome, []byte(entry.Outcome))
+
+	return append(appendUvarint(nil, uint64(len(msg))), msg...)
+}
+
+func decodeProtobuf(r *bufio.Reader) (Entry, error) {
+	b, err := readDelimited(r, func() (int64, error) {
+		size, err := binary.ReadUvarint(r)
+		return int64(size), err
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+
+	var entry Entry
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return Entry{}, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+
+		var (
+			field = int(key >> 3)
+			value uint64
+			bytes []byte
+		)
+		switch key & 7 {
+		case wireVarint:
+			if value, n = binary.Uvarint(b); n <= 0 {
+				return Entry{}, errors.New("invalid protobuf varint")
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return Entry{}, errors.New("invalid protobuf length")
+			}
+			bytes, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return Entry{}, errors.Errorf("unexpected protobuf wire type %d", key&7)
+		}
+
+		switch field {
+		case protoVersion:
+			entry.Version = int(value)
+		case protoID:
+			entry.ID = string(bytes)
+		case protoMessageID:
+			entry.MessageID = string(bytes)
+		case protoReceipt:
+			entry.Receipt = string(bytes)
+		case protoGroupID:
+			entry.GroupID = string(bytes)
+		case protoAttributes:
+			k, v, err := decodeProtoPair(bytes)
+			if err != nil {
+				return Entry{}, err
+			}
+			if entry.Attributes == nil {
+				entry.Attributes = make(map[string]string)
+			}
+			entry.Attributes[k] = v
+		case protoBody:
+			entry.Body = append([]byte(nil), bytes...)
+		case protoAttempts:
+			entry.Attempts = int(value)
+		case protoReceivedAt:
+			entry.ReceivedAt = fromUnixNano(int64(value))
+		case protoDeliveredAt:
+			entry.DeliveredAt = fromUnixNano(int64(value))
+		case protoRecipient:
+			entry.Recipient = string(bytes)
+		case protoStatusCode:
+			entry.StatusCode = int(value)
+		case protoOutcome:
+			entry.Outcome = Outcome(bytes)
+		}
+	}
+	return entry, nil
+}
+
+func decodeProtoPair(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag&7 != wireBytes {
+			return "", "", errors.New("invalid protobuf map entry")
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return "", "", errors.New("invalid protobuf map entry")
+		}
+		switch tag >> 3 {
+		case 1:
+			key = string(b[n : n+int(size)])
+		case 2:
+			value = string(b[n : n+int(size)])
+		}
+		b = b[n+int(size):]
+	}
+	return key, value, nil
+}
+
+func appendTag(b []byte, field, wire int) []byte {
+	return appendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	return appendUvarint(appendTag(b, field, wireVarint), value)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = appendUvarint(appendTag(b, field, wireBytes), uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendUvarint(b []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], value)]...)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unixNano returns the time in unix nanoseconds, or zero if the time isn't
+// set.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
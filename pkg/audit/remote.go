@@ -2,6 +2,9 @@ package audit
 
 import (
 	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -12,6 +15,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/trussle/courier/pkg/audit/lru"
 	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/fsys"
 	"github.com/trussle/uuid"
 )
 
@@ -24,19 +28,54 @@ type RemoteConfig struct {
 	EC2Role           bool
 	ID, Secret, Token string
 	Region, Stream    string
+	Endpoint          string
+	DisableSSL        bool
+	ForcePathStyle    bool
+	Format            Format
+	PutAttempts       int
+	PutBackoff        time.Duration
+	PutMaxBackoff     time.Duration
+	FallbackPath      string
+	Fsys              fsys.Filesystem
 }
 
 // Log represents a series of active records
 type remoteLog struct {
-	client    *firehose.Firehose
-	streamURL *string
-	lru       *lru.LRU
-	logger    log.Logger
+	mutex        sync.Mutex
+	putter       *firehosePutter
+	format       Format
+	fallbackPath string
+	fsys         fsys.Filesystem
+	lastName     int64
+	now          func() time.Time
+	lru          *lru.LRU
+	logger       log.Logger
 }
 
 // NewRemoteLog creates a new Log with a size and age to know when a
 // Log is at a certain capacity
 func newRemoteLog(config *RemoteConfig, logger log.Logger) (Log, error) {
+	sess, err := newSession(config, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	log := &remoteLog{
+		putter:       newFirehosePutter(firehose.New(sess), config),
+		format:       config.Format,
+		fallbackPath: config.FallbackPath,
+		fsys:         config.Fsys,
+		now:          time.Now,
+		logger:       logger,
+	}
+
+	log.lru = lru.NewLRU(defaultSelectCacheAmount, log.onElementEviction)
+
+	return log, nil
+}
+
+// newSession creates an AWS session from the configuration, pointed at the
+// endpoint if it's not empty.
+func newSession(config *RemoteConfig, endpoint string) (*session.Session, error) {
 	// If in EC2Role, attempt to get things from env or ec2role, else just use
 	// static credentials...
 	var creds *credentials.Credentials
@@ -44,7 +83,7 @@ func newRemoteLog(config *RemoteConfig, logger log.Logger) (Log, error) {
 		var sess = session.New(&aws.Config{
 			LogLevel:                      aws.LogLevel(aws.LogDebug),
 			CredentialsChainVerboseErrors: aws.Bool(true),
-			Region: aws.String(config.Region),
+			Region:                        aws.String(config.Region),
 		})
 		creds = sess.Config.Credentials
 	} else {
@@ -57,30 +96,38 @@ func newRemoteLog(config *RemoteConfig, logger log.Logger) (Log, error) {
 	if _, err := creds.Get(); err != nil {
 		return nil, errors.Wrap(err, "invalid credentials")
 	}
-	var (
-		cfg = aws.NewConfig().
-			WithRegion(config.Region).
-			WithCredentials(creds).
-			WithCredentialsChainVerboseErrors(true)
-		client = firehose.New(session.New(cfg))
-	)
-
-	log := &remoteLog{
-		client:    client,
-		streamURL: aws.String(config.Stream),
-		logger:    logger,
+	cfg := aws.NewConfig().
+		WithRegion(config.Region).
+		WithCredentials(creds).
+		WithCredentialsChainVerboseErrors(true).
+		WithDisableSSL(config.DisableSSL).
+		WithS3ForcePathStyle(config.ForcePathStyle)
+	if endpoint != "" {
+		// Point the client at a compatible service, like LocalStack, instead
+		// of AWS.
+		cfg = cfg.WithEndpoint(endpoint)
 	}
-
-	log.lru = lru.NewLRU(defaultSelectCacheAmount, log.onElementEviction)
-
-	return log, nil
+	return session.New(cfg), nil
 }
 
 func (r *remoteLog) Append(txn models.Transaction) error {
+	return r.AppendOutcome(txn, OutcomeCommitted)
+}
+
+func (r *remoteLog) AppendOutcome(txn models.Transaction, outcome Outcome) error {
 	// Serialize all the record data
-	var data [][]byte
+	var (
+		entries []Entry
+		data    [][]byte
+	)
 	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
-		data = append(data, row(id, record))
+		entry := NewEntry(id, record, outcome)
+		row, err := encodeEntry(r.format, entry)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		data = append(data, row)
 		return nil
 	}); err != nil {
 		return err
@@ -90,27 +137,30 @@ func (r *remoteLog) Append(txn models.Transaction) error {
 		return nil
 	}
 
-	records := make([]*firehose.Record, len(data))
-	for k, v := range data {
-		records[k] = &firehose.Record{
-			Data: v,
+	// Anything that still fails to be put is spilled to the fallback, so that
+	// it's not lost.
+	if failed, err := r.putter.put(data); len(failed) > 0 {
+		level.Warn(r.logger).Log("state", "remote-put", "failed", len(failed), "err", err)
+
+		spilled := make([]Entry, len(failed))
+		for k, v := range failed {
+			spilled[k] = entries[v]
+		}
+		if err := r.spill(spilled); err != nil {
+			return errors.Wrapf(err, "failed to put %d records", len(failed))
 		}
 	}
 
-	input := &firehose.PutRecordBatchInput{
-		DeliveryStreamName: r.streamURL,
-		Records:            records,
-	}
+	// Store the transactions in the LRU, along with what happened to them,
+	// so that they can be found.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if output, err := r.client.PutRecordBatch(input); err != nil {
-		return err
-	} else if failed := int(*output.FailedPutCount); failed > 0 {
-		level.Warn(r.logger).Log("state", "remote-put", "failed", failed)
-	}
-
-	// Store the transactions in the LRU
 	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
-		r.lru.Add(id, record)
+		r.lru.Add(id, outcomeRecord{
+			Record:  record,
+			outcome: outcome,
+		})
 		return nil
 	}); err != nil {
 		// We don't care about this error.
@@ -120,13 +170,55 @@ func (r *remoteLog) Append(txn models.Transaction) error {
 	return nil
 }
 
-func (r *remoteLog) onElementEviction(reason lru.EvictionReason, key uuid.UUID, value models.Record) {
-	// Do nothing here, we don't really care.
+// Find returns the entries selected by the query, from the records most
+// recently appended.
+func (r *remoteLog) Find(query Query) ([]Entry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var entries []Entry
+	for _, v := range r.lru.Slice() {
+		var entry Entry
+		if record, ok := v.Value.(outcomeRecord); ok {
+			entry = NewEntry(v.Key, record.Record, record.outcome)
+		} else {
+			entry = NewEntry(v.Key, v.Value, OutcomeCommitted)
+		}
+		if query.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
 }
 
-func row(id uuid.UUID, record models.Record) []byte {
-	msg := fmt.Sprintf("%s %s\n", record.RecordID(), string(record.Body()))
-	return []byte(msg)
+// outcomeRecord is a record kept in the LRU, along with what happened to it.
+type outcomeRecord struct {
+	models.Record
+	outcome Outcome
+}
+
+// spill writes the entries to a new flushed segment with in the fallback path.
+func (r *remoteLog) spill(entries []Entry) error {
+	if r.fallbackPath == "" || r.fsys == nil {
+		return errors.New("no fallback to spill to")
+	}
+
+	// Make sure that spills with in the same tick don't share a name.
+	name := r.now().UnixNano()
+	if name <= r.lastName {
+		name = r.lastName + 1
+	}
+	r.lastName = name
+
+	if err := r.fsys.MkdirAll(r.fallbackPath); err != nil {
+		return err
+	}
+	stem := filepath.Join(r.fallbackPath, fmt.Sprintf("%020d", name))
+	return writeSegment(r.fsys, stem, r.format, false, entries)
+}
+
+func (r *remoteLog) onElementEviction(reason lru.EvictionReason, key uuid.UUID, value models.Record) {
+	// Do nothing here, we don't really care.
 }
 
 // RemoteConfigOption defines a option for generating a RemoteConfig
@@ -135,7 +227,11 @@ type RemoteConfigOption func(*RemoteConfig) error
 // BuildRemoteConfig ingests configuration options to then yield a
 // RemoteConfig, and return an error if it fails during configuring.
 func BuildRemoteConfig(opts ...RemoteConfigOption) (*RemoteConfig, error) {
-	var config RemoteConfig
+	config := RemoteConfig{
+		PutAttempts:   defaultPutAttempts,
+		PutBackoff:    defaultPutBackoff,
+		PutMaxBackoff: defaultPutMaxBackoff,
+	}
 	for _, opt := range opts {
 		err := opt(&config)
 		if err != nil {
@@ -192,3 +288,76 @@ func WithStream(stream string) RemoteConfigOption {
 		return nil
 	}
 }
+
+// WithEndpoint adds an Endpoint option to the configuration, so that a
+// Firehose compatible service can be used instead of AWS
+func WithEndpoint(endpoint string) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		config.Endpoint = endpoint
+		return nil
+	}
+}
+
+// WithDisableSSL adds an DisableSSL option to the configuration
+func WithDisableSSL(disableSSL bool) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		config.DisableSSL = disableSSL
+		return nil
+	}
+}
+
+// WithRemoteFormat adds an Format option to the configuration, which is how
+// entries are encoded, defaulting to FormatJSON
+func WithRemoteFormat(format Format) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		config.Format = format
+		return nil
+	}
+}
+
+// WithForcePathStyle adds an ForcePathStyle option to the configuration
+func WithForcePathStyle(forcePathStyle bool) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		config.ForcePathStyle = forcePathStyle
+		return nil
+	}
+}
+
+// WithPutAttempts adds the number of times a record is put on to the stream
+// before it's spilled to the fallback, to the configuration
+func WithPutAttempts(attempts int) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		if attempts <= 0 {
+			return errors.Errorf("invalid put attempts %d", attempts)
+		}
+		config.PutAttempts = attempts
+		return nil
+	}
+}
+
+// WithPutBackoff adds the backoff after the first failure to put records,
+// which is doubled for every failure after it up to the max, to the
+// configuration
+func WithPutBackoff(backoff, maxBackoff time.Duration) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		if backoff < 0 {
+			return errors.Errorf("invalid put backoff %s", backoff)
+		}
+		if maxBackoff < backoff {
+			return errors.Errorf("invalid put max backoff %s", maxBackoff)
+		}
+		config.PutBackoff = backoff
+		config.PutMaxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithFallback adds the filesystem and the path that records which still fail
+// to be put are spilled to, to the configuration
+func WithFallback(fsys fsys.Filesystem, path string) RemoteConfigOption {
+	return func(config *RemoteConfig) error {
+		config.Fsys = fsys
+		config.FallbackPath = path
+		return nil
+	}
+}
@@ -4,22 +4,25 @@ package audit_test
 
 import (
 	"math/rand"
+	"net/http/httptest"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/trussle/courier/pkg/audit"
+	"github.com/trussle/courier/pkg/fakeaws"
 	"github.com/trussle/courier/pkg/queue"
 	"github.com/trussle/uuid"
 )
 
 const (
-	defaultAWSID     = ""
-	defaultAWSSecret = ""
-	defaultAWSToken  = ""
-	defaultAWSRegion = "eu-west-1"
-	defaultAWSStream = ""
+	defaultAWSID       = "id"
+	defaultAWSSecret   = "secret"
+	defaultAWSToken    = ""
+	defaultAWSRegion   = "eu-west-1"
+	defaultAWSStream   = "courier"
+	defaultAWSEndpoint = ""
 )
 
 func TestRemoteLog_Integration(t *testing.T) {
@@ -27,13 +30,30 @@ func TestRemoteLog_Integration(t *testing.T) {
 
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	var (
+		stream   = GetEnv("AWS_FIREHOSE_STREAM", defaultAWSStream)
+		endpoint = GetEnv("AWS_FIREHOSE_ENDPOINT", defaultAWSEndpoint)
+	)
+
+	// Without an endpoint, run against the fake Firehose.
+	if endpoint == "" {
+		fake := fakeaws.NewServer()
+		fake.Firehose.CreateStream(stream)
+
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		endpoint = server.URL
+	}
+
 	remoteConfig, err := audit.BuildRemoteConfig(
 		audit.WithEC2Role(false),
 		audit.WithRegion(GetEnv("AWS_REGION", defaultAWSRegion)),
 		audit.WithID(GetEnv("AWS_ID", defaultAWSID)),
 		audit.WithSecret(GetEnv("AWS_SECRET", defaultAWSSecret)),
 		audit.WithToken(GetEnv("AWS_TOKEN", defaultAWSToken)),
-		audit.WithStream(GetEnv("AWS_FIREHOSE_STREAM", defaultAWSStream)),
+		audit.WithStream(stream),
+		audit.WithEndpoint(endpoint),
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -85,7 +105,8 @@ func TestRemoteLog_Integration(t *testing.T) {
 
 func GetEnv(key string, defaultValue string) (value string) {
 	var ok bool
-	if value, ok = syscall.Getenv(key); ok {
+	// docker-compose passes unset variables through as empty.
+	if value, ok = syscall.Getenv(key); ok && value != "" {
 		return
 	}
 	return defaultValue
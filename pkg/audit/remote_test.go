@@ -1,17 +1,184 @@
 package audit
 
 import (
+	"math/rand"
+	"reflect"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/audit/lru"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
 )
 
+func TestRemoteLog(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	newTransaction := func(t *testing.T, n int) models.Transaction {
+		txn := queue.NewTransaction()
+		for i := 0; i < n; i++ {
+			id, err := uuid.NewWithRand(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txn.Push(id, record)
+		}
+		return txn
+	}
+
+	newRemoteLog := func(client firehoseAPI, virtual fsys.Filesystem, fallbackPath string) *remoteLog {
+		l := &remoteLog{
+			putter:       newTestPutter(client),
+			format:       FormatJSON,
+			fallbackPath: fallbackPath,
+			fsys:         virtual,
+			now:          time.Now,
+			logger:       log.NewNopLogger(),
+		}
+		l.lru = lru.NewLRU(defaultSelectCacheAmount, l.onElementEviction)
+		return l
+	}
+
+	t.Run("append retries rejected records", func(t *testing.T) {
+		var (
+			client  = &fakeFirehose{rejects: 3}
+			virtual = fsys.NewVirtualFilesystem()
+			l       = newRemoteLog(client, virtual, "/fallback")
+		)
+
+		if err := l.Append(newTransaction(t, 2)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []int{2, 2, 1}, client.batches; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 2, len(client.records); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		infos, err := walkSegments(virtual, "/fallback")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(infos); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("append spills failed records", func(t *testing.T) {
+		var (
+			client  = &fakeFirehose{err: errors.New("bad")}
+			virtual = fsys.NewVirtualFilesystem()
+			l       = newRemoteLog(client, virtual, "/fallback")
+		)
+
+		if err := l.AppendOutcome(newTransaction(t, 2), OutcomeFailed); err != nil {
+			t.Fatal(err)
+		}
+
+		infos, err := walkSegments(virtual, "/fallback")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(infos); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := Flushed, infos[0].ext; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		entries, err := readSegment(virtual, infos[0].path, FormatJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 2, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for _, v := range entries {
+			if expected, actual := OutcomeFailed, v.Outcome; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("find", func(t *testing.T) {
+		var (
+			l   = newRemoteLog(&fakeFirehose{}, nil, "")
+			txn = newTransaction(t, 2)
+		)
+
+		if err := l.AppendOutcome(txn, OutcomeEvicted); err != nil {
+			t.Fatal(err)
+		}
+
+		txn.Walk(func(id uuid.UUID, record models.Record) error {
+			for _, query := range []Query{
+				{ID: id.String()},
+				{MessageID: record.RecordID()},
+			} {
+				entries, err := l.Find(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected, actual := []Entry{NewEntry(id, record, OutcomeEvicted)}, entries; !reflect.DeepEqual(expected, actual) {
+					t.Errorf("expected: %v, actual: %v", expected, actual)
+				}
+			}
+			return nil
+		})
+
+		entries, err := l.Find(Query{ID: "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(entries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("append without fallback", func(t *testing.T) {
+		var (
+			client = &fakeFirehose{err: errors.New("bad")}
+			l      = newRemoteLog(client, nil, "")
+		)
+
+		err := l.Append(newTransaction(t, 1))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("invalid put options", func(t *testing.T) {
+		for _, opt := range []RemoteConfigOption{
+			WithPutAttempts(0),
+			WithPutBackoff(-1, time.Second),
+			WithPutBackoff(time.Minute, time.Second),
+		} {
+			_, err := BuildRemoteConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
 func TestBuildRemoteConfig(t *testing.T) {
 	t.Parallel()
 
 	t.Run("build", func(t *testing.T) {
-		fn := func(id, secret, token, region, stream string, numOfMessages int, timeout int64) bool {
+		fn := func(id, secret, token, region, stream string, numOfMessages int, timeout int64, endpoint string, disableSSL, forcePathStyle bool) bool {
 			config, err := BuildRemoteConfig(
 				WithEC2Role(false),
 				WithID(id),
@@ -19,6 +186,13 @@ func TestBuildRemoteConfig(t *testing.T) {
 				WithToken(token),
 				WithRegion(region),
 				WithStream(stream),
+				WithEndpoint(endpoint),
+				WithDisableSSL(disableSSL),
+				WithForcePathStyle(forcePathStyle),
+				WithRemoteFormat(FormatAvro),
+				WithPutAttempts(numOfMessages&0xff+1),
+				WithPutBackoff(time.Duration(timeout&0xffff), time.Duration(timeout&0xffff)*2),
+				WithFallback(fsys.NewNopFilesystem(), endpoint),
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -27,7 +201,15 @@ func TestBuildRemoteConfig(t *testing.T) {
 				config.Secret == secret &&
 				config.Token == token &&
 				config.Region == region &&
-				config.Stream == stream
+				config.Stream == stream &&
+				config.Endpoint == endpoint &&
+				config.DisableSSL == disableSSL &&
+				config.ForcePathStyle == forcePathStyle &&
+				config.Format == FormatAvro &&
+				config.PutAttempts == numOfMessages&0xff+1 &&
+				config.PutBackoff == time.Duration(timeout&0xffff) &&
+				config.PutMaxBackoff == time.Duration(timeout&0xffff)*2 &&
+				config.FallbackPath == endpoint
 		}
 
 		if err := quick.Check(fn, nil); err != nil {
@@ -46,4 +228,17 @@ func TestBuildRemoteConfig(t *testing.T) {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
 		}
 	})
+
+	t.Run("invalid put options", func(t *testing.T) {
+		for _, opt := range []RemoteConfigOption{
+			WithPutAttempts(0),
+			WithPutBackoff(-1, time.Second),
+			WithPutBackoff(time.Minute, time.Second),
+		} {
+			_, err := BuildRemoteConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
 }
@@ -0,0 +1,344 @@
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/metrics"
+	"github.com/trussle/fsys"
+)
+
+const (
+	defaultShipInterval   = 10 * time.Second
+	defaultShipBackoff    = time.Second
+	defaultShipMaxBackoff = 5 * time.Minute
+)
+
+// ShipperConfig creates a configuration to create a Shipper.
+type ShipperConfig struct {
+	RootPath     string
+	Fsys         fsys.Filesystem
+	Format       Format
+	Sink         string
+	Interval     time.Duration
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	RemoteConfig *RemoteConfig
+	Endpoint     string
+	Bucket       string
+	Prefix       string
+	URL          string
+}
+
+// Shipper tails the flushed segments of local audit logs, shipping each one
+// to a Sink, oldest first. Once shipped, a segment is marked as shipped by
+// it's extension. If a segment fails to ship, the shipper backs off before
+// trying it again, so a segment may be shipped more than once.
+type Shipper struct {
+	root       string
+	fsys       fsys.Filesystem
+	format     Format
+	sink       Sink
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	failures   int
+	retryAt    time.Time
+	now        func() time.Time
+	stop       chan chan struct{}
+	shipped    metrics.Counter
+	failed     metrics.Counter
+	logger     log.Logger
+}
+
+// NewShipper creates a Shipper that ships to the sink of the configuration.
+func NewShipper(config *ShipperConfig,
+	shipped, failed metrics.Counter,
+	logger log.Logger,
+) (*Shipper, error) {
+	var (
+		sink Sink
+		err  error
+	)
+	if config.RemoteConfig == nil && (config.Sink == "firehose" || config.Sink == "s3") {
+		return nil, errors.Errorf("missing remote config for sink %q", config.Sink)
+	}
+	switch config.Sink {
+	case "firehose":
+		sink, err = NewFirehoseSink(config.RemoteConfig)
+	case "s3":
+		sink, err = NewS3Sink(config.RemoteConfig, config.Endpoint, config.Bucket, config.Prefix)
+	case "http":
+		sink = NewHTTPSink(http.DefaultClient, config.URL)
+	default:
+		err = errors.Errorf("unexpected sink %q", config.Sink)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newShipper(config, sink, shipped, failed, logger), nil
+}
+
+func newShipper(config *ShipperConfig,
+	sink Sink,
+	shipped, failed metrics.Counter,
+	logger log.Logger,
+) *Shipper {
+	return &Shipper{
+		root:       config.RootPath,
+		fsys:       config.Fsys,
+		format:     config.Format,
+		sink:       sink,
+		interval:   config.Interval,
+		backoff:    config.Backoff,
+		maxBackoff: config.MaxBackoff,
+		now:        time.Now,
+		stop:       make(chan chan struct{}),
+		shipped:    shipped,
+		failed:     failed,
+		logger:     logger,
+	}
+}
+
+// Run ships segments at every interval, until Stop is invoked.
+func (s *Shipper) Run() {
+	step := time.NewTicker(s.interval)
+	defer step.Stop()
+
+	for {
+		select {
+		case <-step.C:
+			s.ship()
+
+		case q := <-s.stop:
+			close(q)
+			return
+		}
+	}
+}
+
+// Stop the shipper from shipping.
+func (s *Shipper) Stop() {
+	q := make(chan struct{})
+	s.stop <- q
+	<-q
+}
+
+// ship every flushed segment, until one fails.
+func (s *Shipper) ship() {
+	if s.now().Before(s.retryAt) {
+		return
+	}
+
+	infos, err := walkSegments(s.fsys, s.root)
+	if err != nil {
+		level.Warn(s.logger).Log("state", "ship", "action", "walk", "err", err)
+		return
+	}
+
+	for _, info := range infos {
+		if info.ext != Flushed {
+			continue
+		}
+
+		if err := s.shipSegment(info.path); err != nil {
+			// The retention of the segment's log dropped it since it was
+			// walked, so there's nothing left to ship.
+			if !s.fsys.Exists(info.path) {
+				continue
+			}
+
+			level.Warn(s.logger).Log("state", "ship", "segment", info.path, "err", err)
+			s.failed.Inc()
+
+			// Back off, so that a sink that's down isn't overwhelmed.
+			s.failures++
+			s.retryAt = s.now().Add(s.delay())
+			return
+		}
+
+		s.shipped.Inc()
+		s.failures = 0
+		s.retryAt = time.Time{}
+	}
+}
+
+func (s *Shipper) shipSegment(path string) error {
+	file, err := s.fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	var (
+		stem       = strings.TrimSuffix(path, filepath.Ext(path))
+		compressed = filepath.Ext(stem) == compressedExt
+		name       = strings.TrimSuffix(stem, compressedExt)
+	)
+	if rel, err := filepath.Rel(s.root, name); err == nil {
+		name = filepath.ToSlash(rel)
+	}
+
+	if err := s.sink.Ship(Segment{
+		Name:       name,
+		Format:     s.format,
+		Compressed: compressed,
+		Data:       data,
+	}); err != nil {
+		return err
+	}
+
+	// The segment is shipped even if the retention of it's log dropped it
+	// while it was being shipped, so there's nothing left to rename.
+	if err := s.fsys.Rename(path, modifyExtension(path, Shipped.Ext())); err != nil && s.fsys.Exists(path) {
+		return err
+	}
+	return nil
+}
+
+// delay returns how long to back off for, doubling with every failure.
+func (s *Shipper) delay() time.Duration {
+	delay := s.backoff
+	for i := 1; i < s.failures && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	return delay
+}
+
+// ShipperConfigOption defines a option for generating a ShipperConfig
+type ShipperConfigOption func(*ShipperConfig) error
+
+// BuildShipperConfig ingests configuration options to then yield a
+// ShipperConfig, and return an error if it fails during configuring.
+func BuildShipperConfig(opts ...ShipperConfigOption) (*ShipperConfig, error) {
+	config := ShipperConfig{
+		Interval:   defaultShipInterval,
+		Backoff:    defaultShipBackoff,
+		MaxBackoff: defaultShipMaxBackoff,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithShipperRootPath adds an rootPath option to the configuration, which is
+// where the segments of every local audit log are found
+func WithShipperRootPath(rootPath string) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.RootPath = rootPath
+		return nil
+	}
+}
+
+// WithShipperFsys adds an fsys option to the configuration
+func WithShipperFsys(fsys fsys.Filesystem) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.Fsys = fsys
+		return nil
+	}
+}
+
+// WithShipperFormat adds an Format option to the configuration, which is how
+// the entries with in the segments are encoded
+func WithShipperFormat(format Format) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.Format = format
+		return nil
+	}
+}
+
+// WithSink adds the type of sink to ship to (firehose, s3, http) to the
+// configuration
+func WithSink(sink string) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		switch sink {
+		case "firehose", "s3", "http":
+			config.Sink = sink
+			return nil
+		default:
+			return errors.Errorf("unexpected sink %q", sink)
+		}
+	}
+}
+
+// WithShipInterval adds an Interval option to the configuration, which is how
+// often flushed segments are looked for
+func WithShipInterval(interval time.Duration) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		if interval <= 0 {
+			return errors.Errorf("invalid ship interval %s", interval)
+		}
+		config.Interval = interval
+		return nil
+	}
+}
+
+// WithShipBackoff adds the backoff after the first failure to ship, which is
+// doubled for every failure after it up to the max, to the configuration
+func WithShipBackoff(backoff, maxBackoff time.Duration) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		if backoff < 0 {
+			return errors.Errorf("invalid ship backoff %s", backoff)
+		}
+		if maxBackoff < backoff {
+			return errors.Errorf("invalid ship max backoff %s", maxBackoff)
+		}
+		config.Backoff = backoff
+		config.MaxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithShipRemoteConfig adds a remote config to the configuration, which has
+// the AWS credentials and region for the firehose and s3 sinks, along with the
+// stream for the firehose sink
+func WithShipRemoteConfig(remoteConfig *RemoteConfig) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.RemoteConfig = remoteConfig
+		return nil
+	}
+}
+
+// WithBucket adds the bucket and the prefix of the keys of the s3 sink to the
+// configuration
+func WithBucket(bucket, prefix string) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.Bucket = bucket
+		config.Prefix = prefix
+		return nil
+	}
+}
+
+// WithBucketEndpoint adds an Endpoint option to the configuration, so that a
+// S3 compatible store can be used instead of AWS
+func WithBucketEndpoint(endpoint string) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.Endpoint = endpoint
+		return nil
+	}
+}
+
+// WithShipURL adds the URL of the http sink to the configuration
+func WithShipURL(url string) ShipperConfigOption {
+	return func(config *ShipperConfig) error {
+		config.URL = url
+		return nil
+	}
+}
@@ -0,0 +1,601 @@
+package audit
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	metricsMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
+)
+
+func TestShipper(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// flush writes a flushed segment for every transaction, to a local log
+	// with in the root.
+	flush := func(t *testing.T, virtual fsys.Filesystem, root string, compress bool, n int) {
+		config, err := BuildLocalConfig(
+			WithRootPath(root),
+			WithFsys(virtual),
+			WithSegmentSize(1),
+			WithCompression(compress),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			id, err := uuid.NewWithRand(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			txn := queue.NewTransaction()
+			txn.Push(id, record)
+			if err := l.Append(txn); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	newShipperConfig := func(t *testing.T, virtual fsys.Filesystem) *ShipperConfig {
+		config, err := BuildShipperConfig(
+			WithShipperRootPath("/root"),
+			WithShipperFsys(virtual),
+			WithShipperFormat(FormatJSON),
+			WithShipBackoff(time.Second, time.Minute),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	exts := func(t *testing.T, virtual fsys.Filesystem) []Extension {
+		infos, err := walkSegments(virtual, "/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make([]Extension, len(infos))
+		for k, v := range infos {
+			res[k] = v.ext
+		}
+		return res
+	}
+
+	t.Run("ship", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		virtual := fsys.NewVirtualFilesystem()
+		flush(t, virtual, "/root/audit-0000", false, 2)
+		flush(t, virtual, "/root/audit-0001", true, 1)
+
+		var (
+			sink    = &fakeSink{}
+			shipped = metricsMocks.NewMockCounter(ctrl)
+			failed  = metricsMocks.NewMockCounter(ctrl)
+			shipper = newShipper(newShipperConfig(t, virtual), sink, shipped, failed, log.NewNopLogger())
+		)
+
+		shipped.EXPECT().Inc().Times(3)
+
+		shipper.ship()
+
+		if expected, actual := []Extension{Shipped, Shipped, Shipped}, exts(t, virtual); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 3, len(sink.segments); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var compressed int
+		for _, segment := range sink.segments {
+			if expected, actual := "audit-", segment.Name[:6]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if segment.Compressed {
+				compressed++
+			}
+
+			entries, err := segment.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := 1, len(entries); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+		if expected, actual := 1, compressed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Nothing is shipped twice.
+		shipper.ship()
+
+		if expected, actual := 3, len(sink.segments); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("ship leaves active segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		virtual := fsys.NewVirtualFilesystem()
+		virtual.Create("/root/audit-0000/00000000000000000001.active")
+
+		var (
+			sink    = &fakeSink{}
+			shipped = metricsMocks.NewMockCounter(ctrl)
+			failed  = metricsMocks.NewMockCounter(ctrl)
+			shipper = newShipper(newShipperConfig(t, virtual), sink, shipped, failed, log.NewNopLogger())
+		)
+
+		shipper.ship()
+
+		if expected, actual := 0, len(sink.segments); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("ship with failure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		virtual := fsys.NewVirtualFilesystem()
+		flush(t, virtual, "/root/audit-0000", false, 2)
+
+		var (
+			sink    = &fakeSink{err: errors.New("bad")}
+			shipped = metricsMocks.NewMockCounter(ctrl)
+			failed  = metricsMocks.NewMockCounter(ctrl)
+			shipper = newShipper(newShipperConfig(t, virtual), sink, shipped, failed, log.NewNopLogger())
+		)
+
+		now := time.Now()
+		shipper.now = func() time.Time { return now }
+
+		failed.EXPECT().Inc().Times(2)
+		shipped.EXPECT().Inc().Times(2)
+
+		// Stops at the first failure, and backs off before trying again.
+		shipper.ship()
+		if expected, actual := 1, sink.attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		shipper.ship()
+		if expected, actual := 1, sink.attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		now = now.Add(time.Second)
+		shipper.ship()
+		if expected, actual := 2, sink.attempts; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// The backoff doubles.
+		if expected, actual := now.Add(2*time.Second), shipper.retryAt; !expected.Equal(actual) {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		sink.err = nil
+		now = now.Add(2 * time.Second)
+		shipper.ship()
+
+		if expected, actual := []Extension{Shipped, Shipped}, exts(t, virtual); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, shipper.failures; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	// shippingLog creates a local log with in the root, that flushes a segment
+	// for every transaction and keeps them until they're shipped.
+	shippingLog := func(t *testing.T, virtual fsys.Filesystem, opts ...LocalConfigOption) *localLog {
+		config, err := BuildLocalConfig(append([]LocalConfigOption{
+			WithRootPath("/root/audit-0000"),
+			WithFsys(virtual),
+			WithSegmentSize(1),
+			WithShipping(true),
+		}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := newLocalLog(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.(*localLog)
+	}
+
+	appendTxn := func(t *testing.T, l Log) {
+		id, err := uuid.NewWithRand(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn := queue.NewTransaction()
+		txn.Push(id, record)
+		if err := l.Append(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("retain by age keeps unshipped segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			virtual  = fsys.NewVirtualFilesystem()
+			localLog = shippingLog(t, virtual, WithRetentionAge(time.Hour))
+			shipped  = metricsMocks.NewMockCounter(ctrl)
+			failed   = metricsMocks.NewMockCounter(ctrl)
+			shipper  = newShipper(newShipperConfig(t, virtual), &fakeSink{}, shipped, failed, log.NewNopLogger())
+		)
+
+		shipped.EXPECT().Inc()
+
+		appendTxn(t, localLog)
+		shipper.ship()
+		appendTxn(t, localLog)
+
+		infos, err := walkSegments(virtual, "/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if err := virtual.Chtimes(info.path, time.Now(), time.Now().Add(-2*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Only the shipped segment is old enough to be removed, the flushed
+		// one is kept until it's shipped.
+		appendTxn(t, localLog)
+
+		if expected, actual := []Extension{Flushed, Flushed}, exts(t, virtual); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("retain by size drops unshipped segments last", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			virtual  = fsys.NewVirtualFilesystem()
+			dropped  = metricsMocks.NewMockCounter(ctrl)
+			localLog = shippingLog(t, virtual, WithRetentionMetrics(dropped))
+			shipped  = metricsMocks.NewMockCounter(ctrl)
+			failed   = metricsMocks.NewMockCounter(ctrl)
+			shipper  = newShipper(newShipperConfig(t, virtual), &fakeSink{}, shipped, failed, log.NewNopLogger())
+		)
+
+		shipped.EXPECT().Inc()
+		dropped.EXPECT().Add(float64(1))
+
+		appendTxn(t, localLog)
+		shipper.ship()
+		appendTxn(t, localLog)
+		appendTxn(t, localLog)
+
+		infos, err := walkSegments(virtual, "/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := []Extension{Shipped, Flushed, Flushed}, exts(t, virtual); !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Only the newest segment fits, so the shipped segment is removed
+		// before the oldest unshipped segment is dropped.
+		localLog.mutex.Lock()
+		localLog.retentionSize = infos[2].size
+		err = localLog.retain()
+		localLog.mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remaining, err := walkSegments(virtual, "/root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(remaining); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := infos[2].path, remaining[0].path; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("ship and retain concurrently", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			virtual  = fsys.NewVirtualFilesystem()
+			localLog = shippingLog(t, virtual)
+			shipped  = metricsMocks.NewMockCounter(ctrl)
+			failed   = metricsMocks.NewMockCounter(ctrl)
+			shipper  = newShipper(newShipperConfig(t, virtual), &fakeSink{}, shipped, failed, log.NewNopLogger())
+		)
+
+		shipped.EXPECT().Inc().AnyTimes()
+		failed.EXPECT().Inc().Times(0)
+
+		for i := 0; i < 50; i++ {
+			appendTxn(t, localLog)
+		}
+
+		// Nothing fits, so the retention removes every segment, while the
+		// shipper renames the ones it ships.
+		localLog.mutex.Lock()
+		localLog.retentionSize = 1
+		localLog.mutex.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 10; i++ {
+				shipper.ship()
+			}
+		}()
+
+		for i := 0; i < 10; i++ {
+			localLog.mutex.Lock()
+			err := localLog.retain()
+			localLog.mutex.Unlock()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		<-done
+
+		localLog.mutex.Lock()
+		err := localLog.retain()
+		localLog.mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(exts(t, virtual)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("retain a segment shipped since it was walked", func(t *testing.T) {
+		var (
+			virtual  = &shippingFsys{Filesystem: fsys.NewVirtualFilesystem()}
+			localLog = shippingLog(t, virtual)
+		)
+
+		appendTxn(t, localLog)
+		appendTxn(t, localLog)
+
+		// The oldest segment is shipped just as the retention removes it, so
+		// it's left for the next retention.
+		localLog.mutex.Lock()
+		localLog.retentionSize = 1
+		err := localLog.retain()
+		localLog.mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []Extension{Shipped, Shipped}, exts(t, virtual); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("ship a segment dropped while it's shipped", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			virtual = fsys.NewVirtualFilesystem()
+			sink    = sinkFunc(func(segment Segment) error {
+				return virtual.Remove("/root/audit-0000/" + filepath.Base(segment.Name) + Flushed.Ext())
+			})
+			shipped = metricsMocks.NewMockCounter(ctrl)
+			failed  = metricsMocks.NewMockCounter(ctrl)
+			shipper = newShipper(newShipperConfig(t, virtual), sink, shipped, failed, log.NewNopLogger())
+		)
+
+		shipped.EXPECT().Inc().Times(1)
+		failed.EXPECT().Inc().Times(0)
+
+		flush(t, virtual, "/root/audit-0000", false, 1)
+		shipper.ship()
+
+		if expected, actual := 0, len(exts(t, virtual)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		shipper := &Shipper{
+			backoff:    time.Second,
+			maxBackoff: 5 * time.Second,
+		}
+
+		var delays []time.Duration
+		for i := 1; i <= 5; i++ {
+			shipper.failures = i
+			delays = append(delays, shipper.delay())
+		}
+
+		expected := []time.Duration{
+			time.Second,
+			2 * time.Second,
+			4 * time.Second,
+			5 * time.Second,
+			5 * time.Second,
+		}
+		if actual := delays; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("run", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		config, err := BuildShipperConfig(
+			WithShipperRootPath("/root"),
+			WithShipperFsys(fsys.NewVirtualFilesystem()),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			shipped = metricsMocks.NewMockCounter(ctrl)
+			failed  = metricsMocks.NewMockCounter(ctrl)
+			shipper = newShipper(config, &fakeSink{}, shipped, failed, log.NewNopLogger())
+		)
+
+		go shipper.Run()
+
+		shipper.Stop()
+	})
+}
+
+func TestBuildShipperConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(path, bucket, prefix, endpoint, url string, interval, backoff uint16) bool {
+			sinks := []string{"firehose", "s3", "http"}
+			sink := sinks[int(interval)%len(sinks)]
+
+			config, err := BuildShipperConfig(
+				WithShipperRootPath(path),
+				WithShipperFsys(fsys.NewNopFilesystem()),
+				WithShipperFormat(FormatAvro),
+				WithSink(sink),
+				WithShipInterval(time.Duration(interval)+1),
+				WithShipBackoff(time.Duration(backoff), time.Duration(backoff)*2),
+				WithBucket(bucket, prefix),
+				WithBucketEndpoint(endpoint),
+				WithShipURL(url),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.RootPath == path &&
+				config.Format == FormatAvro &&
+				config.Sink == sink &&
+				config.Interval == time.Duration(interval)+1 &&
+				config.Backoff == time.Duration(backoff) &&
+				config.MaxBackoff == time.Duration(backoff)*2 &&
+				config.Bucket == bucket &&
+				config.Prefix == prefix &&
+				config.Endpoint == endpoint &&
+				config.URL == url
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []ShipperConfigOption{
+			WithSink("ftp"),
+			WithShipInterval(0),
+			WithShipBackoff(-1, time.Second),
+			WithShipBackoff(time.Minute, time.Second),
+		} {
+			_, err := BuildShipperConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("missing remote config", func(t *testing.T) {
+		config, err := BuildShipperConfig(
+			WithSink("firehose"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = NewShipper(config, nil, nil, log.NewNopLogger())
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+// sinkFunc ships segments with a func.
+type sinkFunc func(Segment) error
+
+func (f sinkFunc) Ship(segment Segment) error {
+	return f(segment)
+}
+
+// shippingFsys ships every flushed segment just before it's removed, the same
+// as the shipper renaming a segment the retention is about to remove.
+type shippingFsys struct {
+	fsys.Filesystem
+}
+
+func (f *shippingFsys) Remove(path string) error {
+	if filepath.Ext(path) == Flushed.Ext() {
+		if err := f.Filesystem.Rename(path, modifyExtension(path, Shipped.Ext())); err != nil {
+			return err
+		}
+	}
+	return f.Filesystem.Remove(path)
+}
+
+// fakeSink keeps every segment shipped to it, sorted by name, unless it has
+// an error to return.
+type fakeSink struct {
+	segments []Segment
+	attempts int
+	err      error
+}
+
+func (s *fakeSink) Ship(segment Segment) error {
+	s.attempts++
+	if s.err != nil {
+		return s.err
+	}
+	s.segments = append(s.segments, segment)
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].Name < s.segments[j].Name
+	})
+	return nil
+}
@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Segment is a flushed segment of the local audit log that's being shipped.
+type Segment struct {
+
+	// Name of the segment relative to the root of the audit log, without any
+	// extensions, which is unique for every segment.
+	Name string
+
+	// Format the entries with in the segment are encoded in.
+	Format Format
+
+	// Compressed states if the data is gzipped.
+	Compressed bool
+
+	// Data is the segment as it is on disk.
+	Data []byte
+}
+
+// Entries decodes all the entries with in the segment.
+func (s Segment) Entries() ([]Entry, error) {
+	var r io.Reader = bytes.NewReader(s.Data)
+	if s.Compressed {
+		zip, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zip.Close()
+		r = zip
+	}
+
+	var (
+		entries []Entry
+		reader  = bufio.NewReader(r)
+	)
+	for {
+		entry, err := decodeEntry(s.Format, reader)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Sink is somewhere that segments are shipped to.
+type Sink interface {
+
+	// Ship the segment to the sink, returning an error if the segment has to
+	// be shipped again.
+	Ship(Segment) error
+}
+
+type firehoseSink struct {
+	putter *firehosePutter
+}
+
+// NewFirehoseSink creates a Sink that puts every entry with in a segment on to
+// the Firehose stream of the configuration.
+func NewFirehoseSink(config *RemoteConfig) (Sink, error) {
+	sess, err := newSession(config, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &firehoseSink{
+		putter: newFirehosePutter(firehose.New(sess), config),
+	}, nil
+}
+
+func (s *firehoseSink) Ship(segment Segment) error {
+	entries, err := segment.Entries()
+	if err != nil {
+		return errors.Wrap(err, "decoding segment")
+	}
+
+	rows := make([][]byte, len(entries))
+	for k, v := range entries {
+		row, err := encodeEntry(segment.Format, v)
+		if err != nil {
+			return err
+		}
+		rows[k] = row
+	}
+
+	// The segment is still on disk, so if anything fails the whole segment is
+	// shipped again later.
+	if failed, err := s.putter.put(rows); len(failed) > 0 {
+		return errors.Errorf("failed to put %d records: %v", len(failed), err)
+	}
+	return nil
+}
+
+// s3API is the part of the S3 API that's used.
+type s3API interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+type s3Sink struct {
+	client s3API
+	bucket string
+	prefix string
+}
+
+// NewS3Sink creates a Sink that uploads every segment as an object with in the
+// bucket, where the key is the name of the segment following the prefix. The
+// endpoint points it at a S3 compatible store, instead of AWS.
+func NewS3Sink(config *RemoteConfig, endpoint, bucket, prefix string) (Sink, error) {
+	sess, err := newSession(config, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Sink{
+		client: s3.New(sess),
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (s *s3Sink) Ship(segment Segment) error {
+	key := path.Join(s.prefix, segment.Name) + formatExt(segment.Format)
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(segment.Data),
+		ContentLength: aws.Int64(int64(len(segment.Data))),
+		ContentType:   aws.String(contentType(segment.Format)),
+	}
+	if segment.Compressed {
+		input.Key = aws.String(key + compressedExt)
+		input.ContentEncoding = aws.String("gzip")
+	}
+
+	_, err := s.client.PutObject(input)
+	return err
+}
+
+type httpSink struct {
+	client *http.Client
+	url    string
+}
+
+// NewHTTPSink creates a Sink that posts every segment to the url, where any
+// 2xx status means that it was shipped.
+func NewHTTPSink(client *http.Client, url string) Sink {
+	return &httpSink{
+		client: client,
+		url:    url,
+	}
+}
+
+func (s *httpSink) Ship(segment Segment) error {
+	request, err := http.NewRequest("POST", s.url, bytes.NewReader(segment.Data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType(segment.Format))
+	request.Header.Set("X-Courier-Segment", segment.Name)
+	request.Header.Set("X-Courier-Format", string(segment.Format))
+	if segment.Compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Read the body, so that the connection can be used again.
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+func contentType(format Format) string {
+	switch format {
+	case FormatJSON, "":
+		return "application/x-ndjson"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func formatExt(format Format) string {
+	switch format {
+	case FormatJSON, "":
+		return ".json"
+	default:
+		return fmt.Sprintf(".%s", format)
+	}
+}
@@ -0,0 +1,262 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestSegment(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, compressed := range []bool{false, true} {
+		entries := []Entry{generateEntry(rnd), generateEntry(rnd)}
+		segment := testSegment(t, FormatJSON, compressed, entries)
+
+		actual, err := segment.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := entries; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+}
+
+func TestFirehoseSink(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("ship", func(t *testing.T) {
+		entries := make([]Entry, maxFirehoseBatch+1)
+		for k := range entries {
+			entries[k] = generateEntry(rnd)
+		}
+
+		var (
+			client = &fakeFirehose{}
+			sink   = &firehoseSink{
+				putter: newTestPutter(client),
+			}
+		)
+
+		if err := sink.Ship(testSegment(t, FormatJSON, true, entries)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []int{maxFirehoseBatch, 1}, client.batches; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("ship with failed puts", func(t *testing.T) {
+		var (
+			client = &fakeFirehose{rejects: defaultPutAttempts}
+			sink   = &firehoseSink{
+				putter: newTestPutter(client),
+			}
+		)
+
+		err := sink.Ship(testSegment(t, FormatJSON, false, []Entry{generateEntry(rnd)}))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestS3Sink(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, compressed := range []bool{false, true} {
+		var (
+			client = &fakeS3{}
+			sink   = &s3Sink{
+				client: client,
+				bucket: "bucket",
+				prefix: "audit",
+			}
+			segment = testSegment(t, FormatAvro, compressed, []Entry{generateEntry(rnd)})
+		)
+
+		if err := sink.Ship(segment); err != nil {
+			t.Fatal(err)
+		}
+
+		input := client.input
+		if expected, actual := "bucket", aws.StringValue(input.Bucket); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		key, encoding := "audit/audit-0000/00000000000000000001.avro", ""
+		if compressed {
+			key, encoding = key+".gz", "gzip"
+		}
+		if expected, actual := key, aws.StringValue(input.Key); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := encoding, aws.StringValue(input.ContentEncoding); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		body, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := segment.Data, body; !bytes.Equal(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("ship", func(t *testing.T) {
+		var request *http.Request
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		sink := NewHTTPSink(http.DefaultClient, server.URL)
+		if err := sink.Ship(testSegment(t, FormatJSON, true, []Entry{generateEntry(rnd)})); err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range map[string]string{
+			"Content-Type":      "application/x-ndjson",
+			"Content-Encoding":  "gzip",
+			"X-Courier-Segment": "audit-0000/00000000000000000001",
+			"X-Courier-Format":  "json",
+		} {
+			if expected, actual := v, request.Header.Get(k); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("ship with bad status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		sink := NewHTTPSink(http.DefaultClient, server.URL)
+		err := sink.Ship(testSegment(t, FormatJSON, false, []Entry{generateEntry(rnd)}))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func testSegment(t *testing.T, format Format, compressed bool, entries []Entry) Segment {
+	var buf bytes.Buffer
+	for _, v := range entries {
+		row, err := encodeEntry(format, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(row)
+	}
+
+	data := buf.Bytes()
+	if compressed {
+		var zipped bytes.Buffer
+		zip := gzip.NewWriter(&zipped)
+		zip.Write(data)
+		zip.Close()
+		data = zipped.Bytes()
+	}
+
+	return Segment{
+		Name:       "audit-0000/00000000000000000001",
+		Format:     format,
+		Compressed: compressed,
+		Data:       data,
+	}
+}
+
+// fakeFirehose records the size of every batch put, rejecting the first
+// records put until it has rejected as many as it's told to, or failing every
+// batch if it has an error to return.
+type fakeFirehose struct {
+	batches []int
+	records [][]byte
+	rejects int
+	err     error
+}
+
+func (f *fakeFirehose) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	f.batches = append(f.batches, len(input.Records))
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var (
+		failed    int64
+		responses = make([]*firehose.PutRecordBatchResponseEntry, len(input.Records))
+	)
+	for k, v := range input.Records {
+		if f.rejects > 0 {
+			f.rejects--
+			failed++
+			responses[k] = &firehose.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String("ServiceUnavailableException"),
+				ErrorMessage: aws.String("slow down"),
+			}
+			continue
+		}
+		f.records = append(f.records, v.Data)
+		responses[k] = &firehose.PutRecordBatchResponseEntry{
+			RecordId: aws.String("id"),
+		}
+	}
+	return &firehose.PutRecordBatchOutput{
+		FailedPutCount:   aws.Int64(failed),
+		RequestResponses: responses,
+	}, nil
+}
+
+func newTestPutter(client firehoseAPI) *firehosePutter {
+	config, err := BuildRemoteConfig(
+		WithStream("stream"),
+	)
+	if err != nil {
+		panic(err)
+	}
+	putter := newFirehosePutter(client, config)
+	putter.sleep = func(time.Duration) {}
+	return putter
+}
+
+// fakeS3 records the last object put.
+type fakeS3 struct {
+	input *s3.PutObjectInput
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.input = input
+	return &s3.PutObjectOutput{}, nil
+}
+
+func generateEntry(rnd *rand.Rand) Entry {
+	return Entry(testEntry{}.Generate(rnd, 64).Interface().(testEntry))
+}
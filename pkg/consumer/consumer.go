@@ -1,11 +1,13 @@
 package consumer
 
 import (
+	"io"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
 	"github.com/trussle/courier/pkg/audit"
 	"github.com/trussle/courier/pkg/consumer/fifo"
 	"github.com/trussle/courier/pkg/http"
@@ -19,15 +21,120 @@ const (
 	defaultActiveTargetSize = 10
 	defaultActiveTargetAge  = time.Minute
 	defaultWaitTime         = time.Millisecond * 100
+	defaultConcurrency      = 1
 )
 
+var errNotAccepted = errors.New("not accepted")
+
+// Config encapsulates the requirements for generating a Consumer
+type Config struct {
+	retry       RetryPolicy
+	concurrency int
+	ordered     bool
+	batch       bool
+	heartbeat   time.Duration
+	recipient   string
+}
+
+// Option defines a option for generating a consumer Config
+type Option func(*Config) error
+
+// Build ingests configuration options to then yield a Config and return an
+// error if it fails during setup.
+func Build(opts ...Option) (*Config, error) {
+	config := Config{
+		concurrency: defaultConcurrency,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithRetryPolicy adds a retry policy for delivering records to the
+// configuration
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(config *Config) error {
+		if policy.MaxAttempts < 0 {
+			return errors.Errorf("invalid max attempts %d", policy.MaxAttempts)
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return errors.Errorf("invalid jitter %f", policy.Jitter)
+		}
+		config.retry = policy
+		return nil
+	}
+}
+
+// WithConcurrency adds the number of records that can be delivered at the
+// same time to the configuration
+func WithConcurrency(concurrency int) Option {
+	return func(config *Config) error {
+		if concurrency < 1 {
+			return errors.Errorf("invalid concurrency %d", concurrency)
+		}
+		config.concurrency = concurrency
+		return nil
+	}
+}
+
+// WithOrderedDelivery adds the ordering of delivery to the configuration. When
+// ordered, records that share the same group are delivered one after another
+// in the order they were received.
+func WithOrderedDelivery(ordered bool) Option {
+	return func(config *Config) error {
+		config.ordered = ordered
+		return nil
+	}
+}
+
+// WithBatchDelivery adds the delivery mode to the configuration. When batched,
+// all the records gathered are sent to the recipient in a single request.
+func WithBatchDelivery(batch bool) Option {
+	return func(config *Config) error {
+		config.batch = batch
+		return nil
+	}
+}
+
+// WithHeartbeat adds the interval at which the visibility of records held by
+// the consumer is extended to the configuration. An interval of zero turns the
+// heartbeat off.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(config *Config) error {
+		if interval < 0 {
+			return errors.Errorf("invalid heartbeat interval %s", interval)
+		}
+		config.heartbeat = interval
+		return nil
+	}
+}
+
+// WithRecipient adds the name of the recipient records are delivered to, which
+// is written to the audit log, to the configuration. Senders that route
+// records name the recipient of each record themselves.
+func WithRecipient(recipient string) Option {
+	return func(config *Config) error {
+		config.recipient = recipient
+		return nil
+	}
+}
+
+// router is implemented by senders that pick a recipient for each record.
+type router interface {
+	Route(models.Record) (string, error)
+}
+
 // Consumer reads segments from the queue, and replicates merged segments to
 // the rest of the cluster. It's implemented as a state machine: gather
-// segments, replicate, commit, and repeat. All failures invalidate the entire
-// batch.
+// segments, replicate, commit, and repeat. Records that still fail after
+// exhausting the retry policy are handed back to the queue as failures.
 type Consumer struct {
 	mutex              sync.Mutex
-	client             *http.Client
+	client             http.Sender
 	queue              queue.Queue
 	log                audit.Log
 	fifo               *fifo.FIFO
@@ -37,6 +144,17 @@ type Consumer struct {
 	activeTargetSize   int
 	gatherErrors       int
 	waitTime           time.Duration
+	retry              RetryPolicy
+	concurrency        int
+	ordered            bool
+	batch              bool
+	heartbeat          time.Duration
+	recipient          string
+	held               map[uuid.UUID]models.Record
+	deliveries         map[uuid.UUID]audit.Delivery
+	reasons            map[uuid.UUID]string
+	evicted            []fifo.KeyValue
+	skipped            []fifo.KeyValue
 	stop               chan chan struct{}
 	consumedSegments   metrics.Counter
 	consumedRecords    metrics.Counter
@@ -44,18 +162,21 @@ type Consumer struct {
 	replicatedRecords  metrics.Counter
 	failedSegments     metrics.Counter
 	failedRecords      metrics.Counter
+	heartbeatFailures  metrics.Counter
 	logger             log.Logger
 }
 
 // New creates a consumer.
 func New(
-	client *http.Client,
+	client http.Sender,
 	queue queue.Queue,
 	log audit.Log,
 	frequency time.Duration,
+	config *Config,
 	consumedSegments, consumedRecords metrics.Counter,
 	replicatedSegments, replicatedRecords metrics.Counter,
 	failedSegments, failedRecords metrics.Counter,
+	heartbeatFailures metrics.Counter,
 	logger log.Logger,
 ) *Consumer {
 	consumer := &Consumer{
@@ -69,6 +190,15 @@ func New(
 		activeTargetSize:   defaultActiveTargetSize,
 		gatherErrors:       0,
 		waitTime:           defaultWaitTime,
+		retry:              config.retry,
+		concurrency:        config.concurrency,
+		ordered:            config.ordered,
+		batch:              config.batch,
+		heartbeat:          config.heartbeat,
+		recipient:          config.recipient,
+		held:               make(map[uuid.UUID]models.Record),
+		deliveries:         make(map[uuid.UUID]audit.Delivery),
+		reasons:            make(map[uuid.UUID]string),
 		stop:               make(chan chan struct{}),
 		consumedSegments:   consumedSegments,
 		consumedRecords:    consumedRecords,
@@ -76,6 +206,7 @@ func New(
 		replicatedRecords:  replicatedRecords,
 		failedSegments:     failedSegments,
 		failedRecords:      failedRecords,
+		heartbeatFailures:  heartbeatFailures,
 		logger:             logger,
 	}
 
@@ -90,6 +221,8 @@ func (c *Consumer) Run() {
 	step := time.NewTicker(c.frequency)
 	defer step.Stop()
 
+	stopHeartbeat := c.startHeartbeat()
+
 	state := c.gather
 	for {
 		select {
@@ -97,7 +230,17 @@ func (c *Consumer) Run() {
 			state = state()
 
 		case q := <-c.stop:
+			stopHeartbeat()
+			// Anything still held is left for the queue to redeliver.
+			c.appendOutcome(c.fifo.Slice(), audit.OutcomeDropped)
 			c.fifo.Purge()
+			// The audit log is closed, so that nothing appended to it is left
+			// unflushed.
+			if l, ok := c.log.(io.Closer); ok {
+				if err := l.Close(); err != nil {
+					level.Warn(c.logger).Log("state", "stop", "err", err)
+				}
+			}
 			close(q)
 			return
 		}
@@ -111,6 +254,41 @@ func (c *Consumer) Stop() {
 	<-q
 }
 
+// startHeartbeat extends the visibility of every record held by the consumer
+// at the heartbeat interval, in the background, so that long running
+// deliveries aren't redelivered by the queue. The returned function stops the
+// heartbeat and waits for it to finish.
+func (c *Consumer) startHeartbeat() func() {
+	if c.heartbeat <= 0 {
+		return func() {}
+	}
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+
+		beat := time.NewTicker(c.heartbeat)
+		defer beat.Stop()
+
+		for {
+			select {
+			case <-beat.C:
+				c.extend()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
 // stateFn is a lazy chaining mechism, similar to a trampoline, but via
 // calls through Run.:
 type stateFn func() stateFn
@@ -154,6 +332,7 @@ func (c *Consumer) gather() stateFn {
 
 	for _, v := range records {
 		c.fifo.Add(v.ID(), v)
+		c.hold(v.ID(), v)
 	}
 
 	c.activeSince = time.Now()
@@ -176,19 +355,32 @@ func (c *Consumer) replicate() stateFn {
 		return c.gather
 	}
 
-	// We want to replicate all things first
-	dequeued, err := c.fifo.Dequeue(func(key uuid.UUID, value models.Record) error {
-		debug.Log("action", "sending", "key", key.String())
-		return c.client.Send(value.Body())
-	})
+	// We want to replicate all things first, anything that fails after all
+	// it's attempts is left in the fifo for the failure state. Records that
+	// are skipped, because an earlier record in their group failed, are left
+	// for the queue to redeliver once they become visible again, or are
+	// released by the failure state if the queue only redelivers them once
+	// they're released.
+	var dequeued, failed, skipped []fifo.KeyValue
+	if c.batch {
+		dequeued, failed, skipped = c.sendBatch(debug)
+	} else {
+		dequeued, failed, skipped = c.send(debug)
+	}
 
 	// even if we err out, we should send them in a transaction
 	if err := c.commit(dequeued); err != nil {
 		warn.Log("action", "commit", "err", err)
 	}
 
-	if err != nil {
-		warn.Log("action", "dequeue", "err", err)
+	c.appendOutcome(c.takeEvicted(), audit.OutcomeEvicted)
+
+	if len(failed) > 0 {
+		warn.Log("action", "dequeue", "dequeued", len(dequeued), "failed", len(failed), "skipped", len(skipped))
+		if len(dequeued) > 0 {
+			c.replicatedRecords.Add(float64(len(dequeued)))
+		}
+		c.skipped = skipped
 		return c.failure
 	}
 
@@ -198,13 +390,88 @@ func (c *Consumer) replicate() stateFn {
 	return c.gather
 }
 
+func (c *Consumer) send(debug log.Logger) (dequeued, failed, skipped []fifo.KeyValue) {
+	var key fifo.KeyFunc
+	if c.ordered {
+		key = groupID
+	}
+
+	return c.fifo.Partition(c.concurrency, key, func(key uuid.UUID, value models.Record) error {
+		debug.Log("action", "sending", "key", key.String(), "attempts", value.Attempts())
+		var status int
+		if err := c.retry.Do(value, func() (err error) {
+			status, err = http.SendStatus(c.client, value)
+			return err
+		}); err != nil {
+			c.undelivered(key, err)
+			return err
+		}
+		c.delivered(key, value, status)
+		return nil
+	})
+}
+
+func (c *Consumer) sendBatch(debug log.Logger) (dequeued, failed, skipped []fifo.KeyValue) {
+	values := c.fifo.Slice()
+
+	records := make([]models.Record, len(values))
+	for k, v := range values {
+		records[k] = v.Value
+	}
+
+	// The status code each record was accepted with is kept, as a record can
+	// be accepted by any of the attempts.
+	statuses := make(map[uuid.UUID]int, len(records))
+	succeeded := c.retry.DoBatch(records, func(pending []models.Record) ([]bool, error) {
+		debug.Log("action", "sending batch", "records", len(pending))
+		res, err := http.SendBatchStatus(c.client, pending)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range res {
+			if v != 0 {
+				statuses[pending[k].ID()] = v
+			}
+		}
+		return http.Accepted(res), nil
+	})
+
+	accepted := make(map[string]int, len(values))
+	for k, v := range values {
+		if succeeded[k] {
+			accepted[v.Key.String()] = statuses[v.Value.ID()]
+		}
+	}
+
+	return c.fifo.Partition(1, nil, func(key uuid.UUID, value models.Record) error {
+		status, ok := accepted[key.String()]
+		if !ok {
+			c.undelivered(key, errNotAccepted)
+			return errNotAccepted
+		}
+		c.delivered(key, value, status)
+		return nil
+	})
+}
+
 func (c *Consumer) failure() stateFn {
+	values := c.fifo.Slice()
+	c.appendOutcome(values, audit.OutcomeFailed)
+
+	// The queue is given the reason each record failed, so that it can say
+	// why when it gives up on them.
 	txn := queue.NewTransaction()
-	for _, v := range c.fifo.Slice() {
-		if err := txn.Push(v.Value.ID(), v.Value); err != nil {
+	c.mutex.Lock()
+	for _, v := range values {
+		record := v.Value
+		if reason, ok := c.reasons[v.Key]; ok {
+			record = queue.FailedRecord(record, reason)
+		}
+		if err := txn.Push(v.Value.ID(), record); err != nil {
 			continue
 		}
 	}
+	c.mutex.Unlock()
 	if _, err := c.queue.Failed(txn); err != nil {
 		level.Warn(c.logger).Log("state", "failure", "err", err)
 		goto PURGE
@@ -215,16 +482,100 @@ func (c *Consumer) failure() stateFn {
 
 PURGE:
 	c.fifo.Purge()
+
+	// The skipped records are released after the records that failed, so
+	// that they're delivered again after them.
+	c.releaseSkipped()
+
 	return c.gather
 }
 
+// releaseSkipped releases the records that were skipped back to the queue, if
+// the queue doesn't redeliver them on it's own.
+func (c *Consumer) releaseSkipped() {
+	skipped := c.skipped
+	c.skipped = nil
+
+	c.releaseValues("failure", skipped)
+}
+
+// releaseValues releases the records back to the queue, if the queue doesn't
+// redeliver records that are left uncommitted on it's own.
+func (c *Consumer) releaseValues(state string, values []fifo.KeyValue) {
+	releaser, ok := c.queue.(queue.Releaser)
+	if !ok || len(values) == 0 {
+		return
+	}
+
+	txn := queue.NewTransaction()
+	for _, v := range values {
+		if err := txn.Push(v.Value.ID(), v.Value); err != nil {
+			continue
+		}
+	}
+
+	result, err := releaser.Release(txn)
+	if err != nil {
+		level.Warn(c.logger).Log("state", state, "action", "release", "err", err)
+		return
+	}
+	if result.Failure > 0 {
+		level.Warn(c.logger).Log("state", state, "action", "release", "failed", result.Failure)
+	}
+}
+
 func (c *Consumer) onElementEviction(reason fifo.EvictionReason, key uuid.UUID, value models.Record) {
+	// Once evicted, the record is either committed, failed or left for the
+	// queue to redeliver, so the heartbeat should no longer extend it.
+	c.release(key)
+
 	// We should fail the transaction
 	switch reason {
-	case fifo.Dequeued:
-		// do nothing
+	case fifo.Dequeued, fifo.Purged:
+		// do nothing, as they're written to the audit log when they're
+		// committed, failed or dropped.
+	case fifo.Skipped:
+		level.Debug(c.logger).Log("state", "eviction", "id", key.String(), "record", value.RecordID(), "reason", "skipped")
+		c.evict(key, value)
 	default:
 		level.Warn(c.logger).Log("state", "eviction", "id", key.String(), "record", value.RecordID())
+		c.evict(key, value)
+	}
+}
+
+// evict notes that the record was evicted without being delivered, so that
+// it's written to the audit log once replication has finished.
+func (c *Consumer) evict(key uuid.UUID, value models.Record) {
+	c.mutex.Lock()
+	c.evicted = append(c.evicted, fifo.KeyValue{Key: key, Value: value})
+	c.mutex.Unlock()
+}
+
+func (c *Consumer) takeEvicted() []fifo.KeyValue {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	evicted := c.evicted
+	c.evicted = nil
+	return evicted
+}
+
+// appendOutcome appends the values to the audit log along with what happened
+// to them. If it fails there's nothing to do but continue, so it only warns.
+func (c *Consumer) appendOutcome(values []fifo.KeyValue, outcome audit.Outcome) {
+	if len(values) == 0 {
+		return
+	}
+
+	txn := queue.NewTransaction()
+	for _, v := range values {
+		if err := txn.Push(v.Value.ID(), v.Value); err != nil {
+			continue
+		}
+	}
+
+	if err := c.log.AppendOutcome(txn, outcome); err != nil {
+		level.Warn(c.logger).Log("state", string(outcome), "action", "log", "err", err)
 	}
 }
 
@@ -241,10 +592,29 @@ func (c *Consumer) commit(values []fifo.KeyValue) error {
 		}
 	}
 
-	// Try and append to the audit log, if it fails do nothing but continue.
-	if err := c.log.Append(txn); err != nil {
-		// do nothing here, we tried!
-		warn.Log("state", "commit", "action", "log", "err", err)
+	// The audit log is given the records along with how they were delivered.
+	entries := queue.NewTransaction()
+	c.mutex.Lock()
+	for _, v := range values {
+		record := v.Value
+		if delivery, ok := c.deliveries[v.Key]; ok {
+			record = audit.Delivered(record, delivery)
+			delete(c.deliveries, v.Key)
+		}
+		if err := entries.Push(v.Value.ID(), record); err != nil {
+			continue
+		}
+	}
+	c.mutex.Unlock()
+
+	// The records are only committed once they're in the audit log. A multi
+	// log only fails to append when one of it's required logs fails, in which
+	// case the records are left for the queue to deliver again, rather than
+	// being committed without being audited.
+	if err := c.log.Append(entries); err != nil {
+		warn.Log("action", "log", "err", err)
+		c.releaseValues("commit", values)
+		return errors.Wrap(err, "appending to audit log")
 	}
 
 	if _, err := c.queue.Commit(txn); err != nil {
@@ -253,3 +623,85 @@ func (c *Consumer) commit(values []fifo.KeyValue) error {
 
 	return txn.Flush()
 }
+
+func (c *Consumer) extend() {
+	txn := queue.NewTransaction()
+
+	c.mutex.Lock()
+	for k, v := range c.held {
+		if err := txn.Push(k, v); err != nil {
+			continue
+		}
+	}
+	c.mutex.Unlock()
+
+	if txn.Len() == 0 {
+		return
+	}
+
+	result, err := c.queue.Extend(txn)
+	if err != nil {
+		level.Warn(c.logger).Log("state", "heartbeat", "err", err)
+		c.heartbeatFailures.Add(float64(txn.Len()))
+		return
+	}
+	if result.Failure > 0 {
+		level.Warn(c.logger).Log("state", "heartbeat", "failed", result.Failure)
+		c.heartbeatFailures.Add(float64(result.Failure))
+	}
+}
+
+func (c *Consumer) hold(key uuid.UUID, value models.Record) {
+	c.mutex.Lock()
+	if c.held == nil {
+		c.held = make(map[uuid.UUID]models.Record)
+	}
+	c.held[key] = value
+	c.mutex.Unlock()
+}
+
+// delivered notes how the record was delivered, so that it's written to the
+// audit log along with the record once it's committed. A record is only
+// delivered once the recipient has replied with a StatusOK, or with a
+// successful status for it with in a batch, which is the status that's noted.
+func (c *Consumer) delivered(key uuid.UUID, value models.Record, status int) {
+	recipient := c.recipient
+	if r, ok := c.client.(router); ok {
+		if name, err := r.Route(value); err == nil {
+			recipient = name
+		}
+	}
+
+	c.mutex.Lock()
+	if c.deliveries == nil {
+		c.deliveries = make(map[uuid.UUID]audit.Delivery)
+	}
+	c.deliveries[key] = audit.Delivery{
+		Recipient:   recipient,
+		StatusCode:  status,
+		DeliveredAt: time.Now(),
+	}
+	c.mutex.Unlock()
+}
+
+// undelivered notes why the record failed delivery, so that the reason is
+// handed to the queue if it's failed.
+func (c *Consumer) undelivered(key uuid.UUID, err error) {
+	c.mutex.Lock()
+	if c.reasons == nil {
+		c.reasons = make(map[uuid.UUID]string)
+	}
+	c.reasons[key] = errors.Cause(err).Error()
+	c.mutex.Unlock()
+}
+
+func (c *Consumer) release(key uuid.UUID) {
+	c.mutex.Lock()
+	delete(c.held, key)
+	delete(c.reasons, key)
+	c.mutex.Unlock()
+}
+
+func groupID(record models.Record) string {
+	return record.GroupID()
+}
@@ -2,11 +2,14 @@ package consumer
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	nhttp "net/http"
 	"net/http/httptest"
 	"reflect"
 	"runtime"
+	"sort"
 	"sync"
 	"testing"
 	"testing/quick"
@@ -14,6 +17,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/golang/mock/gomock"
+	"github.com/trussle/courier/pkg/audit"
 	auditMocks "github.com/trussle/courier/pkg/audit/mocks"
 	"github.com/trussle/courier/pkg/consumer/fifo"
 	"github.com/trussle/courier/pkg/http"
@@ -44,17 +48,27 @@ func TestConsumer(t *testing.T) {
 			replicatedRecords  = metricsMocks.NewMockCounter(ctrl)
 			failedSegments     = metricsMocks.NewMockCounter(ctrl)
 			failedRecords      = metricsMocks.NewMockCounter(ctrl)
+			heartbeatFailures  = metricsMocks.NewMockCounter(ctrl)
 		)
+		config, err := Build(
+			WithRetryPolicy(RetryPolicy{}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
 		consumer := New(client,
 			queue,
 			audit,
 			time.Second,
+			config,
 			consumedSegments,
 			consumedRecords,
 			replicatedSegments,
 			replicatedRecords,
 			failedSegments,
 			failedRecords,
+			heartbeatFailures,
 			log.NewNopLogger(),
 		)
 
@@ -69,6 +83,72 @@ func TestConsumer(t *testing.T) {
 
 		consumer.Stop()
 	})
+
+	t.Run("run drops held records when stopped", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		record, err := queue.GenerateQueueRecord(rand.New(rand.NewSource(time.Now().UnixNano())))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auditLog := auditMocks.NewMockLog(ctrl)
+		auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeDropped).Do(func(txn models.Transaction, outcome audit.Outcome) {
+			if expected, actual := 1, txn.Len(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		})
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.frequency = time.Minute
+		consumer.logger = log.NewNopLogger()
+		consumer.stop = make(chan chan struct{})
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+
+		go consumer.Run()
+
+		consumer.Stop()
+
+		if expected, actual := 0, consumer.fifo.Len(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("run closes the audit log when stopped", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		auditLog := &closingLog{MockLog: auditMocks.NewMockLog(ctrl)}
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.frequency = time.Minute
+		consumer.logger = log.NewNopLogger()
+		consumer.stop = make(chan chan struct{})
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+
+		go consumer.Run()
+
+		consumer.Stop()
+
+		if expected, actual := 1, auditLog.closed; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+// closingLog is an audit log that counts how many times it's closed.
+type closingLog struct {
+	*auditMocks.MockLog
+	closed int
+}
+
+func (l *closingLog) Close() error {
+	l.closed++
+	return nil
 }
 
 func TestConsumerGather(t *testing.T) {
@@ -412,6 +492,462 @@ func TestConsumerReplicate(t *testing.T) {
 	})
 }
 
+func TestConsumerReplicateRetry(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("replicate with retry", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			queue              = queueMocks.NewMockQueue(ctrl)
+			audit              = auditMocks.NewMockLog(ctrl)
+			replicatedSegments = metricsMocks.NewMockCounter(ctrl)
+			replicatedRecords  = metricsMocks.NewMockCounter(ctrl)
+		)
+
+		audit.EXPECT().Append(gomock.Any())
+		queue.EXPECT().Commit(gomock.Any())
+		replicatedSegments.EXPECT().Inc()
+		replicatedRecords.EXPECT().Add(float64(1))
+
+		var requests int
+		mux := nhttp.NewServeMux()
+		mux.HandleFunc("/", func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			requests++
+			if requests < 3 {
+				w.WriteHeader(nhttp.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(nhttp.StatusOK)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = audit
+		consumer.queue = queue
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.retry = RetryPolicy{
+			MaxAttempts: 3,
+			BaseBackoff: time.Millisecond,
+			MaxBackoff:  time.Millisecond * 2,
+		}
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+		consumer.replicatedSegments = replicatedSegments
+		consumer.replicatedRecords = replicatedRecords
+
+		if expected, actual := consumer.gather, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 3, requests; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("replicate with exhausted attempts", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		id, err := uuid.NewWithRand(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := queue.NewRecord(id, "message-id", "receipt", []byte("body"), time.Now(), nil, receiveCount(4))
+
+		var (
+			queue = queueMocks.NewMockQueue(ctrl)
+			audit = auditMocks.NewMockLog(ctrl)
+		)
+
+		audit.EXPECT().Append(gomock.Any())
+		queue.EXPECT().Commit(gomock.Any())
+
+		var requests int
+		mux := nhttp.NewServeMux()
+		mux.HandleFunc("/", func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			requests++
+			w.WriteHeader(nhttp.StatusOK)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = audit
+		consumer.queue = queue
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.retry = RetryPolicy{
+			MaxAttempts: 3,
+		}
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+
+		if expected, actual := consumer.failure, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 0, requests; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, consumer.fifo.Len(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestConsumerReplicateOrdered(t *testing.T) {
+	t.Parallel()
+
+	t.Run("replicate stops a failed group", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var records []models.Record
+		for _, v := range []struct {
+			body, group string
+		}{
+			{"a1", "a"},
+			{"b1", "b"},
+			{"a2", "a"},
+			{"b2", "b"},
+		} {
+			id, err := uuid.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, queue.NewRecord(id, v.body, "receipt", []byte(v.body), time.Now(), nil, map[string]string{
+				"MessageGroupId": v.group,
+			}))
+		}
+
+		var (
+			queue             = queueMocks.NewMockQueue(ctrl)
+			auditLog          = auditMocks.NewMockLog(ctrl)
+			replicatedRecords = metricsMocks.NewMockCounter(ctrl)
+		)
+
+		auditLog.EXPECT().Append(gomock.Any())
+		auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeEvicted).Do(func(txn models.Transaction, outcome audit.Outcome) {
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				if expected, actual := "a2", record.RecordID(); expected != actual {
+					t.Errorf("expected: %s, actual: %s", expected, actual)
+				}
+				return nil
+			})
+			if expected, actual := 1, txn.Len(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		})
+		queue.EXPECT().Commit(gomock.Any()).Do(func(txn models.Transaction) {
+			if expected, actual := 2, txn.Len(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		})
+		replicatedRecords.EXPECT().Add(float64(2))
+
+		var (
+			mutex    sync.Mutex
+			received []string
+		)
+		mux := nhttp.NewServeMux()
+		mux.HandleFunc("/", func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mutex.Lock()
+			received = append(received, string(body))
+			mutex.Unlock()
+
+			if string(body) == "a1" {
+				w.WriteHeader(nhttp.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(nhttp.StatusOK)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = queue
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.concurrency = 2
+		consumer.ordered = true
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.replicatedRecords = replicatedRecords
+
+		for _, record := range records {
+			consumer.fifo.Add(record.ID(), record)
+		}
+
+		if expected, actual := consumer.failure, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+
+		// a2 is never sent, as it has to wait for a1 to be redelivered.
+		sort.Strings(received)
+		if expected, actual := []string{"a1", "b1", "b2"}, received; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		values := consumer.fifo.Slice()
+		if expected, actual := 1, len(values); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "a1", values[0].Value.RecordID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("failure releases skipped records", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var records []models.Record
+		for _, body := range []string{"a1", "a2"} {
+			id, err := uuid.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, queue.NewRecord(id, body, "receipt", []byte(body), time.Now(), nil, map[string]string{
+				"MessageGroupId": "a",
+			}))
+		}
+
+		var (
+			que = releasingQueue{
+				MockQueue:    queueMocks.NewMockQueue(ctrl),
+				MockReleaser: queueMocks.NewMockReleaser(ctrl),
+			}
+			auditLog       = auditMocks.NewMockLog(ctrl)
+			failedSegments = metricsMocks.NewMockCounter(ctrl)
+			failedRecords  = metricsMocks.NewMockCounter(ctrl)
+		)
+
+		var calls []string
+		walk := func(txn models.Transaction) []string {
+			var ids []string
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				ids = append(ids, record.RecordID())
+				return nil
+			})
+			return ids
+		}
+
+		auditLog.EXPECT().Append(gomock.Any())
+		auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeEvicted)
+		auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeFailed)
+		que.MockQueue.EXPECT().Commit(gomock.Any())
+		que.MockQueue.EXPECT().Failed(gomock.Any()).Do(func(txn models.Transaction) {
+			calls = append(calls, walk(txn)...)
+		})
+		que.MockReleaser.EXPECT().Release(gomock.Any()).Do(func(txn models.Transaction) {
+			calls = append(calls, walk(txn)...)
+		})
+		failedSegments.EXPECT().Inc()
+		failedRecords.EXPECT().Add(float64(1))
+
+		server := httptest.NewServer(nhttp.HandlerFunc(func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			w.WriteHeader(nhttp.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.concurrency = 1
+		consumer.ordered = true
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.failedSegments = failedSegments
+		consumer.failedRecords = failedRecords
+
+		for _, record := range records {
+			consumer.fifo.Add(record.ID(), record)
+		}
+
+		if expected, actual := consumer.failure, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := consumer.gather, consumer.failure(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+
+		// a2 is released after a1 has failed, so that it's delivered again
+		// after it.
+		if expected, actual := []string{"a1", "a2"}, calls; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// The skipped records are only released once.
+		if expected, actual := 0, len(consumer.skipped); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+// releasingQueue is a queue that has to be told to release the records that
+// are skipped.
+type releasingQueue struct {
+	*queueMocks.MockQueue
+	*queueMocks.MockReleaser
+}
+
+func TestConsumerReplicateBatch(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("replicate batch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var records []models.Record
+		for i := 0; i < 3; i++ {
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+
+		var (
+			queue              = queueMocks.NewMockQueue(ctrl)
+			audit              = auditMocks.NewMockLog(ctrl)
+			replicatedSegments = metricsMocks.NewMockCounter(ctrl)
+			replicatedRecords  = metricsMocks.NewMockCounter(ctrl)
+		)
+
+		audit.EXPECT().Append(gomock.Any())
+		queue.EXPECT().Commit(gomock.Any())
+		replicatedSegments.EXPECT().Inc()
+		replicatedRecords.EXPECT().Add(float64(3))
+
+		var requests int
+		mux := nhttp.NewServeMux()
+		mux.HandleFunc("/", func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			requests++
+			w.WriteHeader(nhttp.StatusOK)
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = audit
+		consumer.queue = queue
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.batch = true
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.replicatedSegments = replicatedSegments
+		consumer.replicatedRecords = replicatedRecords
+
+		for _, record := range records {
+			consumer.fifo.Add(record.ID(), record)
+		}
+
+		if expected, actual := consumer.gather, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 1, requests; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("replicate partial batch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var records []models.Record
+		for i := 0; i < 3; i++ {
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+
+		var (
+			queue             = queueMocks.NewMockQueue(ctrl)
+			auditLog          = auditMocks.NewMockLog(ctrl)
+			replicatedRecords = metricsMocks.NewMockCounter(ctrl)
+		)
+
+		var entries []audit.Entry
+		auditLog.EXPECT().Append(gomock.Any()).Do(func(txn models.Transaction) {
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				entries = append(entries, audit.NewEntry(id, record, audit.OutcomeCommitted))
+				return nil
+			})
+		})
+		queue.EXPECT().Commit(gomock.Any()).Do(func(txn models.Transaction) {
+			if expected, actual := 1, txn.Len(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		})
+		replicatedRecords.EXPECT().Add(float64(1))
+
+		mux := nhttp.NewServeMux()
+		mux.HandleFunc("/", func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			w.WriteHeader(http.StatusMultiStatus)
+			fmt.Fprintf(w, `{"results":[{"id":%q,"status":202}]}`, records[1].ID().String())
+		})
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = queue
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.batch = true
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.replicatedRecords = replicatedRecords
+
+		for _, record := range records {
+			consumer.fifo.Add(record.ID(), record)
+		}
+
+		if expected, actual := consumer.failure, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+
+		values := consumer.fifo.Slice()
+		if expected, actual := 2, len(values); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := records[0].ID().String(), values[0].Key.String(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := records[2].ID().String(), values[1].Key.String(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		// The accepted record is written to the audit log with the status it
+		// was accepted with, rather than the status of the batch.
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := nhttp.StatusAccepted, entries[0].StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
 func TestConsumerFailure(t *testing.T) {
 	t.Parallel()
 
@@ -427,10 +963,16 @@ func TestConsumerFailure(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			que := queueMocks.NewMockQueue(ctrl)
+			var (
+				que      = queueMocks.NewMockQueue(ctrl)
+				auditLog = auditMocks.NewMockLog(ctrl)
+			)
+
+			auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeFailed)
 			que.EXPECT().Failed(gomock.Any()).Return(queue.Result{}, errors.New("bad"))
 
 			consumer := &Consumer{}
+			consumer.log = auditLog
 			consumer.queue = que
 			consumer.logger = log.NewNopLogger()
 			consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
@@ -459,15 +1001,22 @@ func TestConsumerFailure(t *testing.T) {
 
 			var (
 				queue          = queueMocks.NewMockQueue(ctrl)
+				auditLog       = auditMocks.NewMockLog(ctrl)
 				failedSegments = metricsMocks.NewMockCounter(ctrl)
 				failedRecords  = metricsMocks.NewMockCounter(ctrl)
 			)
 
+			auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeFailed).Do(func(txn models.Transaction, outcome audit.Outcome) {
+				if expected, actual := 1, txn.Len(); expected != actual {
+					t.Errorf("expected: %d, actual: %d", expected, actual)
+				}
+			})
 			queue.EXPECT().Failed(gomock.Any())
 			failedSegments.EXPECT().Inc()
 			failedRecords.EXPECT().Add(float64(1))
 
 			consumer := &Consumer{}
+			consumer.log = auditLog
 			consumer.queue = queue
 			consumer.logger = log.NewNopLogger()
 			consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
@@ -485,30 +1034,353 @@ func TestConsumerFailure(t *testing.T) {
 			t.Error(err)
 		}
 	})
-}
 
-func TestConsumerCommit(t *testing.T) {
-	t.Parallel()
+	t.Run("failure with reason", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
 
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	t.Run("commit with log failure", func(t *testing.T) {
-		fn := func(id uuid.UUID) bool {
-			ctrl := gomock.NewController(t)
-			defer ctrl.Finish()
+		var (
+			que            = queueMocks.NewMockQueue(ctrl)
+			auditLog       = auditMocks.NewMockLog(ctrl)
+			failedSegments = metricsMocks.NewMockCounter(ctrl)
+			failedRecords  = metricsMocks.NewMockCounter(ctrl)
+		)
 
-			record, err := queue.GenerateQueueRecord(rnd)
-			if err != nil {
-				t.Fatal(err)
+		auditLog.EXPECT().Append(gomock.Any())
+		auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeFailed)
+		que.EXPECT().Commit(gomock.Any())
+		que.EXPECT().Failed(gomock.Any()).Do(func(txn models.Transaction) {
+			var reasons []string
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				reasons = append(reasons, queue.FailureReason(record))
+				return nil
+			})
+			if expected, actual := []string{"invalid status code: 503"}, reasons; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
 			}
+		})
+		failedSegments.EXPECT().Inc()
+		failedRecords.EXPECT().Add(float64(1))
 
-			var (
+		server := httptest.NewServer(nhttp.HandlerFunc(func(w nhttp.ResponseWriter, r *nhttp.Request) {
+			w.WriteHeader(nhttp.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+		consumer.client = http.NewClient(nhttp.DefaultClient, server.URL)
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+		consumer.failedSegments = failedSegments
+		consumer.failedRecords = failedRecords
+
+		if expected, actual := consumer.failure, consumer.replicate(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := consumer.gather, consumer.failure(); !funcEquality(expected, actual) {
+			t.Errorf("expected: %T, actual: %T", expected, actual)
+		}
+		if expected, actual := 0, len(consumer.reasons); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestConsumerHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("extend with no records", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		que := queueMocks.NewMockQueue(ctrl)
+
+		consumer := &Consumer{}
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+
+		consumer.extend()
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			que := queueMocks.NewMockQueue(ctrl)
+			que.EXPECT().Extend(gomock.Any()).Return(queue.Result{Success: 1}, nil)
+
+			consumer := &Consumer{}
+			consumer.queue = que
+			consumer.logger = log.NewNopLogger()
+			consumer.hold(id, record)
+
+			consumer.extend()
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("extend with failures", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				que               = queueMocks.NewMockQueue(ctrl)
+				heartbeatFailures = metricsMocks.NewMockCounter(ctrl)
+			)
+
+			que.EXPECT().Extend(gomock.Any()).Return(queue.Result{Failure: 1}, nil)
+			heartbeatFailures.EXPECT().Add(float64(1))
+
+			consumer := &Consumer{}
+			consumer.queue = que
+			consumer.logger = log.NewNopLogger()
+			consumer.heartbeatFailures = heartbeatFailures
+			consumer.hold(id, record)
+
+			consumer.extend()
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("extend with queue error", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				que               = queueMocks.NewMockQueue(ctrl)
+				heartbeatFailures = metricsMocks.NewMockCounter(ctrl)
+			)
+
+			que.EXPECT().Extend(gomock.Any()).Return(queue.Result{}, errors.New("bad"))
+			heartbeatFailures.EXPECT().Add(float64(1))
+
+			consumer := &Consumer{}
+			consumer.queue = que
+			consumer.logger = log.NewNopLogger()
+			consumer.heartbeatFailures = heartbeatFailures
+			consumer.hold(id, record)
+
+			consumer.extend()
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("extend stops after commit", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			que := queueMocks.NewMockQueue(ctrl)
+
+			consumer := &Consumer{}
+			consumer.queue = que
+			consumer.logger = log.NewNopLogger()
+			consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+			consumer.fifo.Add(id, record)
+			consumer.hold(id, record)
+
+			consumer.fifo.Partition(1, nil, func(uuid.UUID, models.Record) error {
+				return nil
+			})
+
+			consumer.extend()
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("extend stops after failure", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				que            = queueMocks.NewMockQueue(ctrl)
+				auditLog       = auditMocks.NewMockLog(ctrl)
+				failedSegments = metricsMocks.NewMockCounter(ctrl)
+				failedRecords  = metricsMocks.NewMockCounter(ctrl)
+			)
+
+			auditLog.EXPECT().AppendOutcome(gomock.Any(), audit.OutcomeFailed)
+			que.EXPECT().Failed(gomock.Any())
+			failedSegments.EXPECT().Inc()
+			failedRecords.EXPECT().Add(float64(1))
+
+			consumer := &Consumer{}
+			consumer.log = auditLog
+			consumer.queue = que
+			consumer.logger = log.NewNopLogger()
+			consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+			consumer.fifo.Add(id, record)
+			consumer.hold(id, record)
+			consumer.failedSegments = failedSegments
+			consumer.failedRecords = failedRecords
+
+			consumer.failure()
+			consumer.extend()
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			que      = queueMocks.NewMockQueue(ctrl)
+			extended = make(chan struct{}, 1)
+		)
+
+		que.EXPECT().Extend(gomock.Any()).Do(func(models.Transaction) {
+			select {
+			case extended <- struct{}{}:
+			default:
+			}
+		}).Return(queue.Result{Success: 1}, nil).AnyTimes()
+
+		consumer := &Consumer{}
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+		consumer.heartbeat = time.Millisecond
+		consumer.hold(record.ID(), record)
+
+		stop := consumer.startHeartbeat()
+
+		select {
+		case <-extended:
+		case <-time.After(time.Second):
+			t.Error("expected heartbeat to extend held records")
+		}
+
+		stop()
+	})
+}
+
+func TestConsumerCommit(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("commit with required log failure", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
 				queue = queueMocks.NewMockQueue(ctrl)
 				audit = auditMocks.NewMockLog(ctrl)
 			)
 
+			// A multi log only fails to append when a required log fails, so
+			// the records aren't committed.
 			audit.EXPECT().Append(gomock.Any()).Return(errors.New("bad"))
-			queue.EXPECT().Commit(gomock.Any())
+			queue.EXPECT().Commit(gomock.Any()).Times(0)
+
+			consumer := &Consumer{}
+			consumer.log = audit
+			consumer.queue = queue
+			consumer.logger = log.NewNopLogger()
+			consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+			consumer.fifo.Add(id, record)
+
+			err = consumer.commit(consumer.fifo.Slice())
+			if expected, actual := true, err != nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("commit with best effort log failure", func(t *testing.T) {
+		fn := func(id uuid.UUID) bool {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			record, err := queue.GenerateQueueRecord(rnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				queue = queueMocks.NewMockQueue(ctrl)
+				audit = auditMocks.NewMockLog(ctrl)
+			)
+
+			// A multi log only warns when a best effort log fails, so the
+			// append succeeds and the records are committed.
+			audit.EXPECT().Append(gomock.Any()).Return(nil)
+			queue.EXPECT().Commit(gomock.Any()).Times(1)
 
 			consumer := &Consumer{}
 			consumer.log = audit
@@ -529,6 +1401,40 @@ func TestConsumerCommit(t *testing.T) {
 		}
 	})
 
+	t.Run("commit with required log failure releases records", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			que = releasingQueue{
+				MockQueue:    queueMocks.NewMockQueue(ctrl),
+				MockReleaser: queueMocks.NewMockReleaser(ctrl),
+			}
+			auditLog = auditMocks.NewMockLog(ctrl)
+		)
+
+		auditLog.EXPECT().Append(gomock.Any()).Return(errors.New("bad"))
+		que.MockQueue.EXPECT().Commit(gomock.Any()).Times(0)
+		que.MockReleaser.EXPECT().Release(gomock.Any()).Return(queue.Result{Success: 1}, nil)
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+
+		err = consumer.commit(consumer.fifo.Slice())
+		if expected, actual := true, err != nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
 	t.Run("commit with cache failure", func(t *testing.T) {
 		fn := func(id uuid.UUID) bool {
 			ctrl := gomock.NewController(t)
@@ -603,6 +1509,59 @@ func TestConsumerCommit(t *testing.T) {
 		}
 	})
 
+	t.Run("commit with delivery", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		record, err := queue.GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			que      = queueMocks.NewMockQueue(ctrl)
+			auditLog = auditMocks.NewMockLog(ctrl)
+		)
+
+		var entries []audit.Entry
+		auditLog.EXPECT().Append(gomock.Any()).Do(func(txn models.Transaction) {
+			txn.Walk(func(id uuid.UUID, record models.Record) error {
+				entries = append(entries, audit.NewEntry(id, record, audit.OutcomeCommitted))
+				return nil
+			})
+		})
+		que.EXPECT().Commit(gomock.Any())
+
+		consumer := &Consumer{}
+		consumer.log = auditLog
+		consumer.queue = que
+		consumer.logger = log.NewNopLogger()
+		consumer.recipient = "recipient"
+		consumer.fifo = fifo.NewFIFO(consumer.onElementEviction)
+		consumer.fifo.Add(record.ID(), record)
+
+		consumer.delivered(record.ID(), record, nhttp.StatusOK)
+		if err := consumer.commit(consumer.fifo.Slice()); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "recipient", entries[0].Recipient; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := nhttp.StatusOK, entries[0].StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := false, entries[0].DeliveredAt.IsZero(); expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := 0, len(consumer.deliveries); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
 	t.Run("commit", func(t *testing.T) {
 		fn := func(id uuid.UUID) bool {
 			ctrl := gomock.NewController(t)
@@ -641,6 +1600,86 @@ func TestConsumerCommit(t *testing.T) {
 	})
 }
 
+func TestConfigBuild(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(attempts, concurrency uint8, base, max time.Duration, ordered bool) bool {
+			policy := RetryPolicy{
+				MaxAttempts: int(attempts),
+				BaseBackoff: base,
+				MaxBackoff:  max,
+				Jitter:      0.5,
+			}
+			config, err := Build(
+				WithRetryPolicy(policy),
+				WithConcurrency(int(concurrency)+1),
+				WithOrderedDelivery(ordered),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return reflect.DeepEqual(config.retry, policy) &&
+				config.concurrency == int(concurrency)+1 &&
+				config.ordered == ordered
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		_, err := Build(
+			WithRetryPolicy(RetryPolicy{
+				Jitter: 2,
+			}),
+		)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("invalid concurrency", func(t *testing.T) {
+		_, err := Build(
+			WithConcurrency(0),
+		)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		config, err := Build(
+			WithHeartbeat(time.Second),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := time.Second, config.heartbeat; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("invalid heartbeat", func(t *testing.T) {
+		_, err := Build(
+			WithHeartbeat(-time.Second),
+		)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("default concurrency", func(t *testing.T) {
+		config, err := Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := defaultConcurrency, config.concurrency; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
 func funcEquality(a, b stateFn) bool {
 	return runtime.FuncForPC(reflect.ValueOf(a).Pointer()).Name() ==
 		runtime.FuncForPC(reflect.ValueOf(b).Pointer()).Name()
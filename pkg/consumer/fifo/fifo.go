@@ -1,6 +1,9 @@
 package fifo
 
 import (
+	"sync"
+
+	"github.com/pkg/errors"
 	"github.com/trussle/courier/pkg/models"
 	"github.com/trussle/uuid"
 )
@@ -20,6 +23,9 @@ const (
 
 	// Dequeued by walking over due to being dequeued
 	Dequeued
+
+	// Skipped by walking over due to an earlier item with the same key failing
+	Skipped
 )
 
 type KeyValue struct {
@@ -30,6 +36,12 @@ type KeyValue struct {
 // EvictCallback lets you know when an eviction has happened in the cache
 type EvictCallback func(EvictionReason, uuid.UUID, models.Record)
 
+// KeyFunc returns the ordering key for a record, an empty key means the record
+// can be called in any order.
+type KeyFunc func(models.Record) string
+
+var errSkipped = errors.New("skipped")
+
 type FIFO struct {
 	items   []KeyValue
 	onEvict EvictCallback
@@ -125,6 +137,93 @@ func (f *FIFO) Slice() []KeyValue {
 	return f.items[0:]
 }
 
+// Partition iterates over the FIFO cache, calling fn for every item using up
+// to workers concurrent calls. Items that are successful are removed from the
+// cache, leaving only the items that failed with in the cache.
+//
+// If key is not nil, items that share the same non-empty key are called in
+// order on the same worker and the first failure causes the rest of the items
+// with that key to be skipped without calling fn. Skipped items are removed
+// from the cache. fn must be safe for concurrent use when workers is greater
+// than one.
+func (f *FIFO) Partition(workers int, key KeyFunc, fn func(uuid.UUID, models.Record) error) (dequeued, failed, skipped []KeyValue) {
+	errs := make([]error, len(f.items))
+
+	lanes := make(chan []int)
+	go func() {
+		for _, lane := range f.lanes(key) {
+			lanes <- lane
+		}
+		close(lanes)
+	}()
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for lane := range lanes {
+				for k, index := range lane {
+					v := f.items[index]
+					if errs[index] = fn(v.Key, v.Value); errs[index] != nil {
+						for _, index := range lane[k+1:] {
+							errs[index] = errSkipped
+						}
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for k, v := range f.items {
+		switch errs[k] {
+		case nil:
+			f.onEvict(Dequeued, v.Key, v.Value)
+			dequeued = append(dequeued, v)
+		case errSkipped:
+			f.onEvict(Skipped, v.Key, v.Value)
+			skipped = append(skipped, v)
+		default:
+			failed = append(failed, v)
+		}
+	}
+
+	f.items = append(f.items[:0], failed...)
+	return
+}
+
+// lanes groups the indexes of the items that need to be called in order. Items
+// with no key are given a lane of their own.
+func (f *FIFO) lanes(key KeyFunc) [][]int {
+	var (
+		lanes   [][]int
+		offsets = make(map[string]int)
+	)
+	for k, v := range f.items {
+		var group string
+		if key != nil {
+			group = key(v.Value)
+		}
+		if group == "" {
+			lanes = append(lanes, []int{k})
+			continue
+		}
+		if offset, ok := offsets[group]; ok {
+			lanes[offset] = append(lanes[offset], k)
+			continue
+		}
+		offsets[group] = len(lanes)
+		lanes = append(lanes, []int{k})
+	}
+	return lanes
+}
+
 // Dequeue iterates over the LRU cache removing an item upon each iteration.
 func (f *FIFO) Dequeue(fn func(uuid.UUID, models.Record) error) ([]KeyValue, error) {
 	var dequeued []KeyValue
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
 	"time"
@@ -519,18 +520,226 @@ func TestFIFO_Dequeue(t *testing.T) {
 	})
 }
 
+func TestFIFO_Partition(t *testing.T) {
+	t.Parallel()
+
+	t.Run("partition", func(t *testing.T) {
+		fn := func(id0, id1, id2 uuid.UUID, rec0, rec1, rec2 TestRecord) bool {
+			evictted := 0
+			onEviction := func(reason fifo.EvictionReason, k uuid.UUID, v models.Record) {
+				evictted += 1
+			}
+
+			l := fifo.NewFIFO(onEviction)
+
+			l.Add(id0, rec0)
+			l.Add(id1, rec1)
+			l.Add(id2, rec2)
+
+			values := []fifo.KeyValue{
+				fifo.KeyValue{id0, rec0},
+				fifo.KeyValue{id1, rec1},
+				fifo.KeyValue{id2, rec2},
+			}
+
+			dequeued, failed, _ := l.Partition(1, nil, func(key uuid.UUID, value models.Record) error {
+				return nil
+			})
+
+			if expected, actual := 3, evictted; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := values, dequeued; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := 0, len(failed); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := 0, l.Len(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("partition with error", func(t *testing.T) {
+		fn := func(id0, id1, id2 uuid.UUID, rec0, rec1, rec2 TestRecord) bool {
+			evictted := 0
+			onEviction := func(reason fifo.EvictionReason, k uuid.UUID, v models.Record) {
+				evictted += 1
+			}
+
+			l := fifo.NewFIFO(onEviction)
+
+			l.Add(id0, rec0)
+			l.Add(id1, rec1)
+			l.Add(id2, rec2)
+
+			dequeued, failed, _ := l.Partition(1, nil, func(key uuid.UUID, value models.Record) error {
+				if key.Equals(id1) {
+					return errors.New("bad")
+				}
+				return nil
+			})
+
+			if expected, actual := 2, evictted; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+
+			values := []fifo.KeyValue{
+				fifo.KeyValue{id0, rec0},
+				fifo.KeyValue{id2, rec2},
+			}
+			if expected, actual := values, dequeued; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+
+			values = []fifo.KeyValue{
+				fifo.KeyValue{id1, rec1},
+			}
+			if expected, actual := values, failed; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := values, l.Slice(); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("partition with workers", func(t *testing.T) {
+		fn := func(ids [10]uuid.UUID) bool {
+			l := fifo.NewFIFO(func(fifo.EvictionReason, uuid.UUID, models.Record) {})
+
+			for _, id := range ids {
+				l.Add(id, TestRecord{id: id})
+			}
+
+			var (
+				mutex  sync.Mutex
+				called = make(map[string]bool)
+			)
+			dequeued, failed, _ := l.Partition(4, nil, func(key uuid.UUID, value models.Record) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				called[key.String()] = true
+				if key.Equals(ids[3]) {
+					return errors.New("bad")
+				}
+				return nil
+			})
+
+			if expected, actual := len(ids), len(called); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := len(ids)-1, len(dequeued); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := []fifo.KeyValue{failed[0]}, l.Slice(); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := ids[3].String(), failed[0].Key.String(); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("partition with key ordering", func(t *testing.T) {
+		fn := func(ids [10]uuid.UUID) bool {
+			l := fifo.NewFIFO(func(fifo.EvictionReason, uuid.UUID, models.Record) {})
+
+			groups := []string{"a", "b"}
+			for k, id := range ids {
+				l.Add(id, TestRecord{id: id, groupID: groups[k%len(groups)]})
+			}
+
+			var (
+				mutex sync.Mutex
+				order = make(map[string][]string)
+			)
+			dequeued, failed, skipped := l.Partition(4, func(record models.Record) string {
+				return record.GroupID()
+			}, func(key uuid.UUID, value models.Record) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				order[value.GroupID()] = append(order[value.GroupID()], key.String())
+				if key.Equals(ids[5]) {
+					return errors.New("bad")
+				}
+				return nil
+			})
+
+			if expected, actual := []string{
+				ids[0].String(),
+				ids[2].String(),
+				ids[4].String(),
+				ids[6].String(),
+				ids[8].String(),
+			}, order["a"]; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+
+			// Everything after the failure in group b is skipped to keep the
+			// group in order.
+			if expected, actual := []string{
+				ids[1].String(),
+				ids[3].String(),
+				ids[5].String(),
+			}, order["b"]; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := 7, len(dequeued); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := []fifo.KeyValue{{ids[5], TestRecord{id: ids[5], groupID: "b"}}}, failed; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := 2, len(skipped); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := failed, l.Slice(); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
 type TestRecord struct {
 	id        uuid.UUID
 	messageID string
 	receipt   models.Receipt
 	body      []byte
 	timestamp time.Time
+	attempts  int
+	groupID   string
 }
 
 func (t TestRecord) ID() uuid.UUID           { return t.id }
 func (t TestRecord) Body() []byte            { return t.body }
 func (t TestRecord) RecordID() string        { return t.messageID }
 func (t TestRecord) Receipt() models.Receipt { return t.receipt }
+func (t TestRecord) Attempts() int           { return t.attempts }
+func (t TestRecord) GroupID() string         { return t.groupID }
+func (t TestRecord) ReceivedAt() time.Time   { return t.timestamp }
+
+func (t TestRecord) Attributes() map[string]string       { return nil }
+func (t TestRecord) SystemAttributes() map[string]string { return nil }
 
 func (t TestRecord) Commit(txn models.Transaction) error {
 	return txn.Push(t.id, t)
@@ -590,5 +799,8 @@ func generate(rnd *rand.Rand) (rec TestRecord, err error) {
 	// Timestamp generation
 	rec.timestamp = time.Now().Round(time.Millisecond)
 
+	// Attempts generation
+	rec.attempts = 1
+
 	return
 }
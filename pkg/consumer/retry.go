@@ -0,0 +1,140 @@
+package consumer
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+)
+
+var errAttemptsExhausted = errors.New("attempts exhausted")
+
+// RetryPolicy describes how many times the delivery of a record is attempted
+// before it's considered failed, along with how long to back off between each
+// of those attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts a record has, every time a
+	// record has previously been received counts as a used attempt. Anything
+	// less than one means only attempt once and never give up on redelivery.
+	MaxAttempts int
+
+	// BaseBackoff is the backoff after the first attempt, which then doubles
+	// for every subsequent attempt up to MaxBackoff.
+	BaseBackoff, MaxBackoff time.Duration
+
+	// Jitter is the fraction (0.0 to 1.0) of the backoff that is randomly
+	// removed, so that failing consumers don't retry in lockstep.
+	Jitter float64
+}
+
+// Remaining returns the number of attempts that are left for a record.
+func (p RetryPolicy) Remaining(record models.Record) int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+
+	previous := record.Attempts() - 1
+	if previous < 0 {
+		previous = 0
+	}
+	return p.MaxAttempts - previous
+}
+
+// Backoff returns how long to wait after a number of failed attempts.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 || p.BaseBackoff <= 0 {
+		return 0
+	}
+
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	if jitter := clamp(p.Jitter, 0, 1); jitter > 0 {
+		backoff -= time.Duration(rand.Float64() * jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// Do calls fn until it succeeds or the record has no more attempts remaining.
+// If the record has already exhausted all of it's attempts, fn is never
+// called.
+func (p RetryPolicy) Do(record models.Record, fn func() error) error {
+	remaining := p.Remaining(record)
+	if remaining < 1 {
+		return errAttemptsExhausted
+	}
+
+	var err error
+	for attempt := 1; attempt <= remaining; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < remaining {
+			time.Sleep(p.Backoff(attempt))
+		}
+	}
+	return errors.Wrap(err, "retry")
+}
+
+// DoBatch calls fn with the records that still need attempting until every
+// record succeeds or has no more attempts remaining. fn reports which of the
+// records it was given succeeded, an error fails all of them. DoBatch returns
+// which of the records succeeded.
+func (p RetryPolicy) DoBatch(records []models.Record, fn func([]models.Record) ([]bool, error)) []bool {
+	var (
+		succeeded = make([]bool, len(records))
+		remaining = make([]int, len(records))
+	)
+	for k, v := range records {
+		remaining[k] = p.Remaining(v)
+	}
+
+	for attempt := 1; ; attempt++ {
+		var (
+			indexes []int
+			pending []models.Record
+		)
+		for k, v := range records {
+			if !succeeded[k] && remaining[k] >= attempt {
+				indexes = append(indexes, k)
+				pending = append(pending, v)
+			}
+		}
+		if len(pending) == 0 {
+			return succeeded
+		}
+
+		if attempt > 1 {
+			time.Sleep(p.Backoff(attempt - 1))
+		}
+
+		accepted, err := fn(pending)
+		if err != nil {
+			continue
+		}
+		for k, index := range indexes {
+			if k < len(accepted) && accepted[k] {
+				succeeded[index] = true
+			}
+		}
+	}
+}
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
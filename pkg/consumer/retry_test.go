@@ -0,0 +1,169 @@
+package consumer
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("remaining with no max attempts", func(t *testing.T) {
+		fn := func(id uuid.UUID, attempts uint8) bool {
+			record := queue.NewRecord(id, "", "", nil, time.Now(), nil, receiveCount(int(attempts)))
+			return RetryPolicy{}.Remaining(record) == 1
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("remaining", func(t *testing.T) {
+		fn := func(id uuid.UUID, max, attempts uint8) bool {
+			var (
+				policy = RetryPolicy{MaxAttempts: int(max) + 1}
+				record = queue.NewRecord(id, "", "", nil, time.Now(), nil, receiveCount(int(attempts)+1))
+			)
+			return policy.Remaining(record) == int(max)+1-int(attempts)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		policy := RetryPolicy{
+			BaseBackoff: time.Millisecond,
+			MaxBackoff:  time.Millisecond * 5,
+		}
+		for attempt, expected := range []time.Duration{
+			0,
+			time.Millisecond,
+			time.Millisecond * 2,
+			time.Millisecond * 4,
+			time.Millisecond * 5,
+			time.Millisecond * 5,
+		} {
+			if actual := policy.Backoff(attempt); expected != actual {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		}
+	})
+
+	t.Run("backoff with jitter", func(t *testing.T) {
+		fn := func(attempt uint8) bool {
+			policy := RetryPolicy{
+				BaseBackoff: time.Millisecond,
+				MaxBackoff:  time.Second,
+				Jitter:      0.5,
+			}
+			backoff := policy.Backoff(int(attempt) + 1)
+			return backoff > 0 && backoff <= time.Second
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("do", func(t *testing.T) {
+		fn := func(id uuid.UUID, failures uint8) bool {
+			var (
+				calls  int
+				policy = RetryPolicy{MaxAttempts: int(failures) + 1}
+				record = queue.NewRecord(id, "", "", nil, time.Now(), nil, receiveCount(1))
+			)
+			err := policy.Do(record, func() error {
+				if calls++; calls <= int(failures) {
+					return errors.New("bad")
+				}
+				return nil
+			})
+			return err == nil && calls == int(failures)+1
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("do with failures", func(t *testing.T) {
+		fn := func(id uuid.UUID, max uint8) bool {
+			var (
+				calls  int
+				policy = RetryPolicy{MaxAttempts: int(max) + 1}
+				record = queue.NewRecord(id, "", "", nil, time.Now(), nil, receiveCount(1))
+			)
+			err := policy.Do(record, func() error {
+				calls++
+				return errors.New("bad")
+			})
+			return err != nil && calls == int(max)+1
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("do with exhausted attempts", func(t *testing.T) {
+		fn := func(id uuid.UUID, max uint8) bool {
+			var (
+				calls  int
+				policy = RetryPolicy{MaxAttempts: int(max) + 1}
+				record = queue.NewRecord(id, "", "", nil, time.Now(), nil, receiveCount(int(max)+2))
+			)
+			err := policy.Do(record, func() error {
+				calls++
+				return nil
+			})
+			return err == errAttemptsExhausted && calls == 0
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("do batch", func(t *testing.T) {
+		fn := func(id0, id1, id2 uuid.UUID) bool {
+			var (
+				calls   []int
+				policy  = RetryPolicy{MaxAttempts: 3}
+				records = []models.Record{
+					queue.NewRecord(id0, "", "", nil, time.Now(), nil, receiveCount(1)),
+					queue.NewRecord(id1, "", "", nil, time.Now(), nil, receiveCount(1)),
+					queue.NewRecord(id2, "", "", nil, time.Now(), nil, receiveCount(3)),
+				}
+			)
+			succeeded := policy.DoBatch(records, func(pending []models.Record) ([]bool, error) {
+				calls = append(calls, len(pending))
+				if len(calls) == 1 {
+					return nil, errors.New("bad")
+				}
+				// Only ever accept the first of the pending records.
+				accepted := make([]bool, len(pending))
+				accepted[0] = true
+				return accepted, nil
+			})
+
+			// The last record only has one attempt remaining, so it's only part
+			// of the first failed batch.
+			return reflect.DeepEqual(calls, []int{3, 2, 1}) &&
+				reflect.DeepEqual(succeeded, []bool{true, true, false})
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func receiveCount(attempts int) map[string]string {
+	return map[string]string{
+		"ApproximateReceiveCount": strconv.Itoa(attempts),
+	}
+}
@@ -0,0 +1,183 @@
+package fakeaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	firehoseTargetPrefix = "Firehose_20150804."
+	firehoseContentType  = "application/x-amz-json-1.1"
+)
+
+// Firehose is an in memory fake of the Firehose API, covering the actions
+// courier uses. Records put on a stream are kept, so they can be inspected.
+type Firehose struct {
+	mutex   sync.Mutex
+	streams map[string][][]byte
+	rejects int
+}
+
+// NewFirehose creates a Firehose without any delivery streams.
+func NewFirehose() *Firehose {
+	return &Firehose{
+		streams: make(map[string][][]byte),
+	}
+}
+
+// CreateStream creates a delivery stream with the name, if it doesn't already
+// exist.
+func (f *Firehose) CreateStream(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.streams[name]; !ok {
+		f.streams[name] = make([][]byte, 0)
+	}
+}
+
+// Records returns the data of all the records put on the delivery stream.
+func (f *Firehose) Records(name string) [][]byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	records := f.streams[name]
+	res := make([][]byte, len(records))
+	copy(res, records)
+	return res
+}
+
+// RejectRecords makes the next n records put in a batch fail, as if Firehose
+// was throttling them, so that partial failures can be tested.
+func (f *Firehose) RejectRecords(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.rejects = n
+}
+
+func (f *Firehose) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, firehoseTargetPrefix) {
+		writeFirehoseError(w, "UnknownOperationException", fmt.Sprintf("Unknown target %q.", target))
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch action := strings.TrimPrefix(target, firehoseTargetPrefix); action {
+	case "PutRecord":
+		f.handlePutRecord(w, r)
+	case "PutRecordBatch":
+		f.handlePutRecordBatch(w, r)
+	default:
+		writeFirehoseError(w, "UnknownOperationException", fmt.Sprintf("Unknown operation %q.", action))
+	}
+}
+
+type firehoseRecord struct {
+	Data []byte
+}
+
+func (f *Firehose) handlePutRecord(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeliveryStreamName string
+		Record             firehoseRecord
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeFirehoseError(w, "SerializationException", err.Error())
+		return
+	}
+
+	records, ok := f.streams[input.DeliveryStreamName]
+	if !ok {
+		writeFirehoseError(w, "ResourceNotFoundException", fmt.Sprintf("Stream %s not found.", input.DeliveryStreamName))
+		return
+	}
+	f.streams[input.DeliveryStreamName] = append(records, input.Record.Data)
+
+	writeJSON(w, http.StatusOK, struct {
+		RecordID  string `json:"RecordId"`
+		Encrypted bool
+	}{
+		RecordID: newID(),
+	})
+}
+
+func (f *Firehose) handlePutRecordBatch(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeliveryStreamName string
+		Records            []firehoseRecord
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeFirehoseError(w, "SerializationException", err.Error())
+		return
+	}
+
+	records, ok := f.streams[input.DeliveryStreamName]
+	if !ok {
+		writeFirehoseError(w, "ResourceNotFoundException", fmt.Sprintf("Stream %s not found.", input.DeliveryStreamName))
+		return
+	}
+
+	type response struct {
+		RecordID     string `json:"RecordId,omitempty"`
+		ErrorCode    string `json:",omitempty"`
+		ErrorMessage string `json:",omitempty"`
+	}
+	var (
+		failed    int
+		responses = make([]response, len(input.Records))
+	)
+	for k, v := range input.Records {
+		if f.rejects > 0 {
+			f.rejects--
+			failed++
+			responses[k] = response{
+				ErrorCode:    "ServiceUnavailableException",
+				ErrorMessage: "Slow down.",
+			}
+			continue
+		}
+		records = append(records, v.Data)
+		responses[k] = response{RecordID: newID()}
+	}
+	f.streams[input.DeliveryStreamName] = records
+
+	writeJSON(w, http.StatusOK, struct {
+		Encrypted        bool
+		FailedPutCount   int
+		RequestResponses []response
+	}{
+		FailedPutCount:   failed,
+		RequestResponses: responses,
+	})
+}
+
+func writeFirehoseError(w http.ResponseWriter, code, message string) {
+	writeJSON(w, http.StatusBadRequest, struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}{
+		Type:    code,
+		Message: message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", firehoseContentType)
+	w.WriteHeader(status)
+	w.Write(b)
+}
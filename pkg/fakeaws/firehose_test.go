@@ -0,0 +1,157 @@
+package fakeaws
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func TestFirehose(t *testing.T) {
+	t.Parallel()
+
+	t.Run("put record batch", func(t *testing.T) {
+		fn := func(data [][]byte) bool {
+			if len(data) == 0 {
+				return true
+			}
+
+			firehose := NewFirehose()
+			firehose.CreateStream("stream")
+
+			server := httptest.NewServer(firehose)
+			defer server.Close()
+
+			records := make([]firehoseRecord, len(data))
+			for k, v := range data {
+				records[k] = firehoseRecord{v}
+			}
+
+			var res struct {
+				FailedPutCount   int
+				RequestResponses []struct {
+					RecordID string `json:"RecordId"`
+				}
+			}
+			target(t, server.URL, "PutRecordBatch", map[string]interface{}{
+				"DeliveryStreamName": "stream",
+				"Records":            records,
+			}, http.StatusOK, &res)
+
+			if expected, actual := 0, res.FailedPutCount; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := len(data), len(res.RequestResponses); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+
+			actual := firehose.Records("stream")
+			for k, v := range data {
+				if !bytes.Equal(v, actual[k]) {
+					return false
+				}
+			}
+			return len(data) == len(actual)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("put record batch with rejected records", func(t *testing.T) {
+		firehose := NewFirehose()
+		firehose.CreateStream("stream")
+		firehose.RejectRecords(1)
+
+		server := httptest.NewServer(firehose)
+		defer server.Close()
+
+		var res struct {
+			FailedPutCount   int
+			RequestResponses []struct {
+				RecordID  string `json:"RecordId"`
+				ErrorCode string
+			}
+		}
+		target(t, server.URL, "PutRecordBatch", map[string]interface{}{
+			"DeliveryStreamName": "stream",
+			"Records":            []firehoseRecord{{[]byte("a")}, {[]byte("b")}},
+		}, http.StatusOK, &res)
+
+		if expected, actual := 1, res.FailedPutCount; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "ServiceUnavailableException", res.RequestResponses[0].ErrorCode; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := [][]byte{[]byte("b")}, firehose.Records("stream"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put record", func(t *testing.T) {
+		firehose := NewFirehose()
+		firehose.CreateStream("stream")
+
+		server := httptest.NewServer(firehose)
+		defer server.Close()
+
+		target(t, server.URL, "PutRecord", map[string]interface{}{
+			"DeliveryStreamName": "stream",
+			"Record":             firehoseRecord{[]byte("data")},
+		}, http.StatusOK, nil)
+
+		if expected, actual := [][]byte{[]byte("data")}, firehose.Records("stream"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put record with unknown stream", func(t *testing.T) {
+		server := httptest.NewServer(NewFirehose())
+		defer server.Close()
+
+		var res struct {
+			Type string `json:"__type"`
+		}
+		target(t, server.URL, "PutRecordBatch", map[string]interface{}{
+			"DeliveryStreamName": "stream",
+		}, http.StatusBadRequest, &res)
+
+		if expected, actual := "ResourceNotFoundException", res.Type; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+}
+
+func target(t *testing.T, endpoint, action string, input interface{}, status int, v interface{}) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", firehoseContentType)
+	req.Header.Set("X-Amz-Target", firehoseTargetPrefix+action)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if expected, actual := status, resp.StatusCode; expected != actual {
+		t.Fatalf("expected: %d, actual: %d", expected, actual)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
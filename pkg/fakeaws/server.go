@@ -0,0 +1,50 @@
+package fakeaws
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Server is a fake of the AWS services used by courier, so that it can be
+// run and tested without AWS. Requests are routed to SQS, unless they're
+// targeted at Firehose.
+type Server struct {
+	SQS      *SQS
+	Firehose *Firehose
+}
+
+// NewServer creates a Server with a SQS and Firehose that are both empty.
+func NewServer() *Server {
+	return &Server{
+		SQS:      NewSQS(),
+		Firehose: NewFirehose(),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Target") != "" {
+		s.Firehose.ServeHTTP(w, r)
+		return
+	}
+	s.SQS.ServeHTTP(w, r)
+}
+
+// newID returns a random id, formatted like the ids handed out by AWS.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,31 @@
+package fakeaws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer()
+	s.SQS.CreateQueue("queue")
+	s.Firehose.CreateStream("stream")
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	send(t, server.URL, server.URL+"/"+accountID+"/queue", "body")
+	target(t, server.URL, "PutRecord", map[string]interface{}{
+		"DeliveryStreamName": "stream",
+		"Record":             firehoseRecord{[]byte("data")},
+	}, http.StatusOK, nil)
+
+	if expected, actual := 1, s.SQS.Len("queue"); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+	if expected, actual := 1, len(s.Firehose.Records("stream")); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+}
@@ -0,0 +1,717 @@
+package fakeaws
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sqsNamespace = "http://queue.amazonaws.com/doc/2012-11-05/"
+	accountID    = "000000000000"
+
+	defaultVisibilityTimeout = 30 * time.Second
+	maxBatchEntries          = 10
+
+	allAttributes = "All"
+	fifoSuffix    = ".fifo"
+)
+
+// SQS is an in memory fake of the SQS query API, covering the actions courier
+// uses. Long polling isn't supported, so receives always return straight away.
+type SQS struct {
+	mutex  sync.Mutex
+	queues map[string]*sqsQueue
+	now    func() time.Time
+}
+
+// NewSQS creates a SQS without any queues.
+func NewSQS() *SQS {
+	return &SQS{
+		queues: make(map[string]*sqsQueue),
+		now:    time.Now,
+	}
+}
+
+// CreateQueue creates a queue with the name, if it doesn't already exist. A
+// name ending in ".fifo" creates a FIFO queue.
+func (s *SQS) CreateQueue(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.createQueue(name)
+}
+
+// Len returns the number of messages on the queue, including the messages that
+// aren't visible.
+func (s *SQS) Len(name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if q, ok := s.queues[name]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+func (s *SQS) createQueue(name string) *sqsQueue {
+	if q, ok := s.queues[name]; ok {
+		return q
+	}
+
+	q := &sqsQueue{
+		fifo:         strings.HasSuffix(name, fifoSuffix),
+		deduplicated: make(map[string]string),
+	}
+	s.queues[name] = q
+	return q
+}
+
+func (s *SQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := r.ParseForm(); err != nil {
+		writeSQSError(w, "MalformedQueryString", err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch action := r.Form.Get("Action"); action {
+	case "CreateQueue":
+		name := r.Form.Get("QueueName")
+		s.createQueue(name)
+		writeSQSResult(w, action, queueURLResult{
+			XMLName:  xml.Name{Local: "CreateQueueResult"},
+			QueueURL: queueURL(r, name),
+		})
+	case "GetQueueUrl":
+		name := r.Form.Get("QueueName")
+		if _, ok := s.queues[name]; !ok {
+			writeSQSError(w, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+			return
+		}
+		writeSQSResult(w, action, queueURLResult{
+			XMLName:  xml.Name{Local: "GetQueueUrlResult"},
+			QueueURL: queueURL(r, name),
+		})
+	case "SendMessage":
+		s.handleSendMessage(w, r)
+	case "SendMessageBatch":
+		s.handleSendMessageBatch(w, r)
+	case "ReceiveMessage":
+		s.handleReceiveMessage(w, r)
+	case "DeleteMessage":
+		s.handleDeleteMessage(w, r)
+	case "DeleteMessageBatch":
+		s.handleDeleteMessageBatch(w, r)
+	case "ChangeMessageVisibility":
+		s.handleChangeMessageVisibility(w, r)
+	case "ChangeMessageVisibilityBatch":
+		s.handleChangeMessageVisibilityBatch(w, r)
+	default:
+		writeSQSError(w, "InvalidAction", fmt.Sprintf("The action %s is not valid for this endpoint.", action))
+	}
+}
+
+func (s *SQS) queue(w http.ResponseWriter, r *http.Request) (*sqsQueue, bool) {
+	raw := r.Form.Get("QueueUrl")
+	if raw == "" {
+		// Requests can also be sent to the queue url itself.
+		raw = r.URL.Path
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		writeSQSError(w, "InvalidAddress", err.Error())
+		return nil, false
+	}
+
+	q, ok := s.queues[path.Base(u.Path)]
+	if !ok {
+		writeSQSError(w, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+		return nil, false
+	}
+	return q, true
+}
+
+func (s *SQS) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	msg, err := q.send(s.now(), r.Form)
+	if err != nil {
+		writeSQSError(w, err.code, err.message)
+		return
+	}
+
+	writeSQSResult(w, "SendMessage", sendMessageResult{
+		MessageID:        msg.id,
+		MD5OfMessageBody: msg.md5,
+	})
+}
+
+func (s *SQS) handleSendMessageBatch(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	entries, ok := batchEntries(w, r.Form, "SendMessageBatchRequestEntry")
+	if !ok {
+		return
+	}
+
+	result := batchResult{
+		XMLName: xml.Name{Local: "SendMessageBatchResult"},
+	}
+	for _, entry := range entries {
+		msg, err := q.send(s.now(), entry)
+		if err != nil {
+			result.Failed = append(result.Failed, err.entry(entry.Get("Id")))
+			continue
+		}
+		result.Successful = append(result.Successful, batchResultEntry{
+			XMLName:          xml.Name{Local: "SendMessageBatchResultEntry"},
+			ID:               entry.Get("Id"),
+			MessageID:        msg.id,
+			MD5OfMessageBody: msg.md5,
+		})
+	}
+
+	writeSQSResult(w, "SendMessageBatch", result)
+}
+
+func (s *SQS) handleReceiveMessage(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	max := 1
+	if v := r.Form.Get("MaxNumberOfMessages"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxBatchEntries {
+			writeSQSError(w, "InvalidParameterValue", fmt.Sprintf("Value %s for parameter MaxNumberOfMessages is invalid.", v))
+			return
+		}
+		max = n
+	}
+
+	timeout := defaultVisibilityTimeout
+	if v := r.Form.Get("VisibilityTimeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeSQSError(w, "InvalidParameterValue", fmt.Sprintf("Value %s for parameter VisibilityTimeout is invalid.", v))
+			return
+		}
+		timeout = time.Duration(n) * time.Second
+	}
+
+	var (
+		attributeNames        = list(r.Form, "AttributeName")
+		messageAttributeNames = list(r.Form, "MessageAttributeName")
+	)
+
+	var result receiveMessageResult
+	for _, msg := range q.receive(s.now(), max, timeout) {
+		received := receivedMessage{
+			MessageID:     msg.id,
+			ReceiptHandle: msg.receipt,
+			MD5OfBody:     msg.md5,
+			Body:          msg.body,
+		}
+		system := msg.systemAttributes()
+		for _, name := range sortedKeys(system) {
+			if selected(attributeNames, name) {
+				received.Attributes = append(received.Attributes, attribute{
+					Name:  name,
+					Value: system[name],
+				})
+			}
+		}
+		for _, name := range msg.attributeNames() {
+			if selected(messageAttributeNames, name) {
+				received.MessageAttributes = append(received.MessageAttributes, messageAttribute{
+					Name:  name,
+					Value: msg.attributes[name],
+				})
+			}
+		}
+		result.Messages = append(result.Messages, received)
+	}
+
+	writeSQSResult(w, "ReceiveMessage", result)
+}
+
+func (s *SQS) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := q.delete(r.Form.Get("ReceiptHandle")); err != nil {
+		writeSQSError(w, err.code, err.message)
+		return
+	}
+
+	writeSQSResponse(w, "DeleteMessage")
+}
+
+func (s *SQS) handleDeleteMessageBatch(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	entries, ok := batchEntries(w, r.Form, "DeleteMessageBatchRequestEntry")
+	if !ok {
+		return
+	}
+
+	result := batchResult{
+		XMLName: xml.Name{Local: "DeleteMessageBatchResult"},
+	}
+	for _, entry := range entries {
+		if err := q.delete(entry.Get("ReceiptHandle")); err != nil {
+			result.Failed = append(result.Failed, err.entry(entry.Get("Id")))
+			continue
+		}
+		result.Successful = append(result.Successful, batchResultEntry{
+			XMLName: xml.Name{Local: "DeleteMessageBatchResultEntry"},
+			ID:      entry.Get("Id"),
+		})
+	}
+
+	writeSQSResult(w, "DeleteMessageBatch", result)
+}
+
+func (s *SQS) handleChangeMessageVisibility(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	if err := q.changeVisibility(s.now(), r.Form); err != nil {
+		writeSQSError(w, err.code, err.message)
+		return
+	}
+
+	writeSQSResponse(w, "ChangeMessageVisibility")
+}
+
+func (s *SQS) handleChangeMessageVisibilityBatch(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.queue(w, r)
+	if !ok {
+		return
+	}
+
+	entries, ok := batchEntries(w, r.Form, "ChangeMessageVisibilityBatchRequestEntry")
+	if !ok {
+		return
+	}
+
+	result := batchResult{
+		XMLName: xml.Name{Local: "ChangeMessageVisibilityBatchResult"},
+	}
+	for _, entry := range entries {
+		if err := q.changeVisibility(s.now(), entry); err != nil {
+			result.Failed = append(result.Failed, err.entry(entry.Get("Id")))
+			continue
+		}
+		result.Successful = append(result.Successful, batchResultEntry{
+			XMLName: xml.Name{Local: "ChangeMessageVisibilityBatchResultEntry"},
+			ID:      entry.Get("Id"),
+		})
+	}
+
+	writeSQSResult(w, "ChangeMessageVisibilityBatch", result)
+}
+
+type sqsQueue struct {
+	fifo         bool
+	messages     []*sqsMessage
+	deduplicated map[string]string
+}
+
+type sqsMessage struct {
+	id, body, md5   string
+	groupID         string
+	deduplicationID string
+	attributes      map[string]messageAttributeValue
+	sentAt          time.Time
+	firstReceivedAt time.Time
+	receiveCount    int
+	receipt         string
+	visibleAt       time.Time
+}
+
+type sqsError struct {
+	code, message string
+}
+
+func (e *sqsError) entry(id string) batchErrorEntry {
+	return batchErrorEntry{
+		ID:          id,
+		Code:        e.code,
+		Message:     e.message,
+		SenderFault: true,
+	}
+}
+
+func (q *sqsQueue) send(now time.Time, params url.Values) (*sqsMessage, *sqsError) {
+	body := params.Get("MessageBody")
+	if body == "" {
+		return nil, &sqsError{"MissingParameter", "The request must contain the parameter MessageBody."}
+	}
+
+	var (
+		groupID         = params.Get("MessageGroupId")
+		deduplicationID = params.Get("MessageDeduplicationId")
+	)
+	if q.fifo {
+		if groupID == "" {
+			return nil, &sqsError{"MissingParameter", "The request must contain the parameter MessageGroupId."}
+		}
+		if deduplicationID == "" {
+			return nil, &sqsError{"InvalidParameterValue", "The queue should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly."}
+		}
+	}
+
+	sum := md5.Sum([]byte(body))
+	msg := &sqsMessage{
+		id:              newID(),
+		body:            body,
+		md5:             hex.EncodeToString(sum[:]),
+		groupID:         groupID,
+		deduplicationID: deduplicationID,
+		attributes:      make(map[string]messageAttributeValue),
+		sentAt:          now,
+	}
+	for _, attr := range members(params, "MessageAttribute") {
+		msg.attributes[attr.Get("Name")] = messageAttributeValue{
+			DataType:    attr.Get("Value.DataType"),
+			StringValue: attr.Get("Value.StringValue"),
+			BinaryValue: attr.Get("Value.BinaryValue"),
+		}
+	}
+
+	if q.fifo {
+		// Messages with the same deduplication id are accepted, but only
+		// delivered once.
+		if id, ok := q.deduplicated[deduplicationID]; ok {
+			msg.id = id
+			return msg, nil
+		}
+		q.deduplicated[deduplicationID] = msg.id
+	}
+
+	q.messages = append(q.messages, msg)
+	return msg, nil
+}
+
+func (q *sqsQueue) receive(now time.Time, max int, timeout time.Duration) []*sqsMessage {
+	var (
+		res []*sqsMessage
+		// held are the groups of a FIFO queue that have a message in flight,
+		// no other messages are delivered from them until it's done.
+		held = make(map[string]bool)
+	)
+	for _, msg := range q.messages {
+		if len(res) >= max {
+			break
+		}
+
+		visible := !msg.visibleAt.After(now)
+		if q.fifo && (held[msg.groupID] || !visible) {
+			held[msg.groupID] = true
+			continue
+		}
+		if !visible {
+			continue
+		}
+
+		if msg.firstReceivedAt.IsZero() {
+			msg.firstReceivedAt = now
+		}
+		msg.receiveCount++
+		msg.receipt = newID()
+		msg.visibleAt = now.Add(timeout)
+
+		res = append(res, msg)
+	}
+	return res
+}
+
+func (q *sqsQueue) delete(receipt string) *sqsError {
+	for k, msg := range q.messages {
+		if receipt != "" && msg.receipt == receipt {
+			q.messages = append(q.messages[:k], q.messages[k+1:]...)
+			return nil
+		}
+	}
+	return &sqsError{"ReceiptHandleIsInvalid", fmt.Sprintf("The receipt handle %q is not valid.", receipt)}
+}
+
+func (q *sqsQueue) changeVisibility(now time.Time, params url.Values) *sqsError {
+	var (
+		receipt = params.Get("ReceiptHandle")
+		raw     = params.Get("VisibilityTimeout")
+	)
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds < 0 {
+		return &sqsError{"InvalidParameterValue", fmt.Sprintf("Value %s for parameter VisibilityTimeout is invalid.", raw)}
+	}
+
+	for _, msg := range q.messages {
+		if receipt == "" || msg.receipt != receipt {
+			continue
+		}
+		if !msg.visibleAt.After(now) {
+			return &sqsError{"AWS.SimpleQueueService.MessageNotInflight", "The message referred to isn't in flight."}
+		}
+		msg.visibleAt = now.Add(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	return &sqsError{"ReceiptHandleIsInvalid", fmt.Sprintf("The receipt handle %q is not valid.", receipt)}
+}
+
+func (m *sqsMessage) systemAttributes() map[string]string {
+	attributes := map[string]string{
+		"SentTimestamp":                    millis(m.sentAt),
+		"ApproximateReceiveCount":          strconv.Itoa(m.receiveCount),
+		"ApproximateFirstReceiveTimestamp": millis(m.firstReceivedAt),
+	}
+	if m.groupID != "" {
+		attributes["MessageGroupId"] = m.groupID
+	}
+	if m.deduplicationID != "" {
+		attributes["MessageDeduplicationId"] = m.deduplicationID
+	}
+	return attributes
+}
+
+func (m *sqsMessage) attributeNames() []string {
+	names := make([]string, 0, len(m.attributes))
+	for k := range m.attributes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Responses, as described by the SQS query API.
+
+type responseMetadata struct {
+	RequestID string `xml:"RequestId"`
+}
+
+type sqsResponse struct {
+	XMLName  xml.Name
+	Xmlns    string           `xml:"xmlns,attr"`
+	Result   interface{}      `xml:",omitempty"`
+	Metadata responseMetadata `xml:"ResponseMetadata"`
+}
+
+type queueURLResult struct {
+	XMLName  xml.Name
+	QueueURL string `xml:"QueueUrl"`
+}
+
+type sendMessageResult struct {
+	XMLName          struct{} `xml:"SendMessageResult"`
+	MessageID        string   `xml:"MessageId"`
+	MD5OfMessageBody string
+}
+
+type receiveMessageResult struct {
+	XMLName  struct{}          `xml:"ReceiveMessageResult"`
+	Messages []receivedMessage `xml:"Message"`
+}
+
+type receivedMessage struct {
+	MessageID         string `xml:"MessageId"`
+	ReceiptHandle     string
+	MD5OfBody         string
+	Body              string
+	Attributes        []attribute        `xml:"Attribute"`
+	MessageAttributes []messageAttribute `xml:"MessageAttribute"`
+}
+
+type attribute struct {
+	Name, Value string
+}
+
+type messageAttribute struct {
+	Name  string
+	Value messageAttributeValue
+}
+
+type messageAttributeValue struct {
+	DataType    string
+	StringValue string `xml:",omitempty"`
+	BinaryValue string `xml:",omitempty"`
+}
+
+type batchResult struct {
+	XMLName    xml.Name
+	Successful []batchResultEntry
+	Failed     []batchErrorEntry `xml:"BatchResultErrorEntry"`
+}
+
+type batchResultEntry struct {
+	XMLName          xml.Name
+	ID               string `xml:"Id"`
+	MessageID        string `xml:"MessageId,omitempty"`
+	MD5OfMessageBody string `xml:",omitempty"`
+}
+
+type batchErrorEntry struct {
+	ID          string `xml:"Id"`
+	Code        string
+	Message     string
+	SenderFault bool
+}
+
+type sqsErrorResponse struct {
+	XMLName   struct{} `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func writeSQSResponse(w http.ResponseWriter, action string) {
+	writeSQSResult(w, action, nil)
+}
+
+func writeSQSResult(w http.ResponseWriter, action string, result interface{}) {
+	writeXML(w, http.StatusOK, sqsResponse{
+		XMLName:  xml.Name{Local: action + "Response"},
+		Xmlns:    sqsNamespace,
+		Result:   result,
+		Metadata: responseMetadata{newID()},
+	})
+}
+
+func writeSQSError(w http.ResponseWriter, code, message string) {
+	writeXML(w, http.StatusBadRequest, sqsErrorResponse{
+		Type:      "Sender",
+		Code:      code,
+		Message:   message,
+		RequestID: newID(),
+	})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+// batchEntries returns the entries of a batch request, or writes an error if
+// the number of entries isn't valid.
+func batchEntries(w http.ResponseWriter, form url.Values, prefix string) ([]url.Values, bool) {
+	entries := members(form, prefix)
+	switch {
+	case len(entries) == 0:
+		writeSQSError(w, "AWS.SimpleQueueService.EmptyBatchRequest", "There should be at least one entry in the request.")
+		return nil, false
+	case len(entries) > maxBatchEntries:
+		writeSQSError(w, "AWS.SimpleQueueService.TooManyEntriesInBatchRequest", fmt.Sprintf("Maximum number of entries per request are %d.", maxBatchEntries))
+		return nil, false
+	}
+
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		id := entry.Get("Id")
+		if _, ok := seen[id]; ok {
+			writeSQSError(w, "AWS.SimpleQueueService.BatchEntryIdsNotDistinct", fmt.Sprintf("Id %s repeated.", id))
+			return nil, false
+		}
+		seen[id] = struct{}{}
+	}
+	return entries, true
+}
+
+// members returns the structures of a flattened list in a query request, such
+// as "SendMessageBatchRequestEntry.1.Id", keyed by their field names.
+func members(form url.Values, prefix string) []url.Values {
+	var res []url.Values
+	for i := 1; ; i++ {
+		var (
+			member = url.Values{}
+			p      = fmt.Sprintf("%s.%d.", prefix, i)
+		)
+		for k, v := range form {
+			if strings.HasPrefix(k, p) {
+				member[strings.TrimPrefix(k, p)] = v
+			}
+		}
+		if len(member) == 0 {
+			return res
+		}
+		res = append(res, member)
+	}
+}
+
+// list returns the values of a flattened list in a query request, such as
+// "AttributeName.1".
+func list(form url.Values, prefix string) []string {
+	var res []string
+	for i := 1; ; i++ {
+		v, ok := form[fmt.Sprintf("%s.%d", prefix, i)]
+		if !ok || len(v) == 0 {
+			return res
+		}
+		res = append(res, v[0])
+	}
+}
+
+// selected returns if the attribute has been asked for, either by name, by a
+// prefix ending in ".*" or with "All".
+func selected(names []string, name string) bool {
+	for _, v := range names {
+		switch {
+		case v == allAttributes || v == ".*" || v == name:
+			return true
+		case strings.HasSuffix(v, ".*") && strings.HasPrefix(name, strings.TrimSuffix(v, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+func queueURL(r *http.Request, name string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/%s/%s", scheme, r.Host, accountID, name)
+}
+
+func millis(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
@@ -0,0 +1,332 @@
+package fakeaws
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestSQS(t *testing.T) {
+	t.Parallel()
+
+	t.Run("get queue url", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue")
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		var res struct {
+			QueueURL string `xml:"GetQueueUrlResult>QueueUrl"`
+		}
+		post(t, server.URL, url.Values{
+			"Action":    {"GetQueueUrl"},
+			"QueueName": {"queue"},
+		}, http.StatusOK, &res)
+
+		if expected, actual := server.URL+"/"+accountID+"/queue", res.QueueURL; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("get queue url with unknown queue", func(t *testing.T) {
+		server := httptest.NewServer(NewSQS())
+		defer server.Close()
+
+		var res struct {
+			Code string `xml:"Error>Code"`
+		}
+		post(t, server.URL, url.Values{
+			"Action":    {"GetQueueUrl"},
+			"QueueName": {"queue"},
+		}, http.StatusBadRequest, &res)
+
+		if expected, actual := "AWS.SimpleQueueService.NonExistentQueue", res.Code; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("send and receive", func(t *testing.T) {
+		fn := func(body, value string) bool {
+			if body == "" {
+				return true
+			}
+
+			sqs := NewSQS()
+			sqs.CreateQueue("queue")
+
+			server := httptest.NewServer(sqs)
+			defer server.Close()
+
+			queueURL := server.URL + "/" + accountID + "/queue"
+
+			var sent struct {
+				MessageID        string `xml:"SendMessageResult>MessageId"`
+				MD5OfMessageBody string `xml:"SendMessageResult>MD5OfMessageBody"`
+			}
+			post(t, server.URL, url.Values{
+				"Action":                               {"SendMessage"},
+				"QueueUrl":                             {queueURL},
+				"MessageBody":                          {body},
+				"MessageAttribute.1.Name":              {"name"},
+				"MessageAttribute.1.Value.DataType":    {"String"},
+				"MessageAttribute.1.Value.StringValue": {value},
+			}, http.StatusOK, &sent)
+
+			sum := md5.Sum([]byte(body))
+			if expected, actual := hex.EncodeToString(sum[:]), sent.MD5OfMessageBody; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+
+			received := receive(t, server.URL, queueURL)
+			if expected, actual := 1, len(received.Messages); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			msg := received.Messages[0]
+			if expected, actual := sent.MessageID, msg.MessageID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := sent.MD5OfMessageBody, msg.MD5OfBody; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := "1", attributeValue(msg.Attributes, "ApproximateReceiveCount"); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := 1, len(msg.MessageAttributes); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := value, msg.MessageAttributes[0].Value.StringValue; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return msg.Body == body
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("receive hides messages", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue")
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		queueURL := server.URL + "/" + accountID + "/queue"
+		send(t, server.URL, queueURL, "body")
+
+		if expected, actual := 1, len(receive(t, server.URL, queueURL).Messages); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(receive(t, server.URL, queueURL).Messages); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("change visibility", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue")
+
+		now := time.Now()
+		sqs.now = func() time.Time { return now }
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		queueURL := server.URL + "/" + accountID + "/queue"
+		send(t, server.URL, queueURL, "body")
+
+		received := receive(t, server.URL, queueURL)
+		if expected, actual := 1, len(received.Messages); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var res struct {
+			Successful []string `xml:"ChangeMessageVisibilityBatchResult>ChangeMessageVisibilityBatchResultEntry>Id"`
+		}
+		post(t, server.URL, url.Values{
+			"Action":   {"ChangeMessageVisibilityBatch"},
+			"QueueUrl": {queueURL},
+			"ChangeMessageVisibilityBatchRequestEntry.1.Id":                {"a"},
+			"ChangeMessageVisibilityBatchRequestEntry.1.ReceiptHandle":     {received.Messages[0].ReceiptHandle},
+			"ChangeMessageVisibilityBatchRequestEntry.1.VisibilityTimeout": {"0"},
+		}, http.StatusOK, &res)
+
+		if expected, actual := 1, len(res.Successful); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		received = receive(t, server.URL, queueURL)
+		if expected, actual := 1, len(received.Messages); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "2", attributeValue(received.Messages[0].Attributes, "ApproximateReceiveCount"); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue")
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		queueURL := server.URL + "/" + accountID + "/queue"
+		send(t, server.URL, queueURL, "body")
+
+		received := receive(t, server.URL, queueURL)
+		if expected, actual := 1, len(received.Messages); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var res struct {
+			Successful []string `xml:"DeleteMessageBatchResult>DeleteMessageBatchResultEntry>Id"`
+			Failed     []string `xml:"DeleteMessageBatchResult>BatchResultErrorEntry>Id"`
+		}
+		post(t, server.URL, url.Values{
+			"Action":                              {"DeleteMessageBatch"},
+			"QueueUrl":                            {queueURL},
+			"DeleteMessageBatchRequestEntry.1.Id": {"a"},
+			"DeleteMessageBatchRequestEntry.1.ReceiptHandle": {received.Messages[0].ReceiptHandle},
+			"DeleteMessageBatchRequestEntry.2.Id":            {"b"},
+			"DeleteMessageBatchRequestEntry.2.ReceiptHandle": {"bad"},
+		}, http.StatusOK, &res)
+
+		if expected, actual := []string{"a"}, res.Successful; len(actual) != 1 || expected[0] != actual[0] {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := []string{"b"}, res.Failed; len(actual) != 1 || expected[0] != actual[0] {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, sqs.Len("queue"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("fifo", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue.fifo")
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		queueURL := server.URL + "/" + accountID + "/queue.fifo"
+		for _, v := range []struct {
+			body, group, dedup string
+		}{
+			{"a1", "a", "1"},
+			{"a2", "a", "2"},
+			{"b1", "b", "3"},
+			{"a1", "a", "1"},
+		} {
+			post(t, server.URL, url.Values{
+				"Action":                 {"SendMessage"},
+				"QueueUrl":               {queueURL},
+				"MessageBody":            {v.body},
+				"MessageGroupId":         {v.group},
+				"MessageDeduplicationId": {v.dedup},
+			}, http.StatusOK, nil)
+		}
+
+		if expected, actual := 3, sqs.Len("queue.fifo"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Take the first message of group a, which should hold back the rest of
+		// the group until it's done.
+		var first receiveResult
+		post(t, server.URL, url.Values{
+			"Action":              {"ReceiveMessage"},
+			"QueueUrl":            {queueURL},
+			"MaxNumberOfMessages": {"1"},
+		}, http.StatusOK, &first)
+
+		received := receive(t, server.URL, queueURL)
+		if expected, actual := 1, len(received.Messages); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "b1", received.Messages[0].Body; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("fifo without group", func(t *testing.T) {
+		sqs := NewSQS()
+		sqs.CreateQueue("queue.fifo")
+
+		server := httptest.NewServer(sqs)
+		defer server.Close()
+
+		post(t, server.URL, url.Values{
+			"Action":      {"SendMessage"},
+			"QueueUrl":    {server.URL + "/" + accountID + "/queue.fifo"},
+			"MessageBody": {"body"},
+		}, http.StatusBadRequest, nil)
+	})
+}
+
+type receiveResult struct {
+	Messages []struct {
+		MessageID         string `xml:"MessageId"`
+		ReceiptHandle     string
+		MD5OfBody         string
+		Body              string
+		Attributes        []attribute        `xml:"Attribute"`
+		MessageAttributes []messageAttribute `xml:"MessageAttribute"`
+	} `xml:"ReceiveMessageResult>Message"`
+}
+
+func send(t *testing.T, endpoint, queueURL, body string) {
+	post(t, endpoint, url.Values{
+		"Action":      {"SendMessage"},
+		"QueueUrl":    {queueURL},
+		"MessageBody": {body},
+	}, http.StatusOK, nil)
+}
+
+func receive(t *testing.T, endpoint, queueURL string) receiveResult {
+	var res receiveResult
+	post(t, endpoint, url.Values{
+		"Action":                 {"ReceiveMessage"},
+		"QueueUrl":               {queueURL},
+		"MaxNumberOfMessages":    {"10"},
+		"AttributeName.1":        {"All"},
+		"MessageAttributeName.1": {"All"},
+	}, http.StatusOK, &res)
+	return res
+}
+
+func post(t *testing.T, endpoint string, form url.Values, status int, v interface{}) {
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if expected, actual := status, resp.StatusCode; expected != actual {
+		t.Fatalf("expected: %d, actual: %d", expected, actual)
+	}
+	if v == nil {
+		return
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func attributeValue(attributes []attribute, name string) string {
+	for _, v := range attributes {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,295 @@
+package fakeredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Server is an in memory fake of a redis server, speaking RESP over TCP and
+// covering the stream commands courier uses.
+type Server struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	streams  map[string]*stream
+	// notify is closed, and replaced, whenever an entry is added to a stream,
+	// waking up any blocked reads.
+	notify chan struct{}
+	closed chan struct{}
+	offset time.Duration
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a Server without any streams, listening on the address.
+// Use "127.0.0.1:0" to listen on any free port.
+func NewServer(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		streams:  make(map[string]*stream),
+		notify:   make(chan struct{}),
+		closed:   make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops listening and closes every connection.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	close(s.closed)
+
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Advance moves the clock of the server on, so that pending entries become
+// idle without having to wait.
+func (s *Server) Advance(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.offset += d
+}
+
+// Len returns the number of entries in the stream.
+func (s *Server) Len(name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if st, ok := s.streams[name]; ok {
+		return len(st.entries)
+	}
+	return 0
+}
+
+// Pending returns the number of entries that have been delivered to the
+// group, but haven't been acknowledged.
+func (s *Server) Pending(name, group string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if st, ok := s.streams[name]; ok {
+		if g, ok := st.groups[group]; ok {
+			return len(g.pending)
+		}
+	}
+	return 0
+}
+
+// Fields returns the fields of every entry in the stream, oldest first.
+func (s *Server) Fields(name string) []map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		return nil
+	}
+
+	fields := make([]map[string]string, len(st.entries))
+	for k, e := range st.entries {
+		fields[k] = make(map[string]string, len(e.fields)/2)
+		for i := 0; i+1 < len(e.fields); i += 2 {
+			fields[k][e.fields[i]] = e.fields[i+1]
+		}
+	}
+	return fields
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	var (
+		reader = bufio.NewReader(conn)
+		writer = bufio.NewWriter(conn)
+	)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		s.exec(writer, args)
+
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(w *bufio.Writer, args []string) {
+	if len(args) == 0 {
+		writeError(w, "ERR empty command")
+		return
+	}
+
+	var (
+		name  = strings.ToUpper(args[0])
+		reply interface{}
+		err   error
+	)
+	switch name {
+	case "PING":
+		reply = status("PONG")
+	case "XADD":
+		reply, err = s.xadd(args[1:])
+	case "XLEN":
+		reply, err = s.xlen(args[1:])
+	case "XRANGE":
+		reply, err = s.xrange(args[1:])
+	case "XGROUP":
+		reply, err = s.xgroup(args[1:])
+	case "XREADGROUP":
+		reply, err = s.xreadgroup(args[1:])
+	case "XACK":
+		reply, err = s.xack(args[1:])
+	case "XPENDING":
+		reply, err = s.xpending(args[1:])
+	case "XCLAIM":
+		reply, err = s.xclaim(args[1:])
+	case "DEL":
+		reply, err = s.del(args[1:])
+	default:
+		err = errors.Errorf("ERR unknown command '%s'", args[0])
+	}
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	writeReply(w, reply)
+}
+
+// status is a simple string reply.
+type status string
+
+// readCommand reads a command, sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, errors.Errorf("unexpected command %q", line)
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for k := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.Errorf("unexpected argument %q", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[k] = string(b[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeError(w *bufio.Writer, err string) {
+	fmt.Fprintf(w, "-%s\r\n", err)
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("*-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected reply %T", reply))
+	}
+}
@@ -0,0 +1,132 @@
+package fakeredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ping", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		if expected, actual := "PONG", c.do(t, "PING"); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		reply := c.do(t, "GET", "key")
+		if expected, actual := true, strings.HasPrefix(fmt.Sprint(reply), "ERR unknown command"); expected != actual {
+			t.Errorf("expected: %t, actual: %t (%v)", expected, actual, reply)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s := newTestServer(t)
+
+		c := dial(t, s)
+		defer c.Close()
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.reader.ReadByte(); err == nil {
+			t.Errorf("expected: error, actual: nil")
+		}
+	})
+}
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+type client struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, s *Server) *client {
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// do sends the command, returning the reply, where errors are returned as an
+// error value.
+func (c *client) do(t *testing.T, args ...string) interface{} {
+	fmt.Fprintf(c, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func (c *client) read() (interface{}, error) {
+	line, err := readLine(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return line[1:], nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return nil, err
+		}
+		return string(b[:size]), nil
+	case '*':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, size)
+		for k := range values {
+			if values[k], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.Errorf("unexpected reply %q", line)
+}
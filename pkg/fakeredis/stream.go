@@ -0,0 +1,535 @@
+package fakeredis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type stream struct {
+	entries []entry
+	lastID  streamID
+	groups  map[string]*group
+}
+
+type entry struct {
+	id     streamID
+	fields []string
+}
+
+type group struct {
+	lastID  streamID
+	pending map[streamID]*pending
+}
+
+// pending is an entry that has been delivered to a consumer of the group,
+// but hasn't been acknowledged.
+type pending struct {
+	consumer    string
+	deliveredAt time.Time
+	deliveries  int
+}
+
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// parseID parses an id, where a missing sequence is filled in with the
+// sequence given.
+func parseID(s string, seq uint64) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return streamID{^uint64(0), ^uint64(0)}, nil
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return streamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	if len(parts) == 2 {
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return streamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return streamID{ms, seq}, nil
+}
+
+func (s *Server) stream(name string, create bool) *stream {
+	st, ok := s.streams[name]
+	if !ok && create {
+		st = &stream{
+			groups: make(map[string]*group),
+		}
+		s.streams[name] = st
+	}
+	return st
+}
+
+func (s *Server) group(name, groupName string) (*stream, *group, error) {
+	st := s.stream(name, false)
+	if st == nil {
+		return nil, nil, errors.Errorf("NOGROUP No such key '%s' or consumer group '%s'", name, groupName)
+	}
+	g, ok := st.groups[groupName]
+	if !ok {
+		return nil, nil, errors.Errorf("NOGROUP No such key '%s' or consumer group '%s'", name, groupName)
+	}
+	return st, g, nil
+}
+
+func (st *stream) find(id streamID) (entry, bool) {
+	i := sort.Search(len(st.entries), func(i int) bool {
+		return !st.entries[i].id.less(id)
+	})
+	if i < len(st.entries) && st.entries[i].id == id {
+		return st.entries[i], true
+	}
+	return entry{}, false
+}
+
+// XADD key id field value [field value ...]
+func (s *Server) xadd(args []string) (interface{}, error) {
+	if len(args) < 4 || len(args)%2 != 0 {
+		return nil, errors.New("ERR wrong number of arguments for 'xadd' command")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := s.stream(args[0], true)
+
+	var id streamID
+	if args[1] == "*" {
+		ms := uint64(s.now().UnixNano() / int64(time.Millisecond))
+		if ms <= st.lastID.ms {
+			id = streamID{st.lastID.ms, st.lastID.seq + 1}
+		} else {
+			id = streamID{ms, 0}
+		}
+	} else {
+		var err error
+		if id, err = parseID(args[1], 0); err != nil {
+			return nil, err
+		}
+		if !st.lastID.less(id) {
+			return nil, errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+
+	st.entries = append(st.entries, entry{
+		id:     id,
+		fields: append([]string(nil), args[2:]...),
+	})
+	st.lastID = id
+
+	close(s.notify)
+	s.notify = make(chan struct{})
+
+	return id.String(), nil
+}
+
+// XLEN key
+func (s *Server) xlen(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("ERR wrong number of arguments for 'xlen' command")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if st := s.stream(args[0], false); st != nil {
+		return len(st.entries), nil
+	}
+	return 0, nil
+}
+
+// XRANGE key start end [COUNT count]
+func (s *Server) xrange(args []string) (interface{}, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, errors.New("ERR wrong number of arguments for 'xrange' command")
+	}
+
+	start, err := parseID(args[1], 0)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseID(args[2], ^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	count := -1
+	if len(args) == 5 {
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]interface{}, 0)
+	if st := s.stream(args[0], false); st != nil {
+		for _, e := range st.entries {
+			if count >= 0 && len(result) >= count {
+				break
+			}
+			if e.id.less(start) || end.less(e.id) {
+				continue
+			}
+			result = append(result, e.reply())
+		}
+	}
+	return result, nil
+}
+
+// XGROUP CREATE key group id [MKSTREAM]
+func (s *Server) xgroup(args []string) (interface{}, error) {
+	if len(args) < 4 || strings.ToUpper(args[0]) != "CREATE" {
+		return nil, errors.New("ERR only XGROUP CREATE is supported")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mkstream := len(args) > 4 && strings.ToUpper(args[4]) == "MKSTREAM"
+	st := s.stream(args[1], mkstream)
+	if st == nil {
+		return nil, errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	if _, ok := st.groups[args[2]]; ok {
+		return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+	}
+
+	var lastID streamID
+	if args[3] == "$" {
+		lastID = st.lastID
+	} else {
+		var err error
+		if lastID, err = parseID(args[3], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	st.groups[args[2]] = &group{
+		lastID:  lastID,
+		pending: make(map[streamID]*pending),
+	}
+	return status("OK"), nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] STREAMS key id
+func (s *Server) xreadgroup(args []string) (interface{}, error) {
+	if len(args) < 6 || strings.ToUpper(args[0]) != "GROUP" {
+		return nil, errors.New("ERR syntax error")
+	}
+
+	var (
+		groupName = args[1]
+		consumer  = args[2]
+		count     = -1
+		block     = time.Duration(-1)
+		rest      = args[3:]
+	)
+	for len(rest) > 0 && strings.ToUpper(rest[0]) != "STREAMS" {
+		if len(rest) < 2 {
+			return nil, errors.New("ERR syntax error")
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(rest[0]) {
+		case "COUNT":
+			count = n
+		case "BLOCK":
+			block = time.Duration(n) * time.Millisecond
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+		rest = rest[2:]
+	}
+	if len(rest) != 3 {
+		return nil, errors.New("ERR only a single stream is supported")
+	}
+	var (
+		name = rest[1]
+		from = rest[2]
+	)
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		s.mutex.Lock()
+		result, err := s.readGroup(name, groupName, consumer, from, count)
+		notify := s.notify
+		s.mutex.Unlock()
+
+		if err != nil || result != nil || block < 0 || from != ">" {
+			return result, err
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			return nil, nil
+		case <-s.closed:
+			return nil, errors.New("ERR server closed")
+		}
+	}
+}
+
+func (s *Server) readGroup(name, groupName, consumer, from string, count int) (interface{}, error) {
+	st, g, err := s.group(name, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []interface{}
+	if from == ">" {
+		now := s.now()
+		for _, e := range st.entries {
+			if count >= 0 && len(entries) >= count {
+				break
+			}
+			if !g.lastID.less(e.id) {
+				continue
+			}
+			g.lastID = e.id
+			g.pending[e.id] = &pending{
+				consumer:    consumer,
+				deliveredAt: now,
+				deliveries:  1,
+			}
+			entries = append(entries, e.reply())
+		}
+		if len(entries) == 0 {
+			return nil, nil
+		}
+	} else {
+		// The history of the entries pending for the consumer.
+		after, err := parseID(from, 0)
+		if err != nil {
+			return nil, err
+		}
+		entries = make([]interface{}, 0)
+		for _, e := range st.entries {
+			if count >= 0 && len(entries) >= count {
+				break
+			}
+			p, ok := g.pending[e.id]
+			if !ok || p.consumer != consumer || !after.less(e.id) {
+				continue
+			}
+			entries = append(entries, e.reply())
+		}
+	}
+
+	return []interface{}{
+		[]interface{}{name, entries},
+	}, nil
+}
+
+// XACK key group id [id ...]
+func (s *Server) xack(args []string) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errors.New("ERR wrong number of arguments for 'xack' command")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, g, err := s.group(args[0], args[1])
+	if err != nil {
+		return 0, nil
+	}
+
+	var acked int
+	for _, v := range args[2:] {
+		id, err := parseID(v, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+	return acked, nil
+}
+
+// XPENDING key group [start end count [consumer]]
+func (s *Server) xpending(args []string) (interface{}, error) {
+	if len(args) != 2 && len(args) != 5 && len(args) != 6 {
+		return nil, errors.New("ERR wrong number of arguments for 'xpending' command")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, g, err := s.group(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]streamID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+
+	if len(args) == 2 {
+		if len(ids) == 0 {
+			return []interface{}{0, nil, nil, nil}, nil
+		}
+		consumers := make(map[string]int)
+		for _, id := range ids {
+			consumers[g.pending[id].consumer]++
+		}
+		names := make([]string, 0, len(consumers))
+		for name := range consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		counts := make([]interface{}, len(names))
+		for k, name := range names {
+			counts[k] = []interface{}{name, strconv.Itoa(consumers[name])}
+		}
+		return []interface{}{len(ids), ids[0].String(), ids[len(ids)-1].String(), counts}, nil
+	}
+
+	start, err := parseID(args[2], 0)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseID(args[3], ^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(args[4])
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+
+	var (
+		now    = s.now()
+		result = make([]interface{}, 0)
+	)
+	for _, id := range ids {
+		if len(result) >= count {
+			break
+		}
+		p := g.pending[id]
+		if id.less(start) || end.less(id) || (len(args) == 6 && p.consumer != args[5]) {
+			continue
+		}
+		result = append(result, []interface{}{
+			id.String(),
+			p.consumer,
+			int(now.Sub(p.deliveredAt) / time.Millisecond),
+			p.deliveries,
+		})
+	}
+	return result, nil
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [JUSTID]
+func (s *Server) xclaim(args []string) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, errors.New("ERR wrong number of arguments for 'xclaim' command")
+	}
+
+	minIdle, err := strconv.Atoi(args[3])
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+
+	var (
+		consumer = args[2]
+		ids      = args[4:]
+		justID   bool
+	)
+	if strings.ToUpper(ids[len(ids)-1]) == "JUSTID" {
+		justID = true
+		ids = ids[:len(ids)-1]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, g, err := s.group(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now    = s.now()
+		result = make([]interface{}, 0, len(ids))
+	)
+	for _, v := range ids {
+		id, err := parseID(v, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		p, ok := g.pending[id]
+		if !ok || now.Sub(p.deliveredAt) < time.Duration(minIdle)*time.Millisecond {
+			continue
+		}
+
+		e, ok := st.find(id)
+		if !ok {
+			// The entry has since been deleted, so it can't be claimed.
+			delete(g.pending, id)
+			continue
+		}
+
+		p.consumer = consumer
+		p.deliveredAt = now
+		if justID {
+			result = append(result, id.String())
+			continue
+		}
+		p.deliveries++
+		result = append(result, e.reply())
+	}
+	return result, nil
+}
+
+// DEL key [key ...]
+func (s *Server) del(args []string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var deleted int
+	for _, name := range args {
+		if _, ok := s.streams[name]; ok {
+			delete(s.streams, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (e entry) reply() interface{} {
+	return []interface{}{e.id.String(), e.fields}
+}
@@ -0,0 +1,207 @@
+package fakeredis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	t.Run("add and range", func(t *testing.T) {
+		fn := func(value string) bool {
+			s := newTestServer(t)
+			defer s.Close()
+
+			c := dial(t, s)
+			defer c.Close()
+
+			id := c.do(t, "XADD", "stream", "*", "field", value)
+
+			expected := []interface{}{
+				[]interface{}{id, []interface{}{"field", value}},
+			}
+			if actual := c.do(t, "XRANGE", "stream", "-", "+"); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			return s.Len("stream") == 1
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("add with smaller id", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		c.do(t, "XADD", "stream", "2-0", "field", "value")
+		reply := c.do(t, "XADD", "stream", "1-0", "field", "value")
+		if expected, actual := true, strings.HasPrefix(reply.(string), "ERR The ID specified"); expected != actual {
+			t.Errorf("expected: %t, actual: %t (%v)", expected, actual, reply)
+		}
+	})
+
+	t.Run("create group twice", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		if expected, actual := "OK", c.do(t, "XGROUP", "CREATE", "stream", "group", "0", "MKSTREAM"); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		reply := c.do(t, "XGROUP", "CREATE", "stream", "group", "0", "MKSTREAM")
+		if expected, actual := true, strings.HasPrefix(reply.(string), "BUSYGROUP"); expected != actual {
+			t.Errorf("expected: %t, actual: %t (%v)", expected, actual, reply)
+		}
+	})
+
+	t.Run("read group and acknowledge", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		c.do(t, "XGROUP", "CREATE", "stream", "group", "0", "MKSTREAM")
+		id := c.do(t, "XADD", "stream", "*", "field", "value")
+
+		expected := []interface{}{
+			[]interface{}{"stream", []interface{}{
+				[]interface{}{id, []interface{}{"field", "value"}},
+			}},
+		}
+		if actual := c.do(t, "XREADGROUP", "GROUP", "group", "a", "COUNT", "10", "STREAMS", "stream", ">"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 1, s.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Nothing new is delivered, but it's in the history of the consumer.
+		if actual := c.do(t, "XREADGROUP", "GROUP", "group", "a", "STREAMS", "stream", ">"); actual != nil {
+			t.Errorf("expected: nil, actual: %v", actual)
+		}
+		if actual := c.do(t, "XREADGROUP", "GROUP", "group", "a", "STREAMS", "stream", "0"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		if expected, actual := 1, c.do(t, "XACK", "stream", "group", id.(string)); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, s.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("read group blocks", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		c.do(t, "XGROUP", "CREATE", "stream", "group", "$", "MKSTREAM")
+
+		// Times out when nothing arrives.
+		if actual := c.do(t, "XREADGROUP", "GROUP", "group", "a", "BLOCK", "10", "STREAMS", "stream", ">"); actual != nil {
+			t.Errorf("expected: nil, actual: %v", actual)
+		}
+
+		other := dial(t, s)
+		defer other.Close()
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			other.Write([]byte("*5\r\n$4\r\nXADD\r\n$6\r\nstream\r\n$1\r\n*\r\n$5\r\nfield\r\n$5\r\nvalue\r\n"))
+		}()
+
+		reply := c.do(t, "XREADGROUP", "GROUP", "group", "a", "BLOCK", "0", "STREAMS", "stream", ">")
+		if expected, actual := 1, len(reply.([]interface{})); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("pending and claim", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		c.do(t, "XGROUP", "CREATE", "stream", "group", "0", "MKSTREAM")
+		id := c.do(t, "XADD", "stream", "*", "field", "value").(string)
+		c.do(t, "XREADGROUP", "GROUP", "group", "a", "STREAMS", "stream", ">")
+
+		s.Advance(time.Minute)
+
+		expected := []interface{}{
+			[]interface{}{id, "a", 60000, 1},
+		}
+		actual := c.do(t, "XPENDING", "stream", "group", "-", "+", "10")
+		// The idle time isn't exact, as the clock moves on regardless.
+		if p, ok := actual.([]interface{}); ok && len(p) == 1 {
+			if e := p[0].([]interface{}); e[2].(int) >= 60000 {
+				e[2] = 60000
+			}
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Not idle for long enough.
+		if expected, actual := 0, len(c.do(t, "XCLAIM", "stream", "group", "b", "120000", id).([]interface{})); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		claimed := []interface{}{
+			[]interface{}{id, []interface{}{"field", "value"}},
+		}
+		if actual := c.do(t, "XCLAIM", "stream", "group", "b", "30000", id); !reflect.DeepEqual(claimed, actual) {
+			t.Errorf("expected: %v, actual: %v", claimed, actual)
+		}
+
+		summary := []interface{}{
+			1, id, id, []interface{}{
+				[]interface{}{"b", "1"},
+			},
+		}
+		if actual := c.do(t, "XPENDING", "stream", "group"); !reflect.DeepEqual(summary, actual) {
+			t.Errorf("expected: %v, actual: %v", summary, actual)
+		}
+
+		pending := c.do(t, "XPENDING", "stream", "group", "-", "+", "10", "b").([]interface{})
+		if expected, actual := 2, pending[0].([]interface{})[3]; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("claim just id", func(t *testing.T) {
+		s := newTestServer(t)
+		defer s.Close()
+
+		c := dial(t, s)
+		defer c.Close()
+
+		c.do(t, "XGROUP", "CREATE", "stream", "group", "0", "MKSTREAM")
+		id := c.do(t, "XADD", "stream", "*", "field", "value").(string)
+		c.do(t, "XREADGROUP", "GROUP", "group", "a", "STREAMS", "stream", ">")
+
+		if expected, actual := []interface{}{id}, c.do(t, "XCLAIM", "stream", "group", "a", "0", id, "JUSTID"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		pending := c.do(t, "XPENDING", "stream", "group", "-", "+", "10").([]interface{})
+		if expected, actual := 1, pending[0].([]interface{})[3]; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+}
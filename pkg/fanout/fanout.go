@@ -0,0 +1,190 @@
+package fanout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/metrics"
+	"github.com/trussle/courier/pkg/models"
+)
+
+const (
+	defaultCapacity = 10000
+
+	statusSuccess = "success"
+	statusFailure = "failure"
+)
+
+// Recipient is a named destination for a record.
+type Recipient struct {
+	Name   string
+	Sender http.Sender
+}
+
+// FanOut sends each record to all of the recipients, with the record being
+// accepted once the policy is met. Recipients that have accepted a record are
+// remembered by the record's provider id, so that they aren't sent the record
+// again when it's retried. FanOut is safe for concurrent use.
+type FanOut struct {
+	recipients []Recipient
+	policy     Policy
+	tracker    *tracker
+	duration   metrics.HistogramVec
+}
+
+// New creates a FanOut for the recipients with a policy. The time taken to
+// send to each recipient is observed in the duration, labelled by recipient
+// name and status.
+func New(recipients []Recipient, policy Policy, duration metrics.HistogramVec) (*FanOut, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if _, err := ParsePolicy(string(policy)); err != nil {
+		return nil, err
+	}
+
+	return &FanOut{
+		recipients: recipients,
+		policy:     policy,
+		tracker:    newTracker(defaultCapacity),
+		duration:   duration,
+	}, nil
+}
+
+// Send the record to every recipient that hasn't already accepted it,
+// returning an error if the policy isn't met.
+func (f *FanOut) Send(record models.Record) error {
+	var (
+		id       = record.RecordID()
+		accepted = f.tracker.Get(id, len(f.recipients))
+		errs     = make([]error, len(f.recipients))
+	)
+
+	f.each(accepted, func(k int, recipient Recipient) {
+		begin := time.Now()
+		errs[k] = recipient.Sender.Send(record)
+		f.observe(recipient, begin, errs[k])
+	})
+
+	var (
+		count int
+		err   error
+	)
+	for k, v := range errs {
+		if v == nil {
+			accepted[k] = true
+		} else if err == nil {
+			err = errors.Wrapf(v, "recipient %q", f.recipients[k].Name)
+		}
+		if accepted[k] {
+			count++
+		}
+	}
+
+	if f.policy.Met(count, len(f.recipients)) {
+		f.tracker.Remove(id)
+		return nil
+	}
+
+	f.tracker.Set(id, accepted)
+	if err == nil {
+		err = errors.New("policy not met")
+	}
+	return errors.Wrapf(err, "%d of %d recipients accepted", count, len(f.recipients))
+}
+
+// SendBatch sends each recipient a batch of the records it hasn't already
+// accepted, returning which of the records met the policy.
+func (f *FanOut) SendBatch(records []models.Record) ([]bool, error) {
+	accepted := make([][]bool, len(records))
+	for k, v := range records {
+		accepted[k] = f.tracker.Get(v.RecordID(), len(f.recipients))
+	}
+
+	var (
+		mutex sync.Mutex
+		sent  int
+		err   error
+	)
+	f.each(nil, func(k int, recipient Recipient) {
+		var (
+			indexes []int
+			batch   []models.Record
+		)
+		for index, v := range records {
+			if !accepted[index][k] {
+				indexes = append(indexes, index)
+				batch = append(batch, v)
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		begin := time.Now()
+		results, e := recipient.Sender.SendBatch(batch)
+		f.observe(recipient, begin, e)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if e != nil {
+			err = errors.Wrapf(e, "recipient %q", recipient.Name)
+			return
+		}
+		sent++
+		for i, index := range indexes {
+			if i < len(results) && results[i] {
+				accepted[index][k] = true
+			}
+		}
+	})
+
+	met := make([]bool, len(records))
+	for k, v := range records {
+		var count int
+		for _, ok := range accepted[k] {
+			if ok {
+				count++
+			}
+		}
+
+		if met[k] = f.policy.Met(count, len(f.recipients)); met[k] {
+			f.tracker.Remove(v.RecordID())
+		} else {
+			f.tracker.Set(v.RecordID(), accepted[k])
+		}
+	}
+
+	if sent == 0 && err != nil {
+		return nil, err
+	}
+	return met, nil
+}
+
+// each calls fn concurrently for every recipient that isn't skipped.
+func (f *FanOut) each(skip []bool, fn func(int, Recipient)) {
+	var wg sync.WaitGroup
+	for k, v := range f.recipients {
+		if k < len(skip) && skip[k] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(k int, recipient Recipient) {
+			defer wg.Done()
+			fn(k, recipient)
+		}(k, v)
+	}
+	wg.Wait()
+}
+
+func (f *FanOut) observe(recipient Recipient, begin time.Time, err error) {
+	status := statusSuccess
+	if err != nil {
+		status = statusFailure
+	}
+	f.duration.WithLabelValues(recipient.Name, status).Observe(time.Since(begin).Seconds())
+}
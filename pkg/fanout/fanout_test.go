@@ -0,0 +1,311 @@
+package fanout
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+func TestParsePolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []Policy{All, Any, Quorum} {
+		policy, err := ParsePolicy(string(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := v, policy; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+
+	if _, err := ParsePolicy("most"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestPolicyMet(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		policy          Policy
+		accepted, total int
+		met             bool
+	}{
+		{All, 3, 3, true},
+		{All, 2, 3, false},
+		{Any, 1, 3, true},
+		{Any, 0, 3, false},
+		{Quorum, 2, 3, true},
+		{Quorum, 1, 3, false},
+		{Quorum, 2, 4, false},
+		{Quorum, 3, 4, true},
+	} {
+		if expected, actual := testcase.met, testcase.policy.Met(testcase.accepted, testcase.total); expected != actual {
+			t.Errorf("%s (%d/%d) expected: %t, actual: %t", testcase.policy, testcase.accepted, testcase.total, expected, actual)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	t.Parallel()
+
+	t.Run("new without recipients", func(t *testing.T) {
+		if _, err := New(nil, All, nil); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("new with invalid policy", func(t *testing.T) {
+		if _, err := New([]Recipient{{"a", &fakeSender{}}}, Policy("bad"), nil); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("send all", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			a, b     = &fakeSender{}, &fakeSender{fail: 1}
+			duration = newDuration(ctrl)
+		)
+
+		fanout, err := New([]Recipient{{"a", a}, {"b", b}}, All, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := newRecord(t)
+		if err := fanout.Send(record); err == nil {
+			t.Errorf("expected error")
+		}
+
+		// The retry should only go to the recipient that failed.
+		if err := fanout.Send(record); err != nil {
+			t.Error(err)
+		}
+
+		if expected, actual := 1, a.Sent(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, b.Sent(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, fanout.tracker.Len(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send any", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			a, b     = &fakeSender{fail: 1}, &fakeSender{}
+			duration = newDuration(ctrl)
+		)
+
+		fanout, err := New([]Recipient{{"a", a}, {"b", b}}, Any, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fanout.Send(newRecord(t)); err != nil {
+			t.Error(err)
+		}
+		if expected, actual := 0, fanout.tracker.Len(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send quorum", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			a, b, c  = &fakeSender{}, &fakeSender{fail: 2}, &fakeSender{fail: 2}
+			duration = newDuration(ctrl)
+		)
+
+		fanout, err := New([]Recipient{{"a", a}, {"b", b}, {"c", c}}, Quorum, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := newRecord(t)
+		if err := fanout.Send(record); err == nil {
+			t.Errorf("expected error")
+		}
+		if expected, actual := 1, fanout.tracker.Len(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if err := fanout.Send(record); err == nil {
+			t.Errorf("expected error")
+		}
+		if err := fanout.Send(record); err != nil {
+			t.Error(err)
+		}
+
+		if expected, actual := 1, a.Sent(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send batch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			a, b     = &fakeSender{}, &fakeSender{reject: 1}
+			duration = newDuration(ctrl)
+		)
+
+		fanout, err := New([]Recipient{{"a", a}, {"b", b}}, All, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records := []models.Record{newRecord(t), newRecord(t), newRecord(t)}
+
+		accepted, err := fanout.SendBatch(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := []bool{true, false, true}, accepted; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Only the rejected record should be sent again, and only to b.
+		accepted, err = fanout.SendBatch(records[1:2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := []bool{true}, accepted; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 3, a.Sent(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 4, b.Sent(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send batch with failure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			a        = &fakeSender{fail: 1}
+			duration = newDuration(ctrl)
+		)
+
+		fanout, err := New([]Recipient{{"a", a}}, All, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fanout.SendBatch([]models.Record{newRecord(t)}); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := newTracker(2)
+	tracker.Set("a", []bool{true, false})
+	tracker.Set("b", []bool{false, true})
+	tracker.Set("c", []bool{true, true})
+
+	if expected, actual := 2, tracker.Len(); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+	if expected, actual := []bool{false, false}, tracker.Get("a", 2); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+	if expected, actual := []bool{false, true}, tracker.Get("b", 2); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v", expected, actual)
+	}
+
+	tracker.Remove("b")
+	if expected, actual := 1, tracker.Len(); expected != actual {
+		t.Errorf("expected: %d, actual: %d", expected, actual)
+	}
+}
+
+func newDuration(ctrl *gomock.Controller) *metricMocks.MockHistogramVec {
+	var (
+		duration = metricMocks.NewMockHistogramVec(ctrl)
+		observer = metricMocks.NewMockObserver(ctrl)
+	)
+	duration.EXPECT().WithLabelValues(gomock.Any(), gomock.Any()).Return(observer).AnyTimes()
+	observer.EXPECT().Observe(gomock.Any()).AnyTimes()
+	return duration
+}
+
+func newRecord(t *testing.T) models.Record {
+	id, err := uuid.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.NewRecord(id, id.String(), "receipt", nil, time.Now(), nil, nil)
+}
+
+// fakeSender fails the first fail number of sends, and rejects the first
+// reject number of records with in batches.
+type fakeSender struct {
+	mutex        sync.Mutex
+	sent         int
+	fail, reject int
+}
+
+func (s *fakeSender) Send(models.Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sent++
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("bad")
+	}
+	return nil
+}
+
+func (s *fakeSender) SendBatch(records []models.Record) ([]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sent += len(records)
+	if s.fail > 0 {
+		s.fail--
+		return nil, errors.New("bad")
+	}
+
+	accepted := make([]bool, len(records))
+	for k := range accepted {
+		if k == 1 && s.reject > 0 {
+			s.reject--
+			continue
+		}
+		accepted[k] = true
+	}
+	return accepted, nil
+}
+
+func (s *fakeSender) Sent() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sent
+}
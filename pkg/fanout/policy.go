@@ -0,0 +1,46 @@
+package fanout
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policy decides when a record has been accepted by enough of the recipients
+// to be considered delivered.
+type Policy string
+
+const (
+	// All recipients have to accept the record.
+	All Policy = "all"
+
+	// Any one of the recipients has to accept the record.
+	Any Policy = "any"
+
+	// Quorum requires a majority of the recipients to accept the record.
+	Quorum Policy = "quorum"
+)
+
+// ParsePolicy returns the Policy for a name or returns an error if the name
+// isn't known.
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(strings.ToLower(name)); policy {
+	case All, Any, Quorum:
+		return policy, nil
+	default:
+		return "", errors.Errorf("unexpected policy %q", name)
+	}
+}
+
+// Met returns if the number of accepted recipients out of the total satisfies
+// the policy.
+func (p Policy) Met(accepted, total int) bool {
+	switch p {
+	case Any:
+		return accepted > 0
+	case Quorum:
+		return accepted > total/2
+	default:
+		return accepted >= total
+	}
+}
@@ -0,0 +1,70 @@
+package fanout
+
+import "sync"
+
+// tracker remembers which recipients have accepted a record, so that on a
+// retry (or a redelivery of the same message) the record isn't sent to them
+// again. It holds up to capacity records, forgetting the oldest first.
+type tracker struct {
+	mutex    sync.Mutex
+	capacity int
+	accepted map[string][]bool
+	order    []string
+}
+
+func newTracker(capacity int) *tracker {
+	return &tracker{
+		capacity: capacity,
+		accepted: make(map[string][]bool),
+	}
+}
+
+// Get returns which of the recipients have accepted the record.
+func (t *tracker) Get(id string, recipients int) []bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	accepted := make([]bool, recipients)
+	copy(accepted, t.accepted[id])
+	return accepted
+}
+
+// Set stores which of the recipients have accepted the record.
+func (t *tracker) Set(id string, accepted []bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.accepted[id]; !ok {
+		if t.capacity > 0 && len(t.order) >= t.capacity {
+			delete(t.accepted, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, id)
+	}
+	t.accepted[id] = accepted
+}
+
+// Remove forgets the record.
+func (t *tracker) Remove(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.accepted[id]; !ok {
+		return
+	}
+	delete(t.accepted, id)
+	for k, v := range t.order {
+		if v == id {
+			t.order = append(t.order[:k], t.order[k+1:]...)
+			break
+		}
+	}
+}
+
+// Len returns the number of records being tracked.
+func (t *tracker) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.accepted)
+}
@@ -0,0 +1,227 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+)
+
+// BatchFormat describes how a batch of records is encoded in to a single
+// request.
+type BatchFormat string
+
+const (
+	// BatchJSON encodes the records as a JSON array of entries.
+	BatchJSON BatchFormat = "json"
+
+	// BatchNDJSON encodes the records as newline-delimited JSON entries.
+	BatchNDJSON BatchFormat = "ndjson"
+
+	// BatchMultipart encodes the records as a multipart body, with one part
+	// per record.
+	BatchMultipart BatchFormat = "multipart"
+)
+
+// StatusMultiStatus is returned by a recipient when only some of the records
+// with in a batch were accepted.
+const StatusMultiStatus = 207
+
+const (
+	headerContentID = "Content-ID"
+
+	encodingBase64 = "base64"
+)
+
+// ParseBatchFormat returns the BatchFormat for a name or returns an error if
+// the name isn't known.
+func ParseBatchFormat(name string) (BatchFormat, error) {
+	switch format := BatchFormat(strings.ToLower(name)); format {
+	case BatchJSON, BatchNDJSON, BatchMultipart:
+		return format, nil
+	default:
+		return "", errors.Errorf("unexpected batch format %q", name)
+	}
+}
+
+// WithBatchFormat adds the format to use when sending a batch of records.
+func WithBatchFormat(format BatchFormat) ClientOption {
+	return func(client *Client) {
+		client.format = format
+	}
+}
+
+// SendBatch sends all the records in one request to the url associated,
+// returning which of the records were accepted by the recipient.
+//
+// If the response is a StatusOK (200) or StatusMultiStatus (207) with a JSON
+// body of results, only the records that have a successful status with in the
+// results are accepted. A StatusOK (200) without any results accepts every
+// record. Anything else returns an error.
+func (c *Client) SendBatch(records []models.Record) ([]bool, error) {
+	statuses, err := c.SendBatchStatus(records)
+	if err != nil {
+		return nil, err
+	}
+	return Accepted(statuses), nil
+}
+
+// SendBatchStatus sends the records in the same way as SendBatch, returning
+// the status code each of the records was accepted with, or zero if it wasn't
+// accepted. Records accepted by a response without any results have the
+// status code of the response.
+func (c *Client) SendBatchStatus(records []models.Record) ([]int, error) {
+	body, contentType, err := encodeBatch(c.format, c.headers, records)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding batch")
+	}
+
+	var statuses []int
+	err = c.circuit.Run(func() error {
+		c.limiter.Wait()
+
+		resp, err := c.client.Post(c.url, contentType, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK, StatusMultiStatus:
+		default:
+			return errors.Errorf("invalid status code: %d", resp.StatusCode)
+		}
+
+		statuses, err = decodeResults(resp.StatusCode, resp.Body, records)
+		return err
+	})
+	return statuses, err
+}
+
+// batchEntry is a record with in a JSON or NDJSON batch, along with the
+// message attributes that are forwarded. Bodies that are valid JSON are
+// embedded as is, anything else is base64 encoded.
+type batchEntry struct {
+	ID         string            `json:"id"`
+	MessageID  string            `json:"message_id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Encoding   string            `json:"encoding,omitempty"`
+	Body       json.RawMessage   `json:"body"`
+}
+
+func newBatchEntry(headers Headers, record models.Record) batchEntry {
+	entry := batchEntry{
+		ID:         record.ID().String(),
+		MessageID:  record.RecordID(),
+		Attributes: headers.forwarded(record),
+		Body:       record.Body(),
+	}
+
+	var raw json.RawMessage
+	if err := json.Unmarshal(entry.Body, &raw); err != nil {
+		encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(entry.Body))
+		entry.Encoding = encodingBase64
+		entry.Body = encoded
+	}
+	return entry
+}
+
+// encodeBatch encodes the records in to a single body of the format. Each part
+// of a multipart body has the same headers as a record that's sent on it's
+// own.
+func encodeBatch(format BatchFormat, headers Headers, records []models.Record) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch format {
+	case BatchJSON, "":
+		entries := make([]batchEntry, len(records))
+		for k, v := range records {
+			entries[k] = newBatchEntry(headers, v)
+		}
+		if err := json.NewEncoder(&buf).Encode(entries); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "application/json", nil
+
+	case BatchNDJSON:
+		enc := json.NewEncoder(&buf)
+		for _, v := range records {
+			if err := enc.Encode(newBatchEntry(headers, v)); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+
+	case BatchMultipart:
+		writer := multipart.NewWriter(&buf)
+		for _, v := range records {
+			header := textproto.MIMEHeader(headers.For(v))
+			header.Set("Content-Type", "application/binary")
+			header.Set(headerContentID, v.ID().String())
+
+			part, err := writer.CreatePart(header)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := part.Write(v.Body()); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "multipart/mixed; boundary=" + writer.Boundary(), nil
+
+	default:
+		return nil, "", errors.Errorf("unexpected batch format %q", format)
+	}
+}
+
+// batchResults is the response a recipient can send back to describe which
+// records were accepted.
+type batchResults struct {
+	Results []struct {
+		ID     string `json:"id"`
+		Status int    `json:"status"`
+	} `json:"results"`
+}
+
+// decodeResults returns the status code each of the records was accepted
+// with, or zero for the records that weren't accepted.
+func decodeResults(code int, r io.Reader, records []models.Record) ([]int, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]int, len(records))
+
+	var results batchResults
+	if err := json.Unmarshal(b, &results); err != nil || results.Results == nil {
+		if code == StatusMultiStatus {
+			return nil, errors.New("missing batch results")
+		}
+		for k := range statuses {
+			statuses[k] = code
+		}
+		return statuses, nil
+	}
+
+	received := make(map[string]int, len(results.Results))
+	for _, v := range results.Results {
+		received[v.ID] = v.Status
+	}
+	for k, v := range records {
+		if status := received[v.ID().String()]; status >= 200 && status < 300 {
+			statuses[k] = status
+		}
+	}
+	return statuses, nil
+}
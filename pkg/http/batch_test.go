@@ -0,0 +1,384 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+func TestParseBatchFormat(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		for _, v := range []BatchFormat{BatchJSON, BatchNDJSON, BatchMultipart} {
+			format, err := ParseBatchFormat(string(v))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := v, format; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseBatchFormat("bad")
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestClientSendBatch(t *testing.T) {
+	t.Parallel()
+
+	t.Run("send json", func(t *testing.T) {
+		var entries []batchEntry
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			if expected, actual := "application/json", r.Header.Get("Content-Type"); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		records := []models.Record{
+			newRecord([]byte(`{"a":1}`)),
+			newRecord([]byte("binary")),
+		}
+
+		client := NewClient(http.DefaultClient, server.URL, WithBatchFormat(BatchJSON))
+		accepted, err := client.SendBatch(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []bool{true, true}, accepted; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 2, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := `{"a":1}`, string(entries[0].Body); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		var encoded string
+		if err := json.Unmarshal(entries[1].Body, &encoded); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := encodingBase64, entries[1].Encoding; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := base64.StdEncoding.EncodeToString([]byte("binary")), encoded; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("send ndjson", func(t *testing.T) {
+		var entries []batchEntry
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			if expected, actual := "application/x-ndjson", r.Header.Get("Content-Type"); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			dec := json.NewDecoder(r.Body)
+			for dec.More() {
+				var entry batchEntry
+				if err := dec.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, entry)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		records := []models.Record{
+			newRecord([]byte(`1`)),
+			newRecord([]byte(`2`)),
+			newRecord([]byte(`3`)),
+		}
+
+		client := NewClient(http.DefaultClient, server.URL, WithBatchFormat(BatchNDJSON))
+		if _, err := client.SendBatch(records); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := len(records), len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for k, v := range records {
+			if expected, actual := v.ID().String(), entries[k].ID; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("send multipart", func(t *testing.T) {
+		fn := func(a, b []byte) bool {
+			var bodies [][]byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer r.Body.Close()
+
+				_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader := multipart.NewReader(r.Body, params["boundary"])
+				for {
+					part, err := reader.NextPart()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					body, err := ioutil.ReadAll(part)
+					if err != nil {
+						t.Fatal(err)
+					}
+					bodies = append(bodies, body)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			client := NewClient(http.DefaultClient, server.URL, WithBatchFormat(BatchMultipart))
+			if _, err := client.SendBatch([]models.Record{newRecord(a), newRecord(b)}); err != nil {
+				t.Fatal(err)
+			}
+
+			return len(bodies) == 2 &&
+				string(bodies[0]) == string(a) &&
+				string(bodies[1]) == string(b)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("send json with attributes", func(t *testing.T) {
+		var entries []batchEntry
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		record := newRecordWithAttributes([]byte(`{}`), map[string]string{
+			"trace": "abc",
+			"other": "def",
+		})
+
+		client := NewClient(http.DefaultClient, server.URL, WithBatchFormat(BatchJSON), WithHeaders(Headers{
+			Prefix:     DefaultHeaderPrefix,
+			Attributes: []string{"trace"},
+		}))
+		if _, err := client.SendBatch([]models.Record{record}); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 1, len(entries); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "message-id", entries[0].MessageID; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := map[string]string{"trace": "abc"}, entries[0].Attributes; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send multipart with headers", func(t *testing.T) {
+		var headers []textproto.MIMEHeader
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := multipart.NewReader(r.Body, params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				headers = append(headers, part.Header)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		record := newRecordWithAttributes([]byte("body"), map[string]string{
+			"trace": "abc",
+		})
+
+		client := NewClient(http.DefaultClient, server.URL, WithBatchFormat(BatchMultipart))
+		if _, err := client.SendBatch([]models.Record{record}); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 1, len(headers); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for name, value := range map[string]string{
+			"Content-Type":              "application/binary",
+			"Content-Id":                record.ID().String(),
+			"X-Courier-Id":              record.ID().String(),
+			"X-Courier-Message-Id":      "message-id",
+			"X-Courier-Attribute-Trace": "abc",
+		} {
+			if expected, actual := value, headers[0].Get(name); expected != actual {
+				t.Errorf("%s expected: %q, actual: %q", name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("send with partial results", func(t *testing.T) {
+		records := []models.Record{
+			newRecord([]byte(`1`)),
+			newRecord([]byte(`2`)),
+			newRecord([]byte(`3`)),
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			w.WriteHeader(StatusMultiStatus)
+			fmt.Fprintf(w, `{"results":[{"id":%q,"status":200},{"id":%q,"status":500}]}`,
+				records[0].ID().String(),
+				records[1].ID().String(),
+			)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		accepted, err := client.SendBatch(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []bool{true, false, false}, accepted; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send status with partial results", func(t *testing.T) {
+		records := []models.Record{
+			newRecord([]byte(`1`)),
+			newRecord([]byte(`2`)),
+			newRecord([]byte(`3`)),
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			w.WriteHeader(StatusMultiStatus)
+			fmt.Fprintf(w, `{"results":[{"id":%q,"status":201},{"id":%q,"status":500}]}`,
+				records[0].ID().String(),
+				records[1].ID().String(),
+			)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		statuses, err := client.SendBatchStatus(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []int{http.StatusCreated, 0, 0}, statuses; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send status without results", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		statuses, err := client.SendBatchStatus([]models.Record{newRecord(nil), newRecord(nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []int{http.StatusOK, http.StatusOK}, statuses; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send with missing results", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			w.WriteHeader(StatusMultiStatus)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		_, err := client.SendBatch([]models.Record{newRecord(nil)})
+		if expected, actual := true, err != nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("send with failure", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		_, err := client.SendBatch([]models.Record{newRecord(nil)})
+		if expected, actual := true, err != nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func newRecord(body []byte) models.Record {
+	id, err := uuid.New()
+	if err != nil {
+		panic(err)
+	}
+	return queue.NewRecord(id, "message-id", "receipt", body, time.Now(), nil, nil)
+}
+
+func newRecordWithAttributes(body []byte, attributes map[string]string) models.Record {
+	id, err := uuid.New()
+	if err != nil {
+		panic(err)
+	}
+	return queue.NewRecord(id, "message-id", "receipt", body, time.Now(), attributes, nil)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/SimonRichardson/resilience/breaker"
 	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
 )
 
 const (
@@ -14,29 +15,157 @@ const (
 	defaultFailureTimeout = time.Minute
 )
 
+// Sender delivers records to a recipient.
+type Sender interface {
+
+	// Send a record, returning an error if it wasn't accepted.
+	Send(models.Record) error
+
+	// SendBatch sends all the records at once, returning which of the records
+	// were accepted.
+	SendBatch([]models.Record) ([]bool, error)
+}
+
+// StatusSender is implemented by senders that can say which status code the
+// recipient accepted each record with.
+type StatusSender interface {
+
+	// SendStatus sends a record, returning the status code it was accepted
+	// with, or an error if it wasn't accepted.
+	SendStatus(models.Record) (int, error)
+
+	// SendBatchStatus sends all the records at once, returning the status code
+	// each of the records was accepted with, or zero if it wasn't accepted.
+	SendBatchStatus([]models.Record) ([]int, error)
+}
+
+// SendStatus sends the record with the sender, returning the status code it
+// was accepted with. Senders that can't say which status code they got are
+// assumed to have got a StatusOK (200).
+func SendStatus(sender Sender, record models.Record) (int, error) {
+	if s, ok := sender.(StatusSender); ok {
+		return s.SendStatus(record)
+	}
+	if err := sender.Send(record); err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
+
+// SendBatchStatus sends the records with the sender, returning the status code
+// each of the records was accepted with, or zero if it wasn't accepted.
+// Senders that can't say which status code they got are assumed to have got a
+// StatusOK (200) for every record they accepted.
+func SendBatchStatus(sender Sender, records []models.Record) ([]int, error) {
+	if s, ok := sender.(StatusSender); ok {
+		return s.SendBatchStatus(records)
+	}
+	accepted, err := sender.SendBatch(records)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]int, len(accepted))
+	for k, v := range accepted {
+		if v {
+			statuses[k] = http.StatusOK
+		}
+	}
+	return statuses, nil
+}
+
+// Accepted returns which of the records were accepted, from the status code
+// each of them was accepted with.
+func Accepted(statuses []int) []bool {
+	accepted := make([]bool, len(statuses))
+	for k, v := range statuses {
+		accepted[k] = v != 0
+	}
+	return accepted
+}
+
+// Limiter limits the rate at which requests are sent.
+type Limiter interface {
+
+	// Wait blocks until a request is allowed to be sent, returning the
+	// duration it was blocked for.
+	Wait() time.Duration
+}
+
+// ClientOption defines a option for generating a Client
+type ClientOption func(*Client)
+
+// WithLimiter adds a limiter that every request has to wait on before being
+// sent.
+func WithLimiter(limiter Limiter) ClientOption {
+	return func(client *Client) {
+		client.limiter = limiter
+	}
+}
+
+// WithHeaders adds the headers that describe each record to the client.
+func WithHeaders(headers Headers) ClientOption {
+	return func(client *Client) {
+		client.headers = headers
+	}
+}
+
 // Client represents a http client that has a one to one relationship with a url
 type Client struct {
 	circuit *breaker.CircuitBreaker
 	client  *http.Client
 	url     string
+	limiter Limiter
+	format  BatchFormat
+	headers Headers
 }
 
 // NewClient creates a Client with the http.Client and url
-func NewClient(client *http.Client, url string) *Client {
-	return &Client{
+func NewClient(client *http.Client, url string, opts ...ClientOption) *Client {
+	c := &Client{
 		circuit: breaker.New(defaultFailureRate, defaultFailureTimeout),
 		client:  client,
 		url:     url,
+		limiter: nopLimiter{},
+		format:  BatchJSON,
+		headers: Headers{
+			Prefix:     DefaultHeaderPrefix,
+			Attributes: []string{AllAttributes},
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-// Send a request to the url associated.
+// Send a request to the url associated, containing the body of the record
+// along with headers describing the record.
 // If the response returns anything other than a StatusOK (200), then it
 // will return an error.
-func (c *Client) Send(p []byte) error {
-	return c.circuit.Run(func() error {
+func (c *Client) Send(record models.Record) error {
+	_, err := c.SendStatus(record)
+	return err
+}
+
+// SendStatus sends the record in the same way as Send, returning the status
+// code of the response.
+func (c *Client) SendStatus(record models.Record) (int, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(record.Body()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/binary")
+	for name, value := range c.headers.For(record) {
+		req.Header[name] = value
+	}
+
+	// Only requests that the circuit lets through wait on the limiter, so
+	// that requests turned away by an open circuit don't spend it's tokens.
+	var code int
+	err = c.circuit.Run(func() error {
+		c.limiter.Wait()
 
-		resp, err := c.client.Post(c.url, "application/binary", bytes.NewReader(p))
+		resp, err := c.client.Do(req)
 		if err != nil {
 			return err
 		}
@@ -46,6 +175,15 @@ func (c *Client) Send(p []byte) error {
 			return errors.Errorf("invalid status code: %d", resp.StatusCode)
 		}
 
+		code = resp.StatusCode
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return code, nil
 }
+
+type nopLimiter struct{}
+
+func (nopLimiter) Wait() time.Duration { return 0 }
@@ -3,8 +3,13 @@ package http
 import (
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"testing/quick"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
 )
 
 func TestClient(t *testing.T) {
@@ -20,7 +25,7 @@ func TestClient(t *testing.T) {
 
 		fn := func(b []byte) bool {
 			client := NewClient(http.DefaultClient, server.URL)
-			return client.Send(b) == nil
+			return client.Send(newRecord(b)) == nil
 		}
 		if err := quick.Check(fn, nil); err != nil {
 			t.Error(err)
@@ -37,18 +42,158 @@ func TestClient(t *testing.T) {
 
 		fn := func(b []byte) bool {
 			client := NewClient(http.DefaultClient, server.URL)
-			return client.Send(b) != nil
+			return client.Send(newRecord(b)) != nil
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("send with limiter", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			w.WriteHeader(http.StatusOK)
+		})
+		server := httptest.NewServer(mux)
+
+		fn := func(b []byte) bool {
+			limiter := &countingLimiter{}
+			client := NewClient(http.DefaultClient, server.URL, WithLimiter(limiter))
+			return client.Send(newRecord(b)) == nil && limiter.calls == 1
 		}
 		if err := quick.Check(fn, nil); err != nil {
 			t.Error(err)
 		}
 	})
 
+	t.Run("send with limiter and open circuit", func(t *testing.T) {
+		var sent int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			sent++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		var (
+			limiter = &countingLimiter{}
+			client  = NewClient(http.DefaultClient, server.URL, WithLimiter(limiter))
+			records = []models.Record{newRecord(nil)}
+		)
+		for i := 0; i < defaultFailureRate*2; i++ {
+			if err := client.Send(newRecord(nil)); err == nil {
+				t.Fatal("expected error")
+			}
+			if _, err := client.SendBatch(records); err == nil {
+				t.Fatal("expected error")
+			}
+		}
+
+		// Requests turned away by the open circuit never wait on the limiter.
+		if expected, actual := true, sent < defaultFailureRate*4; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := sent, limiter.calls; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
 	t.Run("send with url failure", func(t *testing.T) {
 		client := NewClient(http.DefaultClient, "!!")
-		err := client.Send(nil)
+		err := client.Send(newRecord(nil))
 		if expected, actual := true, err != nil; expected != actual {
 			t.Errorf("expected: %t, actual: %t, err: %v", expected, actual, err)
 		}
 	})
+
+	t.Run("send status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		status, err := SendStatus(NewClient(http.DefaultClient, server.URL), newRecord(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := http.StatusOK, status; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestSendStatus(t *testing.T) {
+	t.Parallel()
+
+	t.Run("send", func(t *testing.T) {
+		status, err := SendStatus(acceptingSender{true}, newRecord(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := http.StatusOK, status; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send with failure", func(t *testing.T) {
+		status, err := SendStatus(acceptingSender{false}, newRecord(nil))
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+		if expected, actual := 0, status; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send batch", func(t *testing.T) {
+		for _, accept := range []bool{true, false} {
+			statuses, err := SendBatchStatus(acceptingSender{accept}, []models.Record{newRecord(nil)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []int{0}
+			if accept {
+				expected = []int{http.StatusOK}
+			}
+			if actual := statuses; !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+			if expected, actual := []bool{accept}, Accepted(statuses); !reflect.DeepEqual(expected, actual) {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		}
+	})
+}
+
+// acceptingSender is a sender that can't say which status code it got, which
+// either accepts or rejects every record.
+type acceptingSender struct {
+	accept bool
+}
+
+func (s acceptingSender) Send(models.Record) error {
+	if !s.accept {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func (s acceptingSender) SendBatch(records []models.Record) ([]bool, error) {
+	accepted := make([]bool, len(records))
+	for k := range accepted {
+		accepted[k] = s.accept
+	}
+	return accepted, nil
+}
+
+type countingLimiter struct {
+	calls int
+}
+
+func (l *countingLimiter) Wait() time.Duration {
+	l.calls++
+	return 0
 }
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/trussle/courier/pkg/models"
+)
+
+const (
+	// DefaultHeaderPrefix is the prefix of every header that describes a
+	// record.
+	DefaultHeaderPrefix = "X-Courier-"
+
+	// AllAttributes forwards every message attribute as a header.
+	AllAttributes = "*"
+)
+
+var newlines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// Headers describes which headers are sent along with a record, so that
+// recipients can deduplicate and trace records.
+//
+// Every record is sent with the following headers, where the system
+// attributes are the provider's names split on word boundaries (for example
+// SentTimestamp becomes Sent-Timestamp):
+//
+//	<Prefix>Id                       courier's id of the record
+//	<Prefix>Message-Id               provider's id of the record
+//	<Prefix><System-Attribute>       each of the system attributes
+//	<Prefix>Attribute-<Attribute>    each of the forwarded message attributes
+type Headers struct {
+	// Prefix is prepended to every header name.
+	Prefix string
+
+	// Attributes are the names of the message attributes to forward, if it
+	// contains AllAttributes then every message attribute is forwarded.
+	Attributes []string
+}
+
+// For returns the headers for a record.
+func (h Headers) For(record models.Record) http.Header {
+	header := make(http.Header)
+	set := func(name, value string) {
+		header.Set(h.Prefix+name, newlines.Replace(value))
+	}
+
+	set("Id", record.ID().String())
+	set("Message-Id", record.RecordID())
+
+	for name, value := range record.SystemAttributes() {
+		set(headerName(name), value)
+	}
+
+	for name, value := range h.forwarded(record) {
+		set("Attribute-"+name, value)
+	}
+
+	return header
+}
+
+// forwarded returns the message attributes of the record that are forwarded.
+func (h Headers) forwarded(record models.Record) map[string]string {
+	var (
+		attributes = record.Attributes()
+		res        = make(map[string]string, len(attributes))
+	)
+	for _, name := range h.Attributes {
+		if name == AllAttributes {
+			for name, value := range attributes {
+				res[name] = value
+			}
+			break
+		}
+		if value, ok := attributes[name]; ok {
+			res[name] = value
+		}
+	}
+	return res
+}
+
+// headerName splits a camel cased name on word boundaries with dashes, so
+// ApproximateReceiveCount becomes Approximate-Receive-Count.
+func headerName(name string) string {
+	var (
+		runes  = []rune(name)
+		result = make([]rune, 0, len(runes)+4)
+	)
+	for k, r := range runes {
+		if k > 0 && unicode.IsUpper(r) && unicode.IsLower(runes[k-1]) {
+			result = append(result, '-')
+		}
+		result = append(result, r)
+	}
+	return string(result)
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+func TestHeaders(t *testing.T) {
+	t.Parallel()
+
+	id, err := uuid.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := queue.NewRecord(id, "message-id", "receipt", nil, time.Now(),
+		map[string]string{
+			"trace": "abc",
+			"other": "multi\nline",
+		},
+		map[string]string{
+			"SentTimestamp":           "1500000000000",
+			"ApproximateReceiveCount": "2",
+			"MessageGroupId":          "group",
+		},
+	)
+
+	t.Run("all attributes", func(t *testing.T) {
+		header := Headers{
+			Prefix:     DefaultHeaderPrefix,
+			Attributes: []string{AllAttributes},
+		}.For(record)
+
+		for name, value := range map[string]string{
+			"X-Courier-Id":                        id.String(),
+			"X-Courier-Message-Id":                "message-id",
+			"X-Courier-Sent-Timestamp":            "1500000000000",
+			"X-Courier-Approximate-Receive-Count": "2",
+			"X-Courier-Message-Group-Id":          "group",
+			"X-Courier-Attribute-Trace":           "abc",
+			"X-Courier-Attribute-Other":           "multi line",
+		} {
+			if expected, actual := value, header.Get(name); expected != actual {
+				t.Errorf("%s expected: %q, actual: %q", name, expected, actual)
+			}
+		}
+	})
+
+	t.Run("some attributes", func(t *testing.T) {
+		header := Headers{
+			Prefix:     "X-Relay-",
+			Attributes: []string{"trace", "missing"},
+		}.For(record)
+
+		if expected, actual := "abc", header.Get("X-Relay-Attribute-Trace"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "", header.Get("X-Relay-Attribute-Other"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := 6, len(header); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		var header http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			header = r.Header
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		client := NewClient(http.DefaultClient, server.URL)
+		if err := client.Send(record); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := id.String(), header.Get("X-Courier-Id"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "message-id", header.Get("X-Courier-Message-Id"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		if expected, actual := "application/binary", header.Get("Content-Type"); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	})
+}
+
+func TestHeaderName(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]string{
+		"SentTimestamp":           "Sent-Timestamp",
+		"ApproximateReceiveCount": "Approximate-Receive-Count",
+		"MessageGroupId":          "Message-Group-Id",
+		"Name":                    "Name",
+		"":                        "",
+	} {
+		if actual := headerName(name); expected != actual {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+	}
+}
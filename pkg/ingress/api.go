@@ -0,0 +1,156 @@
+package ingress
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	errs "github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/metrics"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+// These are the ingress API URL paths.
+const (
+	APIPathRecords = "/records"
+)
+
+const (
+	// maxRecordSize is the largest body accepted, the same as the largest
+	// message SQS accepts.
+	maxRecordSize = 256 * 1024
+
+	// Headers that describe the record being pushed, with the same prefix and
+	// names as the headers records are delivered with.
+	headerAttributePrefix = errs.DefaultHeaderPrefix + "Attribute-"
+	headerMessageGroupID  = errs.DefaultHeaderPrefix + "Message-Group-Id"
+
+	// messageGroupID is the system attribute records keep their group in.
+	messageGroupID = "MessageGroupId"
+)
+
+// API serves the ingress API, which lets producers push records directly on
+// to a queue.
+type API struct {
+	queue    queue.Queue
+	logger   log.Logger
+	clients  metrics.Gauge
+	duration metrics.HistogramVec
+	errors   errs.Error
+}
+
+// NewAPI creates a API with the correct dependencies.
+func NewAPI(q queue.Queue,
+	logger log.Logger,
+	clients metrics.Gauge,
+	duration metrics.HistogramVec,
+) *API {
+	return &API{
+		queue:    q,
+		logger:   logger,
+		clients:  clients,
+		duration: duration,
+		errors:   errs.NewError(logger),
+	}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	level.Info(a.logger).Log("method", r.Method, "url", r.URL.String())
+
+	iw := &interceptingWriter{http.StatusOK, w}
+	w = iw
+
+	// Metrics
+	a.clients.Inc()
+	defer a.clients.Dec()
+
+	defer func(begin time.Time) {
+		a.duration.WithLabelValues(
+			r.Method,
+			r.URL.Path,
+			strconv.Itoa(iw.code),
+		).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	// Routing table
+	method, path := r.Method, r.URL.Path
+	switch {
+	case method == "POST" && path == APIPathRecords:
+		a.handleEnqueue(w, r)
+	default:
+		// Nothing found
+		a.errors.NotFound(w, r)
+	}
+}
+
+// handleEnqueue turns the body of the request into a record, with the message
+// attributes and group taken from the headers.
+func (a *API) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordSize))
+	if err != nil {
+		a.errors.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := uuid.New()
+	if err != nil {
+		a.errors.InternalServerError(w, r, err.Error())
+		return
+	}
+
+	attributes := make(map[string]string)
+	for name, values := range r.Header {
+		if len(values) == 0 || !strings.HasPrefix(name, headerAttributePrefix) {
+			continue
+		}
+		attributes[strings.TrimPrefix(name, headerAttributePrefix)] = values[0]
+	}
+
+	systemAttributes := make(map[string]string)
+	if group := r.Header.Get(headerMessageGroupID); group != "" {
+		systemAttributes[messageGroupID] = group
+	}
+
+	record := queue.NewRecord(id, id.String(), "", body, time.Now(), attributes, systemAttributes)
+	if err := a.queue.Enqueue(record); err != nil {
+		if errors.Cause(err) == queue.ErrQueueFull {
+			w.Header().Set("Retry-After", "1")
+			a.errors.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		a.errors.InternalServerError(w, r, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+
+	if err := json.NewEncoder(w).Encode(enqueued{
+		ID: id.String(),
+	}); err != nil {
+		level.Warn(a.logger).Log("state", "enqueue", "err", err)
+	}
+}
+
+type enqueued struct {
+	ID string `json:"id"`
+}
+
+type interceptingWriter struct {
+	code int
+	http.ResponseWriter
+}
+
+func (iw *interceptingWriter) WriteHeader(code int) {
+	iw.code = code
+	iw.ResponseWriter.WriteHeader(code)
+}
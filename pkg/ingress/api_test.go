@@ -0,0 +1,291 @@
+package ingress
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/fsys"
+)
+
+func TestAPI(t *testing.T) {
+	t.Parallel()
+
+	t.Run("enqueue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			que      = newTestQueue(t)
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(que, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("POST", "/records", "202").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		request, err := http.NewRequest("POST", fmt.Sprintf("%s/records", server.URL), strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-Courier-Attribute-Source", "webhook")
+		request.Header.Set("X-Courier-Message-Group-Id", "group")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusAccepted, response.StatusCode; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var body enqueued
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		records, err := que.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		record := records[0]
+		if expected, actual := body.ID, record.ID().String(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "hello", string(record.Body()); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "webhook", record.Attributes()["Source"]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "group", record.GroupID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("enqueue on disk", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			que      = newTestDiskQueue(t)
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(que, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("POST", "/records", "202").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		request, err := http.NewRequest("POST", fmt.Sprintf("%s/records", server.URL), strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-Courier-Message-Group-Id", "group")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusAccepted, response.StatusCode; expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		records, err := que.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "hello", string(records[0].Body()); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "group", records[0].GroupID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("enqueue when full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			que      = newTestQueue(t, queue.WithHTTPCapacity(1))
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(que, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(2)
+		clients.EXPECT().Dec().Times(2)
+
+		duration.EXPECT().WithLabelValues("POST", "/records", "202").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("POST", "/records", "429").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(2)
+
+		for _, code := range []int{http.StatusAccepted, http.StatusTooManyRequests} {
+			response, err := http.Post(fmt.Sprintf("%s/records", server.URL), "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if expected, actual := code, response.StatusCode; expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("enqueue too large", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			que      = newTestQueue(t)
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(que, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("POST", "/records", "413").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		body := strings.Repeat("a", maxRecordSize+1)
+		response, err := http.Post(fmt.Sprintf("%s/records", server.URL), "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if expected, actual := http.StatusRequestEntityTooLarge, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			que      = newTestQueue(t)
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(que, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("GET", "/records", "404").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		response, err := http.Get(fmt.Sprintf("%s/records", server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if expected, actual := http.StatusNotFound, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func newTestQueue(t *testing.T, opts ...queue.HTTPConfigOption) queue.Queue {
+	httpConfig, err := queue.BuildHTTPConfig(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := queue.Build(
+		queue.With("http"),
+		queue.WithHTTPConfig(httpConfig),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	que, err := queue.New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return que
+}
+
+func newTestDiskQueue(t *testing.T) queue.Queue {
+	diskConfig, err := queue.BuildDiskConfig(
+		queue.WithRootPath("queue"),
+		queue.WithFsys(fsys.NewVirtualFilesystem()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := queue.Build(
+		queue.With("disk"),
+		queue.WithDiskConfig(diskConfig),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	que, err := queue.New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return que
+}
+
+type float64Matcher struct{}
+
+func (float64Matcher) Matches(x interface{}) bool {
+	_, ok := x.(float64)
+	return ok
+}
+
+func (float64Matcher) String() string {
+	return "is float64"
+}
+
+func Float64() gomock.Matcher { return float64Matcher{} }
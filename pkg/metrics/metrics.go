@@ -17,6 +17,9 @@ type Gauge interface {
 	// Dec decrements the Gauge by 1. Use Sub to decrement it by arbitrary
 	// values.
 	Dec()
+
+	// Set sets the Gauge to an arbitrary value.
+	Set(float64)
 }
 
 // HistogramVec is a Collector that bundles a set of Histograms that all share the
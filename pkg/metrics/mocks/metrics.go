@@ -53,6 +53,16 @@ func (mr *MockGaugeMockRecorder) Inc() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Inc", reflect.TypeOf((*MockGauge)(nil).Inc))
 }
 
+// Set mocks base method
+func (m *MockGauge) Set(arg0 float64) {
+	m.ctrl.Call(m, "Set", arg0)
+}
+
+// Set indicates an expected call of Set
+func (mr *MockGaugeMockRecorder) Set(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockGauge)(nil).Set), arg0)
+}
+
 // MockHistogramVec is a mock of HistogramVec interface
 type MockHistogramVec struct {
 	ctrl     *gomock.Controller
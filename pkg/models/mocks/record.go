@@ -9,6 +9,7 @@ import (
 	models "github.com/trussle/courier/pkg/models"
 	uuid "github.com/trussle/uuid"
 	reflect "reflect"
+	time "time"
 )
 
 // MockRecord is a mock of Record interface
@@ -34,6 +35,30 @@ func (m *MockRecord) EXPECT() *MockRecordMockRecorder {
 	return m.recorder
 }
 
+// Attempts mocks base method
+func (m *MockRecord) Attempts() int {
+	ret := m.ctrl.Call(m, "Attempts")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Attempts indicates an expected call of Attempts
+func (mr *MockRecordMockRecorder) Attempts() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Attempts", reflect.TypeOf((*MockRecord)(nil).Attempts))
+}
+
+// Attributes mocks base method
+func (m *MockRecord) Attributes() map[string]string {
+	ret := m.ctrl.Call(m, "Attributes")
+	ret0, _ := ret[0].(map[string]string)
+	return ret0
+}
+
+// Attributes indicates an expected call of Attributes
+func (mr *MockRecordMockRecorder) Attributes() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Attributes", reflect.TypeOf((*MockRecord)(nil).Attributes))
+}
+
 // Body mocks base method
 func (m *MockRecord) Body() []byte {
 	ret := m.ctrl.Call(m, "Body")
@@ -82,6 +107,18 @@ func (mr *MockRecordMockRecorder) Failed(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Failed", reflect.TypeOf((*MockRecord)(nil).Failed), arg0)
 }
 
+// GroupID mocks base method
+func (m *MockRecord) GroupID() string {
+	ret := m.ctrl.Call(m, "GroupID")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GroupID indicates an expected call of GroupID
+func (mr *MockRecordMockRecorder) GroupID() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GroupID", reflect.TypeOf((*MockRecord)(nil).GroupID))
+}
+
 // ID mocks base method
 func (m *MockRecord) ID() uuid.UUID {
 	ret := m.ctrl.Call(m, "ID")
@@ -106,6 +143,18 @@ func (mr *MockRecordMockRecorder) Receipt() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Receipt", reflect.TypeOf((*MockRecord)(nil).Receipt))
 }
 
+// ReceivedAt mocks base method
+func (m *MockRecord) ReceivedAt() time.Time {
+	ret := m.ctrl.Call(m, "ReceivedAt")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// ReceivedAt indicates an expected call of ReceivedAt
+func (mr *MockRecordMockRecorder) ReceivedAt() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReceivedAt", reflect.TypeOf((*MockRecord)(nil).ReceivedAt))
+}
+
 // RecordID mocks base method
 func (m *MockRecord) RecordID() string {
 	ret := m.ctrl.Call(m, "RecordID")
@@ -117,3 +166,15 @@ func (m *MockRecord) RecordID() string {
 func (mr *MockRecordMockRecorder) RecordID() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordID", reflect.TypeOf((*MockRecord)(nil).RecordID))
 }
+
+// SystemAttributes mocks base method
+func (m *MockRecord) SystemAttributes() map[string]string {
+	ret := m.ctrl.Call(m, "SystemAttributes")
+	ret0, _ := ret[0].(map[string]string)
+	return ret0
+}
+
+// SystemAttributes indicates an expected call of SystemAttributes
+func (mr *MockRecordMockRecorder) SystemAttributes() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SystemAttributes", reflect.TypeOf((*MockRecord)(nil).SystemAttributes))
+}
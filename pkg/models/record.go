@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/trussle/uuid"
 )
 
@@ -19,6 +21,27 @@ type Record interface {
 	// Receipt is the underlying uniqueness associated with the message
 	Receipt() Receipt
 
+	// ReceivedAt is when the record was received from the underlying
+	// provider.
+	ReceivedAt() time.Time
+
+	// Attempts is the number of times the record has been received from the
+	// underlying provider, including the current one.
+	Attempts() int
+
+	// GroupID is the ordering group the record belongs to, records with in the
+	// same group should be delivered in order. Empty if the record has no
+	// group.
+	GroupID() string
+
+	// Attributes returns the message attributes that were sent along with the
+	// record.
+	Attributes() map[string]string
+
+	// SystemAttributes returns the attributes the underlying provider attached
+	// to the record, such as when it was sent.
+	SystemAttributes() map[string]string
+
 	// Equal another Record or not
 	Equal(Record) bool
 
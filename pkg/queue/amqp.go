@@ -0,0 +1,500 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
+)
+
+const (
+	defaultAMQPPrefetch = maxBatchEntries
+	defaultAMQPWaitTime = time.Second
+
+	// amqpDeliveryCount is the header quorum queues use to count how many
+	// times a message has been delivered.
+	amqpDeliveryCount = "x-delivery-count"
+
+	// amqpDeadLetterExchange is the queue argument naming the exchange that
+	// rejected messages are dead lettered to.
+	amqpDeadLetterExchange = "x-dead-letter-exchange"
+)
+
+// AMQPConfig creates a configuration to create an amqp queue.
+type AMQPConfig struct {
+	URL                string
+	Queue              string
+	DeadLetterExchange string
+	Prefetch           int
+	WaitTime           time.Duration
+}
+
+// amqpChannel is the part of an amqp channel that the queue relies on.
+type amqpChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple, requeue bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// amqpQueue consumes records from a queue with at most prefetch records
+// unacknowledged at once. Committed records are acknowledged and failed
+// records are rejected, either back on to the queue or to the dead letter
+// exchange of the queue when there is one.
+type amqpQueue struct {
+	mutex              sync.Mutex
+	dial               func() (amqpChannel, error)
+	channel            amqpChannel
+	deliveries         <-chan amqp.Delivery
+	generation         int
+	queue              string
+	deadLetterExchange string
+	prefetch           int
+	waitTime           time.Duration
+	held               map[string]uint64
+	logger             log.Logger
+}
+
+func newAMQPQueue(config *AMQPConfig, logger log.Logger) (Queue, error) {
+	if config == nil {
+		return nil, errors.New("missing config")
+	}
+	if config.URL == "" {
+		return nil, errors.New("missing url")
+	}
+	if config.Queue == "" {
+		return nil, errors.New("missing queue")
+	}
+
+	q := newAMQPQueueWithDial(func() (amqpChannel, error) {
+		return dialAMQP(config.URL)
+	}, config, logger)
+
+	// Connect straight away, so that a bad configuration is found early.
+	if err := q.connect(); err != nil {
+		return nil, err
+	}
+
+	level.Debug(logger).Log("queue", config.Queue, "dead_letter_exchange", config.DeadLetterExchange)
+
+	return q, nil
+}
+
+func newAMQPQueueWithDial(dial func() (amqpChannel, error), config *AMQPConfig, logger log.Logger) *amqpQueue {
+	q := &amqpQueue{
+		dial:               dial,
+		queue:              config.Queue,
+		deadLetterExchange: config.DeadLetterExchange,
+		prefetch:           config.Prefetch,
+		waitTime:           config.WaitTime,
+		held:               make(map[string]uint64),
+		logger:             logger,
+	}
+	if q.prefetch <= 0 {
+		q.prefetch = defaultAMQPPrefetch
+	}
+	if q.waitTime <= 0 {
+		q.waitTime = defaultAMQPWaitTime
+	}
+	return q
+}
+
+func (q *amqpQueue) Enqueue(rec models.Record) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := q.connect(); err != nil {
+		return err
+	}
+
+	headers := make(amqp.Table, len(rec.Attributes()))
+	for k, v := range rec.Attributes() {
+		headers[k] = v
+	}
+
+	if err := q.channel.Publish("", q.queue, false, false, amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         rec.Body(),
+	}); err != nil {
+		q.disconnect()
+		return errors.Wrap(err, "publishing")
+	}
+	return nil
+}
+
+// Dequeue waits for the first delivery, then takes whichever others have
+// already been delivered, up to the prefetch.
+func (q *amqpQueue) Dequeue() ([]models.Record, error) {
+	q.mutex.Lock()
+	if err := q.connect(); err != nil {
+		q.mutex.Unlock()
+		return make([]models.Record, 0), err
+	}
+	var (
+		deliveries = q.deliveries
+		generation = q.generation
+	)
+	q.mutex.Unlock()
+
+	var (
+		received []amqp.Delivery
+		closed   bool
+		timer    = time.NewTimer(q.waitTime)
+	)
+	defer timer.Stop()
+
+	select {
+	case delivery, ok := <-deliveries:
+		if ok {
+			received = append(received, delivery)
+		} else {
+			closed = true
+		}
+	case <-timer.C:
+	}
+
+RECEIVE:
+	for !closed && len(received) > 0 && len(received) < q.prefetch {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				closed = true
+				break RECEIVE
+			}
+			received = append(received, delivery)
+		default:
+			break RECEIVE
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if closed {
+		// The deliveries that haven't been acknowledged are requeued by the
+		// broker, so start again with a new channel on the next dequeue.
+		if generation == q.generation {
+			q.disconnect()
+		}
+		return make([]models.Record, 0), errors.New("channel closed")
+	}
+
+	var (
+		now     = time.Now()
+		records = make([]models.Record, 0, len(received))
+	)
+	for _, delivery := range received {
+		id, err := uuid.New()
+		if err != nil {
+			// Reject it straight back on to the queue, rather than leaving it
+			// unacknowledged until the channel closes.
+			if err := q.channel.Nack(delivery.DeliveryTag, false, true); err != nil {
+				level.Warn(q.logger).Log("state", "dequeue", "err", err)
+			}
+			continue
+		}
+
+		receipt := fmt.Sprintf("%d/%d", generation, delivery.DeliveryTag)
+		q.held[receipt] = delivery.DeliveryTag
+
+		messageID := delivery.MessageId
+		if messageID == "" {
+			messageID = receipt
+		}
+
+		records = append(records, NewRecord(
+			id,
+			messageID,
+			models.Receipt(receipt),
+			delivery.Body,
+			now,
+			amqpAttributes(delivery),
+			amqpSystemAttributes(delivery),
+		))
+	}
+	return records, nil
+}
+
+// Commit acknowledges the records.
+func (q *amqpQueue) Commit(txn models.Transaction) (Result, error) {
+	return q.settle(txn, func(tag uint64) error {
+		return q.channel.Ack(tag, false)
+	})
+}
+
+// Failed rejects the records, they're dead lettered if the queue has a dead
+// letter exchange, otherwise they're requeued.
+func (q *amqpQueue) Failed(txn models.Transaction) (Result, error) {
+	requeue := q.deadLetterExchange == ""
+	return q.settle(txn, func(tag uint64) error {
+		return q.channel.Nack(tag, false, requeue)
+	})
+}
+
+// Release rejects the records, which were never attempted, back on to the
+// queue, even if the queue has a dead letter exchange. The broker never
+// delivers them again otherwise, as they stay unacknowledged until the channel
+// closes.
+func (q *amqpQueue) Release(txn models.Transaction) (Result, error) {
+	return q.settle(txn, func(tag uint64) error {
+		return q.channel.Nack(tag, false, true)
+	})
+}
+
+// Extend has nothing to do, as the broker doesn't redeliver records whilst
+// the channel they were delivered on is open.
+func (q *amqpQueue) Extend(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		if _, ok := q.held[record.Receipt().String()]; !ok {
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+	return result, nil
+}
+
+// settle acknowledges or rejects the records that are still held. Records
+// delivered on a channel that has since closed are no longer held, as the
+// broker has already requeued them.
+func (q *amqpQueue) settle(txn models.Transaction, fn func(uint64) error) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		receipt := record.Receipt().String()
+		tag, ok := q.held[receipt]
+		if !ok {
+			result.Failure++
+			continue
+		}
+
+		if err := fn(tag); err != nil {
+			level.Warn(q.logger).Log("state", "settle", "receipt", receipt, "err", err)
+			// The channel is unusable once an acknowledgement fails, so the
+			// records that are held will be redelivered anyway.
+			q.disconnect()
+			result.Failure += len(records) - result.Success - result.Failure
+			return result, nil
+		}
+
+		delete(q.held, receipt)
+		result.Success++
+	}
+	return result, nil
+}
+
+// connect opens a channel and starts consuming, if there isn't one already.
+func (q *amqpQueue) connect() error {
+	if q.channel != nil {
+		return nil
+	}
+
+	channel, err := q.dial()
+	if err != nil {
+		return errors.Wrap(err, "dial")
+	}
+
+	var args amqp.Table
+	if q.deadLetterExchange != "" {
+		args = amqp.Table{
+			amqpDeadLetterExchange: q.deadLetterExchange,
+		}
+	}
+	if _, err := channel.QueueDeclare(q.queue, true, false, false, false, args); err != nil {
+		channel.Close()
+		return errors.Wrap(err, "declaring queue")
+	}
+	if err := channel.Qos(q.prefetch, 0, false); err != nil {
+		channel.Close()
+		return errors.Wrap(err, "qos")
+	}
+
+	deliveries, err := channel.Consume(q.queue, "", false, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return errors.Wrap(err, "consuming")
+	}
+
+	q.channel = channel
+	q.deliveries = deliveries
+	q.generation++
+	return nil
+}
+
+// disconnect closes the channel, forgetting about the records that are held,
+// as their delivery tags are only valid on the channel they came from.
+func (q *amqpQueue) disconnect() {
+	if q.channel == nil {
+		return
+	}
+	if err := q.channel.Close(); err != nil {
+		level.Warn(q.logger).Log("state", "disconnect", "err", err)
+	}
+	q.channel = nil
+	q.deliveries = nil
+	q.held = make(map[string]uint64)
+}
+
+func amqpAttributes(delivery amqp.Delivery) map[string]string {
+	attributes := make(map[string]string, len(delivery.Headers))
+	for k, v := range delivery.Headers {
+		if k == amqpDeliveryCount {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			attributes[k] = s
+			continue
+		}
+		attributes[k] = fmt.Sprint(v)
+	}
+	return attributes
+}
+
+func amqpSystemAttributes(delivery amqp.Delivery) map[string]string {
+	attempts := 1
+	switch count := delivery.Headers[amqpDeliveryCount].(type) {
+	case int64:
+		attempts = int(count) + 1
+	case int32:
+		attempts = int(count) + 1
+	case int:
+		attempts = count + 1
+	default:
+		if delivery.Redelivered {
+			attempts = 2
+		}
+	}
+
+	attributes := map[string]string{
+		approximateReceiveCount: strconv.Itoa(attempts),
+	}
+	if !delivery.Timestamp.IsZero() {
+		attributes[sentTimestamp] = strconv.FormatInt(delivery.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return attributes
+}
+
+// amqpConnection is a channel that closes the connection it belongs to, when
+// it's closed.
+type amqpConnection struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func dialAMQP(url string) (amqpChannel, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return amqpConnection{
+		Channel: channel,
+		conn:    conn,
+	}, nil
+}
+
+func (c amqpConnection) Close() error {
+	// Closing the connection closes the channel with it.
+	return c.conn.Close()
+}
+
+// AMQPConfigOption defines a option for generating a AMQPConfig
+type AMQPConfigOption func(*AMQPConfig) error
+
+// BuildAMQPConfig ingests configuration options to then yield a AMQPConfig,
+// and return an error if it fails during configuring.
+func BuildAMQPConfig(opts ...AMQPConfigOption) (*AMQPConfig, error) {
+	config := AMQPConfig{
+		Prefetch: defaultAMQPPrefetch,
+		WaitTime: defaultAMQPWaitTime,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithAMQPURL adds an URL option to the configuration
+func WithAMQPURL(url string) AMQPConfigOption {
+	return func(config *AMQPConfig) error {
+		config.URL = url
+		return nil
+	}
+}
+
+// WithAMQPQueue adds an Queue option to the configuration
+func WithAMQPQueue(queue string) AMQPConfigOption {
+	return func(config *AMQPConfig) error {
+		config.Queue = queue
+		return nil
+	}
+}
+
+// WithAMQPDeadLetterExchange adds an DeadLetterExchange option to the
+// configuration, which failed records are dead lettered to instead of being
+// requeued
+func WithAMQPDeadLetterExchange(exchange string) AMQPConfigOption {
+	return func(config *AMQPConfig) error {
+		config.DeadLetterExchange = exchange
+		return nil
+	}
+}
+
+// WithAMQPPrefetch adds an Prefetch option to the configuration, which is the
+// max number of records that are unacknowledged at once
+func WithAMQPPrefetch(prefetch int) AMQPConfigOption {
+	return func(config *AMQPConfig) error {
+		if prefetch <= 0 {
+			return errors.Errorf("invalid prefetch %d", prefetch)
+		}
+		config.Prefetch = prefetch
+		return nil
+	}
+}
+
+// WithAMQPWaitTime adds an WaitTime option to the configuration, which is how
+// long a dequeue waits for records
+func WithAMQPWaitTime(waitTime time.Duration) AMQPConfigOption {
+	return func(config *AMQPConfig) error {
+		if waitTime <= 0 {
+			return errors.Errorf("invalid wait time %s", waitTime)
+		}
+		config.WaitTime = waitTime
+		return nil
+	}
+}
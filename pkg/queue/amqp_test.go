@@ -0,0 +1,541 @@
+package queue
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+func TestAMQPQueue(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		fn := func(body []byte, name, value string) bool {
+			var (
+				broker = newAMQPBroker()
+				queue  = newTestAMQPQueue(broker, "")
+			)
+
+			record := NewRecord(newID(t, rnd), "", "", body, time.Now(), map[string]string{
+				name: value,
+			}, nil)
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+
+			records := dequeueRecords(t, queue)
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			res := records[0]
+			if expected, actual := 1, res.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := value, res.Attributes()[name]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return string(body) == string(res.Body())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dequeue is bounded by prefetch", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "")
+		)
+
+		enqueueRecords(t, rnd, queue, defaultAMQPPrefetch+2)
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := defaultAMQPPrefetch, len(records); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		if _, err := queue.Commit(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 2, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit acknowledges", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "")
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{2, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, broker.len("courier"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		res, err = queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 2}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("failed requeues", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "")
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Failed(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		records = dequeueRecords(t, queue)
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed dead letters", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "courier-dlx")
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		if _, err := queue.Failed(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := []string{string(records[0].Body())}, broker.deadLettered("courier-dlx"); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("release requeues", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "courier-dlx")
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Release(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// The record is never dead lettered, and it's no longer held.
+		if expected, actual := 0, len(broker.deadLettered("courier-dlx")); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		res, err = queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		released := dequeueRecords(t, queue)
+		if expected, actual := 1, len(released); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := string(records[0].Body()), string(released[0].Body()); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "")
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		if _, err := queue.Commit(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := queue.Extend(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		var (
+			broker = newAMQPBroker()
+			queue  = newTestAMQPQueue(broker, "")
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		broker.closeChannels()
+
+		if _, err := queue.Dequeue(); err == nil {
+			t.Errorf("expected error")
+		}
+
+		// The records were requeued by the broker, so they can't be committed
+		// any more, but are delivered again.
+		res, err := queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 2}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		records = dequeueRecords(t, queue)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		queue := newAMQPQueueWithDial(func() (amqpChannel, error) {
+			return nil, errors.New("bad")
+		}, &AMQPConfig{Queue: "courier"}, log.NewNopLogger())
+
+		if _, err := queue.Dequeue(); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestBuildAMQPConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(url, queue, exchange string, prefetch uint8, waitTime uint32) bool {
+			config, err := BuildAMQPConfig(
+				WithAMQPURL(url),
+				WithAMQPQueue(queue),
+				WithAMQPDeadLetterExchange(exchange),
+				WithAMQPPrefetch(int(prefetch)+1),
+				WithAMQPWaitTime(time.Duration(waitTime)+1),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.URL == url &&
+				config.Queue == queue &&
+				config.DeadLetterExchange == exchange &&
+				config.Prefetch == int(prefetch)+1 &&
+				config.WaitTime == time.Duration(waitTime)+1
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []AMQPConfigOption{
+			WithAMQPPrefetch(0),
+			WithAMQPWaitTime(0),
+		} {
+			_, err := BuildAMQPConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("invalid queue", func(t *testing.T) {
+		for _, opts := range [][]AMQPConfigOption{
+			{WithAMQPQueue("courier")},
+			{WithAMQPURL("amqp://localhost:5672")},
+		} {
+			config, err := BuildAMQPConfig(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = newAMQPQueue(config, log.NewNopLogger())
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func newTestAMQPQueue(broker *amqpBroker, deadLetterExchange string) *amqpQueue {
+	return newAMQPQueueWithDial(broker.channel, &AMQPConfig{
+		Queue:              "courier",
+		DeadLetterExchange: deadLetterExchange,
+		WaitTime:           10 * time.Millisecond,
+	}, log.NewNopLogger())
+}
+
+// amqpBroker is an in-process stand in for an amqp broker, with queues that
+// dead letter to exchanges that hold on to the messages.
+type amqpBroker struct {
+	mutex       sync.Mutex
+	queues      map[string][]amqp.Delivery
+	deadLetters map[string][]amqp.Delivery
+	exchanges   map[string]string
+	channels    []*amqpStubChannel
+}
+
+func newAMQPBroker() *amqpBroker {
+	return &amqpBroker{
+		queues:      make(map[string][]amqp.Delivery),
+		deadLetters: make(map[string][]amqp.Delivery),
+		exchanges:   make(map[string]string),
+	}
+}
+
+func (b *amqpBroker) channel() (amqpChannel, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	channel := &amqpStubChannel{
+		broker:  b,
+		unacked: make(map[uint64]amqp.Delivery),
+	}
+	b.channels = append(b.channels, channel)
+	return channel, nil
+}
+
+func (b *amqpBroker) len(queue string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	n := len(b.queues[queue])
+	for _, channel := range b.channels {
+		if channel.queue == queue {
+			n += len(channel.unacked)
+		}
+	}
+	return n
+}
+
+func (b *amqpBroker) deadLettered(exchange string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var bodies []string
+	for _, delivery := range b.deadLetters[exchange] {
+		bodies = append(bodies, string(delivery.Body))
+	}
+	return bodies
+}
+
+func (b *amqpBroker) closeChannels() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, channel := range b.channels {
+		channel.close()
+	}
+}
+
+// pump delivers messages to the channels consuming from the queue, whilst
+// they're under their prefetch.
+func (b *amqpBroker) pump(queue string) {
+	for _, channel := range b.channels {
+		if channel.closed || channel.deliveries == nil || channel.queue != queue {
+			continue
+		}
+		for len(b.queues[queue]) > 0 && len(channel.unacked) < channel.prefetch {
+			delivery := b.queues[queue][0]
+			b.queues[queue] = b.queues[queue][1:]
+
+			channel.tag++
+			delivery.DeliveryTag = channel.tag
+			channel.unacked[channel.tag] = delivery
+			channel.deliveries <- delivery
+		}
+	}
+}
+
+type amqpStubChannel struct {
+	broker     *amqpBroker
+	queue      string
+	prefetch   int
+	tag        uint64
+	unacked    map[uint64]amqp.Delivery
+	deliveries chan amqp.Delivery
+	closed     bool
+}
+
+func (c *amqpStubChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+
+	c.prefetch = prefetchCount
+	return nil
+}
+
+func (c *amqpStubChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if exchange, ok := args[amqpDeadLetterExchange].(string); ok {
+		b.exchanges[name] = exchange
+	}
+	return amqp.Queue{Name: name, Messages: len(b.queues[name])}, nil
+}
+
+func (c *amqpStubChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return nil, errors.New("channel closed")
+	}
+
+	c.queue = queue
+	c.deliveries = make(chan amqp.Delivery, 1024)
+	b.pump(queue)
+	return c.deliveries, nil
+}
+
+func (c *amqpStubChannel) Ack(tag uint64, multiple bool) error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := c.unacked[tag]; !ok || c.closed {
+		return errors.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(c.unacked, tag)
+	b.pump(c.queue)
+	return nil
+}
+
+func (c *amqpStubChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delivery, ok := c.unacked[tag]
+	if !ok || c.closed {
+		return errors.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(c.unacked, tag)
+
+	if requeue {
+		delivery.Redelivered = true
+		b.queues[c.queue] = append([]amqp.Delivery{delivery}, b.queues[c.queue]...)
+	} else if exchange, ok := b.exchanges[c.queue]; ok {
+		b.deadLetters[exchange] = append(b.deadLetters[exchange], delivery)
+	}
+	b.pump(c.queue)
+	return nil
+}
+
+func (c *amqpStubChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c.closed {
+		return errors.New("channel closed")
+	}
+
+	b.queues[key] = append(b.queues[key], amqp.Delivery{
+		Headers:      msg.Headers,
+		DeliveryMode: msg.DeliveryMode,
+		MessageId:    msg.MessageId,
+		Timestamp:    msg.Timestamp,
+		Exchange:     exchange,
+		RoutingKey:   key,
+		Body:         msg.Body,
+	})
+	b.pump(key)
+	return nil
+}
+
+func (c *amqpStubChannel) Close() error {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+
+	c.close()
+	return nil
+}
+
+// close requeues every delivery that hasn't been acknowledged, in the order
+// they were delivered.
+func (c *amqpStubChannel) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	tags := make([]uint64, 0, len(c.unacked))
+	for tag := range c.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	requeued := make([]amqp.Delivery, 0, len(tags))
+	for _, tag := range tags {
+		delivery := c.unacked[tag]
+		delivery.Redelivered = true
+		requeued = append(requeued, delivery)
+	}
+	c.broker.queues[c.queue] = append(requeued, c.broker.queues[c.queue]...)
+	c.unacked = make(map[uint64]amqp.Delivery)
+
+	if c.deliveries != nil {
+		close(c.deliveries)
+	}
+}
@@ -0,0 +1,655 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
+)
+
+const (
+	segmentExt   = ".segment"
+	diskLockFile = "LOCK"
+
+	defaultLeaseTimeout = 30 * time.Second
+	defaultSegmentSize  = 16 * 1024 * 1024
+	defaultBatchSize    = maxBatchEntries
+)
+
+// The operations written to the segment log.
+const (
+	opEnqueue = "enqueue"
+	opReceive = "receive"
+	opCommit  = "commit"
+)
+
+// DiskConfig creates a configuration to create a disk queue.
+type DiskConfig struct {
+	RootPath     string
+	Fsys         fsys.Filesystem
+	LeaseTimeout time.Duration
+	SegmentSize  int64
+	BatchSize    int
+	Redelivery   RedeliveryPolicy
+}
+
+// diskQueue stores records in an append-only log of segments, so that they
+// survive restarts. Records that are dequeued are leased, hiding them from
+// other dequeues until the lease runs out, they're committed or they fail.
+// Leases aren't persisted, so every record that isn't committed is visible
+// again after a restart.
+type diskQueue struct {
+	mutex        sync.Mutex
+	root         string
+	fsys         fsys.Filesystem
+	lock         fsys.Releaser
+	segment      fsys.File
+	seq          uint64
+	written      int64
+	removed      int
+	segmentSize  int64
+	leaseTimeout time.Duration
+	batchSize    int
+	redelivery   RedeliveryPolicy
+	entries      []*diskEntry
+	index        map[string]*diskEntry
+	now          func() time.Time
+	logger       log.Logger
+}
+
+// diskEntry is a record that's on the queue.
+type diskEntry struct {
+	MessageID  string            `json:"message_id"`
+	Body       []byte            `json:"body"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	GroupID    string            `json:"group_id,omitempty"`
+	SentAt     int64             `json:"sent_at"`
+	Receives   int               `json:"receives"`
+
+	receipt   string
+	visibleAt time.Time
+	removed   bool
+}
+
+// diskOp is a line in the segment log.
+type diskOp struct {
+	Op    string     `json:"op"`
+	Entry *diskEntry `json:"entry,omitempty"`
+	IDs   []string   `json:"ids,omitempty"`
+}
+
+func newDiskQueue(config *DiskConfig, logger log.Logger) (Queue, error) {
+	var (
+		fsys = config.Fsys
+		root = config.RootPath
+	)
+	if fsys == nil {
+		return nil, errors.New("missing filesystem")
+	}
+	if err := fsys.MkdirAll(root); err != nil {
+		return nil, errors.Wrapf(err, "creating path %s", root)
+	}
+
+	lock := filepath.Join(root, diskLockFile)
+	releaser, _, err := fsys.Lock(lock)
+	if err != nil {
+		return nil, errors.Wrapf(err, "locking %s", lock)
+	}
+
+	q := &diskQueue{
+		root:         root,
+		fsys:         fsys,
+		lock:         releaser,
+		segmentSize:  config.SegmentSize,
+		leaseTimeout: config.LeaseTimeout,
+		batchSize:    config.BatchSize,
+		redelivery:   config.Redelivery,
+		index:        make(map[string]*diskEntry),
+		now:          time.Now,
+		logger:       logger,
+	}
+	if q.segmentSize <= 0 {
+		q.segmentSize = defaultSegmentSize
+	}
+	if q.leaseTimeout <= 0 {
+		q.leaseTimeout = defaultLeaseTimeout
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = defaultBatchSize
+	}
+
+	segments, err := q.segments()
+	if err != nil {
+		releaser.Release()
+		return nil, errors.Wrap(err, "finding segments")
+	}
+	for _, path := range segments {
+		if err := q.replay(path); err != nil {
+			releaser.Release()
+			return nil, errors.Wrapf(err, "replaying %s", path)
+		}
+	}
+
+	// Start with a fresh segment, that only holds the records that are still
+	// on the queue.
+	if err := q.roll(); err != nil {
+		releaser.Release()
+		return nil, errors.Wrap(err, "rolling segment")
+	}
+
+	level.Debug(logger).Log("state", "recovered", "segments", len(segments), "records", len(q.index))
+
+	return q, nil
+}
+
+func (q *diskQueue) Enqueue(rec models.Record) error {
+	id, err := uuid.New()
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entry := &diskEntry{
+		MessageID:  id.String(),
+		Body:       rec.Body(),
+		Attributes: rec.Attributes(),
+		GroupID:    rec.GroupID(),
+		SentAt:     q.now().UnixNano() / int64(time.Millisecond),
+	}
+	if err := q.write(diskOp{Op: opEnqueue, Entry: entry}); err != nil {
+		return err
+	}
+
+	q.entries = append(q.entries, entry)
+	q.index[entry.MessageID] = entry
+
+	q.checkpoint()
+
+	return nil
+}
+
+func (q *diskQueue) Dequeue() ([]models.Record, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var (
+		now     = q.now()
+		entries []*diskEntry
+		// held are the groups with a record that's leased, no other records
+		// are dequeued from them until it's done, so they stay in order.
+		held = make(map[string]bool)
+	)
+	for _, entry := range q.entries {
+		if entry.removed {
+			continue
+		}
+		if len(entries) >= q.batchSize {
+			break
+		}
+
+		visible := !entry.visibleAt.After(now)
+		if entry.GroupID != "" && (held[entry.GroupID] || !visible) {
+			held[entry.GroupID] = true
+			continue
+		}
+		if !visible {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return make([]models.Record, 0), nil
+	}
+
+	ids := make([]string, len(entries))
+	for k, entry := range entries {
+		ids[k] = entry.MessageID
+	}
+	if err := q.write(diskOp{Op: opReceive, IDs: ids}); err != nil {
+		return make([]models.Record, 0), err
+	}
+
+	records := make([]models.Record, 0, len(entries))
+	for _, entry := range entries {
+		entry.Receives++
+		entry.receipt = fmt.Sprintf("%s/%d", entry.MessageID, entry.Receives)
+		entry.visibleAt = now.Add(q.leaseTimeout)
+
+		id, err := uuid.New()
+		if err != nil {
+			// The record has been received, so it'll be visible again once
+			// the lease runs out.
+			continue
+		}
+
+		records = append(records, NewRecord(
+			id,
+			entry.MessageID,
+			models.Receipt(entry.receipt),
+			entry.Body,
+			now,
+			entry.Attributes,
+			entry.systemAttributes(),
+		))
+	}
+
+	q.checkpoint()
+
+	return records, nil
+}
+
+func (q *diskQueue) Commit(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, _, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(entries) == 0 {
+		return result, nil
+	}
+
+	ids := make([]string, len(entries))
+	for k, entry := range entries {
+		ids[k] = entry.MessageID
+	}
+	if err := q.write(diskOp{Op: opCommit, IDs: ids}); err != nil {
+		return Result{}, err
+	}
+
+	for _, id := range ids {
+		q.remove(id)
+	}
+
+	q.checkpoint()
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// Failed hands the records back to the queue, they become visible again once
+// the redelivery policy allows, or when the lease runs out otherwise.
+func (q *diskQueue) Failed(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, records, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if q.redelivery.Enabled() {
+		now := q.now()
+		for k, entry := range entries {
+			entry.visibleAt = now.Add(q.redelivery.Backoff(records[k]))
+		}
+	}
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// Extend renews the lease of the records.
+func (q *diskQueue) Extend(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, _, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	now := q.now()
+	for _, entry := range entries {
+		entry.visibleAt = now.Add(q.leaseTimeout)
+	}
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// leased returns the entries, along with their records, for the records in
+// the transaction that are still held with the receipt they were dequeued
+// with. Records that have since been dequeued again, or that have been
+// committed, count as failures.
+func (q *diskQueue) leased(txn models.Transaction) ([]*diskEntry, []models.Record, Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return nil, nil, Result{}, err
+	}
+
+	var (
+		result  Result
+		entries = make([]*diskEntry, 0, len(records))
+		held    = make([]models.Record, 0, len(records))
+	)
+	for _, record := range records {
+		entry, ok := q.index[record.RecordID()]
+		if !ok || entry.receipt != record.Receipt().String() {
+			result.Failure++
+			continue
+		}
+		entries = append(entries, entry)
+		held = append(held, record)
+	}
+	return entries, held, result, nil
+}
+
+// remove the entry from the queue. The entry is only marked as removed, so
+// that removing it isn't a scan of the queue, and the removed entries are
+// dropped once they make up most of the queue.
+func (q *diskQueue) remove(id string) {
+	entry, ok := q.index[id]
+	if !ok {
+		return
+	}
+	delete(q.index, id)
+
+	entry.removed = true
+	q.removed++
+	if q.removed > len(q.entries)/2 {
+		q.compact()
+	}
+}
+
+// compact drops the removed entries, keeping the rest in order.
+func (q *diskQueue) compact() {
+	entries := make([]*diskEntry, 0, len(q.index))
+	for _, entry := range q.entries {
+		if !entry.removed {
+			entries = append(entries, entry)
+		}
+	}
+	q.entries = entries
+	q.removed = 0
+}
+
+// write appends the operation to the current segment.
+func (q *diskQueue) write(op diskOp) error {
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	n, err := q.segment.Write(append(b, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "writing segment")
+	}
+	if err := q.segment.Sync(); err != nil {
+		return errors.Wrap(err, "syncing segment")
+	}
+
+	q.written += int64(n)
+	return nil
+}
+
+// checkpoint rolls over to a new segment once the operations written since
+// the last snapshot are as big as a segment. The snapshot isn't counted, so
+// that a backlog bigger than a segment doesn't roll on every operation. It
+// has to be called once an operation has been both written and applied, so
+// that the snapshot in the new segment matches the log.
+func (q *diskQueue) checkpoint() {
+	if q.written < q.segmentSize {
+		return
+	}
+
+	if err := q.roll(); err != nil {
+		// Everything is safely written, so carry on with the current segment
+		// and try rolling again on the next write.
+		level.Warn(q.logger).Log("state", "roll", "err", err)
+	}
+}
+
+// roll starts a new segment with a snapshot of the records still on the
+// queue, before removing all the older segments.
+func (q *diskQueue) roll() error {
+	path := filepath.Join(q.root, fmt.Sprintf("%020d%s", q.seq+1, segmentExt))
+
+	file, err := q.fsys.Create(path)
+	if err != nil {
+		return err
+	}
+
+	q.compact()
+
+	var snapshot int64
+	for _, entry := range q.entries {
+		b, err := json.Marshal(diskOp{Op: opEnqueue, Entry: entry})
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		n, err := file.Write(append(b, '\n'))
+		if err != nil {
+			file.Close()
+			return err
+		}
+		snapshot += int64(n)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if q.segment != nil {
+		if err := q.segment.Close(); err != nil {
+			level.Warn(q.logger).Log("state", "roll", "action", "close", "err", err)
+		}
+	}
+	q.segment = file
+	q.seq++
+	q.written = 0
+
+	level.Debug(q.logger).Log("state", "roll", "segment", path, "records", len(q.entries), "snapshot", snapshot)
+
+	// Everything is in the new segment, so the older segments can go.
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+	for _, v := range segments {
+		if v == path {
+			continue
+		}
+		if err := q.fsys.Remove(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segments returns the paths of all the segments, oldest first.
+func (q *diskQueue) segments() ([]string, error) {
+	var paths []string
+	if err := q.fsys.Walk(q.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != segmentExt {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// replay applies the operations in the segment to the queue.
+func (q *diskQueue) replay(path string) error {
+	name := strings.TrimSuffix(filepath.Base(path), segmentExt)
+	seq, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid segment name %s", name)
+	}
+	if seq > q.seq {
+		q.seq = seq
+	}
+
+	file, err := q.fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var op diskOp
+			if e := json.Unmarshal(line, &op); e != nil {
+				// A write that was cut short, skip it.
+				level.Warn(q.logger).Log("state", "replay", "segment", path, "err", e)
+			} else {
+				q.apply(op)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (q *diskQueue) apply(op diskOp) {
+	switch op.Op {
+	case opEnqueue:
+		if op.Entry == nil {
+			return
+		}
+		if existing, ok := q.index[op.Entry.MessageID]; ok {
+			*existing = *op.Entry
+			return
+		}
+		q.entries = append(q.entries, op.Entry)
+		q.index[op.Entry.MessageID] = op.Entry
+	case opReceive:
+		for _, id := range op.IDs {
+			if entry, ok := q.index[id]; ok {
+				entry.Receives++
+			}
+		}
+	case opCommit:
+		for _, id := range op.IDs {
+			q.remove(id)
+		}
+	}
+}
+
+func (e *diskEntry) systemAttributes() map[string]string {
+	attributes := map[string]string{
+		approximateReceiveCount: strconv.Itoa(e.Receives),
+		sentTimestamp:           strconv.FormatInt(e.SentAt, 10),
+	}
+	if e.GroupID != "" {
+		attributes[messageGroupID] = e.GroupID
+	}
+	return attributes
+}
+
+// DiskConfigOption defines a option for generating a DiskConfig
+type DiskConfigOption func(*DiskConfig) error
+
+// BuildDiskConfig ingests configuration options to then yield a DiskConfig,
+// and return an error if it fails during configuring.
+func BuildDiskConfig(opts ...DiskConfigOption) (*DiskConfig, error) {
+	config := DiskConfig{
+		LeaseTimeout: defaultLeaseTimeout,
+		SegmentSize:  defaultSegmentSize,
+		BatchSize:    defaultBatchSize,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithRootPath adds an RootPath option to the configuration
+func WithRootPath(rootPath string) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		config.RootPath = rootPath
+		return nil
+	}
+}
+
+// WithFsys adds an Fsys option to the configuration
+func WithFsys(fsys fsys.Filesystem) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		config.Fsys = fsys
+		return nil
+	}
+}
+
+// WithLeaseTimeout adds an LeaseTimeout option to the configuration, which is
+// how long dequeued records are hidden for
+func WithLeaseTimeout(leaseTimeout time.Duration) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		if leaseTimeout <= 0 {
+			return errors.Errorf("invalid lease timeout %s", leaseTimeout)
+		}
+		config.LeaseTimeout = leaseTimeout
+		return nil
+	}
+}
+
+// WithSegmentSize adds an SegmentSize option to the configuration, which is
+// how big a segment can get before a new one is started
+func WithSegmentSize(segmentSize int64) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		if segmentSize <= 0 {
+			return errors.Errorf("invalid segment size %d", segmentSize)
+		}
+		config.SegmentSize = segmentSize
+		return nil
+	}
+}
+
+// WithBatchSize adds an BatchSize option to the configuration, which is the
+// max number of records to dequeue at once
+func WithBatchSize(batchSize int) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		if batchSize <= 0 {
+			return errors.Errorf("invalid batch size %d", batchSize)
+		}
+		config.BatchSize = batchSize
+		return nil
+	}
+}
+
+// WithDiskRedelivery adds a policy for when failed records are redelivered to
+// the configuration
+func WithDiskRedelivery(policy RedeliveryPolicy) DiskConfigOption {
+	return func(config *DiskConfig) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		config.Redelivery = policy
+		return nil
+	}
+}
@@ -0,0 +1,477 @@
+package queue
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/fsys"
+	"github.com/trussle/uuid"
+)
+
+func TestDiskQueue(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		fn := func(body []byte, name, value string) bool {
+			queue := newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+
+			record := NewRecord(newID(t, rnd), "", "", body, time.Now(), map[string]string{
+				name: value,
+			}, nil)
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := queue.Dequeue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			res := records[0]
+			if expected, actual := 1, res.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := value, res.Attributes()[name]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return string(body) == string(res.Body())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dequeue leases records", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 2)
+
+		if expected, actual := 2, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Once the lease runs out, they're visible again
+		now = now.Add(defaultLeaseTimeout)
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 3)
+
+		res, err := queue.Commit(newTestTransaction(t, dequeueRecords(t, queue)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{3, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		now = now.Add(defaultLeaseTimeout)
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit with stale receipt", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		stale := dequeueRecords(t, queue)
+		now = now.Add(defaultLeaseTimeout)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Commit(newTestTransaction(t, stale...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		res, err = queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		res, err := queue.Failed(newTestTransaction(t, dequeueRecords(t, queue)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Without a redelivery policy, the record waits for the lease
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed with redelivery", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem(), WithDiskRedelivery(RedeliveryPolicy{
+				Strategy: RedeliverZero,
+			}))
+			now = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		if _, err := queue.Failed(newTestTransaction(t, dequeueRecords(t, queue)...)); err != nil {
+			t.Fatal(err)
+		}
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		var (
+			queue = newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		now = now.Add(defaultLeaseTimeout / 2)
+		res, err := queue.Extend(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		now = now.Add(defaultLeaseTimeout / 2)
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("dequeue keeps groups in order", func(t *testing.T) {
+		queue := newTestDiskQueue(t, fsys.NewVirtualFilesystem())
+
+		for _, group := range []string{"a", "a", "b"} {
+			record := NewRecord(newID(t, rnd), "", "", []byte(group), time.Now(), nil, map[string]string{
+				messageGroupID: group,
+			})
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		queue.batchSize = 1
+		first := dequeueRecords(t, queue)
+
+		queue.batchSize = defaultBatchSize
+		records := dequeueRecords(t, queue)
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "b", string(records[0].Body()); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		if _, err := queue.Commit(newTestTransaction(t, first...)); err != nil {
+			t.Fatal(err)
+		}
+		records = dequeueRecords(t, queue)
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "a", records[0].GroupID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		fs := fsys.NewVirtualFilesystem()
+
+		queue := newTestDiskQueue(t, fs)
+		enqueueRecords(t, rnd, queue, 3)
+
+		records := dequeueRecords(t, queue)
+		if _, err := queue.Commit(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newTestDiskQueue(t, fs)
+
+		records = dequeueRecords(t, restarted)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for _, record := range records {
+			if expected, actual := 2, record.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("restart with rolled segments", func(t *testing.T) {
+		fs := fsys.NewVirtualFilesystem()
+
+		queue := newTestDiskQueue(t, fs, WithSegmentSize(256), WithBatchSize(2))
+		enqueueRecords(t, rnd, queue, 20)
+
+		for i := 0; i < 5; i++ {
+			records := dequeueRecords(t, queue)
+			if _, err := queue.Commit(newTestTransaction(t, records...)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		restarted := newTestDiskQueue(t, fs, WithSegmentSize(256))
+		if expected, actual := 10, len(restarted.index); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := []string{restarted.segment.Name()}, diskSegments(t, fs); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("roll with a backlog bigger than a segment", func(t *testing.T) {
+		queue := newTestDiskQueue(t, fsys.NewVirtualFilesystem(), WithSegmentSize(4096))
+
+		// Every enqueue writes less than half a segment, so it takes at least
+		// three of them to fill one, however big the backlog gets.
+		var (
+			seq  = queue.seq
+			body = make([]byte, 1024)
+		)
+		for i := 0; i < 99; i++ {
+			if err := queue.Enqueue(NewRecord(newID(t, rnd), "", "", body, time.Now(), nil, nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if expected, actual := true, queue.seq-seq <= 33; expected != actual {
+			t.Errorf("expected: %t, actual: %t (%d rolls)", expected, actual, queue.seq-seq)
+		}
+		if expected, actual := 99, len(queue.index); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit keeps the rest in order", func(t *testing.T) {
+		queue := newTestDiskQueue(t, fsys.NewVirtualFilesystem(), WithBatchSize(1))
+		enqueueRecords(t, rnd, queue, 4)
+
+		var committed []string
+		for i := 0; i < 2; i++ {
+			records := dequeueRecords(t, queue)
+			if _, err := queue.Commit(newTestTransaction(t, records...)); err != nil {
+				t.Fatal(err)
+			}
+			committed = append(committed, records[0].RecordID())
+		}
+
+		// The committed records are dropped, leaving the rest in the order
+		// they were enqueued.
+		var ids []string
+		for _, entry := range queue.entries {
+			if !entry.removed {
+				ids = append(ids, entry.MessageID)
+			}
+		}
+		if expected, actual := 2, len(ids); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for _, id := range committed {
+			if _, ok := queue.index[id]; ok {
+				t.Errorf("expected: %s to be removed", id)
+			}
+		}
+		if expected, actual := ids[0], dequeueRecords(t, queue)[0].RecordID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("restart with a torn write", func(t *testing.T) {
+		fs := fsys.NewVirtualFilesystem()
+
+		queue := newTestDiskQueue(t, fs)
+		enqueueRecords(t, rnd, queue, 1)
+
+		if _, err := queue.segment.Write([]byte(`{"op":"enq`)); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newTestDiskQueue(t, fs)
+		if expected, actual := 1, len(restarted.index); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestBuildDiskConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(rootPath string, leaseTimeout, segmentSize uint32, batchSize uint8) bool {
+			fs := fsys.NewVirtualFilesystem()
+			config, err := BuildDiskConfig(
+				WithRootPath(rootPath),
+				WithFsys(fs),
+				WithLeaseTimeout(time.Duration(leaseTimeout)+1),
+				WithSegmentSize(int64(segmentSize)+1),
+				WithBatchSize(int(batchSize)+1),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.RootPath == rootPath &&
+				config.Fsys == fs &&
+				config.LeaseTimeout == time.Duration(leaseTimeout)+1 &&
+				config.SegmentSize == int64(segmentSize)+1 &&
+				config.BatchSize == int(batchSize)+1
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []DiskConfigOption{
+			WithLeaseTimeout(0),
+			WithSegmentSize(0),
+			WithBatchSize(0),
+			WithDiskRedelivery(RedeliveryPolicy{Delay: -time.Second}),
+			func(config *DiskConfig) error {
+				return errors.Errorf("bad")
+			},
+		} {
+			_, err := BuildDiskConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func newTestDiskQueue(t *testing.T, fs fsys.Filesystem, opts ...DiskConfigOption) *diskQueue {
+	config, err := BuildDiskConfig(append([]DiskConfigOption{
+		WithRootPath("queue"),
+		WithFsys(fs),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := newDiskQueue(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.(*diskQueue)
+}
+
+func enqueueRecords(t *testing.T, rnd *rand.Rand, queue Queue, n int) {
+	for i := 0; i < n; i++ {
+		record, err := GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.Enqueue(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func dequeueRecords(t *testing.T, queue Queue) []models.Record {
+	records, err := queue.Dequeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func newTestTransaction(t *testing.T, records ...models.Record) models.Transaction {
+	txn := NewTransaction()
+	for _, record := range records {
+		if err := txn.Push(record.ID(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return txn
+}
+
+func diskSegments(t *testing.T, fs fsys.Filesystem) []string {
+	var paths []string
+	if err := fs.Walk("queue", func(path string, info os.FileInfo, err error) error {
+		if filepath.Ext(path) == segmentExt {
+			paths = append(paths, path)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func newID(t *testing.T, rnd *rand.Rand) uuid.UUID {
+	id, err := uuid.NewWithRand(rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
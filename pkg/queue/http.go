@@ -0,0 +1,329 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+)
+
+const defaultHTTPCapacity = 1000
+
+// ErrQueueFull is returned when enqueueing a record on to a queue that can't
+// hold any more records.
+var ErrQueueFull = errors.New("queue full")
+
+// HTTPConfig creates a configuration to create a http queue.
+type HTTPConfig struct {
+	Capacity     int
+	LeaseTimeout time.Duration
+	BatchSize    int
+	Redelivery   RedeliveryPolicy
+}
+
+// httpQueue holds the records that are pushed to courier over http, until
+// they're committed. It's bounded, so that producers are pushed back on when
+// the consumers can't keep up, and records that are dequeued are leased in
+// the same way as the disk queue, but nothing survives a restart.
+type httpQueue struct {
+	mutex        sync.Mutex
+	capacity     int
+	leaseTimeout time.Duration
+	batchSize    int
+	redelivery   RedeliveryPolicy
+	entries      []*httpEntry
+	index        map[string]*httpEntry
+	now          func() time.Time
+	logger       log.Logger
+}
+
+// httpEntry is a record that's on the queue.
+type httpEntry struct {
+	record    models.Record
+	sentAt    time.Time
+	receives  int
+	receipt   string
+	visibleAt time.Time
+}
+
+func newHTTPQueue(config *HTTPConfig, logger log.Logger) (Queue, error) {
+	if config == nil {
+		return nil, errors.New("missing config")
+	}
+
+	q := &httpQueue{
+		capacity:     config.Capacity,
+		leaseTimeout: config.LeaseTimeout,
+		batchSize:    config.BatchSize,
+		redelivery:   config.Redelivery,
+		index:        make(map[string]*httpEntry),
+		now:          time.Now,
+		logger:       logger,
+	}
+	if q.capacity <= 0 {
+		q.capacity = defaultHTTPCapacity
+	}
+	if q.leaseTimeout <= 0 {
+		q.leaseTimeout = defaultLeaseTimeout
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = defaultBatchSize
+	}
+	return q, nil
+}
+
+// Enqueue holds on to the record, keeping it's id, or returns ErrQueueFull if
+// the queue is at capacity. Records that are leased count towards the
+// capacity until they're committed.
+func (q *httpQueue) Enqueue(rec models.Record) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.entries) >= q.capacity {
+		return ErrQueueFull
+	}
+
+	id := rec.RecordID()
+	if id == "" {
+		id = rec.ID().String()
+	}
+	if _, ok := q.index[id]; ok {
+		return errors.Errorf("duplicate record %s", id)
+	}
+
+	entry := &httpEntry{
+		record: rec,
+		sentAt: q.now(),
+	}
+	q.entries = append(q.entries, entry)
+	q.index[id] = entry
+	return nil
+}
+
+func (q *httpQueue) Dequeue() ([]models.Record, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var (
+		now     = q.now()
+		records = make([]models.Record, 0)
+		// held are the groups with a record that's leased, no other records
+		// are dequeued from them until it's done, so they stay in order.
+		held = make(map[string]bool)
+	)
+	for _, entry := range q.entries {
+		if len(records) >= q.batchSize {
+			break
+		}
+
+		group := entry.record.GroupID()
+		visible := !entry.visibleAt.After(now)
+		if group != "" && (held[group] || !visible) {
+			held[group] = true
+			continue
+		}
+		if !visible {
+			continue
+		}
+
+		entry.receives++
+		entry.receipt = fmt.Sprintf("%s/%d", entry.id(), entry.receives)
+		entry.visibleAt = now.Add(q.leaseTimeout)
+
+		records = append(records, NewRecord(
+			entry.record.ID(),
+			entry.id(),
+			models.Receipt(entry.receipt),
+			entry.record.Body(),
+			now,
+			entry.record.Attributes(),
+			entry.systemAttributes(),
+		))
+	}
+	return records, nil
+}
+
+func (q *httpQueue) Commit(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, _, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	for _, entry := range entries {
+		q.remove(entry)
+	}
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// Failed hands the records back to the queue, they become visible again once
+// the redelivery policy allows, or when the lease runs out otherwise.
+func (q *httpQueue) Failed(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, records, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if q.redelivery.Enabled() {
+		now := q.now()
+		for k, entry := range entries {
+			entry.visibleAt = now.Add(q.redelivery.Backoff(records[k]))
+		}
+	}
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// Extend renews the lease of the records.
+func (q *httpQueue) Extend(txn models.Transaction) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	entries, _, result, err := q.leased(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	now := q.now()
+	for _, entry := range entries {
+		entry.visibleAt = now.Add(q.leaseTimeout)
+	}
+
+	result.Success += len(entries)
+	return result, nil
+}
+
+// leased returns the entries, along with their records, for the records in
+// the transaction that are still held with the receipt they were dequeued
+// with.
+func (q *httpQueue) leased(txn models.Transaction) ([]*httpEntry, []models.Record, Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return nil, nil, Result{}, err
+	}
+
+	var (
+		result  Result
+		entries = make([]*httpEntry, 0, len(records))
+		held    = make([]models.Record, 0, len(records))
+	)
+	for _, record := range records {
+		entry, ok := q.index[record.RecordID()]
+		if !ok || entry.receipt != record.Receipt().String() {
+			result.Failure++
+			continue
+		}
+		entries = append(entries, entry)
+		held = append(held, record)
+	}
+	return entries, held, result, nil
+}
+
+func (q *httpQueue) remove(entry *httpEntry) {
+	delete(q.index, entry.id())
+
+	for k, v := range q.entries {
+		if v == entry {
+			q.entries = append(q.entries[:k], q.entries[k+1:]...)
+			return
+		}
+	}
+}
+
+func (e *httpEntry) id() string {
+	if id := e.record.RecordID(); id != "" {
+		return id
+	}
+	return e.record.ID().String()
+}
+
+func (e *httpEntry) systemAttributes() map[string]string {
+	attributes := map[string]string{
+		approximateReceiveCount: strconv.Itoa(e.receives),
+		sentTimestamp:           strconv.FormatInt(e.sentAt.UnixNano()/int64(time.Millisecond), 10),
+	}
+	if group := e.record.GroupID(); group != "" {
+		attributes[messageGroupID] = group
+	}
+	return attributes
+}
+
+// HTTPConfigOption defines a option for generating a HTTPConfig
+type HTTPConfigOption func(*HTTPConfig) error
+
+// BuildHTTPConfig ingests configuration options to then yield a HTTPConfig,
+// and return an error if it fails during configuring.
+func BuildHTTPConfig(opts ...HTTPConfigOption) (*HTTPConfig, error) {
+	config := HTTPConfig{
+		Capacity:     defaultHTTPCapacity,
+		LeaseTimeout: defaultLeaseTimeout,
+		BatchSize:    defaultBatchSize,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithHTTPCapacity adds an Capacity option to the configuration, which is the
+// max number of records the queue holds before producers are turned away
+func WithHTTPCapacity(capacity int) HTTPConfigOption {
+	return func(config *HTTPConfig) error {
+		if capacity <= 0 {
+			return errors.Errorf("invalid capacity %d", capacity)
+		}
+		config.Capacity = capacity
+		return nil
+	}
+}
+
+// WithHTTPLeaseTimeout adds an LeaseTimeout option to the configuration,
+// which is how long dequeued records are hidden for
+func WithHTTPLeaseTimeout(leaseTimeout time.Duration) HTTPConfigOption {
+	return func(config *HTTPConfig) error {
+		if leaseTimeout <= 0 {
+			return errors.Errorf("invalid lease timeout %s", leaseTimeout)
+		}
+		config.LeaseTimeout = leaseTimeout
+		return nil
+	}
+}
+
+// WithHTTPBatchSize adds an BatchSize option to the configuration, which is
+// the max number of records to dequeue at once
+func WithHTTPBatchSize(batchSize int) HTTPConfigOption {
+	return func(config *HTTPConfig) error {
+		if batchSize <= 0 {
+			return errors.Errorf("invalid batch size %d", batchSize)
+		}
+		config.BatchSize = batchSize
+		return nil
+	}
+}
+
+// WithHTTPRedelivery adds a policy for when failed records are redelivered to
+// the configuration
+func WithHTTPRedelivery(policy RedeliveryPolicy) HTTPConfigOption {
+	return func(config *HTTPConfig) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		config.Redelivery = policy
+		return nil
+	}
+}
@@ -0,0 +1,235 @@
+package queue
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+func TestHTTPQueue(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		fn := func(body []byte, name, value string) bool {
+			queue := newTestHTTPQueue(t)
+
+			id := newID(t, rnd)
+			record := NewRecord(id, id.String(), "", body, time.Now(), map[string]string{
+				name: value,
+			}, nil)
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+
+			records := dequeueRecords(t, queue)
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			res := records[0]
+			if expected, actual := id, res.ID(); !expected.Equals(actual) {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := 1, res.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := value, res.Attributes()[name]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return string(body) == string(res.Body())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("enqueue when full", func(t *testing.T) {
+		queue := newTestHTTPQueue(t, WithHTTPCapacity(2))
+
+		enqueueRecords(t, rnd, queue, 2)
+
+		record, err := GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := ErrQueueFull, errors.Cause(queue.Enqueue(record)); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Leased records still count, until they're committed.
+		records := dequeueRecords(t, queue)
+		if expected, actual := ErrQueueFull, errors.Cause(queue.Enqueue(record)); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		if _, err := queue.Commit(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.Enqueue(record); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dequeue leases records", func(t *testing.T) {
+		var (
+			queue = newTestHTTPQueue(t)
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 2)
+
+		if expected, actual := 2, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		now = now.Add(defaultLeaseTimeout)
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit with stale receipt", func(t *testing.T) {
+		var (
+			queue = newTestHTTPQueue(t)
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		stale := dequeueRecords(t, queue)
+		now = now.Add(defaultLeaseTimeout)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Commit(newTestTransaction(t, stale...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		res, err = queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("failed with redelivery", func(t *testing.T) {
+		queue := newTestHTTPQueue(t, WithHTTPRedelivery(RedeliveryPolicy{
+			Strategy: RedeliverZero,
+		}))
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		res, err := queue.Failed(newTestTransaction(t, dequeueRecords(t, queue)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, records[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		var (
+			queue = newTestHTTPQueue(t)
+			now   = time.Now()
+		)
+		queue.now = func() time.Time { return now }
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		now = now.Add(defaultLeaseTimeout / 2)
+		res, err := queue.Extend(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		now = now.Add(defaultLeaseTimeout / 2)
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestBuildHTTPConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(capacity uint16, leaseTimeout uint32, batchSize uint8) bool {
+			config, err := BuildHTTPConfig(
+				WithHTTPCapacity(int(capacity)+1),
+				WithHTTPLeaseTimeout(time.Duration(leaseTimeout)+1),
+				WithHTTPBatchSize(int(batchSize)+1),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.Capacity == int(capacity)+1 &&
+				config.LeaseTimeout == time.Duration(leaseTimeout)+1 &&
+				config.BatchSize == int(batchSize)+1
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []HTTPConfigOption{
+			WithHTTPCapacity(0),
+			WithHTTPLeaseTimeout(0),
+			WithHTTPBatchSize(0),
+			WithHTTPRedelivery(RedeliveryPolicy{Delay: -time.Second}),
+		} {
+			_, err := BuildHTTPConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func newTestHTTPQueue(t *testing.T, opts ...HTTPConfigOption) *httpQueue {
+	config, err := BuildHTTPConfig(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := newHTTPQueue(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.(*httpQueue)
+}
@@ -0,0 +1,782 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
+)
+
+const (
+	defaultKafkaBatchSize     = maxBatchEntries
+	defaultKafkaWaitTime      = time.Second
+	defaultKafkaMaxDeliveries = 5
+
+	// kafkaRetrySuffix is added to the topic to name the retry topic, when one
+	// isn't configured.
+	kafkaRetrySuffix = ".retry"
+
+	// kafkaDeadSuffix is added to the topic to name the dead topic, when one
+	// isn't configured.
+	kafkaDeadSuffix = ".dead"
+
+	// kafkaAttemptsHeader carries the number of times a record has been
+	// received, when it's routed to the retry or dead topic.
+	kafkaAttemptsHeader = "courier-attempts"
+
+	// kafkaReasonHeader carries the reason a record failed, when it's routed to
+	// the dead topic.
+	kafkaReasonHeader = "courier-failure-reason"
+)
+
+// KafkaConfig creates a configuration to create a kafka queue.
+type KafkaConfig struct {
+	Brokers       []string
+	Topic         string
+	Group         string
+	RetryTopic    string
+	DeadTopic     string
+	MaxDeliveries int
+	BatchSize     int
+	WaitTime      time.Duration
+}
+
+// kafkaMessage is a message read from, or written to, a partition of a topic.
+type kafkaMessage struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Timestamp time.Time
+}
+
+// kafkaClient is the part of a kafka consumer group and producer that the
+// queue relies on.
+type kafkaClient interface {
+	// Fetch returns up to max messages from the topics the group consumes,
+	// waiting for at most wait for the first one.
+	Fetch(max int, wait time.Duration) ([]kafkaMessage, error)
+
+	// Commit the offset of the group, so that every message up to and
+	// including the offset in the partition isn't consumed again.
+	Commit(topic string, partition int32, offset int64) error
+
+	// Produce a message to the topic.
+	Produce(topic string, key, value []byte, headers map[string]string) error
+
+	// Revoked returns the partitions the group has taken away from the client
+	// since it was last called.
+	Revoked() []kafkaPartition
+}
+
+// kafkaQueue consumes records from a topic as part of a consumer group. Kafka
+// only keeps an offset for each partition, so a record is only committed once
+// every record before it in the partition has been committed, and records
+// that fail are routed to a retry topic, which the group also consumes. Once
+// a record has been delivered too many times it's routed to a dead topic
+// instead, which isn't consumed.
+type kafkaQueue struct {
+	mutex         sync.Mutex
+	client        kafkaClient
+	topic         string
+	retryTopic    string
+	deadTopic     string
+	maxDeliveries int
+	batchSize     int
+	waitTime      time.Duration
+	partitions    map[kafkaPartition]*kafkaOffsets
+	held          map[string]kafkaHeld
+	logger        log.Logger
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+// kafkaOffsets are the offsets that have been dequeued from a partition, but
+// haven't been committed yet.
+type kafkaOffsets struct {
+	pending   []int64
+	done      map[int64]bool
+	committed int64
+}
+
+// kafkaHeld is a message that has been dequeued and is yet to be committed or
+// failed.
+type kafkaHeld struct {
+	partition kafkaPartition
+	offset    int64
+	key       []byte
+}
+
+func newKafkaQueue(config *KafkaConfig, logger log.Logger) (Queue, error) {
+	if config == nil {
+		return nil, errors.New("missing config")
+	}
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("missing brokers")
+	}
+	if config.Topic == "" {
+		return nil, errors.New("missing topic")
+	}
+	if config.Group == "" {
+		return nil, errors.New("missing group")
+	}
+
+	client, err := newSaramaClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(logger).Log("topic", config.Topic, "retry_topic", config.RetryTopic, "dead_topic", config.DeadTopic, "group", config.Group)
+
+	return newKafkaQueueWithClient(client, config, logger), nil
+}
+
+func newKafkaQueueWithClient(client kafkaClient, config *KafkaConfig, logger log.Logger) *kafkaQueue {
+	q := &kafkaQueue{
+		client:        client,
+		topic:         config.Topic,
+		retryTopic:    config.RetryTopic,
+		deadTopic:     config.DeadTopic,
+		maxDeliveries: config.MaxDeliveries,
+		batchSize:     config.BatchSize,
+		waitTime:      config.WaitTime,
+		partitions:    make(map[kafkaPartition]*kafkaOffsets),
+		held:          make(map[string]kafkaHeld),
+		logger:        logger,
+	}
+	if q.retryTopic == "" {
+		q.retryTopic = config.Topic + kafkaRetrySuffix
+	}
+	if q.deadTopic == "" {
+		q.deadTopic = config.Topic + kafkaDeadSuffix
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = defaultKafkaBatchSize
+	}
+	if q.waitTime <= 0 {
+		q.waitTime = defaultKafkaWaitTime
+	}
+	return q
+}
+
+// Enqueue produces the record to the topic, keyed by the group of the record,
+// so that records in the same group end up in the same partition and stay in
+// order.
+func (q *kafkaQueue) Enqueue(rec models.Record) error {
+	var key []byte
+	if group := rec.GroupID(); group != "" {
+		key = []byte(group)
+	}
+	return q.client.Produce(q.topic, key, rec.Body(), rec.Attributes())
+}
+
+func (q *kafkaQueue) Dequeue() ([]models.Record, error) {
+	// The partitions that have been revoked are dropped before anything else
+	// is fetched, so that nothing fetched from them since they were claimed
+	// again is dropped along with them.
+	revoked := q.client.Revoked()
+
+	messages, err := q.client.Fetch(q.batchSize, q.waitTime)
+	if err != nil {
+		return make([]models.Record, 0), err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.revoke(revoked)
+
+	var (
+		now     = time.Now()
+		records = make([]models.Record, 0, len(messages))
+	)
+	for _, message := range messages {
+		partition := kafkaPartition{message.Topic, message.Partition}
+		offsets, ok := q.partitions[partition]
+		if !ok {
+			offsets = &kafkaOffsets{
+				done:      make(map[int64]bool),
+				committed: -1,
+			}
+			q.partitions[partition] = offsets
+		}
+		if message.Offset <= offsets.committed {
+			continue
+		}
+
+		receipt := fmt.Sprintf("%s/%d/%d", message.Topic, message.Partition, message.Offset)
+		_, held := q.held[receipt]
+		if !held {
+			offsets.add(message.Offset)
+		}
+
+		id, err := uuid.New()
+		if err != nil {
+			// The record can't be delivered without an id, so it's routed
+			// back on to the retry topic as it is, otherwise the partition
+			// would never be committed past it.
+			if !held {
+				q.requeue(message, offsets)
+			}
+			continue
+		}
+
+		q.held[receipt] = kafkaHeld{
+			partition: partition,
+			offset:    message.Offset,
+			key:       message.Key,
+		}
+
+		attributes, systemAttributes := message.attributes()
+		records = append(records, NewRecord(
+			id,
+			receipt,
+			models.Receipt(receipt),
+			message.Value,
+			now,
+			attributes,
+			systemAttributes,
+		))
+	}
+	return records, nil
+}
+
+// Commit marks the records as done, committing the offset of each partition
+// up to the first record that isn't done yet.
+func (q *kafkaQueue) Commit(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		if !q.done(record) {
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+
+	q.commit()
+
+	return result, nil
+}
+
+// Failed routes the records to the retry topic, with the number of times
+// they've been received, and then marks them as done. Records that have been
+// delivered as many times as they can be are routed to the dead topic, along
+// with the reason they failed, instead. Records that can't be routed are left
+// uncommitted, so they're consumed again once the partition is reassigned.
+func (q *kafkaQueue) Failed(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		var (
+			topic   = q.retryTopic
+			headers = kafkaHeaders(record, record.Attempts())
+		)
+		if q.maxDeliveries > 0 && record.Attempts() >= q.maxDeliveries {
+			topic = q.deadTopic
+			headers[kafkaReasonHeader] = FailureReason(record)
+		}
+
+		if !q.route(topic, record, headers) {
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+
+	q.commit()
+
+	return result, nil
+}
+
+// Release routes the records, which were never attempted, to the retry topic
+// without using up any of their deliveries, and then marks them as done.
+// Kafka never delivers them to the group again otherwise, and they'd hold
+// back the offset of their partition.
+func (q *kafkaQueue) Release(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		if !q.route(q.retryTopic, record, kafkaHeaders(record, record.Attempts()-1)) {
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+
+	q.commit()
+
+	return result, nil
+}
+
+// Extend has nothing to do, as kafka doesn't redeliver records to the same
+// group whilst they're held.
+func (q *kafkaQueue) Extend(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var result Result
+	for _, record := range records {
+		if _, ok := q.held[record.Receipt().String()]; !ok {
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+	return result, nil
+}
+
+// route produces the record to the topic, keyed as it was originally, and then
+// marks it as done, returning false if it isn't held or can't be produced.
+func (q *kafkaQueue) route(topic string, record models.Record, headers map[string]string) bool {
+	held, ok := q.held[record.Receipt().String()]
+	if !ok {
+		return false
+	}
+
+	if err := q.client.Produce(topic, held.key, record.Body(), headers); err != nil {
+		level.Warn(q.logger).Log("state", "route", "topic", topic, "receipt", record.Receipt().String(), "err", err)
+		return false
+	}
+
+	q.done(record)
+	return true
+}
+
+// requeue produces a message that can't be held back on to the retry topic,
+// exactly as it was, and marks it's offset as done. If it can't be produced
+// the offset is left pending, so that nothing after it is committed until the
+// partition is revoked and the message is consumed again.
+func (q *kafkaQueue) requeue(message kafkaMessage, offsets *kafkaOffsets) {
+	if err := q.client.Produce(q.retryTopic, message.Key, message.Value, message.Headers); err != nil {
+		level.Warn(q.logger).Log("state", "requeue", "topic", message.Topic, "partition", message.Partition, "offset", message.Offset, "err", err)
+		return
+	}
+	offsets.done[message.Offset] = true
+}
+
+// revoke drops everything held from the partitions, as the group has taken
+// them away, and whoever they're assigned to consumes them again from the last
+// offset that was committed.
+func (q *kafkaQueue) revoke(partitions []kafkaPartition) {
+	if len(partitions) == 0 {
+		return
+	}
+
+	revoked := make(map[kafkaPartition]bool, len(partitions))
+	for _, partition := range partitions {
+		revoked[partition] = true
+		delete(q.partitions, partition)
+	}
+	for receipt, held := range q.held {
+		if revoked[held.partition] {
+			delete(q.held, receipt)
+		}
+	}
+
+	level.Debug(q.logger).Log("state", "revoke", "partitions", len(partitions))
+}
+
+// done marks the record as done with, returning false if it isn't held.
+func (q *kafkaQueue) done(record models.Record) bool {
+	receipt := record.Receipt().String()
+	held, ok := q.held[receipt]
+	if !ok {
+		return false
+	}
+	delete(q.held, receipt)
+
+	q.partitions[held.partition].done[held.offset] = true
+	return true
+}
+
+// commit advances the offset of every partition past the records that are
+// done. Offsets are cumulative, so if committing fails it's committed along
+// with the next one instead.
+func (q *kafkaQueue) commit() {
+	partitions := make([]kafkaPartition, 0, len(q.partitions))
+	for partition := range q.partitions {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].topic != partitions[j].topic {
+			return partitions[i].topic < partitions[j].topic
+		}
+		return partitions[i].partition < partitions[j].partition
+	})
+
+	for _, partition := range partitions {
+		offsets := q.partitions[partition]
+
+		offset, ok := offsets.advance()
+		if !ok {
+			continue
+		}
+		if err := q.client.Commit(partition.topic, partition.partition, offset); err != nil {
+			level.Warn(q.logger).Log("state", "commit", "topic", partition.topic, "partition", partition.partition, "offset", offset, "err", err)
+			continue
+		}
+		offsets.committed = offset
+	}
+}
+
+// add an offset that's been dequeued, keeping the pending offsets in order.
+func (o *kafkaOffsets) add(offset int64) {
+	i := sort.Search(len(o.pending), func(i int) bool {
+		return o.pending[i] >= offset
+	})
+	o.pending = append(o.pending, 0)
+	copy(o.pending[i+1:], o.pending[i:])
+	o.pending[i] = offset
+}
+
+// advance drops the pending offsets that are done, up to the first one that
+// isn't, and returns the offset to commit, if it's moved on.
+func (o *kafkaOffsets) advance() (int64, bool) {
+	offset := o.committed
+	for len(o.pending) > 0 && o.done[o.pending[0]] {
+		offset = o.pending[0]
+		delete(o.done, offset)
+		o.pending = o.pending[1:]
+	}
+	return offset, offset > o.committed
+}
+
+// kafkaHeaders returns the attributes of the record as headers, along with the
+// number of times it's been received.
+func kafkaHeaders(record models.Record, attempts int) map[string]string {
+	headers := make(map[string]string, len(record.Attributes())+1)
+	for k, v := range record.Attributes() {
+		headers[k] = v
+	}
+	headers[kafkaAttemptsHeader] = strconv.Itoa(attempts)
+	return headers
+}
+
+func (m kafkaMessage) attributes() (map[string]string, map[string]string) {
+	attempts := 1
+	attributes := make(map[string]string, len(m.Headers))
+	for k, v := range m.Headers {
+		if k == kafkaAttemptsHeader {
+			if n, err := strconv.Atoi(v); err == nil {
+				attempts = n + 1
+			}
+			continue
+		}
+		attributes[k] = v
+	}
+
+	systemAttributes := map[string]string{
+		approximateReceiveCount: strconv.Itoa(attempts),
+		sentTimestamp:           strconv.FormatInt(m.Timestamp.UnixNano()/int64(time.Millisecond), 10),
+	}
+	if len(m.Key) > 0 {
+		systemAttributes[messageGroupID] = string(m.Key)
+	}
+	return attributes, systemAttributes
+}
+
+// clusterConsumer is the part of a sarama cluster consumer that the client
+// relies on.
+type clusterConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Notifications() <-chan *cluster.Notification
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
+	CommitOffsets() error
+}
+
+// saramaClient is a kafkaClient that consumes with a sarama cluster consumer,
+// which balances the partitions between the members of the group.
+type saramaClient struct {
+	mutex    sync.Mutex
+	consumer clusterConsumer
+	producer sarama.SyncProducer
+	revoked  []kafkaPartition
+}
+
+func newSaramaClient(config *KafkaConfig) (kafkaClient, error) {
+	retryTopic := config.RetryTopic
+	if retryTopic == "" {
+		retryTopic = config.Topic + kafkaRetrySuffix
+	}
+
+	clusterConfig := cluster.NewConfig()
+	// Headers carry the attributes of the records.
+	clusterConfig.Version = sarama.V0_11_0_0
+	clusterConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	clusterConfig.Producer.RequiredAcks = sarama.WaitForAll
+	clusterConfig.Producer.Return.Successes = true
+	// Rebalances say which partitions have been revoked.
+	clusterConfig.Group.Return.Notifications = true
+
+	producer, err := sarama.NewSyncProducer(config.Brokers, &clusterConfig.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "producer")
+	}
+
+	consumer, err := cluster.NewConsumer(config.Brokers, config.Group, []string{
+		config.Topic,
+		retryTopic,
+	}, clusterConfig)
+	if err != nil {
+		producer.Close()
+		return nil, errors.Wrap(err, "consumer")
+	}
+
+	return newSaramaClientWith(consumer, producer), nil
+}
+
+// newSaramaClientWith creates a client from the consumer and producer, which
+// watches the notifications of the consumer for revoked partitions.
+func newSaramaClientWith(consumer clusterConsumer, producer sarama.SyncProducer) *saramaClient {
+	c := &saramaClient{
+		consumer: consumer,
+		producer: producer,
+	}
+	go c.watch()
+	return c
+}
+
+// watch notes the partitions released by every rebalance, until the consumer
+// is closed. The consumer doesn't carry on rebalancing until the notification
+// has been received, so it's always watched rather than only when fetching.
+func (c *saramaClient) watch() {
+	for notification := range c.consumer.Notifications() {
+		if notification == nil {
+			continue
+		}
+
+		c.mutex.Lock()
+		for topic, partitions := range notification.Released {
+			for _, partition := range partitions {
+				c.revoked = append(c.revoked, kafkaPartition{topic, partition})
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *saramaClient) Fetch(max int, wait time.Duration) ([]kafkaMessage, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var messages []kafkaMessage
+	// Wait for the first message, then take whatever else is to hand.
+	select {
+	case message, ok := <-c.consumer.Messages():
+		if !ok {
+			return messages, errors.New("consumer closed")
+		}
+		messages = append(messages, fromConsumerMessage(message))
+	case <-timer.C:
+		return messages, nil
+	}
+
+	for len(messages) < max {
+		select {
+		case message, ok := <-c.consumer.Messages():
+			if !ok {
+				return messages, nil
+			}
+			messages = append(messages, fromConsumerMessage(message))
+		default:
+			return messages, nil
+		}
+	}
+	return messages, nil
+}
+
+func (c *saramaClient) Revoked() []kafkaPartition {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	revoked := c.revoked
+	c.revoked = nil
+	return revoked
+}
+
+func (c *saramaClient) Commit(topic string, partition int32, offset int64) error {
+	c.consumer.MarkPartitionOffset(topic, partition, offset, "")
+	return c.consumer.CommitOffsets()
+}
+
+func (c *saramaClient) Produce(topic string, key, value []byte, headers map[string]string) error {
+	message := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	// Records without a key are spread over the partitions.
+	if len(key) > 0 {
+		message.Key = sarama.ByteEncoder(key)
+	}
+	for k, v := range headers {
+		message.Headers = append(message.Headers, sarama.RecordHeader{
+			Key:   []byte(k),
+			Value: []byte(v),
+		})
+	}
+
+	_, _, err := c.producer.SendMessage(message)
+	return err
+}
+
+func fromConsumerMessage(message *sarama.ConsumerMessage) kafkaMessage {
+	headers := make(map[string]string, len(message.Headers))
+	for _, header := range message.Headers {
+		if header == nil {
+			continue
+		}
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return kafkaMessage{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Key:       message.Key,
+		Value:     message.Value,
+		Headers:   headers,
+		Timestamp: message.Timestamp,
+	}
+}
+
+// KafkaConfigOption defines a option for generating a KafkaConfig
+type KafkaConfigOption func(*KafkaConfig) error
+
+// BuildKafkaConfig ingests configuration options to then yield a KafkaConfig,
+// and return an error if it fails during configuring.
+func BuildKafkaConfig(opts ...KafkaConfigOption) (*KafkaConfig, error) {
+	config := KafkaConfig{
+		MaxDeliveries: defaultKafkaMaxDeliveries,
+		BatchSize:     defaultKafkaBatchSize,
+		WaitTime:      defaultKafkaWaitTime,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithKafkaBrokers adds an Brokers option to the configuration
+func WithKafkaBrokers(brokers []string) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		config.Brokers = brokers
+		return nil
+	}
+}
+
+// WithKafkaTopic adds an Topic option to the configuration
+func WithKafkaTopic(topic string) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		config.Topic = topic
+		return nil
+	}
+}
+
+// WithKafkaGroup adds an Group option to the configuration, which is the
+// consumer group the queue consumes as
+func WithKafkaGroup(group string) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		config.Group = group
+		return nil
+	}
+}
+
+// WithKafkaRetryTopic adds an RetryTopic option to the configuration, which is
+// where failed records are routed to. It defaults to the topic with a
+// ".retry" suffix.
+func WithKafkaRetryTopic(retryTopic string) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		config.RetryTopic = retryTopic
+		return nil
+	}
+}
+
+// WithKafkaDeadTopic adds an DeadTopic option to the configuration, which is
+// where records are routed to once they've been delivered too many times. It
+// defaults to the topic with a ".dead" suffix.
+func WithKafkaDeadTopic(deadTopic string) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		config.DeadTopic = deadTopic
+		return nil
+	}
+}
+
+// WithKafkaMaxDeliveries adds an MaxDeliveries option to the configuration,
+// which is the number of times a record is delivered before it's routed to the
+// dead topic. Zero never routes records to the dead topic.
+func WithKafkaMaxDeliveries(maxDeliveries int) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		if maxDeliveries < 0 {
+			return errors.Errorf("invalid max deliveries %d", maxDeliveries)
+		}
+		config.MaxDeliveries = maxDeliveries
+		return nil
+	}
+}
+
+// WithKafkaBatchSize adds an BatchSize option to the configuration, which is
+// the max number of records to dequeue at once
+func WithKafkaBatchSize(batchSize int) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		if batchSize <= 0 {
+			return errors.Errorf("invalid batch size %d", batchSize)
+		}
+		config.BatchSize = batchSize
+		return nil
+	}
+}
+
+// WithKafkaWaitTime adds an WaitTime option to the configuration, which is how
+// long a dequeue waits for records
+func WithKafkaWaitTime(waitTime time.Duration) KafkaConfigOption {
+	return func(config *KafkaConfig) error {
+		if waitTime <= 0 {
+			return errors.Errorf("invalid wait time %s", waitTime)
+		}
+		config.WaitTime = waitTime
+		return nil
+	}
+}
@@ -0,0 +1,912 @@
+package queue
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+func TestKafkaQueue(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		fn := func(body []byte, group, name, value string) bool {
+			var (
+				broker = newKafkaBroker(1)
+				queue  = newTestKafkaQueue(broker)
+			)
+
+			record := NewRecord(newID(t, rnd), "", "", body, time.Now(), map[string]string{
+				name: value,
+			}, map[string]string{
+				messageGroupID: group,
+			})
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+
+			records := dequeueRecords(t, queue)
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			res := records[0]
+			if expected, actual := 1, res.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := group, res.GroupID(); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := value, res.Attributes()[name]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return string(body) == string(res.Body())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("commit in order", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 3)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Commit(newTestTransaction(t, records[1:]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{2, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// The first record is still held, so nothing can be committed yet.
+		if expected, actual := int64(-1), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		if _, err := queue.Commit(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(2), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit records that aren't held", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		if _, err := queue.Commit(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("commit partitions independently", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(2)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		for _, group := range []string{"a", "b"} {
+			record := NewRecord(newID(t, rnd), "", "", []byte(group), time.Now(), nil, map[string]string{
+				messageGroupID: group,
+			})
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		if _, err := queue.Commit(newTestTransaction(t, records[1])); err != nil {
+			t.Fatal(err)
+		}
+
+		var committed []int64
+		for _, partition := range []int32{0, 1} {
+			committed = append(committed, broker.committed("courier", partition))
+		}
+		sort.Slice(committed, func(i, j int) bool { return committed[i] < committed[j] })
+		if expected, actual := []int64{-1, 0}, committed; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("commit failure", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		broker.commitErr = errors.New("bad")
+		res, err := queue.Commit(newTestTransaction(t, records[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Offsets are cumulative, so the next commit catches up.
+		broker.commitErr = nil
+		if _, err := queue.Commit(newTestTransaction(t, records[1])); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := int64(1), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed routes to retry topic", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		res, err := queue.Failed(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := int64(0), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, broker.len("courier.retry"); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		retried := dequeueRecords(t, queue)
+		if expected, actual := 1, len(retried); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, retried[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := records[0].Attributes(), retried[0].Attributes(); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := string(records[0].Body()), string(retried[0].Body()); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("failed when the retry topic is unavailable", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 1)
+		records := dequeueRecords(t, queue)
+
+		broker.produceErr = errors.New("bad")
+		res, err := queue.Failed(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := int64(-1), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed past max deliveries routes to dead topic", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+		queue.maxDeliveries = 2
+
+		enqueueRecords(t, rnd, queue, 1)
+
+		// The first failure is retried, and the second is dead.
+		for i := 0; i < 2; i++ {
+			records := dequeueRecords(t, queue)
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+			if _, err := queue.Failed(newTestTransaction(t, FailedRecord(records[0], "bad"))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if expected, actual := 1, broker.len("courier.retry"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, broker.len("courier.dead"); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		dead := broker.topic("courier.dead")[0][0]
+		if expected, actual := "bad", dead.Headers[kafkaReasonHeader]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "2", dead.Headers[kafkaAttemptsHeader]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+
+		// The dead topic isn't consumed.
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("release routes to retry topic", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		if _, err := queue.Failed(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+		res, err := queue.Release(newTestTransaction(t, records[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		// Neither of the records hold back the partition.
+		if expected, actual := int64(1), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// The released record is delivered again after the failed one, without
+		// having used up a delivery.
+		retried := dequeueRecords(t, queue)
+		if expected, actual := 2, len(retried); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		for k, expected := range []int{2, 1} {
+			if actual := retried[k].Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := string(records[k].Body()), string(retried[k].Body()); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("revoked partitions are dropped", func(t *testing.T) {
+		var (
+			broker   = newKafkaBroker(1)
+			queue    = newTestKafkaQueue(broker)
+			consumer = queue.client.(*kafkaConsumer)
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		// The partition is taken away and claimed again, so the records are
+		// consumed again.
+		consumer.revoke(kafkaPartition{"courier", 0})
+
+		redelivered := dequeueRecords(t, queue)
+		if expected, actual := 2, len(redelivered); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// The records are held again from the same offsets, so they're
+		// committed as if they'd never been revoked.
+		for k, record := range redelivered {
+			if expected, actual := records[k].Receipt(), record.Receipt(); expected != actual {
+				t.Errorf("expected: %v, actual: %v", expected, actual)
+			}
+		}
+
+		res, err := queue.Commit(newTestTransaction(t, redelivered...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{2, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := int64(1), broker.committed("courier", 0); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		var (
+			broker = newKafkaBroker(1)
+			queue  = newTestKafkaQueue(broker)
+		)
+
+		enqueueRecords(t, rnd, queue, 2)
+		records := dequeueRecords(t, queue)
+
+		if _, err := queue.Commit(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := queue.Extend(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 1}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		broker := newKafkaBroker(1)
+
+		queue := newTestKafkaQueue(broker)
+		enqueueRecords(t, rnd, queue, 3)
+
+		records := dequeueRecords(t, queue)
+		if _, err := queue.Commit(newTestTransaction(t, records[0], records[2])); err != nil {
+			t.Fatal(err)
+		}
+
+		// Everything after the last committed offset is consumed again.
+		restarted := newTestKafkaQueue(broker)
+		records = dequeueRecords(t, restarted)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestBuildKafkaConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(broker, topic, group, retryTopic, deadTopic string, maxDeliveries, batchSize uint8, waitTime uint32) bool {
+			config, err := BuildKafkaConfig(
+				WithKafkaBrokers([]string{broker}),
+				WithKafkaTopic(topic),
+				WithKafkaGroup(group),
+				WithKafkaRetryTopic(retryTopic),
+				WithKafkaDeadTopic(deadTopic),
+				WithKafkaMaxDeliveries(int(maxDeliveries)),
+				WithKafkaBatchSize(int(batchSize)+1),
+				WithKafkaWaitTime(time.Duration(waitTime)+1),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return reflect.DeepEqual(config.Brokers, []string{broker}) &&
+				config.Topic == topic &&
+				config.Group == group &&
+				config.RetryTopic == retryTopic &&
+				config.DeadTopic == deadTopic &&
+				config.MaxDeliveries == int(maxDeliveries) &&
+				config.BatchSize == int(batchSize)+1 &&
+				config.WaitTime == time.Duration(waitTime)+1
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []KafkaConfigOption{
+			WithKafkaMaxDeliveries(-1),
+			WithKafkaBatchSize(0),
+			WithKafkaWaitTime(0),
+		} {
+			_, err := BuildKafkaConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("invalid queue", func(t *testing.T) {
+		for _, opts := range [][]KafkaConfigOption{
+			{WithKafkaTopic("courier"), WithKafkaGroup("courier")},
+			{WithKafkaBrokers([]string{"localhost:9092"}), WithKafkaGroup("courier")},
+			{WithKafkaBrokers([]string{"localhost:9092"}), WithKafkaTopic("courier")},
+		} {
+			config, err := BuildKafkaConfig(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = newKafkaQueue(config, log.NewNopLogger())
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func TestSaramaClient(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	t.Run("fetch", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		defer consumer.close()
+
+		consumer.messages <- &sarama.ConsumerMessage{
+			Topic:     "courier",
+			Partition: 1,
+			Offset:    2,
+			Key:       []byte("group"),
+			Value:     []byte("body"),
+			Headers: []*sarama.RecordHeader{
+				{Key: []byte("name"), Value: []byte("value")},
+				nil,
+			},
+			Timestamp: now,
+		}
+
+		messages, err := client.Fetch(10, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []kafkaMessage{{
+			Topic:     "courier",
+			Partition: 1,
+			Offset:    2,
+			Key:       []byte("group"),
+			Value:     []byte("body"),
+			Headers:   map[string]string{"name": "value"},
+			Timestamp: now,
+		}}
+		if actual := messages; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("fetch at most max", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		defer consumer.close()
+
+		for i := 0; i < 3; i++ {
+			consumer.messages <- &sarama.ConsumerMessage{
+				Topic:  "courier",
+				Offset: int64(i),
+			}
+		}
+
+		for _, expected := range []int{2, 1} {
+			messages, err := client.Fetch(2, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := len(messages); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+		}
+	})
+
+	t.Run("fetch waits", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		defer consumer.close()
+
+		messages, err := client.Fetch(10, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, len(messages); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("fetch from a closed consumer", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		consumer.close()
+
+		_, err := client.Fetch(10, time.Second)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		defer consumer.close()
+
+		if err := client.Commit("courier", 1, 5); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := map[kafkaPartition]int64{{"courier", 1}: 5}, consumer.marked; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 1, consumer.commits; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		consumer.commitErr = errors.New("bad")
+		err := client.Commit("courier", 1, 6)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("produce", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			producer = mocks.NewSyncProducer(t, nil)
+			client   = newSaramaClientWith(consumer, producer)
+		)
+		defer consumer.close()
+		defer producer.Close()
+
+		producer.ExpectSendMessageWithCheckerFunctionAndSucceed(expectValue("body"))
+		producer.ExpectSendMessageAndFail(errors.New("bad"))
+
+		if err := client.Produce("courier", []byte("group"), []byte("body"), map[string]string{"name": "value"}); err != nil {
+			t.Error(err)
+		}
+
+		err := client.Produce("courier", nil, []byte("body"), nil)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			client   = newSaramaClientWith(consumer, mocks.NewSyncProducer(t, nil))
+		)
+		defer consumer.close()
+
+		consumer.notifications <- &cluster.Notification{
+			Type:     cluster.RebalanceOK,
+			Claimed:  map[string][]int32{"courier": {2}},
+			Released: map[string][]int32{"courier": {0, 1}},
+		}
+
+		// The notifications are watched in the background.
+		var revoked []kafkaPartition
+		for deadline := time.Now().Add(time.Second); len(revoked) < 2 && time.Now().Before(deadline); {
+			revoked = append(revoked, client.Revoked()...)
+			time.Sleep(time.Millisecond)
+		}
+		sort.Slice(revoked, func(i, j int) bool { return revoked[i].partition < revoked[j].partition })
+
+		if expected, actual := []kafkaPartition{{"courier", 0}, {"courier", 1}}, revoked; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, len(client.Revoked()); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		var (
+			consumer = newFakeClusterConsumer()
+			producer = mocks.NewSyncProducer(t, nil)
+			queue    = newKafkaQueueWithClient(newSaramaClientWith(consumer, producer), &KafkaConfig{
+				Topic:    "courier",
+				Group:    "courier",
+				WaitTime: time.Millisecond,
+			}, log.NewNopLogger())
+		)
+		defer consumer.close()
+		defer producer.Close()
+
+		for i, body := range []string{"a", "b"} {
+			consumer.messages <- &sarama.ConsumerMessage{
+				Topic:  "courier",
+				Offset: int64(i),
+				Value:  []byte(body),
+			}
+		}
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 2, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// The failed record is produced to the retry topic, and then both of
+		// the offsets are committed.
+		producer.ExpectSendMessageWithCheckerFunctionAndSucceed(expectValue("b"))
+		if _, err := queue.Failed(newTestTransaction(t, records[1])); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := queue.Commit(newTestTransaction(t, records[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := map[kafkaPartition]int64{{"courier", 0}: 1}, consumer.marked; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+}
+
+func newTestKafkaQueue(broker *kafkaBroker) *kafkaQueue {
+	config := &KafkaConfig{
+		Topic: "courier",
+		Group: "courier",
+	}
+	return newKafkaQueueWithClient(broker.consumer(config.Group, []string{
+		"courier",
+		"courier.retry",
+	}), config, log.NewNopLogger())
+}
+
+// kafkaBroker is an in-process stand in for a kafka cluster, where every topic
+// has the same number of partitions.
+type kafkaBroker struct {
+	mutex      sync.Mutex
+	partitions int32
+	topics     map[string][][]kafkaMessage
+	offsets    map[string]map[kafkaPartition]int64
+	produceErr error
+	commitErr  error
+}
+
+func newKafkaBroker(partitions int32) *kafkaBroker {
+	return &kafkaBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]kafkaMessage),
+		offsets:    make(map[string]map[kafkaPartition]int64),
+	}
+}
+
+func (b *kafkaBroker) Produce(topic string, key, value []byte, headers map[string]string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.produceErr != nil {
+		return b.produceErr
+	}
+
+	partitions := b.topic(topic)
+
+	var partition int32
+	if len(key) > 0 {
+		hash := fnv.New32a()
+		hash.Write(key)
+		partition = int32(hash.Sum32() % uint32(b.partitions))
+	}
+
+	h := make(map[string]string, len(headers))
+	for k, v := range headers {
+		h[k] = v
+	}
+	partitions[partition] = append(partitions[partition], kafkaMessage{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    int64(len(partitions[partition])),
+		Key:       key,
+		Value:     value,
+		Headers:   h,
+		Timestamp: time.Now(),
+	})
+	return nil
+}
+
+func (b *kafkaBroker) topic(name string) [][]kafkaMessage {
+	partitions, ok := b.topics[name]
+	if !ok {
+		partitions = make([][]kafkaMessage, b.partitions)
+		b.topics[name] = partitions
+	}
+	return partitions
+}
+
+func (b *kafkaBroker) committed(topic string, partition int32) int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	offset, ok := b.offsets["courier"][kafkaPartition{topic, partition}]
+	if !ok {
+		return -1
+	}
+	return offset
+}
+
+func (b *kafkaBroker) len(topic string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var n int
+	for _, messages := range b.topics[topic] {
+		n += len(messages)
+	}
+	return n
+}
+
+// consumer joins the group, consuming every partition of the topics from the
+// last offset the group committed.
+func (b *kafkaBroker) consumer(group string, topics []string) *kafkaConsumer {
+	return &kafkaConsumer{
+		broker:    b,
+		group:     group,
+		topics:    topics,
+		positions: make(map[kafkaPartition]int64),
+	}
+}
+
+type kafkaConsumer struct {
+	broker    *kafkaBroker
+	group     string
+	topics    []string
+	positions map[kafkaPartition]int64
+	revoked   []kafkaPartition
+}
+
+func (c *kafkaConsumer) Fetch(max int, wait time.Duration) ([]kafkaMessage, error) {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var messages []kafkaMessage
+	for _, topic := range c.topics {
+		for partition, partitionMessages := range b.topic(topic) {
+			key := kafkaPartition{topic, int32(partition)}
+			position, ok := c.positions[key]
+			if !ok {
+				position = 0
+				if offset, ok := b.offsets[c.group][key]; ok {
+					position = offset + 1
+				}
+			}
+			for ; position < int64(len(partitionMessages)) && len(messages) < max; position++ {
+				messages = append(messages, partitionMessages[position])
+			}
+			c.positions[key] = position
+		}
+	}
+	return messages, nil
+}
+
+func (c *kafkaConsumer) Commit(topic string, partition int32, offset int64) error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.commitErr != nil {
+		return b.commitErr
+	}
+
+	offsets, ok := b.offsets[c.group]
+	if !ok {
+		offsets = make(map[kafkaPartition]int64)
+		b.offsets[c.group] = offsets
+	}
+	offsets[kafkaPartition{topic, partition}] = offset
+	return nil
+}
+
+func (c *kafkaConsumer) Revoked() []kafkaPartition {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+
+	revoked := c.revoked
+	c.revoked = nil
+	return revoked
+}
+
+// revoke takes the partition away from the consumer and then gives it back
+// again, as a rebalance would, so it's consumed again from the last offset
+// the group committed.
+func (c *kafkaConsumer) revoke(partition kafkaPartition) {
+	c.broker.mutex.Lock()
+	defer c.broker.mutex.Unlock()
+
+	delete(c.positions, partition)
+	c.revoked = append(c.revoked, partition)
+}
+
+func (c *kafkaConsumer) Produce(topic string, key, value []byte, headers map[string]string) error {
+	return c.broker.Produce(topic, key, value, headers)
+}
+
+// fakeClusterConsumer stands in for a sarama cluster consumer, where the
+// messages and notifications are sent down it's channels, and the offsets that
+// are marked are kept.
+type fakeClusterConsumer struct {
+	messages      chan *sarama.ConsumerMessage
+	notifications chan *cluster.Notification
+	marked        map[kafkaPartition]int64
+	commits       int
+	commitErr     error
+}
+
+func newFakeClusterConsumer() *fakeClusterConsumer {
+	return &fakeClusterConsumer{
+		messages:      make(chan *sarama.ConsumerMessage, 10),
+		notifications: make(chan *cluster.Notification),
+		marked:        make(map[kafkaPartition]int64),
+	}
+}
+
+func (c *fakeClusterConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *fakeClusterConsumer) Notifications() <-chan *cluster.Notification {
+	return c.notifications
+}
+
+func (c *fakeClusterConsumer) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	c.marked[kafkaPartition{topic, partition}] = offset
+}
+
+func (c *fakeClusterConsumer) CommitOffsets() error {
+	if c.commitErr != nil {
+		return c.commitErr
+	}
+	c.commits++
+	return nil
+}
+
+func (c *fakeClusterConsumer) close() {
+	close(c.messages)
+	close(c.notifications)
+}
+
+// expectValue checks the value of a message produced to a mock producer.
+func expectValue(expected string) mocks.ValueChecker {
+	return func(actual []byte) error {
+		if expected != string(actual) {
+			return errors.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		return nil
+	}
+}
@@ -72,6 +72,19 @@ func (mr *MockQueueMockRecorder) Enqueue(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Enqueue", reflect.TypeOf((*MockQueue)(nil).Enqueue), arg0)
 }
 
+// Extend mocks base method
+func (m *MockQueue) Extend(arg0 models.Transaction) (queue.Result, error) {
+	ret := m.ctrl.Call(m, "Extend", arg0)
+	ret0, _ := ret[0].(queue.Result)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Extend indicates an expected call of Extend
+func (mr *MockQueueMockRecorder) Extend(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Extend", reflect.TypeOf((*MockQueue)(nil).Extend), arg0)
+}
+
 // Failed mocks base method
 func (m *MockQueue) Failed(arg0 models.Transaction) (queue.Result, error) {
 	ret := m.ctrl.Call(m, "Failed", arg0)
@@ -20,3 +20,7 @@ func (nopQueue) Commit(txn models.Transaction) (Result, error) {
 func (nopQueue) Failed(txn models.Transaction) (Result, error) {
 	return Result{txn.Len(), 0}, nil
 }
+
+func (nopQueue) Extend(txn models.Transaction) (Result, error) {
+	return Result{txn.Len(), 0}, nil
+}
@@ -87,4 +87,27 @@ func TestNopQueue(t *testing.T) {
 			t.Errorf("expected: %d, actual: %d", expected, actual)
 		}
 	})
+
+	t.Run("extend", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		queue := newNopQueue()
+
+		txn := mocks.NewMockTransaction(ctrl)
+
+		txn.EXPECT().Len().Return(0)
+
+		res, err := queue.Extend(txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 0, res.Success; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, res.Failure; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
 }
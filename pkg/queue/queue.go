@@ -24,6 +24,18 @@ type Queue interface {
 	// Failed a transaction containing the records, so that potential retries can
 	// be used.
 	Failed(models.Transaction) (Result, error)
+
+	// Extend the time a transaction containing the records are held for, so
+	// that they're not redelivered whilst they're still being worked on.
+	Extend(models.Transaction) (Result, error)
+}
+
+// Releaser is implemented by queues that don't deliver records again until
+// they're committed or failed, such as queues without a visibility timeout.
+type Releaser interface {
+	// Release a transaction containing the records that were never attempted,
+	// so that they're delivered again.
+	Release(models.Transaction) (Result, error)
 }
 
 // Result returns the amount of successes and failures
@@ -35,6 +47,11 @@ type Result struct {
 type Config struct {
 	name         string
 	remoteConfig *RemoteConfig
+	diskConfig   *DiskConfig
+	kafkaConfig  *KafkaConfig
+	amqpConfig   *AMQPConfig
+	httpConfig   *HTTPConfig
+	redisConfig  *RedisConfig
 }
 
 // Option defines a option for generating a queue Config
@@ -69,6 +86,46 @@ func WithConfig(remoteConfig *RemoteConfig) Option {
 	}
 }
 
+// WithDiskConfig adds a disk queue config to the configuration
+func WithDiskConfig(diskConfig *DiskConfig) Option {
+	return func(config *Config) error {
+		config.diskConfig = diskConfig
+		return nil
+	}
+}
+
+// WithKafkaConfig adds a kafka queue config to the configuration
+func WithKafkaConfig(kafkaConfig *KafkaConfig) Option {
+	return func(config *Config) error {
+		config.kafkaConfig = kafkaConfig
+		return nil
+	}
+}
+
+// WithAMQPConfig adds an amqp queue config to the configuration
+func WithAMQPConfig(amqpConfig *AMQPConfig) Option {
+	return func(config *Config) error {
+		config.amqpConfig = amqpConfig
+		return nil
+	}
+}
+
+// WithHTTPConfig adds a http queue config to the configuration
+func WithHTTPConfig(httpConfig *HTTPConfig) Option {
+	return func(config *Config) error {
+		config.httpConfig = httpConfig
+		return nil
+	}
+}
+
+// WithRedisConfig adds a redis queue config to the configuration
+func WithRedisConfig(redisConfig *RedisConfig) Option {
+	return func(config *Config) error {
+		config.redisConfig = redisConfig
+		return nil
+	}
+}
+
 // New creates a queue from a configuration or returns error if on failure.
 func New(config *Config, logger log.Logger) (queue Queue, err error) {
 	switch strings.ToLower(config.name) {
@@ -78,6 +135,36 @@ func New(config *Config, logger log.Logger) (queue Queue, err error) {
 			err = errors.Wrap(err, "remote queue")
 			return
 		}
+	case "disk":
+		queue, err = newDiskQueue(config.diskConfig, logger)
+		if err != nil {
+			err = errors.Wrap(err, "disk queue")
+			return
+		}
+	case "kafka":
+		queue, err = newKafkaQueue(config.kafkaConfig, logger)
+		if err != nil {
+			err = errors.Wrap(err, "kafka queue")
+			return
+		}
+	case "amqp":
+		queue, err = newAMQPQueue(config.amqpConfig, logger)
+		if err != nil {
+			err = errors.Wrap(err, "amqp queue")
+			return
+		}
+	case "http":
+		queue, err = newHTTPQueue(config.httpConfig, logger)
+		if err != nil {
+			err = errors.Wrap(err, "http queue")
+			return
+		}
+	case "redis":
+		queue, err = newRedisQueue(config.redisConfig, logger)
+		if err != nil {
+			err = errors.Wrap(err, "redis queue")
+			return
+		}
 	case "virtual":
 		queue = newVirtualQueue()
 	case "nop":
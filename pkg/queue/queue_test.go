@@ -6,6 +6,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/trussle/fsys"
 )
 
 func TestBuildingQueue(t *testing.T) {
@@ -63,6 +64,29 @@ func TestNew(t *testing.T) {
 		}
 	})
 
+	t.Run("disk", func(t *testing.T) {
+		diskConfig, err := BuildDiskConfig(
+			WithRootPath("queue"),
+			WithFsys(fsys.NewVirtualFilesystem()),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := Build(
+			With("disk"),
+			WithDiskConfig(diskConfig),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(config, log.NewNopLogger())
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
 	t.Run("nop", func(t *testing.T) {
 		config, err := Build(
 			With("nop"),
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/trussle/courier/pkg/models"
@@ -11,33 +12,51 @@ import (
 )
 
 type queueRecord struct {
-	id         uuid.UUID
-	messageID  string
-	receipt    models.Receipt
-	body       []byte
-	receivedAt time.Time
+	id               uuid.UUID
+	messageID        string
+	receipt          models.Receipt
+	body             []byte
+	receivedAt       time.Time
+	attributes       map[string]string
+	systemAttributes map[string]string
 }
 
-// NewRecord is a default queue record implementation
+// NewRecord is a default queue record implementation. The number of attempts
+// and the group of the record are taken from the system attributes.
 func NewRecord(id uuid.UUID,
 	messageID string,
 	receipt models.Receipt,
 	body []byte,
 	receivedAt time.Time,
+	attributes, systemAttributes map[string]string,
 ) models.Record {
 	return queueRecord{
-		id:         id,
-		messageID:  messageID,
-		receipt:    receipt,
-		body:       body,
-		receivedAt: receivedAt,
+		id:               id,
+		messageID:        messageID,
+		receipt:          receipt,
+		body:             body,
+		receivedAt:       receivedAt,
+		attributes:       attributes,
+		systemAttributes: systemAttributes,
 	}
 }
 
-func (r queueRecord) ID() uuid.UUID           { return r.id }
-func (r queueRecord) Receipt() models.Receipt { return r.receipt }
-func (r queueRecord) RecordID() string        { return r.messageID }
-func (r queueRecord) Body() []byte            { return r.body }
+func (r queueRecord) ID() uuid.UUID                       { return r.id }
+func (r queueRecord) Receipt() models.Receipt             { return r.receipt }
+func (r queueRecord) RecordID() string                    { return r.messageID }
+func (r queueRecord) Body() []byte                        { return r.body }
+func (r queueRecord) ReceivedAt() time.Time               { return r.receivedAt }
+func (r queueRecord) GroupID() string                     { return r.systemAttributes[messageGroupID] }
+func (r queueRecord) Attributes() map[string]string       { return r.attributes }
+func (r queueRecord) SystemAttributes() map[string]string { return r.systemAttributes }
+
+func (r queueRecord) Attempts() int {
+	count, err := strconv.Atoi(r.systemAttributes[approximateReceiveCount])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
 
 func (r queueRecord) Equal(other models.Record) bool {
 	return r.ID().Equals(other.ID()) &&
@@ -52,6 +71,29 @@ func (r queueRecord) Failed(txn models.Transaction) error {
 	return txn.Push(r.id, r)
 }
 
+// FailedRecord returns the record along with the reason it failed delivery,
+// so that the queue can say why when it gives up on the record.
+func FailedRecord(record models.Record, reason string) models.Record {
+	return failedRecord{
+		Record: record,
+		reason: reason,
+	}
+}
+
+type failedRecord struct {
+	models.Record
+	reason string
+}
+
+// FailureReason returns the reason the record failed delivery, or the default
+// reason if it wasn't given one.
+func FailureReason(record models.Record) string {
+	if r, ok := record.(failedRecord); ok && r.reason != "" {
+		return r.reason
+	}
+	return defaultFailureReason
+}
+
 // Generate allows UUID to be used within quickcheck scenarios.
 func (queueRecord) Generate(r *rand.Rand, size int) reflect.Value {
 	rec, err := GenerateQueueRecord(r)
@@ -102,5 +144,12 @@ func GenerateQueueRecord(rnd *rand.Rand) (models.Record, error) {
 	// Timestamp generation
 	rec.receivedAt = time.Now().Round(time.Millisecond)
 
+	// Attributes generation
+	rec.attributes = map[string]string{}
+	rec.systemAttributes = map[string]string{
+		approximateReceiveCount: "1",
+		sentTimestamp:           strconv.FormatInt(rec.receivedAt.UnixNano()/int64(time.Millisecond), 10),
+	}
+
 	return rec, nil
 }
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"reflect"
+	"strconv"
 	"testing"
 	"testing/quick"
 	"time"
@@ -17,14 +18,36 @@ func TestRecord(t *testing.T) {
 	t.Parallel()
 
 	t.Run("new record", func(t *testing.T) {
-		fn := func(id uuid.UUID, messageID, receipt string, body []byte) bool {
-			now := time.Now()
-			record := NewRecord(id, messageID, models.Receipt(receipt), body, now)
+		fn := func(id uuid.UUID, messageID, receipt string, body []byte, attributes map[string]string, attempts uint8, groupID string) bool {
+			var (
+				now              = time.Now()
+				systemAttributes = map[string]string{
+					approximateReceiveCount: strconv.Itoa(int(attempts) + 1),
+					messageGroupID:          groupID,
+				}
+				record = NewRecord(id, messageID, models.Receipt(receipt), body, now, attributes, systemAttributes)
+			)
 
 			return record.ID().Equals(id) &&
 				record.Receipt().String() == receipt &&
 				record.RecordID() == messageID &&
-				reflect.DeepEqual(record.Body(), body)
+				reflect.DeepEqual(record.Body(), body) &&
+				reflect.DeepEqual(record.Attributes(), attributes) &&
+				reflect.DeepEqual(record.SystemAttributes(), systemAttributes) &&
+				record.Attempts() == int(attempts)+1 &&
+				record.GroupID() == groupID
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("new record without system attributes", func(t *testing.T) {
+		fn := func(id uuid.UUID, body []byte) bool {
+			record := NewRecord(id, "", "", body, time.Now(), nil, nil)
+
+			return record.Attempts() == 1 &&
+				record.GroupID() == ""
 		}
 		if err := quick.Check(fn, nil); err != nil {
 			t.Error(err)
@@ -88,6 +111,23 @@ func TestRecord(t *testing.T) {
 			t.Error(err)
 		}
 	})
+
+	t.Run("failure reason", func(t *testing.T) {
+		fn := func(rec queueRecord, reason string) bool {
+			expected := reason
+			if reason == "" {
+				expected = defaultFailureReason
+			}
+
+			failed := FailedRecord(rec, reason)
+			return FailureReason(failed) == expected &&
+				FailureReason(rec) == defaultFailureReason &&
+				failed.ID().Equals(rec.ID())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 type recordMatcher struct {
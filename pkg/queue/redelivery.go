@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+)
+
+// Redelivery decides when records that failed delivery are made visible on
+// the queue again.
+type Redelivery string
+
+const (
+	// RedeliverDefault leaves the records to become visible once the
+	// visibility timeout lapses.
+	RedeliverDefault Redelivery = "default"
+
+	// RedeliverZero makes the records visible again straight away.
+	RedeliverZero Redelivery = "zero"
+
+	// RedeliverFixed makes the records visible again after a fixed delay.
+	RedeliverFixed Redelivery = "fixed"
+
+	// RedeliverExponential makes the records visible again after a delay that
+	// doubles with every time the record has been received.
+	RedeliverExponential Redelivery = "exponential"
+)
+
+// maxVisibilityTimeout is the longest SQS allows a message to be hidden for.
+const maxVisibilityTimeout = 12 * time.Hour
+
+// ParseRedelivery returns the Redelivery for a name or returns an error if the
+// name isn't known.
+func ParseRedelivery(name string) (Redelivery, error) {
+	switch redelivery := Redelivery(strings.ToLower(name)); redelivery {
+	case RedeliverDefault, RedeliverZero, RedeliverFixed, RedeliverExponential:
+		return redelivery, nil
+	default:
+		return "", errors.Errorf("unexpected redelivery %q", name)
+	}
+}
+
+// RedeliveryPolicy describes how long records that failed delivery are hidden
+// for before they're redelivered.
+type RedeliveryPolicy struct {
+	Strategy Redelivery
+
+	// Delay is the fixed delay, or the delay after the first receive when
+	// exponential.
+	Delay time.Duration
+
+	// MaxDelay caps the exponential delay, a zero value is capped at the
+	// longest visibility timeout SQS allows.
+	MaxDelay time.Duration
+}
+
+// Enabled returns if the policy changes when records are redelivered at all.
+func (p RedeliveryPolicy) Enabled() bool {
+	switch p.Strategy {
+	case RedeliverZero, RedeliverFixed, RedeliverExponential:
+		return true
+	default:
+		return false
+	}
+}
+
+// Validate returns an error if the policy can't be used. The fixed and
+// exponential strategies need a delay, as without one they'd redeliver
+// straight away, the same as zero, which is never what was asked for.
+func (p RedeliveryPolicy) Validate() error {
+	if p.Delay < 0 {
+		return errors.Errorf("invalid redelivery delay %s", p.Delay)
+	}
+	if p.MaxDelay < 0 {
+		return errors.Errorf("invalid redelivery max delay %s", p.MaxDelay)
+	}
+	switch p.Strategy {
+	case RedeliverFixed, RedeliverExponential:
+		if p.Delay == 0 {
+			return errors.Errorf("%s redelivery expects a delay", p.Strategy)
+		}
+	}
+	return nil
+}
+
+// Backoff returns how long the record should be hidden for, before it's
+// redelivered.
+func (p RedeliveryPolicy) Backoff(record models.Record) time.Duration {
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 || maxDelay > maxVisibilityTimeout {
+		maxDelay = maxVisibilityTimeout
+	}
+
+	var delay time.Duration
+	switch p.Strategy {
+	case RedeliverFixed:
+		delay = p.Delay
+	case RedeliverExponential:
+		delay = p.Delay
+		for i := 1; i < record.Attempts() && delay < maxDelay; i++ {
+			delay *= 2
+		}
+	}
+
+	if delay > maxDelay {
+		return maxDelay
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
@@ -0,0 +1,164 @@
+package queue
+
+import (
+	"strconv"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
+)
+
+func TestParseRedelivery(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse", func(t *testing.T) {
+		for name, expected := range map[string]Redelivery{
+			"default":     RedeliverDefault,
+			"zero":        RedeliverZero,
+			"Fixed":       RedeliverFixed,
+			"EXPONENTIAL": RedeliverExponential,
+		} {
+			actual, err := ParseRedelivery(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("parse with unknown name", func(t *testing.T) {
+		_, err := ParseRedelivery("linear")
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestRedeliveryPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("enabled", func(t *testing.T) {
+		for strategy, expected := range map[Redelivery]bool{
+			"":                   false,
+			RedeliverDefault:     false,
+			RedeliverZero:        true,
+			RedeliverFixed:       true,
+			RedeliverExponential: true,
+		} {
+			policy := RedeliveryPolicy{Strategy: strategy}
+			if actual := policy.Enabled(); expected != actual {
+				t.Errorf("%s expected: %t, actual: %t", strategy, expected, actual)
+			}
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		for _, policy := range []RedeliveryPolicy{
+			{Strategy: RedeliverDefault},
+			{Strategy: RedeliverZero},
+			{Strategy: RedeliverFixed, Delay: time.Second},
+			{Strategy: RedeliverExponential, Delay: time.Second, MaxDelay: time.Minute},
+		} {
+			if err := policy.Validate(); err != nil {
+				t.Errorf("%s: %s", policy.Strategy, err)
+			}
+		}
+	})
+
+	t.Run("validate with the default delay", func(t *testing.T) {
+		// The -redelivery.delay flag defaults to no delay, which would leave
+		// fixed and exponential redelivering straight away.
+		for _, policy := range []RedeliveryPolicy{
+			{Strategy: RedeliverFixed},
+			{Strategy: RedeliverExponential, MaxDelay: 15 * time.Minute},
+			{Strategy: RedeliverExponential, Delay: -time.Second},
+			{Strategy: RedeliverZero, MaxDelay: -time.Second},
+		} {
+			err := policy.Validate()
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("%s expected: %t, actual: %t", policy.Strategy, expected, actual)
+			}
+		}
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		fn := func(id uuid.UUID, delay uint16, attempts uint8) bool {
+			policy := RedeliveryPolicy{
+				Strategy: RedeliverZero,
+				Delay:    time.Duration(delay) * time.Second,
+			}
+			return policy.Backoff(receivedRecord(id, int(attempts))) == 0
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		fn := func(id uuid.UUID, delay uint16, attempts uint8) bool {
+			policy := RedeliveryPolicy{
+				Strategy: RedeliverFixed,
+				Delay:    time.Duration(delay) * time.Second,
+			}
+
+			expected := time.Duration(delay) * time.Second
+			if expected > maxVisibilityTimeout {
+				expected = maxVisibilityTimeout
+			}
+			return policy.Backoff(receivedRecord(id, int(attempts))) == expected
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("exponential", func(t *testing.T) {
+		id, err := uuid.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		policy := RedeliveryPolicy{
+			Strategy: RedeliverExponential,
+			Delay:    time.Second,
+			MaxDelay: 10 * time.Second,
+		}
+		for attempts, expected := range map[int]time.Duration{
+			1: time.Second,
+			2: 2 * time.Second,
+			3: 4 * time.Second,
+			4: 8 * time.Second,
+			5: 10 * time.Second,
+			9: 10 * time.Second,
+		} {
+			if actual := policy.Backoff(receivedRecord(id, attempts)); expected != actual {
+				t.Errorf("%d expected: %s, actual: %s", attempts, expected, actual)
+			}
+		}
+	})
+
+	t.Run("exponential without max delay", func(t *testing.T) {
+		id, err := uuid.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		policy := RedeliveryPolicy{
+			Strategy: RedeliverExponential,
+			Delay:    time.Hour,
+		}
+		if expected, actual := maxVisibilityTimeout, policy.Backoff(receivedRecord(id, 100)); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+}
+
+func receivedRecord(id uuid.UUID, attempts int) models.Record {
+	return NewRecord(id, "", "", nil, time.Now(), nil, map[string]string{
+		approximateReceiveCount: strconv.Itoa(attempts),
+	})
+}
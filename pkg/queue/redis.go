@@ -0,0 +1,751 @@
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
+)
+
+const (
+	defaultRedisConsumer      = "courier"
+	defaultRedisMaxDeliveries = 5
+	defaultRedisClaimIdle     = 30 * time.Second
+	defaultRedisBatchSize     = maxBatchEntries
+	defaultRedisBlockTime     = time.Second
+
+	// redisRetrySuffix is added to the stream to name the retry stream, when
+	// one isn't configured.
+	redisRetrySuffix = ":retry"
+
+	// redisTimeout is how long a command has to reply, on top of however long
+	// it blocks for.
+	redisTimeout = 5 * time.Second
+
+	// redisPendingScan is how many pending entries are looked at for entries
+	// to reclaim on every dequeue.
+	redisPendingScan = 100
+
+	// The fields of a stream entry.
+	redisFieldBody       = "body"
+	redisFieldGroup      = "group"
+	redisFieldAttribute  = "attr:"
+	redisFieldSource     = "source"
+	redisFieldDeliveries = "deliveries"
+)
+
+// RedisConfig creates a configuration to create a redis queue.
+type RedisConfig struct {
+	Addr          string
+	Stream        string
+	Group         string
+	Consumer      string
+	RetryStream   string
+	MaxDeliveries int
+	ClaimIdle     time.Duration
+	BatchSize     int
+	BlockTime     time.Duration
+}
+
+// redisQueue consumes entries from a redis stream as a consumer of a consumer
+// group. Entries stay pending for the group until they're acknowledged, so
+// entries left pending by a consumer that died are reclaimed once they've been
+// idle for long enough. Entries that fail are left pending to be reclaimed,
+// until they've been delivered too many times, when they're moved on to a
+// retry stream instead.
+type redisQueue struct {
+	pool          *redisPool
+	stream        string
+	group         string
+	consumer      string
+	retryStream   string
+	maxDeliveries int
+	claimIdle     time.Duration
+	batchSize     int
+	blockTime     time.Duration
+	logger        log.Logger
+}
+
+// redisEntry is an entry read from a stream, along with the number of times
+// it's been delivered.
+type redisEntry struct {
+	id         string
+	fields     map[string]string
+	deliveries int
+}
+
+func newRedisQueue(config *RedisConfig, logger log.Logger) (Queue, error) {
+	if config == nil {
+		return nil, errors.New("missing config")
+	}
+	if config.Addr == "" {
+		return nil, errors.New("missing address")
+	}
+	if config.Stream == "" {
+		return nil, errors.New("missing stream")
+	}
+	if config.Group == "" {
+		return nil, errors.New("missing group")
+	}
+
+	// Every queue is it's own consumer, so that entries left pending by one
+	// that's gone away can be told apart and reclaimed.
+	id, err := uuid.New()
+	if err != nil {
+		return nil, err
+	}
+	consumer := config.Consumer
+	if consumer == "" {
+		consumer = defaultRedisConsumer
+	}
+
+	q := &redisQueue{
+		pool:          newRedisPool(config.Addr),
+		stream:        config.Stream,
+		group:         config.Group,
+		consumer:      fmt.Sprintf("%s-%s", consumer, id.String()),
+		retryStream:   config.RetryStream,
+		maxDeliveries: config.MaxDeliveries,
+		claimIdle:     config.ClaimIdle,
+		batchSize:     config.BatchSize,
+		blockTime:     config.BlockTime,
+		logger:        logger,
+	}
+	if q.retryStream == "" {
+		q.retryStream = config.Stream + redisRetrySuffix
+	}
+	if q.claimIdle <= 0 {
+		q.claimIdle = defaultRedisClaimIdle
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = defaultRedisBatchSize
+	}
+	if q.blockTime <= 0 {
+		q.blockTime = defaultRedisBlockTime
+	}
+
+	if _, err := q.pool.do(0, "XGROUP", "CREATE", q.stream, q.group, "0", "MKSTREAM"); err != nil {
+		if e, ok := err.(redisError); !ok || !strings.HasPrefix(string(e), "BUSYGROUP") {
+			return nil, errors.Wrap(err, "creating group")
+		}
+	}
+
+	level.Debug(logger).Log("stream", q.stream, "group", q.group, "consumer", q.consumer, "retry_stream", q.retryStream)
+
+	return q, nil
+}
+
+// Enqueue adds the record to the end of the stream.
+func (q *redisQueue) Enqueue(rec models.Record) error {
+	args := []string{"XADD", q.stream, "*", redisFieldBody, string(rec.Body())}
+	if group := rec.GroupID(); group != "" {
+		args = append(args, redisFieldGroup, group)
+	}
+	for k, v := range rec.Attributes() {
+		args = append(args, redisFieldAttribute+k, v)
+	}
+
+	_, err := q.pool.do(0, args...)
+	return err
+}
+
+// Dequeue reclaims entries that have been idle for too long first, before
+// reading new entries, blocking for them only if there's nothing to reclaim.
+func (q *redisQueue) Dequeue() ([]models.Record, error) {
+	entries, err := q.reclaim()
+	if err != nil {
+		// Still read new entries, the pending entries can be reclaimed later.
+		level.Warn(q.logger).Log("state", "reclaim", "err", err)
+	}
+
+	if n := q.batchSize - len(entries); n > 0 {
+		args := []string{"XREADGROUP", "GROUP", q.group, q.consumer, "COUNT", strconv.Itoa(n)}
+		var block time.Duration
+		if len(entries) == 0 {
+			block = q.blockTime
+			args = append(args, "BLOCK", strconv.FormatInt(int64(block/time.Millisecond), 10))
+		}
+		args = append(args, "STREAMS", q.stream, ">")
+
+		reply, err := q.pool.do(block, args...)
+		if err != nil {
+			return q.records(entries), err
+		}
+		read, err := readGroupEntries(reply)
+		if err != nil {
+			return q.records(entries), err
+		}
+		entries = append(entries, read...)
+	}
+
+	return q.records(entries), nil
+}
+
+// Commit acknowledges the records, so that they're no longer pending.
+func (q *redisQueue) Commit(txn models.Transaction) (Result, error) {
+	ids, err := q.ids(txn)
+	if err != nil || len(ids) == 0 {
+		return Result{}, err
+	}
+
+	reply, err := q.pool.do(0, append([]string{"XACK", q.stream, q.group}, ids...)...)
+	if err != nil {
+		return Result{}, err
+	}
+	acked, ok := reply.(int64)
+	if !ok {
+		return Result{}, errors.Errorf("unexpected reply %v", reply)
+	}
+	return Result{int(acked), len(ids) - int(acked)}, nil
+}
+
+// Failed leaves the records pending, so they're reclaimed once they've been
+// idle for long enough, unless they've been delivered too many times, in
+// which case they're moved on to the retry stream.
+func (q *redisQueue) Failed(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	for _, record := range records {
+		if q.maxDeliveries <= 0 || record.Attempts() < q.maxDeliveries {
+			result.Success++
+			continue
+		}
+
+		fields := map[string]string{
+			redisFieldBody: string(record.Body()),
+		}
+		if group := record.GroupID(); group != "" {
+			fields[redisFieldGroup] = group
+		}
+		for k, v := range record.Attributes() {
+			fields[redisFieldAttribute+k] = v
+		}
+
+		if err := q.retry(redisEntry{
+			id:         record.RecordID(),
+			fields:     fields,
+			deliveries: record.Attempts(),
+		}); err != nil {
+			level.Warn(q.logger).Log("state", "retry", "id", record.RecordID(), "err", err)
+			result.Failure++
+			continue
+		}
+		result.Success++
+	}
+	return result, nil
+}
+
+// Extend claims the records again, which resets how long they've been idle
+// for, so that they're not reclaimed whilst they're still being worked on.
+func (q *redisQueue) Extend(txn models.Transaction) (Result, error) {
+	ids, err := q.ids(txn)
+	if err != nil || len(ids) == 0 {
+		return Result{}, err
+	}
+
+	args := append([]string{"XCLAIM", q.stream, q.group, q.consumer, "0"}, ids...)
+	reply, err := q.pool.do(0, append(args, "JUSTID")...)
+	if err != nil {
+		return Result{}, err
+	}
+	claimed, ok := reply.([]interface{})
+	if !ok {
+		return Result{}, errors.Errorf("unexpected reply %v", reply)
+	}
+	return Result{len(claimed), len(ids) - len(claimed)}, nil
+}
+
+// reclaim claims the pending entries that have been idle for too long, and
+// moves the ones that have been delivered too many times on to the retry
+// stream.
+func (q *redisQueue) reclaim() ([]redisEntry, error) {
+	reply, err := q.pool.do(0, "XPENDING", q.stream, q.group, "-", "+", strconv.Itoa(redisPendingScan))
+	if err != nil {
+		return nil, err
+	}
+	pending, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected reply %v", reply)
+	}
+
+	var (
+		ids        []string
+		deliveries = make(map[string]int)
+		idle       = int64(q.claimIdle / time.Millisecond)
+	)
+	for _, v := range pending {
+		p, ok := v.([]interface{})
+		if !ok || len(p) != 4 {
+			return nil, errors.Errorf("unexpected pending entry %v", v)
+		}
+		id, _ := p[0].(string)
+		elapsed, _ := p[2].(int64)
+		count, _ := p[3].(int64)
+		if elapsed < idle {
+			continue
+		}
+		ids = append(ids, id)
+		deliveries[id] = int(count)
+		if len(ids) >= q.batchSize {
+			break
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := append([]string{"XCLAIM", q.stream, q.group, q.consumer, strconv.FormatInt(idle, 10)}, ids...)
+	reply, err = q.pool.do(0, args...)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := streamEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]redisEntry, 0, len(claimed))
+	for _, entry := range claimed {
+		entry.deliveries = deliveries[entry.id] + 1
+		if q.maxDeliveries > 0 && entry.deliveries > q.maxDeliveries {
+			// It's already been delivered as many times as it can be, most
+			// likely to consumers that died whilst holding it.
+			if err := q.retry(entry); err != nil {
+				level.Warn(q.logger).Log("state", "retry", "id", entry.id, "err", err)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// retry adds the entry to the retry stream, before acknowledging it.
+func (q *redisQueue) retry(entry redisEntry) error {
+	args := []string{"XADD", q.retryStream, "*"}
+	for k, v := range entry.fields {
+		args = append(args, k, v)
+	}
+	args = append(args,
+		redisFieldSource, entry.id,
+		redisFieldDeliveries, strconv.Itoa(entry.deliveries),
+	)
+	if _, err := q.pool.do(0, args...); err != nil {
+		return errors.Wrap(err, "adding to retry stream")
+	}
+
+	_, err := q.pool.do(0, "XACK", q.stream, q.group, entry.id)
+	return errors.Wrap(err, "acknowledging")
+}
+
+func (q *redisQueue) ids(txn models.Transaction) ([]string, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(records))
+	for k, record := range records {
+		ids[k] = record.RecordID()
+	}
+	return ids, nil
+}
+
+func (q *redisQueue) records(entries []redisEntry) []models.Record {
+	var (
+		now     = time.Now()
+		records = make([]models.Record, 0, len(entries))
+	)
+	for _, entry := range entries {
+		id, err := uuid.New()
+		if err != nil {
+			// The entry stays pending, so it'll be reclaimed.
+			continue
+		}
+
+		attributes := make(map[string]string)
+		for k, v := range entry.fields {
+			if strings.HasPrefix(k, redisFieldAttribute) {
+				attributes[strings.TrimPrefix(k, redisFieldAttribute)] = v
+			}
+		}
+
+		deliveries := entry.deliveries
+		if deliveries < 1 {
+			deliveries = 1
+		}
+		systemAttributes := map[string]string{
+			approximateReceiveCount: strconv.Itoa(deliveries),
+		}
+		// The first part of an entry id is when it was added, in milliseconds.
+		if ms := strings.SplitN(entry.id, "-", 2)[0]; ms != "" {
+			systemAttributes[sentTimestamp] = ms
+		}
+		if group := entry.fields[redisFieldGroup]; group != "" {
+			systemAttributes[messageGroupID] = group
+		}
+
+		records = append(records, NewRecord(
+			id,
+			entry.id,
+			models.Receipt(entry.id),
+			[]byte(entry.fields[redisFieldBody]),
+			now,
+			attributes,
+			systemAttributes,
+		))
+	}
+	return records
+}
+
+// readGroupEntries returns the entries in a XREADGROUP reply, which are
+// grouped by stream.
+func readGroupEntries(reply interface{}) ([]redisEntry, error) {
+	if reply == nil {
+		// Nothing arrived whilst blocked.
+		return nil, nil
+	}
+	streams, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected reply %v", reply)
+	}
+
+	var entries []redisEntry
+	for _, v := range streams {
+		stream, ok := v.([]interface{})
+		if !ok || len(stream) != 2 {
+			return nil, errors.Errorf("unexpected stream %v", v)
+		}
+		read, err := streamEntries(stream[1])
+		if err != nil {
+			return nil, err
+		}
+		for k := range read {
+			read[k].deliveries = 1
+		}
+		entries = append(entries, read...)
+	}
+	return entries, nil
+}
+
+// streamEntries returns the entries in a reply, each of which is the id of the
+// entry, followed by the fields and values of the entry.
+func streamEntries(reply interface{}) ([]redisEntry, error) {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("unexpected entries %v", reply)
+	}
+
+	entries := make([]redisEntry, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			// Entries that have been deleted come back empty.
+			continue
+		}
+		e, ok := v.([]interface{})
+		if !ok || len(e) != 2 {
+			return nil, errors.Errorf("unexpected entry %v", v)
+		}
+		id, ok := e[0].(string)
+		if !ok {
+			return nil, errors.Errorf("unexpected entry id %v", e[0])
+		}
+		values, _ := e[1].([]interface{})
+		fields := make(map[string]string, len(values)/2)
+		for i := 0; i+1 < len(values); i += 2 {
+			name, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+			fields[name] = value
+		}
+		entries = append(entries, redisEntry{
+			id:     id,
+			fields: fields,
+		})
+	}
+	return entries, nil
+}
+
+// redisError is an error replied by redis.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisPool hands out connections to redis, so that a blocking read doesn't
+// hold up other commands.
+type redisPool struct {
+	mutex sync.Mutex
+	addr  string
+	idle  []*redisConn
+}
+
+func newRedisPool(addr string) *redisPool {
+	return &redisPool{
+		addr: addr,
+	}
+}
+
+// do sends the command on a connection from the pool, waiting for however
+// long the command blocks for, on top of the usual timeout.
+func (p *redisPool) do(block time.Duration, args ...string) (interface{}, error) {
+	conn, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(block+redisTimeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection is in an unknown state.
+			conn.Close()
+			return nil, err
+		}
+	}
+	p.put(conn)
+	return reply, err
+}
+
+func (p *redisPool) get() (*redisConn, error) {
+	p.mutex.Lock()
+	if n := len(p.idle); n > 0 {
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return conn, nil
+	}
+	p.mutex.Unlock()
+
+	return dialRedis(p.addr)
+}
+
+func (p *redisPool) put(conn *redisConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.idle = append(p.idle, conn)
+}
+
+// redisConn is a connection to redis, speaking just enough RESP to send
+// commands and read their replies.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dialRedis(addr string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command as an array of bulk strings and reads the reply.
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+// read a reply, where errors are returned as a redisError, integers as an
+// int64, strings as a string, arrays as a []interface{} and nulls as nil.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return nil, err
+		}
+		return string(b[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, size)
+		for k := range values {
+			if values[k], err = c.read(); err != nil {
+				// Errors with in an array are returned as values.
+				if e, ok := err.(redisError); ok {
+					values[k] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, errors.Errorf("unexpected reply %q", line)
+	}
+}
+
+// RedisConfigOption defines a option for generating a RedisConfig
+type RedisConfigOption func(*RedisConfig) error
+
+// BuildRedisConfig ingests configuration options to then yield a RedisConfig,
+// and return an error if it fails during configuring.
+func BuildRedisConfig(opts ...RedisConfigOption) (*RedisConfig, error) {
+	config := RedisConfig{
+		Consumer:      defaultRedisConsumer,
+		MaxDeliveries: defaultRedisMaxDeliveries,
+		ClaimIdle:     defaultRedisClaimIdle,
+		BatchSize:     defaultRedisBatchSize,
+		BlockTime:     defaultRedisBlockTime,
+	}
+	for _, opt := range opts {
+		err := opt(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// WithRedisAddr adds an Addr option to the configuration
+func WithRedisAddr(addr string) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		config.Addr = addr
+		return nil
+	}
+}
+
+// WithRedisStream adds an Stream option to the configuration
+func WithRedisStream(stream string) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		config.Stream = stream
+		return nil
+	}
+}
+
+// WithRedisGroup adds an Group option to the configuration, which is the
+// consumer group the queue consumes as
+func WithRedisGroup(group string) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		config.Group = group
+		return nil
+	}
+}
+
+// WithRedisConsumer adds an Consumer option to the configuration, which
+// prefixes the name of every consumer
+func WithRedisConsumer(consumer string) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		config.Consumer = consumer
+		return nil
+	}
+}
+
+// WithRedisRetryStream adds an RetryStream option to the configuration, which
+// is where records that have been delivered too many times are moved to. It
+// defaults to the stream with a ":retry" suffix.
+func WithRedisRetryStream(retryStream string) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		config.RetryStream = retryStream
+		return nil
+	}
+}
+
+// WithRedisMaxDeliveries adds an MaxDeliveries option to the configuration,
+// which is how many times a record is delivered before it's moved to the
+// retry stream, 0 never moves them
+func WithRedisMaxDeliveries(maxDeliveries int) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		if maxDeliveries < 0 {
+			return errors.Errorf("invalid max deliveries %d", maxDeliveries)
+		}
+		config.MaxDeliveries = maxDeliveries
+		return nil
+	}
+}
+
+// WithRedisClaimIdle adds an ClaimIdle option to the configuration, which is
+// how long a record is pending before it's reclaimed
+func WithRedisClaimIdle(claimIdle time.Duration) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		if claimIdle < time.Millisecond {
+			return errors.Errorf("invalid claim idle %s", claimIdle)
+		}
+		config.ClaimIdle = claimIdle
+		return nil
+	}
+}
+
+// WithRedisBatchSize adds an BatchSize option to the configuration, which is
+// the max number of records to dequeue at once
+func WithRedisBatchSize(batchSize int) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		if batchSize <= 0 {
+			return errors.Errorf("invalid batch size %d", batchSize)
+		}
+		config.BatchSize = batchSize
+		return nil
+	}
+}
+
+// WithRedisBlockTime adds an BlockTime option to the configuration, which is
+// how long a dequeue waits for records
+func WithRedisBlockTime(blockTime time.Duration) RedisConfigOption {
+	return func(config *RedisConfig) error {
+		if blockTime < time.Millisecond {
+			return errors.Errorf("invalid block time %s", blockTime)
+		}
+		config.BlockTime = blockTime
+		return nil
+	}
+}
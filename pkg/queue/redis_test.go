@@ -0,0 +1,383 @@
+package queue
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/trussle/courier/pkg/fakeredis"
+)
+
+func TestRedisQueue(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("enqueue and dequeue", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+
+		fn := func(body []byte, name, value, group string) bool {
+			record := NewRecord(newID(t, rnd), "", "", body, time.Now(), map[string]string{
+				name: value,
+			}, map[string]string{
+				messageGroupID: group,
+			})
+			if err := queue.Enqueue(record); err != nil {
+				t.Fatal(err)
+			}
+
+			records := dequeueRecords(t, queue)
+			if expected, actual := 1, len(records); expected != actual {
+				t.Fatalf("expected: %d, actual: %d", expected, actual)
+			}
+
+			res := records[0]
+			if expected, actual := 1, res.Attempts(); expected != actual {
+				t.Errorf("expected: %d, actual: %d", expected, actual)
+			}
+			if expected, actual := value, res.Attributes()[name]; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := group, res.GroupID(); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			if expected, actual := res.RecordID(), res.Receipt().String(); expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+			return string(body) == string(res.Body())
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("dequeue with nothing to read", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("dequeue is bounded by batch size", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+		enqueueRecords(t, rnd, queue, defaultRedisBatchSize+2)
+
+		if expected, actual := defaultRedisBatchSize, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 2, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("commit acknowledges", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+		enqueueRecords(t, rnd, queue, 3)
+
+		records := dequeueRecords(t, queue)
+		if expected, actual := 3, server.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		res, err := queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{3, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, server.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// Committing again finds nothing to acknowledge.
+		res, err = queue.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 3}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("failed is reclaimed", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+		enqueueRecords(t, rnd, queue, 1)
+
+		records := dequeueRecords(t, queue)
+		if _, err := queue.Failed(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Not until it's been idle for long enough.
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		server.Advance(defaultRedisClaimIdle)
+
+		reclaimed := dequeueRecords(t, queue)
+		if expected, actual := 1, len(reclaimed); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := records[0].RecordID(), reclaimed[0].RecordID(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := 2, reclaimed[0].Attempts(); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed moves to retry stream", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 2)
+		enqueueRecords(t, rnd, queue, 1)
+
+		records := dequeueRecords(t, queue)
+		if _, err := queue.Failed(newTestTransaction(t, records...)); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, server.Len("stream:retry"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		server.Advance(defaultRedisClaimIdle)
+
+		records = dequeueRecords(t, queue)
+		res, err := queue.Failed(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{1, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 0, server.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		retried := server.Fields("stream:retry")
+		if expected, actual := 1, len(retried); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := string(records[0].Body()), retried[0][redisFieldBody]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := records[0].RecordID(), retried[0][redisFieldSource]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := "2", retried[0][redisFieldDeliveries]; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	})
+
+	t.Run("reclaims from a consumer that died", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		dead := newTestRedisQueue(t, server, 0)
+		enqueueRecords(t, rnd, dead, 2)
+
+		records := dequeueRecords(t, dead)
+
+		queue := newTestRedisQueue(t, server, 0)
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		server.Advance(defaultRedisClaimIdle)
+
+		reclaimed := dequeueRecords(t, queue)
+		if expected, actual := len(records), len(reclaimed); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+		if _, err := queue.Commit(newTestTransaction(t, reclaimed...)); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 0, server.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		// They have already been acknowledged by the consumer that reclaimed them.
+		res, err := dead.Commit(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{0, 2}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("reclaim moves to retry stream", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		dead := newTestRedisQueue(t, server, 1)
+		enqueueRecords(t, rnd, dead, 1)
+		dequeueRecords(t, dead)
+
+		server.Advance(defaultRedisClaimIdle)
+
+		queue := newTestRedisQueue(t, server, 1)
+		if expected, actual := 0, len(dequeueRecords(t, queue)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, server.Len("stream:retry"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, server.Pending("stream", "group"); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		defer server.Close()
+
+		queue := newTestRedisQueue(t, server, 0)
+		enqueueRecords(t, rnd, queue, 2)
+
+		records := dequeueRecords(t, queue)
+
+		server.Advance(defaultRedisClaimIdle - time.Second)
+
+		res, err := queue.Extend(newTestTransaction(t, records...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (Result{2, 0}), res; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		server.Advance(time.Second)
+
+		other := newTestRedisQueue(t, server, 0)
+		if expected, actual := 0, len(dequeueRecords(t, other)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("server gone", func(t *testing.T) {
+		server := newTestRedisServer(t)
+		queue := newTestRedisQueue(t, server, 0)
+		server.Close()
+
+		if _, err := queue.Dequeue(); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestBuildRedisConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("build", func(t *testing.T) {
+		fn := func(addr, stream, group, consumer, retryStream string, maxDeliveries, batchSize uint8, claimIdle, blockTime uint32) bool {
+			config, err := BuildRedisConfig(
+				WithRedisAddr(addr),
+				WithRedisStream(stream),
+				WithRedisGroup(group),
+				WithRedisConsumer(consumer),
+				WithRedisRetryStream(retryStream),
+				WithRedisMaxDeliveries(int(maxDeliveries)),
+				WithRedisClaimIdle(time.Duration(claimIdle)+time.Millisecond),
+				WithRedisBatchSize(int(batchSize)+1),
+				WithRedisBlockTime(time.Duration(blockTime)+time.Millisecond),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.Addr == addr &&
+				config.Stream == stream &&
+				config.Group == group &&
+				config.Consumer == consumer &&
+				config.RetryStream == retryStream &&
+				config.MaxDeliveries == int(maxDeliveries) &&
+				config.ClaimIdle == time.Duration(claimIdle)+time.Millisecond &&
+				config.BatchSize == int(batchSize)+1 &&
+				config.BlockTime == time.Duration(blockTime)+time.Millisecond
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid build", func(t *testing.T) {
+		for _, opt := range []RedisConfigOption{
+			WithRedisMaxDeliveries(-1),
+			WithRedisClaimIdle(0),
+			WithRedisBatchSize(0),
+			WithRedisBlockTime(0),
+		} {
+			_, err := BuildRedisConfig(opt)
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+
+	t.Run("invalid queue", func(t *testing.T) {
+		for _, opts := range [][]RedisConfigOption{
+			{WithRedisStream("stream"), WithRedisGroup("group")},
+			{WithRedisAddr("localhost:6379"), WithRedisGroup("group")},
+			{WithRedisAddr("localhost:6379"), WithRedisStream("stream")},
+		} {
+			config, err := BuildRedisConfig(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = newRedisQueue(config, log.NewNopLogger())
+			if expected, actual := false, err == nil; expected != actual {
+				t.Errorf("expected: %t, actual: %t", expected, actual)
+			}
+		}
+	})
+}
+
+func newTestRedisServer(t *testing.T) *fakeredis.Server {
+	server, err := fakeredis.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func newTestRedisQueue(t *testing.T, server *fakeredis.Server, maxDeliveries int) Queue {
+	config, err := BuildRedisConfig(
+		WithRedisAddr(server.Addr()),
+		WithRedisStream("stream"),
+		WithRedisGroup("group"),
+		WithRedisMaxDeliveries(maxDeliveries),
+		WithRedisBlockTime(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := newRedisQueue(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
@@ -1,6 +1,9 @@
 package queue
 
 import (
+	"encoding/base64"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,16 +22,52 @@ type RemoteConfig struct {
 	EC2Role             bool
 	ID, Secret, Token   string
 	Region, Queue       string
+	DeadLetterQueue     string
+	MaxReceiveCount     int
 	MaxNumberOfMessages int64
 	VisibilityTimeout   time.Duration
+	Redelivery          RedeliveryPolicy
+	Endpoint            string
+	DisableSSL          bool
+	ForcePathStyle      bool
+}
+
+const (
+	// maxBatchEntries is the largest number of entries SQS accepts with in a
+	// single batch request.
+	maxBatchEntries = 10
+
+	defaultFailureReason = "delivery failed"
+
+	approximateReceiveCount = "ApproximateReceiveCount"
+	messageGroupID          = "MessageGroupId"
+	messageDeduplicationID  = "MessageDeduplicationId"
+	sentTimestamp           = "SentTimestamp"
+
+	// defaultMessageGroupID is the group used for records without a group
+	// when sending to a FIFO queue, as FIFO queues require one.
+	defaultMessageGroupID = "courier"
+
+	fifoSuffix = ".fifo"
+)
+
+// IsFIFO returns if the name of the queue is a FIFO queue, which preserves the
+// order of messages with in a message group.
+func IsFIFO(queue string) bool {
+	return strings.HasSuffix(queue, fifoSuffix)
 }
 
 type remoteQueue struct {
 	client              *sqs.SQS
 	queueURL            *string
+	deadLetterQueueURL  *string
+	fifo                bool
+	deadLetterFIFO      bool
+	maxReceiveCount     int
 	maxNumberOfMessages *int64
 	waitTime            *int64
 	visibilityTimeout   *int64
+	redelivery          RedeliveryPolicy
 	stop                chan chan struct{}
 	records             chan models.Record
 	logger              log.Logger
@@ -42,7 +81,7 @@ func newRemoteQueue(config *RemoteConfig, logger log.Logger) (Queue, error) {
 		var sess = session.New(&aws.Config{
 			LogLevel:                      aws.LogLevel(aws.LogDebug),
 			CredentialsChainVerboseErrors: aws.Bool(true),
-			Region: aws.String(config.Region),
+			Region:                        aws.String(config.Region),
 		})
 		creds = sess.Config.Credentials
 	} else {
@@ -56,13 +95,18 @@ func newRemoteQueue(config *RemoteConfig, logger log.Logger) (Queue, error) {
 		return nil, errors.Wrap(err, "invalid credentials")
 	}
 
-	var (
-		cfg = aws.NewConfig().
-			WithRegion(config.Region).
-			WithCredentials(creds).
-			WithCredentialsChainVerboseErrors(true)
-		client = sqs.New(session.New(cfg))
-	)
+	cfg := aws.NewConfig().
+		WithRegion(config.Region).
+		WithCredentials(creds).
+		WithCredentialsChainVerboseErrors(true).
+		WithDisableSSL(config.DisableSSL).
+		WithS3ForcePathStyle(config.ForcePathStyle)
+	if config.Endpoint != "" {
+		// Point the client at a compatible service, like ElasticMQ or
+		// LocalStack, instead of AWS.
+		cfg = cfg.WithEndpoint(config.Endpoint)
+	}
+	client := sqs.New(session.New(cfg))
 
 	// Attempt to get the queueURL
 	queueURL, err := client.GetQueueUrl(&sqs.GetQueueUrlInput{
@@ -74,11 +118,30 @@ func newRemoteQueue(config *RemoteConfig, logger log.Logger) (Queue, error) {
 
 	level.Debug(logger).Log("queue_url", *queueURL.QueueUrl)
 
+	// Attempt to get the dead letter queueURL, if one has been configured
+	var deadLetterQueueURL *string
+	if config.DeadLetterQueue != "" {
+		output, err := client.GetQueueUrl(&sqs.GetQueueUrlInput{
+			QueueName: aws.String(config.DeadLetterQueue),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "dead letter queue")
+		}
+		deadLetterQueueURL = output.QueueUrl
+
+		level.Debug(logger).Log("dead_letter_queue_url", *deadLetterQueueURL)
+	}
+
 	return &remoteQueue{
 		client:              client,
 		queueURL:            queueURL.QueueUrl,
+		deadLetterQueueURL:  deadLetterQueueURL,
+		fifo:                IsFIFO(config.Queue),
+		deadLetterFIFO:      IsFIFO(config.DeadLetterQueue),
+		maxReceiveCount:     config.MaxReceiveCount,
 		maxNumberOfMessages: aws.Int64(config.MaxNumberOfMessages),
 		visibilityTimeout:   aws.Int64(int64(config.VisibilityTimeout)),
+		redelivery:          config.Redelivery,
 		stop:                make(chan chan struct{}),
 		records:             make(chan models.Record),
 		logger:              logger,
@@ -90,6 +153,10 @@ func (v *remoteQueue) Enqueue(rec models.Record) error {
 		MessageBody: aws.String(string(rec.Body())),
 		QueueUrl:    v.queueURL,
 	}
+	if v.fifo {
+		input.MessageGroupId = aws.String(groupID(rec))
+		input.MessageDeduplicationId = aws.String(deduplicationID(rec))
+	}
 	_, err := v.client.SendMessage(input)
 	return err
 }
@@ -98,6 +165,12 @@ func (v *remoteQueue) Dequeue() ([]models.Record, error) {
 	input := &sqs.ReceiveMessageInput{
 		QueueUrl:            v.queueURL,
 		MaxNumberOfMessages: v.maxNumberOfMessages,
+		AttributeNames: []*string{
+			aws.String(sentTimestamp),
+			aws.String(approximateReceiveCount),
+			aws.String(messageGroupID),
+			aws.String(messageDeduplicationID),
+		},
 		MessageAttributeNames: []*string{
 			aws.String("All"),
 		},
@@ -122,6 +195,8 @@ func (v *remoteQueue) Dequeue() ([]models.Record, error) {
 			models.Receipt(aws.StringValue(msg.ReceiptHandle)),
 			[]byte(aws.StringValue(msg.Body)),
 			time.Now(),
+			messageAttributes(msg),
+			systemAttributes(msg),
 		)
 	}
 
@@ -133,82 +208,228 @@ func (v *remoteQueue) Dequeue() ([]models.Record, error) {
 	return unique, nil
 }
 
-type keyValue struct {
-	Key   uuid.UUID
-	Value models.Receipt
-}
-
 func (v *remoteQueue) Commit(txn models.Transaction) (Result, error) {
-	records := make(map[uuid.UUID]models.Receipt)
-	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
-		records[id] = record.Receipt()
-		return nil
-	}); err != nil {
+	records, err := uniqueRecords(txn)
+	if err != nil {
 		return Result{}, err
 	}
 
-	// chunk into 10 at a time because of the limitations of AWS
-	var (
-		i, index int
-		parts    = make([][]keyValue, int((float64(len(records))/9)+0.9))
-	)
-	for id, receipt := range records {
-		parts[index] = append(parts[index], keyValue{
-			Key:   id,
-			Value: receipt,
-		})
-		index = (i / 9)
-		i++
+	var result Result
+	for _, part := range chunk(records, maxBatchEntries) {
+		res, err := v.deleteMessages(part)
+		if err != nil {
+			return Result{}, err
+		}
+
+		result.Success += res.Success
+		result.Failure += res.Failure
+	}
+
+	return result, nil
+}
+
+func (v *remoteQueue) Failed(txn models.Transaction) (Result, error) {
+	// Without a dead letter queue or a redelivery policy there is nothing to
+	// do, the records will become visible on the source queue again once the
+	// visibility timeout lapses.
+	if v.deadLetterQueueURL == nil && !v.redelivery.Enabled() {
+		return Result{
+			Success: 0,
+			Failure: txn.Len(),
+		}, nil
+	}
+
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
 	}
 
 	var result Result
-	for _, part := range parts {
+	for _, part := range chunk(records, maxBatchEntries) {
+		res, err := v.failed(part)
+		if err != nil {
+			return result, err
+		}
+
+		result.Success += res.Success
+		result.Failure += res.Failure
+	}
 
-		entities := make([]*sqs.DeleteMessageBatchRequestEntry, len(records))
-		for i, kv := range part {
-			entities[i] = &sqs.DeleteMessageBatchRequestEntry{
-				Id:            aws.String(kv.Key.String()),
-				ReceiptHandle: aws.String(kv.Value.String()),
+	return result, nil
+}
+
+// failed sends a batch of records that have been received too many times to
+// the dead letter queue, if there is one, and schedules the redelivery of any
+// records that aren't dead lettered.
+func (v *remoteQueue) failed(records []models.Record) (Result, error) {
+	var (
+		result  Result
+		pending = records
+	)
+	if v.deadLetterQueueURL != nil {
+		var published []models.Record
+		if exhausted := exhausted(records, v.maxReceiveCount); len(exhausted) > 0 {
+			var err error
+			if published, err = v.publishDeadLetters(exhausted); err != nil {
+				return result, err
 			}
 		}
 
-		input := &sqs.DeleteMessageBatchInput{
-			Entries:  entities,
-			QueueUrl: v.queueURL,
-		}
+		// Only delete the records that have safely made it on to the dead
+		// letter queue, everything else is left to be redelivered.
+		if len(published) > 0 {
+			res, err := v.deleteMessages(published)
+			if err != nil {
+				return result, err
+			}
 
-		output, err := v.client.DeleteMessageBatch(input)
-		if err != nil {
-			return Result{}, err
+			result.Success += res.Success
+			result.Failure += res.Failure
 		}
 
-		result.Success += len(output.Successful)
-		result.Failure += len(output.Failed)
+		pending = difference(records, published)
+	}
+
+	if len(pending) == 0 {
+		return result, nil
+	}
+
+	if !v.redelivery.Enabled() {
+		result.Failure += len(pending)
+		return result, nil
 	}
 
+	res, err := v.setVisibility(pending, func(record models.Record) time.Duration {
+		return v.redelivery.Backoff(record)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result.Success += res.Success
+	result.Failure += res.Failure
+
 	return result, nil
 }
 
-func (v *remoteQueue) Failed(txn models.Transaction) (Result, error) {
-	// TODO: Send to a failure queue.
+// publishDeadLetters sends the records to the dead letter queue, returning the
+// records that where successfully sent.
+func (v *remoteQueue) publishDeadLetters(records []models.Record) ([]models.Record, error) {
+	var (
+		lookup  = make(map[string]models.Record, len(records))
+		entries = make([]*sqs.SendMessageBatchRequestEntry, len(records))
+	)
+	for k, record := range records {
+		id := record.ID().String()
+		lookup[id] = record
+
+		entries[k] = &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(id),
+			MessageBody:       aws.String(string(record.Body())),
+			MessageAttributes: deadLetterAttributes(record),
+		}
+		if v.deadLetterFIFO {
+			entries[k].MessageGroupId = aws.String(groupID(record))
+			entries[k].MessageDeduplicationId = aws.String(deduplicationID(record))
+		}
+	}
+
+	input := &sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: v.deadLetterQueueURL,
+	}
+
+	output, err := v.client.SendMessageBatch(input)
+	if err != nil {
+		return nil, err
+	}
+	if num := len(output.Failed); num > 0 {
+		level.Warn(v.logger).Log("state", "dead letter", "failed", num)
+	}
+
+	published := make([]models.Record, 0, len(output.Successful))
+	for _, entry := range output.Successful {
+		if record, ok := lookup[aws.StringValue(entry.Id)]; ok {
+			published = append(published, record)
+		}
+	}
+	return published, nil
+}
+
+// deleteMessages removes the records from the source queue.
+func (v *remoteQueue) deleteMessages(records []models.Record) (Result, error) {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(records))
+	for k, record := range records {
+		entries[k] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(record.ID().String()),
+			ReceiptHandle: aws.String(record.Receipt().String()),
+		}
+	}
+
+	input := &sqs.DeleteMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: v.queueURL,
+	}
+
+	output, err := v.client.DeleteMessageBatch(input)
+	if err != nil {
+		return Result{}, err
+	}
+
 	return Result{
-		Success: txn.Len(),
-		Failure: 0,
+		Success: len(output.Successful),
+		Failure: len(output.Failed),
 	}, nil
 }
 
+// Extend resets the visibility timeout of the records, so that records that
+// are held for a long time aren't delivered again by the queue.
+func (v *remoteQueue) Extend(txn models.Transaction) (Result, error) {
+	records, err := uniqueRecords(txn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	for _, part := range chunk(records, maxBatchEntries) {
+		res, err := v.changeVisibility(part)
+		if err != nil {
+			return Result{}, err
+		}
+
+		result.Success += res.Success
+		result.Failure += res.Failure
+	}
+	return result, nil
+}
+
 func (v *remoteQueue) changeMessageVisibility(records []models.Record) error {
-	// fast exit
-	if len(records) == 0 {
-		return nil
+	for _, part := range chunk(records, maxBatchEntries) {
+		if _, err := v.changeVisibility(part); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	var (
-		timeout = *v.visibilityTimeout
-		seconds = time.Duration(timeout) / time.Second
-	)
-	if timeout == 0 || seconds <= 0 {
-		return nil
+// changeVisibility resets the visibility timeout for a batch of records.
+func (v *remoteQueue) changeVisibility(records []models.Record) (Result, error) {
+	timeout := time.Duration(*v.visibilityTimeout)
+	if timeout < time.Second {
+		return Result{}, nil
+	}
+
+	return v.setVisibility(records, func(models.Record) time.Duration {
+		return timeout
+	})
+}
+
+// setVisibility changes how long each of a batch of records is hidden for,
+// before the queue delivers them again.
+func (v *remoteQueue) setVisibility(records []models.Record, timeout func(models.Record) time.Duration) (Result, error) {
+	// fast exit
+	if len(records) == 0 {
+		return Result{}, nil
 	}
 
 	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, len(records))
@@ -216,7 +437,7 @@ func (v *remoteQueue) changeMessageVisibility(records []models.Record) error {
 		entries[k] = &sqs.ChangeMessageVisibilityBatchRequestEntry{
 			Id:                aws.String(v.ID().String()),
 			ReceiptHandle:     aws.String(v.Receipt().String()),
-			VisibilityTimeout: aws.Int64(int64(seconds)),
+			VisibilityTimeout: aws.Int64(int64(timeout(v) / time.Second)),
 		}
 	}
 
@@ -227,12 +448,142 @@ func (v *remoteQueue) changeMessageVisibility(records []models.Record) error {
 	output, err := v.client.ChangeMessageVisibilityBatch(input)
 	if err != nil {
 		level.Warn(v.logger).Log("state", "visibility change", "err", err)
-		return err
+		return Result{}, err
 	}
 	if num := len(output.Failed); num > 0 {
 		level.Warn(v.logger).Log("state", "visibility change", "failed", num)
 	}
-	return nil
+	return Result{
+		Success: len(output.Successful),
+		Failure: len(output.Failed),
+	}, nil
+}
+
+// exhausted returns the records that have been received at least as many
+// times as the max receive count, so they're not redelivered again.
+func exhausted(records []models.Record, maxReceiveCount int) []models.Record {
+	var res []models.Record
+	for _, v := range records {
+		if v.Attempts() >= maxReceiveCount {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// difference returns the records that aren't in the others.
+func difference(records, others []models.Record) []models.Record {
+	seen := make(map[uuid.UUID]struct{}, len(others))
+	for _, v := range others {
+		seen[v.ID()] = struct{}{}
+	}
+
+	var res []models.Record
+	for _, v := range records {
+		if _, ok := seen[v.ID()]; !ok {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func deadLetterAttributes(record models.Record) map[string]*sqs.MessageAttributeValue {
+	return map[string]*sqs.MessageAttributeValue{
+		"OriginalMessageId": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(record.RecordID()),
+		},
+		"FailureReason": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(FailureReason(record)),
+		},
+		"AttemptCount": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(record.Attempts())),
+		},
+	}
+}
+
+// groupID returns the message group of the record, or the default group if
+// the record doesn't have one.
+func groupID(record models.Record) string {
+	if group := record.GroupID(); group != "" {
+		return group
+	}
+	return defaultMessageGroupID
+}
+
+// deduplicationID returns the id used by FIFO queues to drop duplicates,
+// preferring the record's original deduplication id, then the provider id.
+func deduplicationID(record models.Record) string {
+	if id := record.SystemAttributes()[messageDeduplicationID]; id != "" {
+		return id
+	}
+	if id := record.RecordID(); id != "" {
+		return id
+	}
+	return record.ID().String()
+}
+
+// messageAttributes flattens the message attributes in to strings, binary
+// values are base64 encoded.
+func messageAttributes(msg *sqs.Message) map[string]string {
+	attributes := make(map[string]string, len(msg.MessageAttributes))
+	for name, value := range msg.MessageAttributes {
+		if value == nil {
+			continue
+		}
+		if value.StringValue != nil {
+			attributes[name] = aws.StringValue(value.StringValue)
+			continue
+		}
+		if value.BinaryValue != nil {
+			attributes[name] = base64.StdEncoding.EncodeToString(value.BinaryValue)
+		}
+	}
+	return attributes
+}
+
+func systemAttributes(msg *sqs.Message) map[string]string {
+	attributes := make(map[string]string, len(msg.Attributes))
+	for name, value := range msg.Attributes {
+		attributes[name] = aws.StringValue(value)
+	}
+	return attributes
+}
+
+// uniqueRecords walks the transaction collecting the records, ignoring any
+// duplicate ids as SQS rejects batches containing them.
+func uniqueRecords(txn models.Transaction) ([]models.Record, error) {
+	var (
+		seen    = make(map[uuid.UUID]struct{})
+		records = make([]models.Record, 0, txn.Len())
+	)
+	if err := txn.Walk(func(id uuid.UUID, record models.Record) error {
+		if _, ok := seen[id]; ok {
+			return nil
+		}
+		seen[id] = struct{}{}
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// chunk splits the records into parts of at most size, because of the
+// limitations of AWS.
+func chunk(records []models.Record, size int) [][]models.Record {
+	var parts [][]models.Record
+	for len(records) > size {
+		parts = append(parts, records[0:size:size])
+		records = records[size:]
+	}
+	if len(records) > 0 {
+		parts = append(parts, records)
+	}
+	return parts
 }
 
 // ConfigOption defines a option for generating a RemoteConfig
@@ -299,6 +650,27 @@ func WithQueue(queue string) ConfigOption {
 	}
 }
 
+// WithDeadLetterQueue adds an DeadLetterQueue option to the configuration
+func WithDeadLetterQueue(queue string) ConfigOption {
+	return func(config *RemoteConfig) error {
+		config.DeadLetterQueue = queue
+		return nil
+	}
+}
+
+// WithMaxReceiveCount adds the number of times a record is received before
+// it's sent to the dead letter queue when it fails, to the configuration.
+// Anything less than one sends records the first time they fail.
+func WithMaxReceiveCount(count int) ConfigOption {
+	return func(config *RemoteConfig) error {
+		if count < 0 {
+			return errors.Errorf("invalid max receive count %d", count)
+		}
+		config.MaxReceiveCount = count
+		return nil
+	}
+}
+
 // WithMaxNumberOfMessages adds an MaxNumberOfMessages option to the
 // configuration
 func WithMaxNumberOfMessages(numOfMessages int64) ConfigOption {
@@ -316,3 +688,40 @@ func WithVisibilityTimeout(visibilityTimeout time.Duration) ConfigOption {
 		return nil
 	}
 }
+
+// WithRedelivery adds a policy for when failed records are redelivered to the
+// configuration
+func WithRedelivery(policy RedeliveryPolicy) ConfigOption {
+	return func(config *RemoteConfig) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		config.Redelivery = policy
+		return nil
+	}
+}
+
+// WithEndpoint adds an Endpoint option to the configuration, so that a SQS
+// compatible service can be used instead of AWS
+func WithEndpoint(endpoint string) ConfigOption {
+	return func(config *RemoteConfig) error {
+		config.Endpoint = endpoint
+		return nil
+	}
+}
+
+// WithDisableSSL adds an DisableSSL option to the configuration
+func WithDisableSSL(disableSSL bool) ConfigOption {
+	return func(config *RemoteConfig) error {
+		config.DisableSSL = disableSSL
+		return nil
+	}
+}
+
+// WithForcePathStyle adds an ForcePathStyle option to the configuration
+func WithForcePathStyle(forcePathStyle bool) ConfigOption {
+	return func(config *RemoteConfig) error {
+		config.ForcePathStyle = forcePathStyle
+		return nil
+	}
+}
@@ -4,20 +4,24 @@ package queue_test
 
 import (
 	"math/rand"
+	"net/http/httptest"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/trussle/courier/pkg/fakeaws"
 	"github.com/trussle/courier/pkg/queue"
 )
 
 const (
-	defaultAWSID     = ""
-	defaultAWSSecret = ""
-	defaultAWSToken  = ""
-	defaultAWSRegion = "eu-west-1"
-	defaultAWSQueue  = ""
+	defaultAWSID       = "id"
+	defaultAWSSecret   = "secret"
+	defaultAWSToken    = ""
+	defaultAWSRegion   = "eu-west-1"
+	defaultAWSQueue    = "courier"
+	defaultAWSDLQ      = "courier-dlq"
+	defaultAWSEndpoint = ""
 )
 
 func TestRemoteQueue_Integration(t *testing.T) {
@@ -25,15 +29,35 @@ func TestRemoteQueue_Integration(t *testing.T) {
 
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	var (
+		queueName  = GetEnv("AWS_SQS_QUEUE", defaultAWSQueue)
+		deadLetter = GetEnv("AWS_SQS_DLQ", defaultAWSDLQ)
+		endpoint   = GetEnv("AWS_SQS_ENDPOINT", defaultAWSEndpoint)
+	)
+
+	// Without an endpoint, run against the fake SQS.
+	if endpoint == "" {
+		fake := fakeaws.NewServer()
+		fake.SQS.CreateQueue(queueName)
+		fake.SQS.CreateQueue(deadLetter)
+
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		endpoint = server.URL
+	}
+
 	remoteConfig, err := queue.BuildConfig(
 		queue.WithEC2Role(false),
 		queue.WithRegion(GetEnv("AWS_REGION", defaultAWSRegion)),
 		queue.WithID(GetEnv("AWS_ID", defaultAWSID)),
 		queue.WithSecret(GetEnv("AWS_SECRET", defaultAWSSecret)),
 		queue.WithToken(GetEnv("AWS_TOKEN", defaultAWSToken)),
-		queue.WithQueue(GetEnv("AWS_SQS_QUEUE", defaultAWSQueue)),
+		queue.WithQueue(queueName),
+		queue.WithDeadLetterQueue(deadLetter),
 		queue.WithMaxNumberOfMessages(1),
 		queue.WithVisibilityTimeout(time.Second*100),
+		queue.WithEndpoint(endpoint),
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -195,9 +219,114 @@ func TestRemoteQueue_Integration(t *testing.T) {
 	})
 }
 
+func TestRemoteQueueRedelivery_Integration(t *testing.T) {
+	// Don't run this in parallel
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// The dead letter queue has to be empty, so this always runs against the
+	// fake SQS.
+	var (
+		queueName  = "courier-redelivery"
+		deadLetter = "courier-redelivery-dlq"
+		fake       = fakeaws.NewServer()
+	)
+	fake.SQS.CreateQueue(queueName)
+	fake.SQS.CreateQueue(deadLetter)
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	remoteConfig, err := queue.BuildConfig(
+		queue.WithEC2Role(false),
+		queue.WithRegion(defaultAWSRegion),
+		queue.WithID(defaultAWSID),
+		queue.WithSecret(defaultAWSSecret),
+		queue.WithQueue(queueName),
+		queue.WithDeadLetterQueue(deadLetter),
+		queue.WithMaxReceiveCount(2),
+		queue.WithMaxNumberOfMessages(1),
+		queue.WithVisibilityTimeout(time.Second*100),
+		queue.WithRedelivery(queue.RedeliveryPolicy{
+			Strategy: queue.RedeliverZero,
+		}),
+		queue.WithEndpoint(server.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := queue.Build(
+		queue.With("remote"),
+		queue.WithConfig(remoteConfig),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := queue.New(config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := queue.GenerateQueueRecord(rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Enqueue(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := func(t *testing.T) {
+		records, err := remote.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, len(records); expected != actual {
+			t.Fatalf("expected: %d, actual: %d", expected, actual)
+		}
+
+		txn := queue.NewTransaction()
+		if err := txn.Push(records[0].ID(), queue.FailedRecord(records[0], "bad")); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := remote.Failed(txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := 1, result.Success; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	}
+
+	t.Run("failed is redelivered", func(t *testing.T) {
+		fail(t)
+
+		if expected, actual := 1, fake.SQS.Len(queueName); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, fake.SQS.Len(deadLetter); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("failed at max receive count is dead lettered", func(t *testing.T) {
+		fail(t)
+
+		if expected, actual := 0, fake.SQS.Len(queueName); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, fake.SQS.Len(deadLetter); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
 func GetEnv(key string, defaultValue string) (value string) {
 	var ok bool
-	if value, ok = syscall.Getenv(key); ok {
+	// docker-compose passes unset variables through as empty.
+	if value, ok = syscall.Getenv(key); ok && value != "" {
 		return
 	}
 	return defaultValue
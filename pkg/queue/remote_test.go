@@ -1,18 +1,23 @@
 package queue
 
 import (
+	"math/rand"
+	"strconv"
 	"testing"
 	"testing/quick"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/uuid"
 )
 
 func TestConfigBuild(t *testing.T) {
 	t.Parallel()
 
 	t.Run("build", func(t *testing.T) {
-		fn := func(id, secret, token, region, queue string, numOfMessages, timeout int64) bool {
+		fn := func(id, secret, token, region, queue, dlq string, numOfMessages, timeout int64, endpoint string, disableSSL, forcePathStyle bool) bool {
 			config, err := BuildConfig(
 				WithEC2Role(false),
 				WithID(id),
@@ -20,8 +25,12 @@ func TestConfigBuild(t *testing.T) {
 				WithToken(token),
 				WithRegion(region),
 				WithQueue(queue),
+				WithDeadLetterQueue(dlq),
 				WithMaxNumberOfMessages(numOfMessages),
 				WithVisibilityTimeout(time.Duration(timeout)),
+				WithEndpoint(endpoint),
+				WithDisableSSL(disableSSL),
+				WithForcePathStyle(forcePathStyle),
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -31,8 +40,12 @@ func TestConfigBuild(t *testing.T) {
 				config.Token == token &&
 				config.Region == region &&
 				config.Queue == queue &&
+				config.DeadLetterQueue == dlq &&
 				config.MaxNumberOfMessages == numOfMessages &&
-				config.VisibilityTimeout == time.Duration(timeout)
+				config.VisibilityTimeout == time.Duration(timeout) &&
+				config.Endpoint == endpoint &&
+				config.DisableSSL == disableSSL &&
+				config.ForcePathStyle == forcePathStyle
 		}
 
 		if err := quick.Check(fn, nil); err != nil {
@@ -51,4 +64,242 @@ func TestConfigBuild(t *testing.T) {
 			t.Errorf("expected: %t, actual: %t", expected, actual)
 		}
 	})
+
+	t.Run("redelivery", func(t *testing.T) {
+		fn := func(delay, maxDelay uint32) bool {
+			policy := RedeliveryPolicy{
+				Strategy: RedeliverExponential,
+				Delay:    time.Duration(delay) + 1,
+				MaxDelay: time.Duration(maxDelay),
+			}
+			config, err := BuildConfig(
+				WithRedelivery(policy),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.Redelivery == policy
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid redelivery", func(t *testing.T) {
+		_, err := BuildConfig(
+			WithRedelivery(RedeliveryPolicy{
+				Strategy: RedeliverFixed,
+				Delay:    -time.Second,
+			}),
+		)
+
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("max receive count", func(t *testing.T) {
+		fn := func(count uint16) bool {
+			config, err := BuildConfig(
+				WithMaxReceiveCount(int(count)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return config.MaxReceiveCount == int(count)
+		}
+
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid max receive count", func(t *testing.T) {
+		_, err := BuildConfig(
+			WithMaxReceiveCount(-1),
+		)
+
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestChunk(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	t.Run("chunk", func(t *testing.T) {
+		fn := func(amount uint8) bool {
+			records := make([]models.Record, int(amount))
+			for k := range records {
+				rec, err := GenerateQueueRecord(rnd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				records[k] = rec
+			}
+
+			var (
+				total int
+				parts = chunk(records, maxBatchEntries)
+			)
+			for _, part := range parts {
+				if len(part) == 0 || len(part) > maxBatchEntries {
+					return false
+				}
+				for _, rec := range part {
+					if !rec.Equal(records[total]) {
+						return false
+					}
+					total++
+				}
+			}
+			return total == len(records)
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("chunk with no records", func(t *testing.T) {
+		if expected, actual := 0, len(chunk(nil, maxBatchEntries)); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+func TestDifference(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	records := make([]models.Record, 5)
+	for k := range records {
+		record, err := GenerateQueueRecord(rnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[k] = record
+	}
+
+	res := difference(records, []models.Record{records[1], records[3]})
+	if expected, actual := 3, len(res); expected != actual {
+		t.Fatalf("expected: %d, actual: %d", expected, actual)
+	}
+	for k, v := range []models.Record{records[0], records[2], records[4]} {
+		if expected, actual := v.ID().String(), res[k].ID().String(); expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	t.Parallel()
+
+	records := make([]models.Record, 4)
+	for k := range records {
+		id, err := uuid.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[k] = NewRecord(id, "", "", nil, time.Now(), nil, map[string]string{
+			approximateReceiveCount: strconv.Itoa(k + 1),
+		})
+	}
+
+	for maxReceiveCount, expected := range map[int]int{
+		0: 4,
+		1: 4,
+		3: 2,
+		5: 0,
+	} {
+		if actual := len(exhausted(records, maxReceiveCount)); expected != actual {
+			t.Errorf("%d expected: %d, actual: %d", maxReceiveCount, expected, actual)
+		}
+	}
+}
+
+func TestDeadLetterAttributes(t *testing.T) {
+	t.Parallel()
+
+	fn := func(id uuid.UUID, messageID, reason string, attempts uint8) bool {
+		record := NewRecord(id, messageID, "", nil, time.Now(), nil, map[string]string{
+			approximateReceiveCount: strconv.Itoa(int(attempts) + 1),
+		})
+
+		expected := reason
+		if reason == "" {
+			expected = defaultFailureReason
+		}
+
+		attributes := deadLetterAttributes(FailedRecord(record, reason))
+		return aws.StringValue(attributes["OriginalMessageId"].StringValue) == messageID &&
+			aws.StringValue(attributes["FailureReason"].StringValue) == expected &&
+			aws.StringValue(attributes["AttemptCount"].StringValue) == strconv.Itoa(int(attempts)+1)
+	}
+	if err := quick.Check(fn, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsFIFO(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]bool{
+		"queue":        false,
+		"queue.fifo":   true,
+		"fifo":         false,
+		"queue-fifo":   false,
+		"a.fifo.queue": false,
+	} {
+		if actual := IsFIFO(name); expected != actual {
+			t.Errorf("%s expected: %t, actual: %t", name, expected, actual)
+		}
+	}
+}
+
+func TestFIFOIDs(t *testing.T) {
+	t.Parallel()
+
+	t.Run("group", func(t *testing.T) {
+		fn := func(id uuid.UUID, group string) bool {
+			record := NewRecord(id, "", "", nil, time.Now(), nil, map[string]string{
+				messageGroupID: group,
+			})
+
+			expected := group
+			if group == "" {
+				expected = defaultMessageGroupID
+			}
+			return groupID(record) == expected
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("deduplication", func(t *testing.T) {
+		fn := func(id uuid.UUID, messageID, dedup string) bool {
+			record := NewRecord(id, messageID, "", nil, time.Now(), nil, map[string]string{
+				messageDeduplicationID: dedup,
+			})
+
+			var expected string
+			switch {
+			case dedup != "":
+				expected = dedup
+			case messageID != "":
+				expected = messageID
+			default:
+				expected = id.String()
+			}
+			return deduplicationID(record) == expected
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
 }
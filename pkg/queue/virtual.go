@@ -38,6 +38,10 @@ func (v *virtualQueue) Failed(txn models.Transaction) (Result, error) {
 	return Result{txn.Len(), 0}, nil
 }
 
+func (v *virtualQueue) Extend(txn models.Transaction) (Result, error) {
+	return Result{txn.Len(), 0}, nil
+}
+
 func max(a, b int) int {
 	if a < b {
 		return b
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	errs "github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/metrics"
+)
+
+// These are the rate limit API URL paths.
+const (
+	APIPathRateQuery = "/rate"
+)
+
+// API serves the rate limit API
+type API struct {
+	limiter  *Limiter
+	logger   log.Logger
+	clients  metrics.Gauge
+	duration metrics.HistogramVec
+	errors   errs.Error
+}
+
+// NewAPI creates a API with the correct dependencies.
+func NewAPI(limiter *Limiter,
+	logger log.Logger,
+	clients metrics.Gauge,
+	duration metrics.HistogramVec,
+) *API {
+	return &API{
+		limiter:  limiter,
+		logger:   logger,
+		clients:  clients,
+		duration: duration,
+		errors:   errs.NewError(logger),
+	}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	level.Info(a.logger).Log("method", r.Method, "url", r.URL.String())
+
+	iw := &interceptingWriter{http.StatusOK, w}
+	w = iw
+
+	// Metrics
+	a.clients.Inc()
+	defer a.clients.Dec()
+
+	defer func(begin time.Time) {
+		a.duration.WithLabelValues(
+			r.Method,
+			r.URL.Path,
+			strconv.Itoa(iw.code),
+		).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	// Routing table
+	method, path := r.Method, r.URL.Path
+	switch {
+	case method == "GET" && path == APIPathRateQuery:
+		a.handleRate(w, r)
+	case method == "PUT" && path == APIPathRateQuery:
+		a.handleSetRate(w, r)
+	default:
+		// Nothing found
+		a.errors.NotFound(w, r)
+	}
+}
+
+func (a *API) handleRate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	a.writeRate(w)
+}
+
+func (a *API) handleSetRate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var body rate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.errors.BadRequest(w, r, err.Error())
+		return
+	}
+
+	if err := a.limiter.SetRate(body.Rate, body.Burst); err != nil {
+		a.errors.BadRequest(w, r, err.Error())
+		return
+	}
+
+	a.writeRate(w)
+}
+
+func (a *API) writeRate(w http.ResponseWriter) {
+	current, burst := a.limiter.Rate()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(rate{
+		Rate:  current,
+		Burst: burst,
+	}); err != nil {
+		a.errors.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type rate struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type interceptingWriter struct {
+	code int
+	http.ResponseWriter
+}
+
+func (iw *interceptingWriter) WriteHeader(code int) {
+	iw.code = code
+	iw.ResponseWriter.WriteHeader(code)
+}
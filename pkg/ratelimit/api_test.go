@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/mock/gomock"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+)
+
+func TestAPI(t *testing.T) {
+	t.Parallel()
+
+	t.Run("get rate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		limiter, err := New(5, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(limiter, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("GET", "/rate", "200").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		response, err := http.Get(fmt.Sprintf("%s/rate", server.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusOK, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		var body rate
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := (rate{Rate: 5, Burst: 10}), body; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("put rate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		limiter, err := New(5, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(limiter, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("PUT", "/rate", "200").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		request, err := http.NewRequest("PUT", fmt.Sprintf("%s/rate", server.URL), bytes.NewBufferString(`{"rate":20,"burst":2}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusOK, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		current, burst := limiter.Rate()
+		if expected, actual := 20.0, current; expected != actual {
+			t.Errorf("expected: %f, actual: %f", expected, actual)
+		}
+		if expected, actual := 2, burst; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("put invalid rate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		limiter, err := New(5, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			clients  = metricMocks.NewMockGauge(ctrl)
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+			api      = NewAPI(limiter, log.NewNopLogger(), clients, duration)
+			server   = httptest.NewServer(api)
+		)
+		defer server.Close()
+
+		clients.EXPECT().Inc().Times(1)
+		clients.EXPECT().Dec().Times(1)
+
+		duration.EXPECT().WithLabelValues("PUT", "/rate", "400").Return(observer).Times(1)
+		observer.EXPECT().Observe(Float64()).Times(1)
+
+		request, err := http.NewRequest("PUT", fmt.Sprintf("%s/rate", server.URL), bytes.NewBufferString(`{"rate":-1,"burst":2}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		if expected, actual := http.StatusBadRequest, response.StatusCode; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+
+		current, burst := limiter.Rate()
+		if expected, actual := 5.0, current; expected != actual {
+			t.Errorf("expected: %f, actual: %f", expected, actual)
+		}
+		if expected, actual := 10, burst; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
+
+type float64Matcher struct{}
+
+func (float64Matcher) Matches(x interface{}) bool {
+	_, ok := x.(float64)
+	return ok
+}
+
+func (float64Matcher) String() string {
+	return "is float64"
+}
+
+func Float64() gomock.Matcher { return float64Matcher{} }
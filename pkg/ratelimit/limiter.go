@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/metrics"
+)
+
+// Limiter is a token bucket that limits the rate of events, allowing bursts of
+// up to burst events at a time. A rate of zero disables the limiting.
+// Limiter is safe for concurrent use.
+type Limiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     int
+	tokens    float64
+	last      time.Time
+	throttled metrics.Counter
+	clock     func() time.Time
+	sleep     func(time.Duration)
+}
+
+// New creates a Limiter that allows rate events per second with a burst of
+// events, the time spent throttled is added to the throttled counter in
+// seconds.
+func New(rate float64, burst int, throttled metrics.Counter) (*Limiter, error) {
+	if err := validate(rate, burst); err != nil {
+		return nil, err
+	}
+
+	return &Limiter{
+		rate:      rate,
+		burst:     burst,
+		tokens:    float64(burst),
+		last:      time.Now(),
+		throttled: throttled,
+		clock:     time.Now,
+		sleep:     time.Sleep,
+	}, nil
+}
+
+// Wait blocks until an event is allowed to happen, returning the duration
+// that it was throttled for.
+func (l *Limiter) Wait() time.Duration {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return 0
+	}
+
+	l.advance(l.clock())
+
+	// Take the token now, even if it's not available yet, so that everyone
+	// waiting is queued up behind each other.
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if wait > 0 {
+		l.throttled.Add(wait.Seconds())
+		l.sleep(wait)
+	}
+	return wait
+}
+
+// Rate returns the current rate and burst of the Limiter.
+func (l *Limiter) Rate() (float64, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rate, l.burst
+}
+
+// SetRate changes the rate and burst of the Limiter. Events that are already
+// waiting keep their reservation.
+func (l *Limiter) SetRate(rate float64, burst int) error {
+	if err := validate(rate, burst); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.clock()
+	if l.rate <= 0 {
+		l.tokens = float64(burst)
+		l.last = now
+	} else {
+		l.advance(now)
+	}
+
+	l.rate = rate
+	l.burst = burst
+	l.tokens = math.Min(l.tokens, float64(burst))
+
+	return nil
+}
+
+// advance refills the bucket with the tokens accumulated since the last time
+// it was advanced.
+func (l *Limiter) advance(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(float64(l.burst), l.tokens+(elapsed.Seconds()*l.rate))
+	}
+	l.last = now
+}
+
+func validate(rate float64, burst int) error {
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return errors.Errorf("invalid rate %f", rate)
+	}
+	if burst < 1 {
+		return errors.Errorf("invalid burst %d", burst)
+	}
+	return nil
+}
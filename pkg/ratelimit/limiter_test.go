@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("new with invalid rate", func(t *testing.T) {
+		_, err := New(-1, 1, nil)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("new with invalid burst", func(t *testing.T) {
+		_, err := New(1, 0, nil)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+
+	t.Run("wait with no rate", func(t *testing.T) {
+		fn := func(burst uint8) bool {
+			limiter, err := New(0, int(burst)+1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < int(burst)+10; i++ {
+				if limiter.Wait() != 0 {
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("wait with in burst", func(t *testing.T) {
+		fn := func(burst uint8) bool {
+			limiter, err := New(1, int(burst)+1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now()
+			limiter.clock = func() time.Time { return now }
+
+			for i := 0; i < int(burst)+1; i++ {
+				if limiter.Wait() != 0 {
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("wait throttled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		throttled := metricMocks.NewMockCounter(ctrl)
+		throttled.EXPECT().Add(0.5).Times(1)
+		throttled.EXPECT().Add(1.0).Times(1)
+
+		limiter, err := New(2, 1, throttled)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var slept []time.Duration
+		now := time.Now()
+		limiter.last = now
+		limiter.clock = func() time.Time { return now }
+		limiter.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		for i := 0; i < 3; i++ {
+			limiter.Wait()
+		}
+
+		expected := []time.Duration{
+			500 * time.Millisecond,
+			time.Second,
+		}
+		if actual := slept; len(expected) != len(actual) || expected[0] != actual[0] || expected[1] != actual[1] {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("wait refills", func(t *testing.T) {
+		limiter, err := New(1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		limiter.last = now
+		limiter.clock = func() time.Time { return now }
+
+		if expected, actual := time.Duration(0), limiter.Wait(); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+
+		now = now.Add(time.Second)
+
+		if expected, actual := time.Duration(0), limiter.Wait(); expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("set rate", func(t *testing.T) {
+		fn := func(rate float32, burst uint8) bool {
+			limiter, err := New(1, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := float64(rate)
+			if r < 0 {
+				r = -r
+			}
+			if err := limiter.SetRate(r, int(burst)+1); err != nil {
+				t.Fatal(err)
+			}
+
+			actualRate, actualBurst := limiter.Rate()
+			return actualRate == r && actualBurst == int(burst)+1
+		}
+		if err := quick.Check(fn, nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("set invalid rate", func(t *testing.T) {
+		limiter, err := New(1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = limiter.SetRate(1, 0)
+		if expected, actual := false, err == nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+
+		rate, burst := limiter.Rate()
+		if expected, actual := 1.0, rate; expected != actual {
+			t.Errorf("expected: %f, actual: %f", expected, actual)
+		}
+		if expected, actual := 1, burst; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Config describes the routes a record can take. Routes are tried in order,
+// the first route where all the rules match is taken. Records that don't match
+// any of the routes take the default route.
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "name": "orders",
+//	      "url": "http://orders/ingest",
+//	      "rules": [
+//	        {"attribute": "type", "equals": "order"},
+//	        {"field": "$.order.region", "regex": "^eu-"}
+//	      ]
+//	    }
+//	  ],
+//	  "default": {"name": "default", "url": "http://everything/ingest"}
+//	}
+type Config struct {
+	Routes  []RouteConfig `json:"routes"`
+	Default *RouteConfig  `json:"default,omitempty"`
+}
+
+// RouteConfig describes a single route and the rules a record has to match to
+// take it.
+type RouteConfig struct {
+	Name  string       `json:"name"`
+	URL   string       `json:"url"`
+	Rules []RuleConfig `json:"rules,omitempty"`
+}
+
+// RuleConfig describes a single rule. A rule looks up a value from either a
+// message attribute or a JSON body field (using a JSONPath-style lookup such as
+// "$.order.items[0].sku") and then matches it with exactly one of equals,
+// prefix or regex.
+type RuleConfig struct {
+	Attribute string `json:"attribute,omitempty"`
+	Field     string `json:"field,omitempty"`
+	Equals    string `json:"equals,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Regex     string `json:"regex,omitempty"`
+}
+
+// ParseConfig reads a JSON Config from the reader.
+func ParseConfig(r io.Reader) (Config, error) {
+	var config Config
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return Config{}, errors.Wrap(err, "decoding config")
+	}
+	return config, nil
+}
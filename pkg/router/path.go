@@ -0,0 +1,84 @@
+package router
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// path is a parsed JSONPath-style lookup, made up of object keys (string) and
+// array indexes (int).
+type path []interface{}
+
+// parsePath parses a lookup such as "$.order.items[0].sku", the leading "$"
+// is optional.
+func parsePath(value string) (path, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "$"), ".")
+	if value == "" {
+		return nil, errors.New("empty path")
+	}
+
+	var result path
+	for _, part := range strings.Split(value, ".") {
+		if part == "" {
+			return nil, errors.Errorf("invalid path %q", value)
+		}
+
+		key := part
+		if index := strings.Index(part, "["); index >= 0 {
+			key = part[:index]
+		}
+		if key != "" {
+			result = append(result, key)
+		}
+
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, errors.Errorf("invalid path %q", value)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("invalid index in path %q", value)
+			}
+			result = append(result, index)
+			rest = rest[end+1:]
+		}
+	}
+	return result, nil
+}
+
+// lookup walks the decoded JSON document, returning the value found as a
+// string. Objects, arrays and nulls are never found.
+func (p path) lookup(doc interface{}) (string, bool) {
+	for _, token := range p {
+		switch t := token.(type) {
+		case string:
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if doc, ok = object[t]; !ok {
+				return "", false
+			}
+		case int:
+			array, ok := doc.([]interface{})
+			if !ok || t >= len(array) {
+				return "", false
+			}
+			doc = array[t]
+		}
+	}
+
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		value string
+		path  path
+	}{
+		{"$.a", path{"a"}},
+		{"a.b", path{"a", "b"}},
+		{"$.a.b[1].c", path{"a", "b", 1, "c"}},
+		{"$[0][2]", path{0, 2}},
+	} {
+		p, err := parsePath(testcase.value)
+		if err != nil {
+			t.Errorf("(%q): %v", testcase.value, err)
+			continue
+		}
+		if expected, actual := testcase.path, p; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("(%q): expected: %v, actual: %v", testcase.value, expected, actual)
+		}
+	}
+
+	for _, value := range []string{"", "$", "a..b", "a[b]", "a[-1]", "a[0"} {
+		if _, err := parsePath(value); err == nil {
+			t.Errorf("(%q): expected error", value)
+		}
+	}
+}
+
+func TestPathLookup(t *testing.T) {
+	t.Parallel()
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(`{
+		"a": {"b": [{"c": "value"}, {"c": 1.5}]},
+		"d": true,
+		"e": null,
+		"f": {"g": 1}
+	}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		path  string
+		value string
+		ok    bool
+	}{
+		{"$.a.b[0].c", "value", true},
+		{"$.a.b[1].c", "1.5", true},
+		{"$.d", "true", true},
+		{"$.e", "", false},
+		{"$.f", "", false},
+		{"$.a.b[2].c", "", false},
+		{"$.missing", "", false},
+		{"$.d.missing", "", false},
+	} {
+		p, err := parsePath(testcase.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, ok := p.lookup(doc)
+		if value != testcase.value || ok != testcase.ok {
+			t.Errorf("(%q): want [%q %t], have [%q %t]", testcase.path, testcase.value, testcase.ok, value, ok)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package router
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trussle/courier/pkg/http"
+	"github.com/trussle/courier/pkg/metrics"
+	"github.com/trussle/courier/pkg/models"
+)
+
+const (
+	statusSuccess = "success"
+	statusFailure = "failure"
+)
+
+var errNoRoute = errors.New("no route")
+
+// Router sends each record to the recipient of the first route that it
+// matches. Every route has it's own sender, so that a failing recipient
+// doesn't affect the others. Router is safe for concurrent use.
+type Router struct {
+	routes   []route
+	fallback *route
+	duration metrics.HistogramVec
+}
+
+// New creates a Router from the configuration, using newSender to create the
+// sender for each of the routes. The time taken to send to each route is
+// observed in the duration, labelled by route name and status.
+func New(config Config, newSender func(url string) http.Sender, duration metrics.HistogramVec) (*Router, error) {
+	router := &Router{
+		duration: duration,
+	}
+
+	names := make(map[string]struct{})
+	build := func(config RouteConfig) (route, error) {
+		if config.Name == "" {
+			return route{}, errors.New("missing route name")
+		}
+		if _, ok := names[config.Name]; ok {
+			return route{}, errors.Errorf("duplicate route %q", config.Name)
+		}
+		names[config.Name] = struct{}{}
+
+		if config.URL == "" {
+			return route{}, errors.Errorf("missing url for route %q", config.Name)
+		}
+
+		r := route{
+			name:   config.Name,
+			sender: newSender(config.URL),
+		}
+		for _, v := range config.Rules {
+			rule, err := newRule(v)
+			if err != nil {
+				return route{}, errors.Wrapf(err, "route %q", config.Name)
+			}
+			r.rules = append(r.rules, rule)
+		}
+		return r, nil
+	}
+
+	for _, v := range config.Routes {
+		r, err := build(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.rules) == 0 {
+			return nil, errors.Errorf("route %q has no rules", r.name)
+		}
+		router.routes = append(router.routes, r)
+	}
+
+	if config.Default != nil {
+		if len(config.Default.Rules) > 0 {
+			return nil, errors.New("default route can't have rules")
+		}
+		r, err := build(*config.Default)
+		if err != nil {
+			return nil, err
+		}
+		router.fallback = &r
+	}
+
+	return router, nil
+}
+
+// Route returns the name of the route the record takes, or an error if there
+// is no route.
+func (r *Router) Route(record models.Record) (string, error) {
+	route, err := r.route(record)
+	if err != nil {
+		return "", err
+	}
+	return route.name, nil
+}
+
+// Send the record to the recipient of it's route.
+func (r *Router) Send(record models.Record) error {
+	_, err := r.SendStatus(record)
+	return err
+}
+
+// SendStatus sends the record to the recipient of it's route, returning the
+// status code the recipient accepted it with.
+func (r *Router) SendStatus(record models.Record) (int, error) {
+	route, err := r.route(record)
+	if err != nil {
+		return 0, err
+	}
+
+	begin := time.Now()
+	status, err := http.SendStatus(route.sender, record)
+	r.observe(route, begin, err)
+
+	return status, err
+}
+
+// SendBatch groups the records by route and sends each group as a batch to
+// the recipient of the route. Records with no route, or with in a group that
+// failed to be sent, aren't accepted.
+func (r *Router) SendBatch(records []models.Record) ([]bool, error) {
+	statuses, err := r.SendBatchStatus(records)
+	if err != nil {
+		return nil, err
+	}
+	return http.Accepted(statuses), nil
+}
+
+// SendBatchStatus sends the records in the same way as SendBatch, returning
+// the status code each of the records was accepted with, or zero if it wasn't
+// accepted.
+func (r *Router) SendBatchStatus(records []models.Record) ([]int, error) {
+	var (
+		order  []*route
+		groups = make(map[*route][]int)
+	)
+	for k, v := range records {
+		route, err := r.route(v)
+		if err != nil {
+			continue
+		}
+		if _, ok := groups[route]; !ok {
+			order = append(order, route)
+		}
+		groups[route] = append(groups[route], k)
+	}
+
+	var (
+		err      error
+		sent     int
+		statuses = make([]int, len(records))
+	)
+	for _, route := range order {
+		indexes := groups[route]
+
+		batch := make([]models.Record, len(indexes))
+		for k, index := range indexes {
+			batch[k] = records[index]
+		}
+
+		begin := time.Now()
+		results, e := http.SendBatchStatus(route.sender, batch)
+		r.observe(route, begin, e)
+		if e != nil {
+			err = e
+			continue
+		}
+
+		sent++
+		for k, index := range indexes {
+			if k < len(results) {
+				statuses[index] = results[k]
+			}
+		}
+	}
+
+	if sent == 0 {
+		if err == nil {
+			err = errNoRoute
+		}
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (r *Router) route(record models.Record) (*route, error) {
+	msg := &message{record: record}
+	for k := range r.routes {
+		if r.routes[k].matches(msg) {
+			return &r.routes[k], nil
+		}
+	}
+	if r.fallback != nil {
+		return r.fallback, nil
+	}
+	return nil, errNoRoute
+}
+
+func (r *Router) observe(route *route, begin time.Time, err error) {
+	status := statusSuccess
+	if err != nil {
+		status = statusFailure
+	}
+	r.duration.WithLabelValues(route.name, status).Observe(time.Since(begin).Seconds())
+}
+
+type route struct {
+	name   string
+	rules  []rule
+	sender http.Sender
+}
+
+func (r route) matches(msg *message) bool {
+	for _, rule := range r.rules {
+		value, ok := rule.lookup(msg)
+		if !ok || !rule.match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+type rule struct {
+	lookup func(*message) (string, bool)
+	match  func(string) bool
+}
+
+func newRule(config RuleConfig) (rule, error) {
+	var r rule
+
+	switch {
+	case config.Attribute != "" && config.Field != "":
+		return r, errors.New("rule can only have one of attribute or field")
+	case config.Attribute != "":
+		name := config.Attribute
+		r.lookup = func(msg *message) (string, bool) {
+			value, ok := msg.record.Attributes()[name]
+			return value, ok
+		}
+	case config.Field != "":
+		p, err := parsePath(config.Field)
+		if err != nil {
+			return r, err
+		}
+		r.lookup = func(msg *message) (string, bool) {
+			doc, ok := msg.document()
+			if !ok {
+				return "", false
+			}
+			return p.lookup(doc)
+		}
+	default:
+		return r, errors.New("rule requires an attribute or field")
+	}
+
+	var matchers int
+	if config.Equals != "" {
+		matchers++
+		equals := config.Equals
+		r.match = func(value string) bool { return value == equals }
+	}
+	if config.Prefix != "" {
+		matchers++
+		prefix := config.Prefix
+		r.match = func(value string) bool { return strings.HasPrefix(value, prefix) }
+	}
+	if config.Regex != "" {
+		matchers++
+		re, err := regexp.Compile(config.Regex)
+		if err != nil {
+			return r, errors.Wrap(err, "invalid regex")
+		}
+		r.match = re.MatchString
+	}
+	if matchers != 1 {
+		return r, errors.New("rule requires exactly one of equals, prefix or regex")
+	}
+
+	return r, nil
+}
+
+// message lazily decodes the body of a record, so that the body is only
+// decoded once and only if a field is looked up.
+type message struct {
+	record  models.Record
+	decoded bool
+	doc     interface{}
+	err     error
+}
+
+func (m *message) document() (interface{}, bool) {
+	if !m.decoded {
+		m.decoded = true
+		m.err = json.Unmarshal(m.record.Body(), &m.doc)
+	}
+	return m.doc, m.err == nil
+}
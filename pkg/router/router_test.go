@@ -0,0 +1,362 @@
+package router
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/trussle/courier/pkg/http"
+	metricMocks "github.com/trussle/courier/pkg/metrics/mocks"
+	"github.com/trussle/courier/pkg/models"
+	"github.com/trussle/courier/pkg/queue"
+	"github.com/trussle/uuid"
+)
+
+const config = `{
+	"routes": [
+		{
+			"name": "orders",
+			"url": "http://orders",
+			"rules": [
+				{"attribute": "type", "equals": "order"}
+			]
+		},
+		{
+			"name": "eu",
+			"url": "http://eu",
+			"rules": [
+				{"field": "$.region", "prefix": "eu-"},
+				{"field": "$.items[0].sku", "regex": "^[A-Z]+$"}
+			]
+		}
+	],
+	"default": {"name": "default", "url": "http://default"}
+}`
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("parse", func(t *testing.T) {
+		c, err := ParseConfig(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := 2, len(c.Routes); expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := "default", c.Default.Name; expected != actual {
+			t.Errorf("expected: %s, actual: %s", expected, actual)
+		}
+		if expected, actual := (RuleConfig{Attribute: "type", Equals: "order"}), c.Routes[0].Rules[0]; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("parse invalid", func(t *testing.T) {
+		_, err := ParseConfig(strings.NewReader("{"))
+		if expected, actual := true, err != nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	for name, c := range map[string]Config{
+		"missing name":     {Routes: []RouteConfig{{URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Equals: "a"}}}}},
+		"missing url":      {Routes: []RouteConfig{{Name: "a", Rules: []RuleConfig{{Attribute: "a", Equals: "a"}}}}},
+		"missing rules":    {Routes: []RouteConfig{{Name: "a", URL: "http://a"}}},
+		"duplicate name":   {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Equals: "a"}}}}, Default: &RouteConfig{Name: "a", URL: "http://a"}},
+		"default rules":    {Default: &RouteConfig{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Equals: "a"}}}},
+		"no lookup":        {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Equals: "a"}}}}},
+		"both lookups":     {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Field: "a", Equals: "a"}}}}},
+		"no matcher":       {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a"}}}}},
+		"multiple matcher": {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Equals: "a", Prefix: "a"}}}}},
+		"invalid regex":    {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Attribute: "a", Regex: "("}}}}},
+		"invalid field":    {Routes: []RouteConfig{{Name: "a", URL: "http://a", Rules: []RuleConfig{{Field: "a..b", Equals: "a"}}}}},
+	} {
+		if _, err := New(c, newFakeSenders().New, nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+
+	c, err := ParseConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("route", func(t *testing.T) {
+		router, err := New(c, newFakeSenders().New, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, testcase := range []struct {
+			attributes map[string]string
+			body       string
+			route      string
+		}{
+			{map[string]string{"type": "order"}, `{}`, "orders"},
+			{map[string]string{"type": "refund"}, `{"region": "eu-west-1", "items": [{"sku": "ABC"}]}`, "eu"},
+			{nil, `{"region": "eu-west-1", "items": [{"sku": "abc"}]}`, "default"},
+			{nil, `{"region": "us-east-1", "items": [{"sku": "ABC"}]}`, "default"},
+			{nil, `not json`, "default"},
+		} {
+			name, err := router.Route(newRecord(t, testcase.attributes, testcase.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := testcase.route, name; expected != actual {
+				t.Errorf("expected: %s, actual: %s", expected, actual)
+			}
+		}
+	})
+
+	t.Run("route without default", func(t *testing.T) {
+		router, err := New(Config{Routes: c.Routes}, newFakeSenders().New, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = router.Route(newRecord(t, nil, `{}`))
+		if expected, actual := errNoRoute, err; expected != actual {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			senders  = newFakeSenders()
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+		)
+
+		duration.EXPECT().WithLabelValues("orders", "success").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("default", "failure").Return(observer).Times(1)
+		observer.EXPECT().Observe(gomock.Any()).Times(2)
+
+		router, err := New(c, senders.New, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		senders.Get("http://default").err = errors.New("bad")
+
+		if err := router.Send(newRecord(t, map[string]string{"type": "order"}, `{}`)); err != nil {
+			t.Error(err)
+		}
+		if err := router.Send(newRecord(t, nil, `{}`)); err == nil {
+			t.Errorf("expected error")
+		}
+
+		if expected, actual := 1, senders.Get("http://orders").sent; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 0, senders.Get("http://eu").sent; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+		if expected, actual := 1, senders.Get("http://default").sent; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send batch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			senders  = newFakeSenders()
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+		)
+
+		duration.EXPECT().WithLabelValues("orders", "success").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("default", "failure").Return(observer).Times(1)
+		observer.EXPECT().Observe(gomock.Any()).Times(2)
+
+		router, err := New(c, senders.New, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		senders.Get("http://default").err = errors.New("bad")
+
+		accepted, err := router.SendBatch([]models.Record{
+			newRecord(t, map[string]string{"type": "order"}, `{}`),
+			newRecord(t, nil, `{}`),
+			newRecord(t, map[string]string{"type": "order"}, `{}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []bool{true, false, true}, accepted; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+		if expected, actual := 2, senders.Get("http://orders").sent; expected != actual {
+			t.Errorf("expected: %d, actual: %d", expected, actual)
+		}
+	})
+
+	t.Run("send batch status", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+		)
+
+		duration.EXPECT().WithLabelValues("orders", "success").Return(observer).Times(1)
+		duration.EXPECT().WithLabelValues("default", "success").Return(observer).Times(1)
+		observer.EXPECT().Observe(gomock.Any()).Times(2)
+
+		// Only the orders recipient says which status code it got, the rest
+		// are taken to have got a StatusOK.
+		router, err := New(c, func(url string) http.Sender {
+			if url == "http://orders" {
+				return statusSender{&fakeSender{}, 201}
+			}
+			return &fakeSender{}
+		}, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses, err := router.SendBatchStatus([]models.Record{
+			newRecord(t, map[string]string{"type": "order"}, `{}`),
+			newRecord(t, nil, `{}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := []int{201, 200}, statuses; !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected: %v, actual: %v", expected, actual)
+		}
+	})
+
+	t.Run("send batch with all failures", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var (
+			senders  = newFakeSenders()
+			duration = metricMocks.NewMockHistogramVec(ctrl)
+			observer = metricMocks.NewMockObserver(ctrl)
+		)
+
+		duration.EXPECT().WithLabelValues("default", "failure").Return(observer).Times(1)
+		observer.EXPECT().Observe(gomock.Any()).Times(1)
+
+		router, err := New(c, senders.New, duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		senders.Get("http://default").err = errors.New("bad")
+
+		_, err = router.SendBatch([]models.Record{
+			newRecord(t, nil, `{}`),
+		})
+		if expected, actual := true, err != nil; expected != actual {
+			t.Errorf("expected: %t, actual: %t", expected, actual)
+		}
+	})
+}
+
+func newRecord(t *testing.T, attributes map[string]string, body string) models.Record {
+	id, err := uuid.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.NewRecord(id, "message-id", "receipt", []byte(body), time.Now(), attributes, nil)
+}
+
+type fakeSender struct {
+	sent int
+	err  error
+}
+
+func (s *fakeSender) Send(models.Record) error {
+	s.sent++
+	return s.err
+}
+
+func (s *fakeSender) SendBatch(records []models.Record) ([]bool, error) {
+	s.sent += len(records)
+	if s.err != nil {
+		return nil, s.err
+	}
+	accepted := make([]bool, len(records))
+	for k := range accepted {
+		accepted[k] = true
+	}
+	return accepted, nil
+}
+
+// statusSender is a sender that says every record it accepts was accepted
+// with the status code.
+type statusSender struct {
+	*fakeSender
+	status int
+}
+
+func (s statusSender) SendStatus(record models.Record) (int, error) {
+	if err := s.Send(record); err != nil {
+		return 0, err
+	}
+	return s.status, nil
+}
+
+func (s statusSender) SendBatchStatus(records []models.Record) ([]int, error) {
+	accepted, err := s.SendBatch(records)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]int, len(accepted))
+	for k, v := range accepted {
+		if v {
+			statuses[k] = s.status
+		}
+	}
+	return statuses, nil
+}
+
+type fakeSenders struct {
+	mutex   sync.Mutex
+	senders map[string]*fakeSender
+}
+
+func newFakeSenders() *fakeSenders {
+	return &fakeSenders{
+		senders: make(map[string]*fakeSender),
+	}
+}
+
+func (s *fakeSenders) New(url string) http.Sender {
+	return s.Get(url)
+}
+
+func (s *fakeSenders) Get(url string) *fakeSender {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.senders[url]; !ok {
+		s.senders[url] = &fakeSender{}
+	}
+	return s.senders[url]
+}